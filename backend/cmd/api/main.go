@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/config"
+	"github.com/peoplecoin/backend/internal/database"
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/middleware"
+	"github.com/peoplecoin/backend/internal/services/auth"
+	"github.com/peoplecoin/backend/internal/services/user"
+	"github.com/peoplecoin/backend/internal/services/token"
+	"github.com/peoplecoin/backend/internal/services/orderbook"
+	"github.com/peoplecoin/backend/internal/services/fees"
+	"github.com/peoplecoin/backend/internal/services/idempotency"
+	"github.com/peoplecoin/backend/internal/services/restrictions"
+	"github.com/peoplecoin/backend/internal/handlers"
+	"github.com/peoplecoin/backend/internal/ws"
+	"github.com/peoplecoin/backend/internal/blockchain/suiscan"
+	"github.com/peoplecoin/backend/internal/blockchain/coingecko"
+	"github.com/peoplecoin/backend/internal/blockchain/sui"
+)
+
+func main() {
+	// Load configuration
+	cfg := config.Load()
+
+	// Orders without their own mode fall back to the default, so a bad one
+	// stops startup rather than the first self-trade
+	if !orderbook.ValidSTPMode(cfg.Trading.DefaultSTPMode) {
+		log.Fatalf("Invalid STP_DEFAULT_MODE %q", cfg.Trading.DefaultSTPMode)
+	}
+
+	// Initialize database
+	db, err := database.Connect(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	// Initialize Redis cache
+	redisClient := cache.NewRedisClient(cfg)
+	defer redisClient.Close()
+
+	// Initialize third-party API clients
+	suiscanClient := suiscan.NewClient(cfg.ThirdParty.SuiScanAPIURL)
+	coingeckoClient := coingecko.NewClient(cfg.ThirdParty.CoinGeckoAPIURL, cfg.ThirdParty.CoinGeckoAPIKey)
+	suiClient := sui.NewClient(cfg.Sui.RPCURL)
+
+	// Initialize services
+	authService := auth.NewService(db, cfg)
+	userService := user.NewService(db)
+	tokenService := token.NewService(db, redisClient, suiscanClient, coingeckoClient)
+	feeService := fees.NewService(db)
+	idempotencyService := idempotency.NewService(db)
+	restrictionService := restrictions.NewService(db, suiClient, time.Duration(cfg.Trading.RestrictionMaxAge)*time.Second)
+	orderbookService := orderbook.NewService(db, redisClient, cfg, feeService, restrictionService)
+
+	// Push order book changes to WebSocket subscribers
+	gateway := ws.NewGateway(cfg, orderbookService)
+	orderbookService.SetListener(gateway)
+
+	// Rebuild the in-memory order books before accepting orders
+	if err := orderbookService.LoadOrderBooks(); err != nil {
+		log.Fatalf("Failed to restore order books: %v", err)
+	}
+
+	// Cancel good-till-date orders as they expire
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	go orderbookService.RunExpirySweeper(sweeperCtx, time.Duration(cfg.Trading.ExpirySweepInterval)*time.Second)
+
+	// Open newly active tokens with a call auction and uncross auctions as
+	// they end
+	go orderbookService.RunAuctions(sweeperCtx, time.Duration(cfg.Trading.AuctionCheckInterval)*time.Second)
+
+	// Mirror creators' trading restrictions from chain
+	go restrictionService.Run(sweeperCtx, time.Duration(cfg.Trading.RestrictionSyncInterval)*time.Second)
+
+	// Keep the fee schedules and users' volume tiers in memory for pricing
+	// orders
+	go feeService.Run(sweeperCtx, time.Duration(cfg.Trading.FeeRefreshInterval)*time.Second)
+
+	// Initialize handlers
+	authHandler := handlers.NewAuthHandler(authService)
+	userHandler := handlers.NewUserHandler(userService)
+	tokenHandler := handlers.NewTokenHandler(tokenService)
+	orderbookHandler := handlers.NewOrderBookHandler(orderbookService)
+	feeHandler := handlers.NewFeeHandler(feeService)
+	restrictionHandler := handlers.NewRestrictionHandler(restrictionService)
+
+	// Set up Gin router
+	if cfg.Server.Env == "production" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	router := gin.Default()
+
+	// Global middleware
+	router.Use(middleware.CORS(cfg.CORS.AllowedOrigins))
+	router.Use(middleware.RequestID())
+	router.Use(middleware.Logger())
+	router.Use(middleware.Recovery())
+	router.Use(middleware.RateLimit(100)) // 100 requests per minute
+
+	// Health check endpoint
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"timestamp": time.Now().Unix(),
+		})
+	})
+
+	// API v1 routes
+	v1 := router.Group("/api/v1")
+	{
+		// WebSocket market data (private channels authenticate on the connection)
+		v1.GET("/ws", gin.WrapH(gateway))
+
+		// Authentication routes (public)
+		authGroup := v1.Group("/auth")
+		{
+			authGroup.POST("/nonce", authHandler.RequestNonce)
+			authGroup.POST("/verify", authHandler.VerifySignature)
+			authGroup.POST("/refresh", authHandler.RefreshToken)
+			authGroup.POST("/logout", middleware.AuthRequired(cfg), authHandler.Logout)
+		}
+
+		// User routes (protected)
+		userGroup := v1.Group("/users")
+		userGroup.Use(middleware.AuthRequired(cfg))
+		{
+			userGroup.GET("/me", userHandler.GetCurrentUser)
+			userGroup.PATCH("/me", userHandler.UpdateProfile)
+			userGroup.POST("/me/email", userHandler.AddEmail)
+			userGroup.POST("/me/email/verify", userHandler.VerifyEmail)
+		}
+
+		// Token routes
+		tokenGroup := v1.Group("/tokens")
+		{
+			tokenGroup.GET("/:id", tokenHandler.GetToken)
+			tokenGroup.GET("/:id/price-history", tokenHandler.GetPriceHistory)
+			tokenGroup.GET("/:id/holders", tokenHandler.GetHolders)
+			tokenGroup.GET("/:id/transactions", tokenHandler.GetTransactions)
+		}
+
+		// Order book routes
+		orderbookGroup := v1.Group("/orderbook")
+		{
+			orderbookGroup.GET("/:tokenId", orderbookHandler.GetOrderBook)
+			orderbookGroup.GET("/:tokenId/snapshot", orderbookHandler.GetOrderBookSnapshot)
+			orderbookGroup.GET("/:tokenId/market", orderbookHandler.GetMarketInfo)
+		}
+
+		// Orders routes (protected)
+		ordersGroup := v1.Group("/orders")
+		ordersGroup.Use(middleware.AuthRequired(cfg), middleware.Idempotency(idempotencyService))
+		{
+			ordersGroup.POST("", orderbookHandler.CreateOrder)
+			ordersGroup.POST("/batch", orderbookHandler.PlaceOrders)
+			ordersGroup.GET("", orderbookHandler.GetUserOrders)
+			ordersGroup.GET("/client/:clientOrderId", orderbookHandler.GetOrderByClientID)
+			ordersGroup.DELETE("", orderbookHandler.CancelOrders)
+			ordersGroup.DELETE("/:id", orderbookHandler.CancelOrder)
+			ordersGroup.DELETE("/client/:clientOrderId", orderbookHandler.CancelOrderByClientID)
+			ordersGroup.PATCH("/:id", orderbookHandler.AmendOrder)
+			ordersGroup.POST("/estimate", orderbookHandler.EstimateOrder)
+		}
+
+		// Trades routes (protected)
+		tradesGroup := v1.Group("/trades")
+		tradesGroup.Use(middleware.AuthRequired(cfg))
+		{
+			tradesGroup.GET("", orderbookHandler.GetTrades)
+		}
+
+		// Admin routes (protected)
+		adminGroup := v1.Group("/admin")
+		adminGroup.Use(middleware.AuthRequired(cfg), middleware.AdminRequired())
+		{
+			adminGroup.GET("/fee-schedules", feeHandler.ListFeeSchedules)
+			adminGroup.POST("/fee-schedules", feeHandler.CreateFeeSchedule)
+			adminGroup.DELETE("/fee-schedules/:id", feeHandler.DeleteFeeSchedule)
+			adminGroup.POST("/tokens/:id/auction", orderbookHandler.StartAuction)
+			adminGroup.PUT("/tokens/:id/market", orderbookHandler.UpdateMarketRules)
+			adminGroup.PUT("/tokens/:id/status", orderbookHandler.SetTokenStatus)
+			adminGroup.POST("/tokens/:id/halt", orderbookHandler.HaltTrading)
+			adminGroup.POST("/tokens/:id/resume", orderbookHandler.ResumeTrading)
+			adminGroup.PUT("/tokens/:id/registry", restrictionHandler.SetTokenRegistry)
+		}
+	}
+
+	// Start HTTP server
+	srv := &http.Server{
+		Addr:         ":" + cfg.Server.Port,
+		Handler:      router,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Start server in a goroutine
+	go func() {
+		log.Printf("🚀 Server starting on port %s", cfg.Server.Port)
+		log.Printf("📝 Environment: %s", cfg.Server.Env)
+		log.Printf("🌐 API available at http://localhost:%s/api/v1", cfg.Server.Port)
+
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Graceful shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("🛑 Shutting down server...")
+	stopSweeper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+
+	// Shutdown does not close hijacked connections, so close the WebSocket
+	// clients separately
+	if err := gateway.Shutdown(ctx); err != nil {
+		log.Printf("WebSocket connections forced to close: %v", err)
+	}
+
+	log.Println("✅ Server exited gracefully")
+}
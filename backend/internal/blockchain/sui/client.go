@@ -0,0 +1,125 @@
+package sui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Client reads objects from a Sui full node over JSON-RPC
+type Client struct {
+	rpcURL     string
+	httpClient *http.Client
+}
+
+func NewClient(rpcURL string) *Client {
+	return &Client{
+		rpcURL: rpcURL,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// TradingRestrictions are the creator trading restrictions of a token, as
+// returned by creator_token::get_trading_restrictions
+type TradingRestrictions struct {
+	Creator                  string
+	TradingBlockEndDate      time.Time // the creator cannot trade before it
+	TradingBlockDurationDays int
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type objectResponse struct {
+	Result struct {
+		Data *struct {
+			Content struct {
+				Type   string          `json:"type"`
+				Fields json.RawMessage `json:"fields"`
+			} `json:"content"`
+		} `json:"data"`
+		Error *json.RawMessage `json:"error"`
+	} `json:"result"`
+	Error *rpcError `json:"error"`
+}
+
+// registryFields are the TokenRegistry fields the trading restrictions are
+// read from. Sui encodes u64 values as strings.
+type registryFields struct {
+	Creator                  string `json:"creator"`
+	TradingBlockEndDate      string `json:"trading_block_end_date"`
+	TradingBlockDurationDays int    `json:"trading_block_duration_days"`
+}
+
+// GetTradingRestrictions reads the creator trading restrictions from a
+// token's TokenRegistry object
+func (c *Client) GetTradingRestrictions(registryAddress string) (*TradingRestrictions, error) {
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "sui_getObject",
+		Params:  []interface{}{registryAddress, map[string]bool{"showContent": true}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sui RPC error: %d - %s", resp.StatusCode, string(body))
+	}
+
+	var objResp objectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&objResp); err != nil {
+		return nil, err
+	}
+	if objResp.Error != nil {
+		return nil, fmt.Errorf("sui RPC error: %d - %s", objResp.Error.Code, objResp.Error.Message)
+	}
+	if objResp.Result.Data == nil {
+		return nil, fmt.Errorf("token registry %s not found", registryAddress)
+	}
+
+	var fields registryFields
+	if err := json.Unmarshal(objResp.Result.Data.Content.Fields, &fields); err != nil {
+		return nil, fmt.Errorf("failed to decode token registry %s: %w", registryAddress, err)
+	}
+
+	endMillis, err := strconv.ParseInt(fields.TradingBlockEndDate, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token registry %s: invalid trading block end date: %w", registryAddress, err)
+	}
+
+	return &TradingRestrictions{
+		Creator:                  fields.Creator,
+		TradingBlockEndDate:      time.UnixMilli(endMillis).UTC(),
+		TradingBlockDurationDays: fields.TradingBlockDurationDays,
+	}, nil
+}
@@ -120,6 +120,20 @@ func (r *RedisClient) DeletePattern(pattern string) error {
 	return iter.Err()
 }
 
+// Publish sends a value as JSON to a pub/sub channel
+func (r *RedisClient) Publish(channel string, value interface{}) error {
+	if r.client == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Publish(r.ctx, channel, data).Err()
+}
+
 // Exists checks if a key exists
 func (r *RedisClient) Exists(key string) (bool, error) {
 	if r.client == nil {
@@ -160,3 +174,7 @@ func OrderBookKey(tokenID string) string {
 func UserProfileKey(userID string) string {
 	return fmt.Sprintf("user:profile:%s", userID)
 }
+
+// MarketStatusChannel is the pub/sub channel trading halts, resumptions and
+// token status changes are announced on
+const MarketStatusChannel = "market:status"
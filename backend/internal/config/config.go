@@ -18,6 +18,8 @@ type Config struct {
 	Sui       SuiConfig
 	ThirdParty ThirdPartyConfig
 	CORS      CORSConfig
+	Trading   TradingConfig
+	WebSocket WebSocketConfig
 }
 
 type ServerConfig struct {
@@ -69,6 +71,28 @@ type CORSConfig struct {
 	AllowedOrigins []string
 }
 
+type TradingConfig struct {
+	DefaultSTPMode           string // Self-trade prevention mode for orders that don't set one
+	ExpirySweepInterval      int    // Seconds between sweeps for expired good-till-date orders
+	MaxBatchOrders           int    // Most orders accepted in one batch request
+	OpeningAuctionDuration   int    // Seconds a newly active token spends in its opening call auction
+	ReopeningAuctionDuration int    // Seconds a token spends in the call auction that resumes it
+	AuctionCheckInterval     int    // Seconds between checks for auctions to start or uncross
+	PriceBandPercent         int    // Percent limit prices may stray from the reference price; 0 disables
+	CircuitBreakerPercent    int    // Percent move within the window that halts a token; 0 disables
+	CircuitBreakerWindow     int    // Seconds of trades the reference price and circuit breaker look back over
+	HaltCooldown             int    // Seconds a circuit breaker halt lasts before the token re-opens
+	RestrictionSyncInterval  int    // Seconds between syncs of creator trading restrictions from chain
+	RestrictionMaxAge        int    // Seconds a sync is trusted for before creators' orders are refused; 0 trusts it forever
+	FeeRefreshInterval       int    // Seconds between reloads of fee schedules and users' trailing volumes
+}
+
+type WebSocketConfig struct {
+	PingInterval     int // Seconds between heartbeats; a client silent for twice as long is dropped
+	SendBuffer       int // Messages queued per client before it is dropped as a slow consumer
+	MaxSubscriptions int // Most channels one client may subscribe to
+}
+
 func Load() *Config {
 	// Load .env file if exists
 	if err := godotenv.Load(); err != nil {
@@ -117,6 +141,26 @@ func Load() *Config {
 		CORS: CORSConfig{
 			AllowedOrigins: getEnvAsSlice("CORS_ALLOWED_ORIGINS", []string{"http://localhost:3000"}),
 		},
+		Trading: TradingConfig{
+			DefaultSTPMode:           getEnv("STP_DEFAULT_MODE", "cancel_newest"),
+			ExpirySweepInterval:      getEnvAsInt("ORDER_EXPIRY_SWEEP_INTERVAL", 5),
+			MaxBatchOrders:           getEnvAsInt("ORDER_BATCH_MAX", 50),
+			OpeningAuctionDuration:   getEnvAsInt("AUCTION_OPENING_DURATION", 300),
+			ReopeningAuctionDuration: getEnvAsInt("AUCTION_REOPENING_DURATION", 120),
+			AuctionCheckInterval:     getEnvAsInt("AUCTION_CHECK_INTERVAL", 1),
+			PriceBandPercent:         getEnvAsInt("PRICE_BAND_PERCENT", 10),
+			CircuitBreakerPercent:    getEnvAsInt("CIRCUIT_BREAKER_PERCENT", 20),
+			CircuitBreakerWindow:     getEnvAsInt("CIRCUIT_BREAKER_WINDOW", 300),
+			HaltCooldown:             getEnvAsInt("HALT_COOLDOWN", 300),
+			RestrictionSyncInterval:  getEnvAsInt("CREATOR_RESTRICTION_SYNC_INTERVAL", 300),
+			RestrictionMaxAge:        getEnvAsInt("CREATOR_RESTRICTION_MAX_AGE", 1800),
+			FeeRefreshInterval:       getEnvAsInt("FEE_REFRESH_INTERVAL", 60),
+		},
+		WebSocket: WebSocketConfig{
+			PingInterval:     getEnvAsInt("WS_PING_INTERVAL", 30),
+			SendBuffer:       getEnvAsInt("WS_SEND_BUFFER", 256),
+			MaxSubscriptions: getEnvAsInt("WS_MAX_SUBSCRIPTIONS", 100),
+		},
 	}
 }
 
@@ -0,0 +1,361 @@
+// Package decimal provides an exact fixed-point number for prices, fees and
+// totals. Values carry 8 fractional digits, matching the DECIMAL(x, 8)
+// columns in Postgres, and are stored as an int64 count of 1e-8 units, so
+// the representable range is roughly ±92 billion.
+package decimal
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of fractional digits a Decimal carries
+const Scale = 8
+
+const unit = 100000000 // 10^Scale
+
+// MaxInt is the largest integer a Decimal can hold; FromInt panics beyond it
+const MaxInt = math.MaxInt64 / unit
+
+// RoundingMode controls how results with more than Scale fractional digits
+// are rounded
+type RoundingMode int
+
+const (
+	RoundDown     RoundingMode = iota // toward zero
+	RoundUp                           // away from zero
+	RoundHalfEven                     // to nearest, ties to even
+)
+
+// Decimal is an exact fixed-point number. The zero value is 0.
+type Decimal struct {
+	units int64
+}
+
+var Zero = Decimal{}
+
+// New returns coefficient * 10^-scale, e.g. New(5, 3) is 0.005
+func New(coefficient int64, scale int) Decimal {
+	if scale < 0 || scale > Scale {
+		panic(fmt.Sprintf("decimal: scale %d out of range", scale))
+	}
+	return FromUnits(coefficient).mulPow10(Scale - scale)
+}
+
+// FromInt returns n as a Decimal
+func FromInt(n int64) Decimal {
+	return New(n, 0)
+}
+
+// FromUnits returns a Decimal of n 1e-8 units
+func FromUnits(n int64) Decimal {
+	return Decimal{units: n}
+}
+
+// Parse parses a plain decimal string such as "-12.345". At most Scale
+// fractional digits are accepted; exponents are not.
+func Parse(s string) (Decimal, error) {
+	str := s
+	negative := false
+	if strings.HasPrefix(str, "-") {
+		negative = true
+		str = str[1:]
+	} else if strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+
+	whole, frac, _ := strings.Cut(str, ".")
+	if whole == "" && frac == "" {
+		return Zero, fmt.Errorf("decimal: invalid value %q", s)
+	}
+	if len(frac) > Scale {
+		// Postgres pads to the column scale; only trailing zeros may be dropped
+		if strings.Trim(frac[Scale:], "0") != "" {
+			return Zero, fmt.Errorf("decimal: %q has more than %d decimal places", s, Scale)
+		}
+		frac = frac[:Scale]
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return Zero, fmt.Errorf("decimal: invalid value %q", s)
+	}
+
+	digits := whole + frac + strings.Repeat("0", Scale-len(frac))
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Zero, fmt.Errorf("decimal: %q out of range", s)
+	}
+
+	if negative {
+		units = -units
+	}
+	return Decimal{units: units}, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for constants
+// and tests.
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Units returns the value as a count of 1e-8 units
+func (d Decimal) Units() int64 {
+	return d.units
+}
+
+func (d Decimal) Add(other Decimal) Decimal {
+	sum := d.units + other.units
+	if (sum > d.units) != (other.units > 0) {
+		panic("decimal: addition overflow")
+	}
+	return Decimal{units: sum}
+}
+
+func (d Decimal) Sub(other Decimal) Decimal {
+	return d.Add(other.Neg())
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{units: -d.units}
+}
+
+// MulInt multiplies by an integer quantity. The result is exact; it panics
+// if the product is out of range (see TryMulInt).
+func (d Decimal) MulInt(n int64) Decimal {
+	product, ok := d.TryMulInt(n)
+	if !ok {
+		panic("decimal: multiplication overflow")
+	}
+	return product
+}
+
+// TryMulInt multiplies by an integer quantity, reporting false if the
+// product is out of range
+func (d Decimal) TryMulInt(n int64) (Decimal, bool) {
+	hi, lo := bits.Mul64(abs(d.units), abs(n))
+	if hi != 0 || lo > math.MaxInt64 {
+		return Zero, false
+	}
+	return Decimal{units: applySign(lo, (d.units < 0) != (n < 0))}, true
+}
+
+// Mul multiplies two decimals, rounding the result to Scale digits
+func (d Decimal) Mul(other Decimal, mode RoundingMode) Decimal {
+	hi, lo := bits.Mul64(abs(d.units), abs(other.units))
+	return divide128(hi, lo, unit, (d.units < 0) != (other.units < 0), mode)
+}
+
+// Div divides by another decimal, rounding the result to Scale digits
+func (d Decimal) Div(other Decimal, mode RoundingMode) Decimal {
+	if other.units == 0 {
+		panic("decimal: division by zero")
+	}
+	hi, lo := bits.Mul64(abs(d.units), unit)
+	return divide128(hi, lo, abs(other.units), (d.units < 0) != (other.units < 0), mode)
+}
+
+// DivInt divides by an integer, rounding the result to Scale digits
+func (d Decimal) DivInt(n int64, mode RoundingMode) Decimal {
+	if n == 0 {
+		panic("decimal: division by zero")
+	}
+	return divide128(0, abs(d.units), abs(n), (d.units < 0) != (n < 0), mode)
+}
+
+// Round rounds to the given number of fractional digits
+func (d Decimal) Round(places int, mode RoundingMode) Decimal {
+	if places >= Scale {
+		return d
+	}
+	step := pow10(Scale - places)
+	return divide128(0, abs(d.units), step, d.units < 0, mode).mulPow10(Scale - places)
+}
+
+// divide128 divides the unsigned 128-bit value hi:lo by divisor and rounds
+func divide128(hi, lo, divisor uint64, negative bool, mode RoundingMode) Decimal {
+	if hi >= divisor {
+		panic("decimal: result out of range")
+	}
+	quotient, remainder := bits.Div64(hi, lo, divisor)
+
+	roundAway := false
+	switch mode {
+	case RoundUp:
+		roundAway = remainder != 0
+	case RoundHalfEven:
+		// compare 2*remainder with divisor without overflowing
+		half := divisor - remainder
+		roundAway = remainder > half || (remainder == half && quotient%2 == 1)
+	}
+	if roundAway {
+		quotient++
+	}
+
+	if quotient > math.MaxInt64 {
+		panic("decimal: result out of range")
+	}
+	return Decimal{units: applySign(quotient, negative)}
+}
+
+func (d Decimal) mulPow10(n int) Decimal {
+	return d.MulInt(int64(pow10(n)))
+}
+
+func pow10(n int) uint64 {
+	result := uint64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+func abs(n int64) uint64 {
+	if n < 0 {
+		return uint64(-n)
+	}
+	return uint64(n)
+}
+
+func applySign(n uint64, negative bool) int64 {
+	if negative {
+		return -int64(n)
+	}
+	return int64(n)
+}
+
+// Cmp returns -1, 0 or +1 depending on whether d is less than, equal to or
+// greater than other
+func (d Decimal) Cmp(other Decimal) int {
+	switch {
+	case d.units < other.units:
+		return -1
+	case d.units > other.units:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Equal(other Decimal) bool {
+	return d.units == other.units
+}
+
+func (d Decimal) LessThan(other Decimal) bool {
+	return d.units < other.units
+}
+
+func (d Decimal) GreaterThan(other Decimal) bool {
+	return d.units > other.units
+}
+
+func (d Decimal) IsZero() bool {
+	return d.units == 0
+}
+
+func (d Decimal) IsPositive() bool {
+	return d.units > 0
+}
+
+func (d Decimal) IsNegative() bool {
+	return d.units < 0
+}
+
+// Min returns the smaller of two decimals
+func Min(a, b Decimal) Decimal {
+	if a.LessThan(b) {
+		return a
+	}
+	return b
+}
+
+// Max returns the larger of two decimals
+func Max(a, b Decimal) Decimal {
+	if a.GreaterThan(b) {
+		return a
+	}
+	return b
+}
+
+// Float64 returns the nearest float64. Use it only for display values such
+// as percentages, never for amounts.
+func (d Decimal) Float64() float64 {
+	return float64(d.units) / unit
+}
+
+// String formats the value without trailing fractional zeros, e.g. "2.45"
+func (d Decimal) String() string {
+	s := d.StringFixed()
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// StringFixed formats the value with all Scale fractional digits
+func (d Decimal) StringFixed() string {
+	sign := ""
+	if d.units < 0 {
+		sign = "-"
+	}
+	u := abs(d.units)
+	return fmt.Sprintf("%s%d.%0*d", sign, u/unit, Scale, u%unit)
+}
+
+// MarshalJSON encodes the value as an exact JSON number
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	s = strings.Trim(s, `"`)
+
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner for NUMERIC/DECIMAL columns
+func (d *Decimal) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case []byte:
+		*d, err = Parse(string(v))
+	case string:
+		*d, err = Parse(v)
+	case int64:
+		*d = FromInt(v)
+	case float64:
+		*d, err = Parse(strconv.FormatFloat(v, 'f', -1, 64))
+	case nil:
+		*d = Zero
+	default:
+		err = fmt.Errorf("decimal: cannot scan %T", value)
+	}
+	return err
+}
+
+// Value implements driver.Valuer
+func (d Decimal) Value() (driver.Value, error) {
+	return d.StringFixed(), nil
+}
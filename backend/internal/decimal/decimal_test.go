@@ -0,0 +1,127 @@
+package decimal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAndString(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      string
+		wantFixed string
+		wantError bool
+	}{
+		{input: "2.45", want: "2.45", wantFixed: "2.45000000"},
+		{input: "0.00000001", want: "0.00000001", wantFixed: "0.00000001"},
+		{input: "-12.5", want: "-12.5", wantFixed: "-12.50000000"},
+		{input: "100", want: "100", wantFixed: "100.00000000"},
+		{input: ".5", want: "0.5", wantFixed: "0.50000000"},
+		{input: "0", want: "0", wantFixed: "0.00000000"},
+		{input: "2.4500000000", want: "2.45", wantFixed: "2.45000000"}, // trailing zeros past scale
+		{input: "2.450000001", wantError: true},
+		{input: "1e-8", wantError: true},
+		{input: "abc", wantError: true},
+		{input: "", wantError: true},
+		{input: "-", wantError: true},
+		{input: "99999999999999", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			d, err := Parse(tt.input)
+
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, d.String())
+			assert.Equal(t, tt.wantFixed, d.StringFixed())
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	price := MustParse("2.45")
+
+	assert.Equal(t, "2450", price.MulInt(1000).String())
+	assert.Equal(t, "4.91", price.Add(MustParse("2.46")).String())
+	assert.Equal(t, "-0.01", price.Sub(MustParse("2.46")).String())
+	assert.Equal(t, New(5, 3), MustParse("0.005"))
+	assert.Equal(t, FromInt(7), MustParse("7"))
+
+	_, ok := MustParse("90000000000").TryMulInt(2)
+	assert.False(t, ok)
+
+	assert.Equal(t, "92233720368", FromInt(MaxInt).String())
+	assert.Panics(t, func() { FromInt(MaxInt + 1) })
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Decimal
+		want string
+	}{
+		// 1.23456789 * 0.005 = 0.00617283945
+		{"mul down", MustParse("1.23456789").Mul(MustParse("0.005"), RoundDown), "0.00617283"},
+		{"mul up", MustParse("1.23456789").Mul(MustParse("0.005"), RoundUp), "0.00617284"},
+		{"mul half even", MustParse("1.23456789").Mul(MustParse("0.005"), RoundHalfEven), "0.00617284"},
+		{"exact mul unaffected by mode", MustParse("2450").Mul(MustParse("0.005"), RoundUp), "12.25"},
+		{"negative mul up rounds away from zero", MustParse("-1.23456789").Mul(MustParse("0.005"), RoundUp), "-0.00617284"},
+		{"div half even tie to even", MustParse("0.00000001").DivInt(2, RoundHalfEven), "0"},
+		{"div half even tie to odd", MustParse("0.00000003").DivInt(2, RoundHalfEven), "0.00000002"},
+		{"div up", MustParse("1").DivInt(3, RoundUp), "0.33333334"},
+		{"div down", MustParse("2").Div(MustParse("3"), RoundDown), "0.66666666"},
+		{"round to cents up", MustParse("2.451").Round(2, RoundUp), "2.46"},
+		{"round to cents down", MustParse("2.459").Round(2, RoundDown), "2.45"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.got.String())
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var payload struct {
+		Price Decimal  `json:"price"`
+		Fee   Decimal  `json:"fee"`
+		Limit *Decimal `json:"limit"`
+	}
+
+	err := json.Unmarshal([]byte(`{"price": 2.45, "fee": "0.01225", "limit": null}`), &payload)
+	assert.NoError(t, err)
+	assert.Equal(t, MustParse("2.45"), payload.Price)
+	assert.Equal(t, MustParse("0.01225"), payload.Fee)
+	assert.Nil(t, payload.Limit)
+
+	encoded, err := json.Marshal(payload)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"price": 2.45, "fee": 0.01225, "limit": null}`, string(encoded))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"price": 1.123456789}`), &payload))
+}
+
+func TestScanAndValue(t *testing.T) {
+	var d Decimal
+
+	assert.NoError(t, d.Scan([]byte("2.45000000")))
+	assert.Equal(t, MustParse("2.45"), d)
+
+	assert.NoError(t, d.Scan(int64(3)))
+	assert.Equal(t, FromInt(3), d)
+
+	assert.NoError(t, d.Scan(2.46))
+	assert.Equal(t, MustParse("2.46"), d)
+
+	assert.Error(t, d.Scan(true))
+
+	value, err := MustParse("0.005").Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "0.00500000", value)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/middleware"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/fees"
+)
+
+type FeeHandler struct {
+	service *fees.Service
+}
+
+func NewFeeHandler(service *fees.Service) *FeeHandler {
+	return &FeeHandler{service: service}
+}
+
+type FeeTierInput struct {
+	MinVolume decimal.Decimal `json:"minVolume"`
+	MakerRate decimal.Decimal `json:"makerRate"`
+	TakerRate decimal.Decimal `json:"takerRate"`
+}
+
+type CreateFeeScheduleInput struct {
+	Name          string         `json:"name" binding:"required,max=100"`
+	UserID        *string        `json:"userId" binding:"omitempty,uuid"`
+	TokenID       *string        `json:"tokenId" binding:"omitempty,uuid"`
+	EffectiveFrom *time.Time     `json:"effectiveFrom"`
+	Tiers         []FeeTierInput `json:"tiers" binding:"required,min=1,dive"`
+}
+
+// ListFeeSchedules returns every fee schedule version
+func (h *FeeHandler) ListFeeSchedules(c *gin.Context) {
+	schedules, err := h.service.ListSchedules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    schedules,
+	})
+}
+
+// CreateFeeSchedule publishes a new fee schedule version
+func (h *FeeHandler) CreateFeeSchedule(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	var input CreateFeeScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	schedule := &models.FeeSchedule{
+		Name:      input.Name,
+		UserID:    input.UserID,
+		TokenID:   input.TokenID,
+		Tiers:     make([]models.FeeTier, 0, len(input.Tiers)),
+		CreatedBy: &userID,
+	}
+	if input.EffectiveFrom != nil {
+		schedule.EffectiveFrom = *input.EffectiveFrom
+	}
+	for _, tier := range input.Tiers {
+		schedule.Tiers = append(schedule.Tiers, models.FeeTier{
+			MinVolume: tier.MinVolume,
+			MakerRate: tier.MakerRate,
+			TakerRate: tier.TakerRate,
+		})
+	}
+
+	if err := h.service.CreateSchedule(schedule); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, fees.ErrInvalidSchedule) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    schedule,
+	})
+}
+
+// DeleteFeeSchedule withdraws a fee schedule version before it takes effect
+func (h *FeeHandler) DeleteFeeSchedule(c *gin.Context) {
+	if err := h.service.DeleteSchedule(c.Param("id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, fees.ErrScheduleNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"message": "Fee schedule deleted successfully",
+		},
+	})
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/decimal"
 	"github.com/peoplecoin/backend/internal/middleware"
 	"github.com/peoplecoin/backend/internal/models"
 	"github.com/peoplecoin/backend/internal/services/orderbook"
@@ -19,20 +22,88 @@ func NewOrderBookHandler(service *orderbook.Service) *OrderBookHandler {
 }
 
 type CreateOrderInput struct {
-	TokenID       string  `json:"tokenId" binding:"required"`
-	OrderType     string  `json:"orderType" binding:"required,oneof=buy sell"`
-	ExecutionType string  `json:"executionType" binding:"required,oneof=market limit"`
-	Quantity      int64   `json:"quantity" binding:"required,min=1"`
-	Price         float64 `json:"price"`
-	TimeInForce   string  `json:"timeInForce" binding:"oneof=GTC IOC FOK"`
+	TokenID       string          `json:"tokenId" binding:"required"`
+	OrderType     string          `json:"orderType" binding:"required,oneof=buy sell"`
+	ExecutionType string          `json:"executionType" binding:"required,oneof=market limit stop_market stop_limit trailing_stop"`
+	Quantity      int64           `json:"quantity" binding:"required,min=1"`
+	Price         decimal.Decimal `json:"price"`
+	TimeInForce   string          `json:"timeInForce" binding:"omitempty,oneof=GTC IOC FOK GTD"`
+	STPMode       string          `json:"stpMode" binding:"omitempty,oneof=cancel_newest cancel_oldest cancel_both decrement_and_cancel"`
+
+	// Optional ID of the client's choosing, unique among the user's orders
+	ClientOrderID *string `json:"clientOrderId" binding:"omitempty,min=1,max=64"`
+
+	// Post-only limit orders never take liquidity; postOnlyMode picks between
+	// rejecting and repricing one tick away when they would
+	PostOnly     bool   `json:"postOnly"`
+	PostOnlyMode string `json:"postOnlyMode" binding:"omitempty,oneof=reject reprice"`
+
+	// Optional iceberg slice for limit orders; only this much is shown in the
+	// order book at a time
+	DisplayQuantity *int64 `json:"displayQuantity" binding:"omitempty,min=1"`
+
+	// Expiry for GTD orders; the order is cancelled once it passes
+	ExpiresAt *time.Time `json:"expiresAt"`
+
+	// Trigger price for stop_market and stop_limit orders
+	StopPrice *decimal.Decimal `json:"stopPrice"`
+
+	// Trail distance for trailing_stop orders; exactly one is required
+	TrailAmount  *decimal.Decimal `json:"trailAmount"`
+	TrailPercent *decimal.Decimal `json:"trailPercent"`
+
+	// Optional market order protection; protectionPrice takes precedence
+	MaxSlippageBps  *int             `json:"maxSlippageBps" binding:"omitempty,min=1,max=10000"`
+	ProtectionPrice *decimal.Decimal `json:"protectionPrice"`
+}
+
+// BatchOrderInput is a batch of orders placed in one request
+type BatchOrderInput struct {
+	Orders []CreateOrderInput `json:"orders" binding:"required,min=1,dive"`
+}
+
+// AmendOrderInput changes a resting limit order; at least one field is
+// required. Quantity is the new total quantity, including anything already
+// filled.
+type AmendOrderInput struct {
+	Price    *decimal.Decimal `json:"price"`
+	Quantity *int64           `json:"quantity" binding:"omitempty,min=1"`
+}
+
+// StartAuctionInput puts a token into a call auction. The duration defaults
+// to the configured one for the reason.
+type StartAuctionInput struct {
+	Reason          string `json:"reason" binding:"required,oneof=opening reopening"`
+	DurationSeconds int    `json:"durationSeconds" binding:"omitempty,min=1"`
+}
+
+// MarketRulesInput sets a token's market rules. A missing tick size returns
+// the token to the default tick sizes.
+type MarketRulesInput struct {
+	TickSize *decimal.Decimal `json:"tickSize"`
+	LotSize  int64            `json:"lotSize" binding:"required,min=1"`
+}
+
+// TradingHaltInput halts or resumes a token's trading with the reason, which
+// is recorded and announced to clients
+type TradingHaltInput struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// TokenStatusInput activates or suspends a token. CancelOrders also cancels
+// every order on a suspended token.
+type TokenStatusInput struct {
+	Status       string `json:"status" binding:"required,oneof=active suspended"`
+	CancelOrders bool   `json:"cancelOrders"`
 }
 
 type EstimateOrderInput struct{
-	TokenID       string  `json:"tokenId" binding:"required"`
-	OrderType     string  `json:"orderType" binding:"required,oneof=buy sell"`
-	ExecutionType string  `json:"executionType" binding:"required,oneof=market limit"`
-	Quantity      int64   `json:"quantity" binding:"required,min=1"`
-	Price         float64 `json:"price"`
+	TokenID       string           `json:"tokenId" binding:"required"`
+	OrderType     string           `json:"orderType" binding:"required,oneof=buy sell"`
+	ExecutionType string           `json:"executionType" binding:"required,oneof=market limit stop_market stop_limit trailing_stop"`
+	Quantity      int64            `json:"quantity" binding:"required,min=1"`
+	Price         decimal.Decimal  `json:"price"`
+	StopPrice     *decimal.Decimal `json:"stopPrice"`
 }
 
 // GetOrderBook returns the order book for a token
@@ -59,6 +130,36 @@ func (h *OrderBookHandler) GetOrderBook(c *gin.Context) {
 	})
 }
 
+// GetOrderBookSnapshot returns a token's whole order book, uncached, with the
+// sequence number its deltas continue from
+func (h *OrderBookHandler) GetOrderBookSnapshot(c *gin.Context) {
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    h.service.GetOrderBookSnapshot(c.Param("tokenId")),
+	})
+}
+
+// GetMarketInfo returns a token's tick sizes, lot size and current price band
+func (h *OrderBookHandler) GetMarketInfo(c *gin.Context) {
+	info, err := h.service.GetMarketInfo(c.Param("tokenId"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, orderbook.ErrTokenNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    info,
+	})
+}
+
 // CreateOrder creates a new order
 func (h *OrderBookHandler) CreateOrder(c *gin.Context) {
 	userID, exists := middleware.GetUserID(c)
@@ -80,7 +181,7 @@ func (h *OrderBookHandler) CreateOrder(c *gin.Context) {
 	}
 
 	// Validate price for limit orders
-	if input.ExecutionType == "limit" && input.Price <= 0 {
+	if (input.ExecutionType == "limit" || input.ExecutionType == "stop_limit") && !input.Price.IsPositive() {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
 			Error:   "Limit orders must have a positive price",
@@ -93,38 +194,131 @@ func (h *OrderBookHandler) CreateOrder(c *gin.Context) {
 		input.TimeInForce = "GTC"
 	}
 
+	// Good-till-date orders need an expiry, and only they may have one
+	if (input.TimeInForce == "GTD") != (input.ExpiresAt != nil) {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "expiresAt is required for GTD orders and only allowed for them",
+		})
+		return
+	}
+
+	order := newOrder(userID, &input)
+
+	createdOrder, trades, err := h.service.CreateOrder(order)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, orderbook.ErrInsufficientFunds), errors.Is(err, orderbook.ErrPostOnlyWouldCross),
+			errors.Is(err, orderbook.ErrNotAllowedInAuction), errors.Is(err, orderbook.ErrOutsidePriceBand),
+			errors.Is(err, orderbook.ErrPriceNotOnTick), errors.Is(err, orderbook.ErrQuantityNotInLots),
+			errors.Is(err, orderbook.ErrTrailTooWide):
+			status = http.StatusBadRequest
+		case errors.Is(err, orderbook.ErrTokenNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, orderbook.ErrDuplicateClientOrderID), errors.Is(err, orderbook.ErrTradingHalted),
+			errors.Is(err, orderbook.ErrTokenNotActive):
+			status = http.StatusConflict
+		case errors.Is(err, orderbook.ErrCreatorTradingBlocked):
+			status = http.StatusForbidden
+		case errors.Is(err, orderbook.ErrCreatorRestrictionsUnavailable):
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    orderbook.ErrorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"order":  createdOrder,
+			"trades": trades,
+		},
+	})
+}
+
+// newOrder builds the order a user submitted
+func newOrder(userID string, input *CreateOrderInput) *models.Order {
 	// Determine side
 	side := "bid"
 	if input.OrderType == "sell" {
 		side = "ask"
 	}
 
-	// Create order
 	order := &models.Order{
-		UserID:        userID,
-		TokenID:       input.TokenID,
-		OrderType:     input.OrderType,
-		Side:          side,
-		Price:         input.Price,
-		Quantity:      input.Quantity,
-		ExecutionType: input.ExecutionType,
-		TimeInForce:   input.TimeInForce,
+		UserID:          userID,
+		ClientOrderID:   input.ClientOrderID,
+		TokenID:         input.TokenID,
+		OrderType:       input.OrderType,
+		Side:            side,
+		Price:           input.Price,
+		Quantity:        input.Quantity,
+		DisplayQuantity: input.DisplayQuantity,
+		ExecutionType:   input.ExecutionType,
+		TimeInForce:     input.TimeInForce,
+		ExpiresAt:       input.ExpiresAt,
+		PostOnly:        input.PostOnly,
+		PostOnlyMode:    input.PostOnlyMode,
+		STPMode:         input.STPMode,
+		StopPrice:       input.StopPrice,
+		TrailAmount:     input.TrailAmount,
+		TrailPercent:    input.TrailPercent,
 	}
 
-	createdOrder, trades, err := h.service.CreateOrder(order)
+	if input.ExecutionType == "market" || input.ExecutionType == "stop_market" || input.ExecutionType == "trailing_stop" {
+		order.MaxSlippageBps = input.MaxSlippageBps
+		order.ProtectionPrice = input.ProtectionPrice
+	}
+
+	return order
+}
+
+// PlaceOrders places a batch of orders, reporting the outcome of each
+func (h *OrderBookHandler) PlaceOrders(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	var input BatchOrderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	orders := make([]*models.Order, len(input.Orders))
+	for i := range input.Orders {
+		orders[i] = newOrder(userID, &input.Orders[i])
+	}
+
+	results, err := h.service.PlaceOrders(orders)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+		status := http.StatusInternalServerError
+		if errors.Is(err, orderbook.ErrBatchTooLarge) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, models.APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 		return
 	}
 
-	c.JSON(http.StatusCreated, models.APIResponse{
+	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Data: gin.H{
-			"order":  createdOrder,
-			"trades": trades,
+			"results": results,
 		},
 	})
 }
@@ -203,6 +397,337 @@ func (h *OrderBookHandler) CancelOrder(c *gin.Context) {
 	})
 }
 
+// CancelOrders cancels all of the user's open orders, optionally only those
+// for one token and/or one side
+func (h *OrderBookHandler) CancelOrders(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	var tokenID, side *string
+	if v := c.Query("tokenId"); v != "" {
+		tokenID = &v
+	}
+	if v := c.Query("side"); v != "" {
+		if v != "bid" && v != "ask" {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "side must be bid or ask",
+			})
+			return
+		}
+		side = &v
+	}
+
+	cancelled, err := h.service.CancelOrders(userID, tokenID, side)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Data: gin.H{
+				"cancelledOrderIds": cancelled,
+			},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"cancelledOrderIds": cancelled,
+		},
+	})
+}
+
+// GetOrderByClientID returns one of the user's orders by its client order ID
+func (h *OrderBookHandler) GetOrderByClientID(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	order, err := h.service.GetOrderByClientID(c.Param("clientOrderId"), userID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, orderbook.ErrOrderNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    order,
+	})
+}
+
+// CancelOrderByClientID cancels an order by its client order ID
+func (h *OrderBookHandler) CancelOrderByClientID(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	orderID, err := h.service.CancelOrderByClientID(c.Param("clientOrderId"), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"orderId": orderID,
+			"message": "Order cancelled successfully",
+		},
+	})
+}
+
+// AmendOrder changes the price and/or quantity of a resting order
+func (h *OrderBookHandler) AmendOrder(c *gin.Context) {
+	userID, exists := middleware.GetUserID(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "User not authenticated",
+		})
+		return
+	}
+
+	var input AmendOrderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if input.Price == nil && input.Quantity == nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "price or quantity is required",
+		})
+		return
+	}
+
+	order, trades, err := h.service.AmendOrder(c.Param("id"), userID, input.Price, input.Quantity)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, orderbook.ErrOrderNotAmendable):
+			status = http.StatusNotFound
+		case errors.Is(err, orderbook.ErrInvalidAmendment), errors.Is(err, orderbook.ErrInsufficientFunds),
+			errors.Is(err, orderbook.ErrPostOnlyWouldCross), errors.Is(err, orderbook.ErrOutsidePriceBand),
+			errors.Is(err, orderbook.ErrPriceNotOnTick), errors.Is(err, orderbook.ErrQuantityNotInLots):
+			status = http.StatusBadRequest
+		case errors.Is(err, orderbook.ErrTradingHalted), errors.Is(err, orderbook.ErrTokenNotActive):
+			status = http.StatusConflict
+		case errors.Is(err, orderbook.ErrCreatorTradingBlocked):
+			status = http.StatusForbidden
+		case errors.Is(err, orderbook.ErrCreatorRestrictionsUnavailable):
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    orderbook.ErrorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"order":  order,
+			"trades": trades,
+		},
+	})
+}
+
+// StartAuction puts a token's order book into a call auction
+func (h *OrderBookHandler) StartAuction(c *gin.Context) {
+	var input StartAuctionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	auction, err := h.service.StartAuction(c.Param("id"), input.Reason, time.Duration(input.DurationSeconds)*time.Second)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, orderbook.ErrInvalidAuction):
+			status = http.StatusBadRequest
+		case errors.Is(err, orderbook.ErrAuctionInProgress), errors.Is(err, orderbook.ErrTradingHalted):
+			status = http.StatusConflict
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    auction,
+	})
+}
+
+// UpdateMarketRules sets a token's tick size and lot size
+func (h *OrderBookHandler) UpdateMarketRules(c *gin.Context) {
+	var input MarketRulesInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	info, err := h.service.UpdateMarketRules(c.Param("id"), input.TickSize, input.LotSize)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, orderbook.ErrInvalidMarketRules):
+			status = http.StatusBadRequest
+		case errors.Is(err, orderbook.ErrTokenNotFound):
+			status = http.StatusNotFound
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    info,
+	})
+}
+
+// HaltTrading halts a token's trading until it is resumed
+func (h *OrderBookHandler) HaltTrading(c *gin.Context) {
+	var input TradingHaltInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	halt, err := h.service.HaltTrading(c.Param("id"), input.Reason)
+	if err != nil {
+		c.JSON(tradingStatusErrorStatus(err), models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    halt,
+	})
+}
+
+// ResumeTrading lifts a token's trading halt, re-opening it with a call
+// auction
+func (h *OrderBookHandler) ResumeTrading(c *gin.Context) {
+	var input TradingHaltInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	auction, err := h.service.ResumeTrading(c.Param("id"), input.Reason)
+	if err != nil {
+		c.JSON(tradingStatusErrorStatus(err), models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    auction,
+	})
+}
+
+// SetTokenStatus activates or suspends a token
+func (h *OrderBookHandler) SetTokenStatus(c *gin.Context) {
+	var input TokenStatusInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	cancelled, err := h.service.SetTokenStatus(c.Param("id"), input.Status, input.CancelOrders)
+	if err != nil {
+		c.JSON(tradingStatusErrorStatus(err), models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"status":          input.Status,
+			"cancelledOrders": cancelled,
+		},
+	})
+}
+
+// tradingStatusErrorStatus maps an error halting, resuming or changing the
+// status of a token to an HTTP status
+func tradingStatusErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, orderbook.ErrInvalidTokenStatus):
+		return http.StatusBadRequest
+	case errors.Is(err, orderbook.ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, orderbook.ErrTradingHalted), errors.Is(err, orderbook.ErrNotHalted),
+		errors.Is(err, orderbook.ErrAuctionInProgress):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 // EstimateOrder estimates order execution
 func (h *OrderBookHandler) EstimateOrder(c *gin.Context) {
 	var input EstimateOrderInput
@@ -215,7 +740,7 @@ func (h *OrderBookHandler) EstimateOrder(c *gin.Context) {
 	}
 
 	// Validate price for limit orders
-	if input.ExecutionType == "limit" && input.Price <= 0 {
+	if (input.ExecutionType == "limit" || input.ExecutionType == "stop_limit") && !input.Price.IsPositive() {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
 			Error:   "Limit orders must have a positive price",
@@ -223,12 +748,21 @@ func (h *OrderBookHandler) EstimateOrder(c *gin.Context) {
 		return
 	}
 
+	userID, _ := middleware.GetUserID(c)
+
+	// Privileged users see iceberg reserves as well as displayed liquidity
+	role, _ := middleware.GetRole(c)
+	includeHidden := role == "admin"
+
 	estimate, err := h.service.EstimateOrder(
+		userID,
 		input.TokenID,
 		input.OrderType,
 		input.Quantity,
 		input.ExecutionType,
 		input.Price,
+		input.StopPrice,
+		includeHidden,
 	)
 
 	if err != nil {
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/restrictions"
+)
+
+type RestrictionHandler struct {
+	service *restrictions.Service
+}
+
+func NewRestrictionHandler(service *restrictions.Service) *RestrictionHandler {
+	return &RestrictionHandler{service: service}
+}
+
+// TokenRegistryInput is the address of a token's TokenRegistry object on chain
+type TokenRegistryInput struct {
+	RegistryAddress string `json:"registryAddress" binding:"required,startswith=0x,max=66"`
+}
+
+// SetTokenRegistry records a token's registry and mirrors its creator
+// trading restrictions from it
+func (h *RestrictionHandler) SetTokenRegistry(c *gin.Context) {
+	var input TokenRegistryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	restriction, err := h.service.SetRegistry(c.Param("id"), input.RegistryAddress)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, restrictions.ErrTokenNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, restrictions.ErrRegistryUnreadable):
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: gin.H{
+			"tokenId":            restriction.TokenID,
+			"registryAddress":    input.RegistryAddress,
+			"tradingBlockEndsAt": restriction.TradingBlockEndsAt,
+			"syncedAt":           restriction.SyncedAt,
+		},
+	})
+}
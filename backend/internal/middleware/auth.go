@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
@@ -45,25 +46,19 @@ func AuthRequired(cfg *config.Config) gin.HandlerFunc {
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
 		// Parse and validate token
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWT.Secret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(cfg, tokenString)
+		if err == errInvalidClaims {
 			c.JSON(http.StatusUnauthorized, models.APIResponse{
 				Success: false,
-				Error:   "Invalid or expired token",
+				Error:   "Invalid token claims",
 			})
 			c.Abort()
 			return
 		}
-
-		// Extract claims
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, models.APIResponse{
 				Success: false,
-				Error:   "Invalid token claims",
+				Error:   "Invalid or expired token",
 			})
 			c.Abort()
 			return
@@ -78,6 +73,48 @@ func AuthRequired(cfg *config.Config) gin.HandlerFunc {
 	}
 }
 
+// errInvalidClaims is returned for a valid token whose claims are not Claims
+var errInvalidClaims = errors.New("invalid token claims")
+
+// ParseToken verifies an access token and returns its claims. It is used by
+// AuthRequired and by connections that authenticate outside a request
+// header, such as WebSockets.
+func ParseToken(cfg *config.Config, tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWT.Secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, errInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// AdminRequired middleware rejects users without the admin role. It must run
+// after AuthRequired.
+func AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if role, _ := GetRole(c); role != "admin" {
+			c.JSON(http.StatusForbidden, models.APIResponse{
+				Success: false,
+				Error:   "Admin access required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // GetUserID extracts user ID from context
 func GetUserID(c *gin.Context) (string, bool) {
 	userID, exists := c.Get("userID")
@@ -87,6 +124,15 @@ func GetUserID(c *gin.Context) (string, bool) {
 	return userID.(string), true
 }
 
+// GetRole extracts the user's role from context
+func GetRole(c *gin.Context) (string, bool) {
+	role, exists := c.Get("role")
+	if !exists {
+		return "", false
+	}
+	return role.(string), true
+}
+
 // GetWalletAddress extracts wallet address from context
 func GetWalletAddress(c *gin.Context) (string, bool) {
 	walletAddress, exists := c.Get("walletAddress")
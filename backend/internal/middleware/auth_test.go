@@ -197,6 +197,93 @@ func TestGetWalletAddress(t *testing.T) {
 	}
 }
 
+func TestGetRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		setupContext func(*gin.Context)
+		wantRole     string
+		wantExists   bool
+	}{
+		{
+			name: "Role exists",
+			setupContext: func(c *gin.Context) {
+				c.Set("role", "admin")
+			},
+			wantRole:   "admin",
+			wantExists: true,
+		},
+		{
+			name:         "Role not set",
+			setupContext: func(c *gin.Context) {},
+			wantRole:     "",
+			wantExists:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			tt.setupContext(c)
+
+			role, exists := GetRole(c)
+
+			assert.Equal(t, tt.wantRole, role)
+			assert.Equal(t, tt.wantExists, exists)
+		})
+	}
+}
+
+func TestAdminRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		setupContext   func(*gin.Context)
+		expectedStatus int
+		expectAbort    bool
+	}{
+		{
+			name: "Admin",
+			setupContext: func(c *gin.Context) {
+				c.Set("role", "admin")
+			},
+			expectedStatus: http.StatusOK,
+			expectAbort:    false,
+		},
+		{
+			name: "Regular user",
+			setupContext: func(c *gin.Context) {
+				c.Set("role", "user")
+			},
+			expectedStatus: http.StatusForbidden,
+			expectAbort:    true,
+		},
+		{
+			name:           "Role not set",
+			setupContext:   func(c *gin.Context) {},
+			expectedStatus: http.StatusForbidden,
+			expectAbort:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			tt.setupContext(c)
+
+			AdminRequired()(c)
+
+			assert.Equal(t, tt.expectAbort, c.IsAborted())
+			if tt.expectAbort {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
 // Helper function to create test JWT tokens
 func createTestToken(t *testing.T, secret string, userID, walletAddress, role string, expiration time.Duration) string {
 	claims := &Claims{
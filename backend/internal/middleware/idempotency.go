@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/idempotency"
+)
+
+// IdempotencyKeyHeader carries the client's key for a retryable request
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyStore records the responses to idempotent requests
+type IdempotencyStore interface {
+	Begin(userID, key, fingerprint string) (*idempotency.Response, error)
+	Complete(userID, key string, response *idempotency.Response) error
+	Release(userID, key string) error
+}
+
+// Idempotency replays the original response when an authenticated user
+// retries a request with the same Idempotency-Key header, instead of
+// processing it again. Requests without the header, and GET requests, pass
+// through. Server errors and panics are not recorded, so a request that
+// failed with one can be retried under the same key. It must run after
+// AuthRequired.
+func Idempotency(store IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		userID, authenticated := GetUserID(c)
+		if key == "" || !authenticated || c.Request.Method == http.MethodGet {
+			c.Next()
+			return
+		}
+
+		if len(key) > idempotency.MaxKeyLength {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "Idempotency-Key is too long",
+			})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "Failed to read request body",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// A key identifies one request: the same method, path, query and body
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		recorded, err := store.Begin(userID, key, fingerprint)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, idempotency.ErrKeyReused):
+				status = http.StatusUnprocessableEntity
+			case errors.Is(err, idempotency.ErrInProgress):
+				status = http.StatusConflict
+			}
+			c.JSON(status, models.APIResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		if recorded != nil {
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(recorded.StatusCode, "application/json; charset=utf-8", recorded.Body)
+			c.Abort()
+			return
+		}
+
+		// A handler that panics never completes the request, so its key is
+		// released for a retry before the panic carries on to Recovery
+		defer func() {
+			if r := recover(); r != nil {
+				if err := store.Release(userID, key); err != nil {
+					log.Printf("Failed to release idempotency key %s: %v", key, err)
+				}
+				panic(r)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		if status := writer.Status(); status >= http.StatusInternalServerError {
+			if err := store.Release(userID, key); err != nil {
+				log.Printf("Failed to release idempotency key %s: %v", key, err)
+			}
+			return
+		}
+
+		response := &idempotency.Response{StatusCode: writer.Status(), Body: writer.body.Bytes()}
+		if err := store.Complete(userID, key, response); err != nil {
+			log.Printf("Failed to record response for idempotency key %s: %v", key, err)
+			if err := store.Release(userID, key); err != nil {
+				log.Printf("Failed to release idempotency key %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response body as it is written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/peoplecoin/backend/internal/services/idempotency"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryIdempotencyStore keeps idempotency keys in memory
+type memoryIdempotencyStore struct {
+	fingerprints map[string]string
+	responses    map[string]*idempotency.Response
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		fingerprints: make(map[string]string),
+		responses:    make(map[string]*idempotency.Response),
+	}
+}
+
+func (s *memoryIdempotencyStore) Begin(userID, key, fingerprint string) (*idempotency.Response, error) {
+	id := userID + ":" + key
+	existing, ok := s.fingerprints[id]
+	if !ok {
+		s.fingerprints[id] = fingerprint
+		return nil, nil
+	}
+	if existing != fingerprint {
+		return nil, idempotency.ErrKeyReused
+	}
+	if s.responses[id] == nil {
+		return nil, idempotency.ErrInProgress
+	}
+	return s.responses[id], nil
+}
+
+func (s *memoryIdempotencyStore) Complete(userID, key string, response *idempotency.Response) error {
+	s.responses[userID+":"+key] = response
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(userID, key string) error {
+	delete(s.fingerprints, userID+":"+key)
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store IdempotencyStore, calls *int, status int) *gin.Engine {
+		router := gin.New()
+		router.POST("/orders", func(c *gin.Context) {
+			c.Set("userID", "user-id")
+		}, Idempotency(store), func(c *gin.Context) {
+			*calls++
+			c.JSON(status, gin.H{"call": *calls})
+		})
+		return router
+	}
+
+	send := func(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/orders", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Retry replays the original response", func(t *testing.T) {
+		calls := 0
+		router := newRouter(newMemoryIdempotencyStore(), &calls, http.StatusCreated)
+
+		first := send(router, "key-1", `{"quantity":100}`)
+		retry := send(router, "key-1", `{"quantity":100}`)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("Key reused for a different request", func(t *testing.T) {
+		calls := 0
+		router := newRouter(newMemoryIdempotencyStore(), &calls, http.StatusCreated)
+
+		send(router, "key-1", `{"quantity":100}`)
+		w := send(router, "key-1", `{"quantity":200}`)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("Request still in progress", func(t *testing.T) {
+		calls := 0
+		store := newMemoryIdempotencyStore()
+		router := newRouter(store, &calls, http.StatusCreated)
+
+		send(router, "key-1", `{}`)
+		delete(store.responses, "user-id:key-1")
+		w := send(router, "key-1", `{}`)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Server errors can be retried", func(t *testing.T) {
+		calls := 0
+		router := newRouter(newMemoryIdempotencyStore(), &calls, http.StatusInternalServerError)
+
+		send(router, "key-1", `{}`)
+		send(router, "key-1", `{}`)
+
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Panics release the key", func(t *testing.T) {
+		calls := 0
+		router := gin.New()
+		router.POST("/orders", func(c *gin.Context) {
+			c.Set("userID", "user-id")
+		}, Idempotency(newMemoryIdempotencyStore()), func(c *gin.Context) {
+			calls++
+			if calls == 1 {
+				panic("handler failed")
+			}
+			c.JSON(http.StatusCreated, gin.H{"call": calls})
+		})
+
+		assert.Panics(t, func() { send(router, "key-1", `{}`) })
+		w := send(router, "key-1", `{}`)
+
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	})
+
+	t.Run("Key reused with a different query", func(t *testing.T) {
+		calls := 0
+		router := newRouter(newMemoryIdempotencyStore(), &calls, http.StatusCreated)
+
+		send(router, "key-1", `{}`)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/orders?dryRun=true", strings.NewReader(`{}`))
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("Requests without a key are not deduplicated", func(t *testing.T) {
+		calls := 0
+		router := newRouter(newMemoryIdempotencyStore(), &calls, http.StatusCreated)
+
+		send(router, "", `{}`)
+		send(router, "", `{}`)
+
+		assert.Equal(t, 2, calls)
+	})
+}
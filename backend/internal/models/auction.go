@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+)
+
+// Auction is a call auction on a token's order book
+type Auction struct {
+	ID            string           `json:"id"`
+	TokenID       string           `json:"tokenId"`
+	Reason        string           `json:"reason"` // "opening" or "reopening"
+	Status        string           `json:"status"` // "running" or "completed"
+	StartedAt     time.Time        `json:"startedAt"`
+	EndsAt        time.Time        `json:"endsAt"`
+	UncrossPrice  *decimal.Decimal `json:"uncrossPrice,omitempty"`
+	UncrossVolume *int64           `json:"uncrossVolume,omitempty"`
+	CompletedAt   *time.Time       `json:"completedAt,omitempty"`
+}
+
+// AuctionInfo is the published state of a running call auction. The
+// indicative price and volume are what an uncross would execute now; the
+// price is omitted while no orders cross.
+type AuctionInfo struct {
+	Reason           string           `json:"reason"`
+	EndsAt           time.Time        `json:"endsAt"`
+	IndicativePrice  *decimal.Decimal `json:"indicativePrice,omitempty"`
+	IndicativeVolume int64            `json:"indicativeVolume"`
+}
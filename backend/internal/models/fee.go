@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+)
+
+// FeeSchedule is one version of a fee schedule. Schedules are never edited
+// in place: a change is published as a new version with a later effective
+// date. A schedule applies to every order (no user or token), to one user,
+// to one token, or to one user on one token.
+type FeeSchedule struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Version       int       `json:"version"`
+	UserID        *string   `json:"userId,omitempty"`
+	TokenID       *string   `json:"tokenId,omitempty"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	Tiers         []FeeTier `json:"tiers"`
+	CreatedBy     *string   `json:"createdBy,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// FeeTier is the rates a schedule charges users whose trailing 30-day quote
+// volume is at least MinVolume
+type FeeTier struct {
+	MinVolume decimal.Decimal `json:"minVolume"`
+	MakerRate decimal.Decimal `json:"makerRate"`
+	TakerRate decimal.Decimal `json:"takerRate"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// HaltInfo is the published state of a trading halt. ResumesAt is omitted
+// while the halt lasts until it is lifted by hand. Unrecorded is set while
+// the halt is in effect but could not be recorded yet; recording it is
+// retried until it succeeds.
+type HaltInfo struct {
+	Reason     string     `json:"reason"`
+	Message    string     `json:"message,omitempty"`
+	HaltedAt   time.Time  `json:"haltedAt"`
+	ResumesAt  *time.Time `json:"resumesAt,omitempty"`
+	Unrecorded bool       `json:"unrecorded,omitempty"`
+}
+
+// MarketStatusEvent announces that a token's trading was halted or resumed,
+// or that its status changed
+type MarketStatusEvent struct {
+	Type    string    `json:"type"` // halted, resumed or status
+	TokenID string    `json:"tokenId"`
+	Status  string    `json:"status,omitempty"` // the token's new status, for status events
+	Reason  string    `json:"reason,omitempty"`
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`
+}
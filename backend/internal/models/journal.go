@@ -0,0 +1,42 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OrderEvent is an entry in a token's append-only order event journal. Data
+// holds the order for accepted, amended, triggered and snapshot events, the
+// trade for matched events and the details of the change otherwise.
+type OrderEvent struct {
+	Sequence  int64           `json:"sequence"`
+	TokenID   string          `json:"tokenId"`
+	OrderID   string          `json:"orderId"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// JournalMismatch is a difference found by replaying an order journal: a
+// gap in its sequence, an event that disagrees with the events before it,
+// or an order or trade whose replayed state differs from its table row
+type JournalMismatch struct {
+	Kind    string `json:"kind"` // "sequence", "event", "order" or "trade"
+	ID      string `json:"id"`
+	Field   string `json:"field"`
+	Journal string `json:"journal"`
+	Table   string `json:"table"`
+}
+
+// JournalReport is the outcome of replaying a token's order journal and
+// diffing the result against the orders and trades tables
+type JournalReport struct {
+	TokenID    string            `json:"tokenId"`
+	Events     int               `json:"events"`
+	Orders     int               `json:"orders"`
+	Trades     int               `json:"trades"`
+	Rejected   int               `json:"rejected"`
+	Bids       []OrderBookLevel  `json:"bids"`
+	Asks       []OrderBookLevel  `json:"asks"`
+	Mismatches []JournalMismatch `json:"mismatches"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "github.com/peoplecoin/backend/internal/decimal"
+
+// MarketInfo is the published trading configuration of a token. Order prices
+// must be a multiple of the tick size for their price and quantities a
+// multiple of the lot size. Only active tokens take orders. PriceBand is
+// omitted while no band applies.
+type MarketInfo struct {
+	TokenID   string     `json:"tokenId"`
+	Status    string     `json:"status,omitempty"`
+	TickSizes []TickTier `json:"tickSizes"`
+	LotSize   int64      `json:"lotSize"`
+	Phase     string     `json:"phase"`
+	PriceBand *PriceBand `json:"priceBand,omitempty"`
+}
+
+// TickTier is the tick size for prices from MinPrice up to the next tier's
+type TickTier struct {
+	MinPrice decimal.Decimal `json:"minPrice"`
+	TickSize decimal.Decimal `json:"tickSize"`
+}
+
+// PriceBand is the range of limit prices a token currently accepts
+type PriceBand struct {
+	Lower decimal.Decimal `json:"lower"`
+	Upper decimal.Decimal `json:"upper"`
+}
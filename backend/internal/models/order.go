@@ -2,84 +2,134 @@ package models
 
 import (
 	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
 )
 
 type Order struct {
-	ID                string    `json:"id"`
-	UserID            string    `json:"userId"`
-	TokenID           string    `json:"tokenId"`
-	OrderType         string    `json:"orderType"` // "buy" or "sell"
-	Side              string    `json:"side"`      // "bid" or "ask"
-	Price             float64   `json:"price"`
-	Quantity          int64     `json:"quantity"`
-	FilledQuantity    int64     `json:"filledQuantity"`
-	RemainingQuantity int64     `json:"remainingQuantity"`
-	ExecutionType     string    `json:"executionType"` // "market" or "limit"
-	TimeInForce       string    `json:"timeInForce"`   // "GTC", "IOC", "FOK"
-	Status            string    `json:"status"`        // "open", "partially_filled", "filled", "cancelled", "rejected"
-	FeeRate           float64   `json:"feeRate"`
-	FeePaid           float64   `json:"feePaid"`
-	CreatedAt         time.Time `json:"createdAt"`
-	UpdatedAt         time.Time `json:"updatedAt"`
+	ID                string           `json:"id"`
+	ClientOrderID     *string          `json:"clientOrderId,omitempty"` // Optional client-assigned ID, unique per user
+	UserID            string           `json:"userId"`
+	TokenID           string           `json:"tokenId"`
+	OrderType         string           `json:"orderType"` // "buy" or "sell"
+	Side              string           `json:"side"`      // "bid" or "ask"
+	Price             decimal.Decimal  `json:"price"`
+	Quantity          int64            `json:"quantity"`
+	DisplayQuantity   *int64           `json:"displayQuantity,omitempty"` // Iceberg orders: size of the displayed slice
+	FilledQuantity    int64            `json:"filledQuantity"`
+	RemainingQuantity int64            `json:"remainingQuantity"`
+	ExecutionType     string           `json:"executionType"`          // "market", "limit", "stop_market", "stop_limit" or "trailing_stop"
+	TimeInForce       string           `json:"timeInForce"`            // "GTC", "IOC", "FOK", "GTD"
+	ExpiresAt         *time.Time       `json:"expiresAt,omitempty"`    // Good-till-date orders only
+	PostOnly          bool             `json:"postOnly"`               // Limit orders that may only make liquidity
+	PostOnlyMode      string           `json:"postOnlyMode,omitempty"` // "reject" (default) or "reprice" when a post-only order would match
+	STPMode           string           `json:"stpMode"`                // Self-trade prevention: "cancel_newest", "cancel_oldest", "cancel_both", "decrement_and_cancel"
+	Status            string           `json:"status"`                 // "pending_trigger", "triggered", "open", "partially_filled", "filled", "cancelled", "rejected"
+	CancelReason      *string          `json:"cancelReason,omitempty"`
+	MaxSlippageBps    *int             `json:"maxSlippageBps,omitempty"`  // Market orders only
+	ProtectionPrice   *decimal.Decimal `json:"protectionPrice,omitempty"` // Market orders only
+	AveragePrice      *decimal.Decimal `json:"averagePrice,omitempty"`
+	StopPrice         *decimal.Decimal `json:"stopPrice,omitempty"`     // Stop orders only
+	TriggeredAt       *time.Time       `json:"triggeredAt,omitempty"`   // When a stop order went live
+	RequeuedAt        *time.Time       `json:"requeuedAt,omitempty"`    // When an amendment or a fresh iceberg slice last sent the order to the back of its price level
+	TrailAmount       *decimal.Decimal `json:"trailAmount,omitempty"`   // Trailing stops: fixed distance from the mark
+	TrailPercent      *decimal.Decimal `json:"trailPercent,omitempty"`  // Trailing stops: distance as a percentage of the mark
+	TrailMark         *decimal.Decimal `json:"trailMark,omitempty"`     // High-water mark for sells, low-water mark for buys
+	FeeRate           decimal.Decimal  `json:"feeRate"`                 // Highest rate the order pays: taker, or maker for post-only orders
+	MakerFeeRate      decimal.Decimal  `json:"makerFeeRate"`            // Rate charged on fills where the order rests
+	FeeScheduleID     *string          `json:"feeScheduleId,omitempty"` // Fee schedule version the rates came from
+	FeePaid           decimal.Decimal  `json:"feePaid"`
+	LockedAmount      decimal.Decimal  `json:"lockedAmount"` // Funds still reserved: quote for bids, tokens for asks
+	CreatedAt         time.Time        `json:"createdAt"`
+	UpdatedAt         time.Time        `json:"updatedAt"`
 }
 
 type Trade struct {
-	ID                 string    `json:"id"`
-	BuyerOrderID       string    `json:"buyerOrderId"`
-	SellerOrderID      string    `json:"sellerOrderId"`
-	BuyerID            string    `json:"buyerId"`
-	SellerID           string    `json:"sellerId"`
-	TokenID            string    `json:"tokenId"`
-	Price              float64   `json:"price"`
-	Quantity           int64     `json:"quantity"`
-	TotalValue         float64   `json:"totalValue"`
-	BuyerFee           float64   `json:"buyerFee"`
-	SellerFee          float64   `json:"sellerFee"`
-	PlatformFee        float64   `json:"platformFee"`
-	SettlementStatus   string    `json:"settlementStatus"` // "pending", "settled", "failed"
-	BlockchainTxHash   *string   `json:"blockchainTxHash,omitempty"`
-	ExecutedAt         time.Time `json:"executedAt"`
-	SettledAt          *time.Time `json:"settledAt,omitempty"`
+	ID                  string          `json:"id"`
+	BuyerOrderID        string          `json:"buyerOrderId"`
+	SellerOrderID       string          `json:"sellerOrderId"`
+	BuyerID             string          `json:"buyerId"`
+	SellerID            string          `json:"sellerId"`
+	TokenID             string          `json:"tokenId"`
+	Price               decimal.Decimal `json:"price"`
+	Quantity            int64           `json:"quantity"`
+	TotalValue          decimal.Decimal `json:"totalValue"`
+	BuyerFee            decimal.Decimal `json:"buyerFee"`
+	SellerFee           decimal.Decimal `json:"sellerFee"`
+	PlatformFee         decimal.Decimal `json:"platformFee"`
+	BuyerFeeScheduleID  *string         `json:"buyerFeeScheduleId,omitempty"`
+	SellerFeeScheduleID *string         `json:"sellerFeeScheduleId,omitempty"`
+	SettlementStatus    string          `json:"settlementStatus"` // "pending", "settled", "failed"
+	BlockchainTxHash    *string         `json:"blockchainTxHash,omitempty"`
+	ExecutedAt          time.Time       `json:"executedAt"`
+	SettledAt           *time.Time      `json:"settledAt,omitempty"`
 }
 
 // OrderBookLevel represents a price level in the order book
 type OrderBookLevel struct {
-	Price    float64 `json:"price"`
-	Quantity int64   `json:"quantity"`
-	Orders   int     `json:"orders"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity int64           `json:"quantity"`
+	Orders   int             `json:"orders"`
+}
+
+// BatchOrderResult is the outcome of one order in a batch: the placed order
+// and its trades, or why it was rejected and the error code, if any
+type BatchOrderResult struct {
+	Order  *Order   `json:"order,omitempty"`
+	Trades []*Trade `json:"trades,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Code   string   `json:"code,omitempty"`
 }
 
 // OrderBook represents the full order book for a token
 type OrderBook struct {
-	TokenID    string           `json:"tokenId"`
-	Bids       []OrderBookLevel `json:"bids"` // Buy orders (descending price)
-	Asks       []OrderBookLevel `json:"asks"` // Sell orders (ascending price)
-	Spread     float64          `json:"spread"`
-	LastPrice  float64          `json:"lastPrice"`
-	UpdatedAt  time.Time        `json:"updatedAt"`
+	TokenID   string           `json:"tokenId"`
+	Bids      []OrderBookLevel `json:"bids"` // Buy orders (descending price)
+	Asks      []OrderBookLevel `json:"asks"` // Sell orders (ascending price)
+	Spread    decimal.Decimal  `json:"spread"`
+	LastPrice decimal.Decimal  `json:"lastPrice"`
+	Phase     string           `json:"phase"`             // "continuous", "auction" or "halted"
+	Auction   *AuctionInfo     `json:"auction,omitempty"` // Set while the book is in a call auction
+	Halt      *HaltInfo        `json:"halt,omitempty"`    // Set while trading is halted
+	Sequence  int64            `json:"sequence"`          // Number of the last change to the levels
+	Checksum  uint32           `json:"checksum"`          // CRC-32 of the top levels of the whole book
+	UpdatedAt time.Time        `json:"updatedAt"`
+}
+
+// OrderBookDelta is one change to a token's order book levels. Changed
+// levels are sent at their new quantity; a quantity of 0 removes the level.
+type OrderBookDelta struct {
+	TokenID   string           `json:"tokenId"`
+	Sequence  int64            `json:"sequence"` // One more than the previous delta's
+	Bids      []OrderBookLevel `json:"bids"`     // Changed buy levels (descending price)
+	Asks      []OrderBookLevel `json:"asks"`     // Changed sell levels (ascending price)
+	LastPrice decimal.Decimal  `json:"lastPrice"`
+	Checksum  uint32           `json:"checksum"` // CRC-32 of the top levels once the delta is applied
+	UpdatedAt time.Time        `json:"updatedAt"`
 }
 
 // OrderEstimate represents the estimated execution of an order
 type OrderEstimate struct {
-	EstimatedPrice  float64                `json:"estimatedPrice"`
-	TotalCost       float64                `json:"totalCost"`
-	Quantity        int64                  `json:"quantity"`
-	FeeRate         float64                `json:"feeRate"`
-	TotalFees       float64                `json:"totalFees"`
-	Slippage        float64                `json:"slippage"`
-	Breakdown       OrderEstimateBreakdown `json:"breakdown"`
-	Warnings        []string               `json:"warnings"`
+	EstimatedPrice decimal.Decimal        `json:"estimatedPrice"`
+	TotalCost      decimal.Decimal        `json:"totalCost"`
+	Quantity       int64                  `json:"quantity"`
+	FeeRate        decimal.Decimal        `json:"feeRate"`
+	TotalFees      decimal.Decimal        `json:"totalFees"`
+	Slippage       float64                `json:"slippage"`               // Percent, for display only
+	WouldTrigger   *bool                  `json:"wouldTrigger,omitempty"` // Stop orders: whether the stop fires at the last price
+	Breakdown      OrderEstimateBreakdown `json:"breakdown"`
+	Warnings       []string               `json:"warnings"`
 }
 
 type OrderEstimateBreakdown struct {
-	BestPrice    float64               `json:"bestPrice"`
-	WorstPrice   float64               `json:"worstPrice"`
-	LevelsUsed   int                   `json:"levelsUsed"`
+	BestPrice     decimal.Decimal      `json:"bestPrice"`
+	WorstPrice    decimal.Decimal      `json:"worstPrice"`
+	LevelsUsed    int                  `json:"levelsUsed"`
 	MatchedOrders []OrderEstimateMatch `json:"matchedOrders"`
 }
 
 type OrderEstimateMatch struct {
-	Price    float64 `json:"price"`
-	Quantity int64   `json:"quantity"`
-	Subtotal float64 `json:"subtotal"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity int64           `json:"quantity"`
+	Subtotal decimal.Decimal `json:"subtotal"`
 }
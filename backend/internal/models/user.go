@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
 )
 
 type User struct {
@@ -27,10 +29,10 @@ type User struct {
 }
 
 type UserBalance struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"userId"`
-	Currency  string    `json:"currency"`
-	Balance   float64   `json:"balance"`
-	Locked    float64   `json:"locked"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID        string          `json:"id"`
+	UserID    string          `json:"userId"`
+	Currency  string          `json:"currency"` // Quote currency code or token ID
+	Balance   decimal.Decimal `json:"balance"`
+	Locked    decimal.Decimal `json:"locked"`
+	UpdatedAt time.Time       `json:"updatedAt"`
 }
@@ -0,0 +1,400 @@
+package fees
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/database"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// VolumeWindow is the trailing window a user's volume tier is measured over
+const VolumeWindow = 30 * 24 * time.Hour
+
+// MaxFeeRate caps the rates a schedule may charge
+var MaxFeeRate = decimal.New(1, 1) // 10%
+
+// ErrInvalidSchedule is returned when a schedule fails validation
+var ErrInvalidSchedule = errors.New("invalid fee schedule")
+
+// ErrScheduleNotFound is returned when a schedule does not exist or can no
+// longer be withdrawn
+var ErrScheduleNotFound = errors.New("fee schedule not found or already in effect")
+
+// Rates are the fee rates resolved for a user's orders on a token and the
+// schedule version they came from
+type Rates struct {
+	ScheduleID string
+	Version    int
+	Maker      decimal.Decimal
+	Taker      decimal.Decimal
+}
+
+type Service struct {
+	db *database.DB
+
+	// Rates are resolved from memory: the schedules and every user's
+	// trailing volume are reloaded by Refresh, and the schedules again after
+	// they change
+	mu        sync.RWMutex
+	loaded    bool
+	schedules []*models.FeeSchedule      // most specific scope first, then newest
+	volumes   map[string]decimal.Decimal // trailing volume by user
+}
+
+func NewService(db *database.DB) *Service {
+	return &Service{db: db}
+}
+
+// RatesFor resolves the rates that apply to a user's orders on a token now.
+// The most specific schedule in effect wins (user and token, then user, then
+// token, then the default) and its tier is picked by the user's trailing
+// volume as of the last refresh. It returns nil if no schedule is in effect.
+func (s *Service) RatesFor(userID, tokenID string) (*Rates, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, schedule := range s.schedules {
+		if schedule.EffectiveFrom.After(now) ||
+			(schedule.UserID != nil && *schedule.UserID != userID) ||
+			(schedule.TokenID != nil && *schedule.TokenID != tokenID) {
+			continue
+		}
+
+		volume := s.volumes[userID]
+		for i := len(schedule.Tiers) - 1; i >= 0; i-- {
+			tier := schedule.Tiers[i]
+			if !tier.MinVolume.GreaterThan(volume) {
+				return &Rates{
+					ScheduleID: schedule.ID,
+					Version:    schedule.Version,
+					Maker:      tier.MakerRate,
+					Taker:      tier.TakerRate,
+				}, nil
+			}
+		}
+		return nil, fmt.Errorf("fee schedule %s has no tier for volume %s", schedule.ID, volume)
+	}
+
+	return nil, nil
+}
+
+// TrailingVolume returns a user's quote volume on both sides of the book
+// over the trailing VolumeWindow, as of the last refresh
+func (s *Service) TrailingVolume(userID string) (decimal.Decimal, error) {
+	if err := s.load(); err != nil {
+		return decimal.Zero, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.volumes[userID], nil
+}
+
+// Refresh reloads the schedules and every user's trailing volume
+func (s *Service) Refresh() error {
+	schedules, err := s.ListSchedules()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return scopeRank(schedules[i]) > scopeRank(schedules[j])
+	})
+
+	volumes, err := s.trailingVolumes()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.schedules, s.volumes, s.loaded = schedules, volumes, true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Run refreshes the rates now and every interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Refresh(); err != nil {
+			log.Printf("Failed to refresh fee schedules: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load refreshes the rates if they have not been loaded since they last
+// changed
+func (s *Service) load() error {
+	s.mu.RLock()
+	loaded := s.loaded
+	s.mu.RUnlock()
+
+	if loaded {
+		return nil
+	}
+	return s.Refresh()
+}
+
+// invalidate makes the next rates resolved reload the schedules
+func (s *Service) invalidate() {
+	s.mu.Lock()
+	s.loaded = false
+	s.mu.Unlock()
+}
+
+// trailingVolumes returns the quote volume of every user who traded over the
+// trailing VolumeWindow, on both sides of the book
+func (s *Service) trailingVolumes() (map[string]decimal.Decimal, error) {
+	query := `
+		SELECT user_id, SUM(total_value)
+		FROM (
+			SELECT buyer_id AS user_id, total_value FROM trades WHERE executed_at >= $1
+			UNION ALL
+			SELECT seller_id, total_value FROM trades WHERE executed_at >= $1 AND seller_id <> buyer_id
+		) sides
+		GROUP BY user_id
+	`
+
+	rows, err := s.db.Query(query, time.Now().Add(-VolumeWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trading volume: %w", err)
+	}
+	defer rows.Close()
+
+	volumes := make(map[string]decimal.Decimal)
+	for rows.Next() {
+		var userID string
+		var volume decimal.Decimal
+		if err := rows.Scan(&userID, &volume); err != nil {
+			return nil, fmt.Errorf("failed to scan trading volume: %w", err)
+		}
+		volumes[userID] = volume
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get trading volume: %w", err)
+	}
+
+	return volumes, nil
+}
+
+// scopeRank orders schedules by how specific their scope is: user and token,
+// then user, then token, then the default
+func scopeRank(schedule *models.FeeSchedule) int {
+	rank := 0
+	if schedule.UserID != nil {
+		rank += 2
+	}
+	if schedule.TokenID != nil {
+		rank++
+	}
+	return rank
+}
+
+// ListSchedules returns every schedule version with its tiers, newest first
+func (s *Service) ListSchedules() ([]*models.FeeSchedule, error) {
+	query := `
+		SELECT id, name, version, user_id, token_id, effective_from, created_by, created_at
+		FROM fee_schedules
+		ORDER BY effective_from DESC, version DESC
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := []*models.FeeSchedule{}
+	byID := make(map[string]*models.FeeSchedule)
+	for rows.Next() {
+		schedule := &models.FeeSchedule{Tiers: []models.FeeTier{}}
+		err := rows.Scan(
+			&schedule.ID, &schedule.Name, &schedule.Version, &schedule.UserID,
+			&schedule.TokenID, &schedule.EffectiveFrom, &schedule.CreatedBy, &schedule.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fee schedule: %w", err)
+		}
+		schedules = append(schedules, schedule)
+		byID[schedule.ID] = schedule
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get fee schedules: %w", err)
+	}
+
+	tierRows, err := s.db.Query(`
+		SELECT schedule_id, min_volume, maker_rate, taker_rate
+		FROM fee_schedule_tiers
+		ORDER BY schedule_id, min_volume ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee tiers: %w", err)
+	}
+	defer tierRows.Close()
+
+	for tierRows.Next() {
+		var scheduleID string
+		var tier models.FeeTier
+		if err := tierRows.Scan(&scheduleID, &tier.MinVolume, &tier.MakerRate, &tier.TakerRate); err != nil {
+			return nil, fmt.Errorf("failed to scan fee tier: %w", err)
+		}
+		if schedule, ok := byID[scheduleID]; ok {
+			schedule.Tiers = append(schedule.Tiers, tier)
+		}
+	}
+	if err := tierRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get fee tiers: %w", err)
+	}
+
+	return schedules, nil
+}
+
+// CreateSchedule publishes a new version of the schedule for the given user
+// and token scope. It takes effect at EffectiveFrom, or immediately if that
+// is unset; orders placed before then keep the rates they were placed with.
+func (s *Service) CreateSchedule(schedule *models.FeeSchedule) error {
+	if schedule.EffectiveFrom.IsZero() {
+		schedule.EffectiveFrom = time.Now()
+	}
+
+	if err := validateSchedule(schedule); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Versions are numbered per scope; concurrent publishers for the same
+	// scope are serialized on the scope's advisory lock
+	scopeKey := fmt.Sprintf("fees:%s:%s", stringOrEmpty(schedule.UserID), stringOrEmpty(schedule.TokenID))
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, scopeKey); err != nil {
+		return fmt.Errorf("failed to lock fee schedule scope: %w", err)
+	}
+
+	versionQuery := `
+		SELECT COALESCE(MAX(version), 0) + 1
+		FROM fee_schedules
+		WHERE user_id IS NOT DISTINCT FROM $1 AND token_id IS NOT DISTINCT FROM $2
+	`
+	if err := tx.QueryRow(versionQuery, schedule.UserID, schedule.TokenID).Scan(&schedule.Version); err != nil {
+		return fmt.Errorf("failed to get fee schedule version: %w", err)
+	}
+
+	insertQuery := `
+		INSERT INTO fee_schedules (name, version, user_id, token_id, effective_from, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+	err = tx.QueryRow(insertQuery,
+		schedule.Name, schedule.Version, schedule.UserID, schedule.TokenID,
+		schedule.EffectiveFrom, schedule.CreatedBy,
+	).Scan(&schedule.ID, &schedule.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create fee schedule: %w", err)
+	}
+
+	tierQuery := `
+		INSERT INTO fee_schedule_tiers (schedule_id, min_volume, maker_rate, taker_rate)
+		VALUES ($1, $2, $3, $4)
+	`
+	for _, tier := range schedule.Tiers {
+		if _, err := tx.Exec(tierQuery, schedule.ID, tier.MinVolume, tier.MakerRate, tier.TakerRate); err != nil {
+			return fmt.Errorf("failed to create fee tier: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.invalidate()
+	return nil
+}
+
+// DeleteSchedule withdraws a schedule version that has not taken effect yet
+func (s *Service) DeleteSchedule(scheduleID string) error {
+	result, err := s.db.Exec(`DELETE FROM fee_schedules WHERE id = $1 AND effective_from > NOW()`, scheduleID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fee schedule: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete fee schedule: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+
+	s.invalidate()
+	return nil
+}
+
+// validateSchedule checks a schedule's tiers: they must start at zero volume
+// so every user has a rate, and each must charge 0 <= maker <= taker <=
+// MaxFeeRate. Tiers are sorted by volume.
+func validateSchedule(schedule *models.FeeSchedule) error {
+	if schedule.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSchedule)
+	}
+
+	if schedule.EffectiveFrom.Before(time.Now().Add(-time.Minute)) {
+		return fmt.Errorf("%w: effective date cannot be in the past", ErrInvalidSchedule)
+	}
+
+	if len(schedule.Tiers) == 0 {
+		return fmt.Errorf("%w: at least one tier is required", ErrInvalidSchedule)
+	}
+
+	sort.Slice(schedule.Tiers, func(i, j int) bool {
+		return schedule.Tiers[i].MinVolume.LessThan(schedule.Tiers[j].MinVolume)
+	})
+
+	if !schedule.Tiers[0].MinVolume.IsZero() {
+		return fmt.Errorf("%w: the first tier must start at zero volume", ErrInvalidSchedule)
+	}
+
+	for i, tier := range schedule.Tiers {
+		if i > 0 && tier.MinVolume.Equal(schedule.Tiers[i-1].MinVolume) {
+			return fmt.Errorf("%w: duplicate tier for volume %s", ErrInvalidSchedule, tier.MinVolume)
+		}
+		if tier.MakerRate.IsNegative() || tier.MakerRate.GreaterThan(tier.TakerRate) {
+			return fmt.Errorf("%w: maker rate must be between 0 and the taker rate", ErrInvalidSchedule)
+		}
+		if tier.TakerRate.GreaterThan(MaxFeeRate) {
+			return fmt.Errorf("%w: taker rate cannot exceed %s", ErrInvalidSchedule, MaxFeeRate)
+		}
+	}
+
+	return nil
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,333 @@
+package fees
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectLoad expects the schedules, their tiers and the users' trailing
+// volumes to be loaded
+func expectLoad(mock sqlmock.Sqlmock, schedules, tiers, volumes *sqlmock.Rows) {
+	mock.ExpectQuery("SELECT id, name, version, user_id, token_id, effective_from, created_by, created_at FROM fee_schedules").
+		WillReturnRows(schedules)
+	mock.ExpectQuery("SELECT schedule_id, min_volume, maker_rate, taker_rate FROM fee_schedule_tiers").
+		WillReturnRows(tiers)
+	mock.ExpectQuery("SELECT user_id, SUM\\(total_value\\) FROM").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(volumes)
+}
+
+func scheduleRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "version", "user_id", "token_id", "effective_from", "created_by", "created_at"})
+}
+
+func tierRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"schedule_id", "min_volume", "maker_rate", "taker_rate"})
+}
+
+func volumeRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"user_id", "sum"})
+}
+
+func TestRatesFor(t *testing.T) {
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	otherUserID := "550e8400-e29b-41d4-a716-446655440002"
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	defaultID := "990e8400-e29b-41d4-a716-446655440001"
+	scheduleID := "990e8400-e29b-41d4-a716-446655440009"
+	otherID := "990e8400-e29b-41d4-a716-446655440002"
+	pendingID := "990e8400-e29b-41d4-a716-446655440003"
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		setupMock func(mock sqlmock.Sqlmock)
+		wantRates *Rates
+		wantError bool
+	}{
+		{
+			name: "Most specific schedule in effect, tier picked by trailing volume",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectLoad(mock,
+					scheduleRows().
+						AddRow(pendingID, "Pending", 4, nil, tokenID, time.Now().Add(time.Hour), nil, past).
+						AddRow(scheduleID, "Token", 3, nil, tokenID, past, nil, past).
+						AddRow(otherID, "Other user", 1, otherUserID, nil, past, nil, past).
+						AddRow(defaultID, "Default", 1, nil, nil, past, nil, past),
+					tierRows().
+						AddRow(defaultID, "0", "0.003", "0.005").
+						AddRow(otherID, "0", "0", "0").
+						AddRow(pendingID, "0", "0", "0").
+						AddRow(scheduleID, "0", "0.002", "0.004").
+						AddRow(scheduleID, "100000", "0.001", "0.0025").
+						AddRow(scheduleID, "500000", "0.0005", "0.001"),
+					volumeRows().AddRow(userID, "250000.00000000").AddRow(otherUserID, "900000.00000000"))
+			},
+			wantRates: &Rates{
+				ScheduleID: scheduleID,
+				Version:    3,
+				Maker:      decimal.MustParse("0.001"),
+				Taker:      decimal.MustParse("0.0025"),
+			},
+		},
+		{
+			name: "No schedule in effect",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectLoad(mock, scheduleRows(), tierRows(), volumeRows())
+			},
+			wantRates: nil,
+		},
+		{
+			name: "Schedule without a matching tier",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectLoad(mock,
+					scheduleRows().AddRow(scheduleID, "Gap", 1, nil, nil, past, nil, past),
+					tierRows().AddRow(scheduleID, "1000", "0.001", "0.002"),
+					volumeRows())
+			},
+			wantError: true,
+		},
+		{
+			name: "Database error",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, name, version, user_id, token_id, effective_from, created_by, created_at FROM fee_schedules").
+					WillReturnError(sql.ErrConnDone)
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db)
+			tt.setupMock(mock)
+
+			rates, err := service.RatesFor(userID, tokenID)
+
+			if tt.wantError {
+				assert.Error(t, err)
+				assert.Nil(t, rates)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantRates, rates)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRatesForCache(t *testing.T) {
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	scheduleID := "990e8400-e29b-41d4-a716-446655440009"
+	past := time.Now().Add(-time.Hour)
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db)
+	expectLoad(mock,
+		scheduleRows().AddRow(scheduleID, "Default", 1, nil, nil, past, nil, past),
+		tierRows().AddRow(scheduleID, "0", "0.003", "0.005").AddRow(scheduleID, "1000", "0.002", "0.004"),
+		volumeRows().AddRow(userID, "500.00000000"))
+
+	// Rates are resolved from memory once loaded
+	for i := 0; i < 3; i++ {
+		rates, err := service.RatesFor(userID, tokenID)
+		assert.NoError(t, err)
+		assert.Equal(t, decimal.MustParse("0.005"), rates.Taker)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// A refresh picks up the volume traded since
+	expectLoad(mock,
+		scheduleRows().AddRow(scheduleID, "Default", 1, nil, nil, past, nil, past),
+		tierRows().AddRow(scheduleID, "0", "0.003", "0.005").AddRow(scheduleID, "1000", "0.002", "0.004"),
+		volumeRows().AddRow(userID, "1500.00000000"))
+	assert.NoError(t, service.Refresh())
+
+	volume, err := service.TrailingVolume(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.MustParse("1500"), volume)
+	rates, err := service.RatesFor(userID, tokenID)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.MustParse("0.004"), rates.Taker)
+
+	// Withdrawing a schedule reloads the schedules before the next rates
+	mock.ExpectExec("DELETE FROM fee_schedules").
+		WithArgs(scheduleID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, service.DeleteSchedule(scheduleID))
+
+	expectLoad(mock, scheduleRows(), tierRows(), volumeRows().AddRow(userID, "1500.00000000"))
+	rates, err = service.RatesFor(userID, tokenID)
+	assert.NoError(t, err)
+	assert.Nil(t, rates)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateSchedule(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	adminID := "550e8400-e29b-41d4-a716-446655440005"
+
+	tier := func(minVolume, maker, taker string) models.FeeTier {
+		return models.FeeTier{
+			MinVolume: decimal.MustParse(minVolume),
+			MakerRate: decimal.MustParse(maker),
+			TakerRate: decimal.MustParse(taker),
+		}
+	}
+
+	tests := []struct {
+		name        string
+		schedule    *models.FeeSchedule
+		setupMock   func(mock sqlmock.Sqlmock)
+		wantVersion int
+		wantError   bool
+	}{
+		{
+			name: "New version of a token schedule",
+			schedule: &models.FeeSchedule{
+				Name:      "Launch discount",
+				TokenID:   &tokenID,
+				Tiers:     []models.FeeTier{tier("100000", "0.001", "0.002"), tier("0", "0.002", "0.004")},
+				CreatedBy: &adminID,
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs("fees::" + tokenID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT COALESCE\\(MAX\\(version\\), 0\\) \\+ 1 FROM fee_schedules").
+					WithArgs(nil, tokenID).
+					WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(2))
+				mock.ExpectQuery("INSERT INTO fee_schedules").
+					WithArgs("Launch discount", 2, nil, tokenID, sqlmock.AnyArg(), adminID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow("990e8400-e29b-41d4-a716-446655440009", time.Now()))
+				// Tiers are written in volume order
+				mock.ExpectExec("INSERT INTO fee_schedule_tiers").
+					WithArgs("990e8400-e29b-41d4-a716-446655440009", decimal.Zero, decimal.MustParse("0.002"), decimal.MustParse("0.004")).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO fee_schedule_tiers").
+					WithArgs("990e8400-e29b-41d4-a716-446655440009", decimal.MustParse("100000"), decimal.MustParse("0.001"), decimal.MustParse("0.002")).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantVersion: 2,
+		},
+		{
+			name: "First tier above zero volume",
+			schedule: &models.FeeSchedule{
+				Name:  "Gap",
+				Tiers: []models.FeeTier{tier("1000", "0.001", "0.002")},
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {},
+			wantError: true,
+		},
+		{
+			name: "Maker rate above taker rate",
+			schedule: &models.FeeSchedule{
+				Name:  "Inverted",
+				Tiers: []models.FeeTier{tier("0", "0.005", "0.003")},
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {},
+			wantError: true,
+		},
+		{
+			name: "Taker rate above the cap",
+			schedule: &models.FeeSchedule{
+				Name:  "Expensive",
+				Tiers: []models.FeeTier{tier("0", "0.01", "0.2")},
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {},
+			wantError: true,
+		},
+		{
+			name: "Effective date in the past",
+			schedule: &models.FeeSchedule{
+				Name:          "Backdated",
+				EffectiveFrom: time.Now().Add(-24 * time.Hour),
+				Tiers:         []models.FeeTier{tier("0", "0.001", "0.002")},
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {},
+			wantError: true,
+		},
+		{
+			name: "No tiers",
+			schedule: &models.FeeSchedule{
+				Name: "Empty",
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db)
+			tt.setupMock(mock)
+
+			err := service.CreateSchedule(tt.schedule)
+
+			if tt.wantError {
+				assert.ErrorIs(t, err, ErrInvalidSchedule)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantVersion, tt.schedule.Version)
+				assert.NotEmpty(t, tt.schedule.ID)
+				assert.False(t, tt.schedule.EffectiveFrom.IsZero())
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteSchedule(t *testing.T) {
+	scheduleID := "990e8400-e29b-41d4-a716-446655440009"
+
+	tests := []struct {
+		name         string
+		rowsAffected int64
+		wantError    error
+	}{
+		{name: "Pending version withdrawn", rowsAffected: 1},
+		{name: "Version already in effect", rowsAffected: 0, wantError: ErrScheduleNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db)
+			mock.ExpectExec("DELETE FROM fee_schedules WHERE id = \\$1 AND effective_from > NOW\\(\\)").
+				WithArgs(scheduleID).
+				WillReturnResult(sqlmock.NewResult(0, tt.rowsAffected))
+
+			err := service.DeleteSchedule(scheduleID)
+
+			if tt.wantError != nil {
+				assert.ErrorIs(t, err, tt.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package idempotency
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/database"
+)
+
+// KeyTTL is how long a key's response is kept for replay. After that the key
+// may be reused for a new request.
+const KeyTTL = 24 * time.Hour
+
+// ClaimLease is how long a claimed key waits for its request to finish. A
+// claim still in progress after that belongs to a request that died before
+// recording or releasing it, and a retry of the same request takes it over.
+const ClaimLease = time.Minute
+
+// MaxKeyLength is the longest idempotency key accepted
+const MaxKeyLength = 255
+
+// ErrKeyReused is returned when a key is sent again with a different request
+var ErrKeyReused = errors.New("idempotency key was already used for a different request")
+
+// ErrInProgress is returned when the original request for a key has not
+// finished yet
+var ErrInProgress = errors.New("a request with this idempotency key is still being processed")
+
+// Response is a recorded response to replay
+type Response struct {
+	StatusCode int
+	Body       []byte
+}
+
+type Service struct {
+	db *database.DB
+}
+
+func NewService(db *database.DB) *Service {
+	return &Service{db: db}
+}
+
+// Begin claims a key for a request identified by fingerprint. It returns nil
+// if the request should be processed, or the recorded response if the key
+// has already completed for the same request.
+func (s *Service) Begin(userID, key, fingerprint string) (*Response, error) {
+	// Keys past their TTL are claimed afresh, and abandoned claims past their
+	// lease by a retry of the same request
+	claimQuery := `
+		INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, idempotency_key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = NULL, response_body = NULL,
+		    created_at = NOW(), completed_at = NULL
+		WHERE idempotency_keys.created_at < NOW() - $4 * INTERVAL '1 second'
+		   OR (idempotency_keys.completed_at IS NULL
+		       AND idempotency_keys.request_hash = EXCLUDED.request_hash
+		       AND idempotency_keys.created_at < NOW() - $5 * INTERVAL '1 second')
+	`
+
+	result, err := s.db.Exec(claimQuery, userID, key, fingerprint, int64(KeyTTL/time.Second), int64(ClaimLease/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if rowsAffected == 1 {
+		return nil, nil
+	}
+
+	var requestHash string
+	var statusCode sql.NullInt64
+	var body []byte
+	err = s.db.QueryRow(
+		`SELECT request_hash, status_code, response_body FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2`,
+		userID, key,
+	).Scan(&requestHash, &statusCode, &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	if requestHash != fingerprint {
+		return nil, ErrKeyReused
+	}
+	if !statusCode.Valid {
+		return nil, ErrInProgress
+	}
+
+	return &Response{StatusCode: int(statusCode.Int64), Body: body}, nil
+}
+
+// Complete records the response to a claimed key for replay
+func (s *Service) Complete(userID, key string, response *Response) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $3, response_body = $4, completed_at = NOW()
+		WHERE user_id = $1 AND idempotency_key = $2
+	`
+
+	if _, err := s.db.Exec(query, userID, key, response.StatusCode, response.Body); err != nil {
+		return fmt.Errorf("failed to record idempotent response: %w", err)
+	}
+
+	return nil
+}
+
+// Release gives up a claimed key without a response, so that the request can
+// be retried
+func (s *Service) Release(userID, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND status_code IS NULL`
+
+	if _, err := s.db.Exec(query, userID, key); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+
+	return nil
+}
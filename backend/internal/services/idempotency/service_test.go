@@ -0,0 +1,99 @@
+package idempotency
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/peoplecoin/backend/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBegin(t *testing.T) {
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	key := "order-1"
+	fingerprint := "3f1a"
+
+	tests := []struct {
+		name         string
+		setupMock    func(mock sqlmock.Sqlmock)
+		wantResponse *Response
+		wantError    error
+	}{
+		{
+			name: "New key is claimed",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys").
+					WithArgs(userID, key, fingerprint, int64(86400), int64(60)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "Abandoned claim is taken over after its lease",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("ON CONFLICT .* OR \\(idempotency_keys.completed_at IS NULL\\s+AND idempotency_keys.request_hash = EXCLUDED.request_hash\\s+AND idempotency_keys.created_at < NOW\\(\\) - \\$5").
+					WithArgs(userID, key, fingerprint, int64(86400), int64(60)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "Completed key replays its response",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT request_hash, status_code, response_body FROM idempotency_keys").
+					WithArgs(userID, key).
+					WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "response_body"}).
+						AddRow(fingerprint, 201, []byte(`{"success":true}`)))
+			},
+			wantResponse: &Response{StatusCode: 201, Body: []byte(`{"success":true}`)},
+		},
+		{
+			name: "Key still in progress",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT request_hash, status_code, response_body FROM idempotency_keys").
+					WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "response_body"}).
+						AddRow(fingerprint, nil, nil))
+			},
+			wantError: ErrInProgress,
+		},
+		{
+			name: "Key used for a different request",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT request_hash, status_code, response_body FROM idempotency_keys").
+					WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "response_body"}).
+						AddRow("9b2c", 201, []byte(`{}`)))
+			},
+			wantError: ErrKeyReused,
+		},
+		{
+			name: "Database error",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys").WillReturnError(sql.ErrConnDone)
+			},
+			wantError: sql.ErrConnDone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db)
+			tt.setupMock(mock)
+
+			response, err := service.Begin(userID, key, fingerprint)
+
+			if tt.wantError != nil {
+				assert.ErrorIs(t, err, tt.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantResponse, response)
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
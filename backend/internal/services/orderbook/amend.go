@@ -0,0 +1,246 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// ErrOrderNotAmendable is returned when an order does not exist, belongs to
+// another user or is not a resting limit order
+var ErrOrderNotAmendable = errors.New("order not found or cannot be amended")
+
+// ErrInvalidAmendment is returned when an amendment's price or quantity is
+// not acceptable
+var ErrInvalidAmendment = errors.New("invalid amendment")
+
+// AmendOrder changes the price and/or total quantity of a resting limit
+// order. Reducing the quantity at the same price keeps the order's place in
+// its queue; any other change cancels and replaces it at the back of the
+// queue for its new price, where it may match immediately. The amended order
+// is returned with any trades it made.
+func (s *Service) AmendOrder(orderID, userID string, price *decimal.Decimal, quantity *int64) (*models.Order, []*models.Trade, error) {
+	var tokenID string
+	err := s.db.QueryRow(`SELECT token_id FROM orders WHERE id = $1 AND user_id = $2`, orderID, userID).Scan(&tokenID)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrOrderNotAmendable
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to amend order: %w", err)
+	}
+
+	if err := s.checkCreatorRestrictions(userID, tokenID); err != nil {
+		return nil, nil, err
+	}
+
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	bo, ok := book.orders[orderID]
+	if !ok || bo.order.UserID != userID || bo.order.ExecutionType != "limit" ||
+		(bo.order.Status != "open" && bo.order.Status != "partially_filled") || expired(bo.order, time.Now()) {
+		return nil, nil, ErrOrderNotAmendable
+	}
+	order := bo.order
+
+	newPrice, newQuantity := order.Price, order.Quantity
+	if price != nil {
+		newPrice = *price
+	}
+	if quantity != nil {
+		newQuantity = *quantity
+	}
+
+	if err := s.checkTradable(book); err != nil {
+		return nil, nil, err
+	}
+	if book.halt != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTradingHalted, book.halt.message)
+	}
+	if !newPrice.IsPositive() {
+		return nil, nil, fmt.Errorf("%w: price must be positive", ErrInvalidAmendment)
+	}
+	if newQuantity <= order.FilledQuantity {
+		return nil, nil, fmt.Errorf("%w: quantity must exceed the %d already filled", ErrInvalidAmendment, order.FilledQuantity)
+	}
+	if newQuantity > decimal.MaxInt {
+		return nil, nil, fmt.Errorf("%w: quantity must be at most %d", ErrInvalidAmendment, decimal.MaxInt)
+	}
+	if _, ok := newPrice.TryMulInt(newQuantity); !ok {
+		return nil, nil, fmt.Errorf("%w: order value is too large", ErrInvalidAmendment)
+	}
+	if order.DisplayQuantity != nil && *order.DisplayQuantity > newQuantity {
+		return nil, nil, fmt.Errorf("%w: quantity is below the display quantity", ErrInvalidAmendment)
+	}
+
+	if !newPrice.Equal(order.Price) {
+		if err := book.rules.checkPrice(newPrice); err != nil {
+			return nil, nil, err
+		}
+		if err := s.checkPriceBand(book, newPrice); err != nil {
+			return nil, nil, err
+		}
+	}
+	if newQuantity != order.Quantity {
+		if err := book.rules.checkQuantity(newQuantity); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if newPrice.Equal(order.Price) && newQuantity <= order.Quantity {
+		if newQuantity < order.Quantity {
+			if err := s.reduceOrder(book, bo, order.Quantity-newQuantity); err != nil {
+				return nil, nil, err
+			}
+		}
+		amended := *order
+		return &amended, []*models.Trade{}, nil
+	}
+
+	return s.replaceOrder(book, bo, newPrice, newQuantity)
+}
+
+// reduceOrder shrinks a resting order in place, keeping its time priority,
+// and releases the reservation the removed quantity held
+func (s *Service) reduceOrder(book *Book, bo *bookOrder, quantity int64) error {
+	order := bo.order
+	release := decimal.Min(reservationFor(order, quantity), order.LockedAmount)
+
+	tx, err := s.beginTokenTx(order.TokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE orders
+		SET quantity = quantity - $2, remaining_quantity = remaining_quantity - $2,
+		    locked_amount = locked_amount - $3, updated_at = NOW()
+		WHERE id = $1
+		  AND status IN ('open', 'partially_filled')
+		  AND remaining_quantity = $4
+	`
+
+	result, err := tx.Exec(query, order.ID, quantity, release, order.RemainingQuantity)
+	if err != nil {
+		return fmt.Errorf("failed to amend order: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to amend order: %w", err)
+	}
+	if rowsAffected != 1 {
+		return fmt.Errorf("failed to amend order: order %s changed concurrently", order.ID)
+	}
+
+	if release.IsPositive() {
+		if err := releaseFunds(tx, order.UserID, balanceCurrency(order), release); err != nil {
+			return err
+		}
+	}
+
+	var events orderEvents
+	events.reduced(order, quantity)
+	if err := events.write(tx, order.TokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	order.LockedAmount = order.LockedAmount.Sub(release)
+	order.UpdatedAt = time.Now()
+	book.reduce(bo, quantity)
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(order.TokenID))
+
+	s.announce(book, events)
+
+	return nil
+}
+
+// replaceOrder cancels a resting order and replaces it under the same ID
+// with a new price and total quantity. The replacement is matched like an
+// incoming order and queues behind every order already resting at its price;
+// its previous entry stays on the book until the replacement is committed and
+// leaves it in the same change.
+func (s *Service) replaceOrder(book *Book, bo *bookOrder, price decimal.Decimal, quantity int64) (*models.Order, []*models.Trade, error) {
+	now := time.Now()
+
+	amended := *bo.order
+	amended.Price = price
+	amended.Quantity = quantity
+	amended.RemainingQuantity = quantity - amended.FilledQuantity
+	amended.AveragePrice = nil
+	amended.CancelReason = nil
+	amended.RequeuedAt = &now
+	amended.UpdatedAt = now
+	amended.Status = "open"
+	if amended.FilledQuantity > 0 {
+		amended.Status = "partially_filled"
+	}
+
+	// A post-only order must still rest without taking liquidity at its new
+	// price
+	if amended.PostOnly {
+		if err := s.applyPostOnly(book, &amended); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	trades, err := s.execute(book, &amended, OrderEventAmended, updateAmendedOrder(bo.order.RemainingQuantity), bo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Trades move the last price, which may set off stop orders
+	if len(trades) > 0 {
+		s.evaluateTriggers(book)
+	}
+
+	return &amended, trades, nil
+}
+
+// updateAmendedOrder journals the execution of a replaced order, failing if
+// the order is no longer resting with the remainder this book last saw
+func updateAmendedOrder(prevRemaining int64) func(*sql.Tx, *models.Order) error {
+	return func(tx *sql.Tx, order *models.Order) error {
+		query := `
+			UPDATE orders
+			SET price = $2, quantity = $3, filled_quantity = $4, remaining_quantity = $5,
+			    status = $6, cancel_reason = $7, fee_paid = $8, locked_amount = $9,
+			    requeued_at = $10, updated_at = NOW()
+			WHERE id = $1
+			  AND status IN ('open', 'partially_filled')
+			  AND remaining_quantity = $11
+		`
+
+		result, err := tx.Exec(query,
+			order.ID, order.Price, order.Quantity, order.FilledQuantity, order.RemainingQuantity,
+			order.Status, order.CancelReason, order.FeePaid, order.LockedAmount,
+			order.RequeuedAt, prevRemaining,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update amended order: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to update amended order: %w", err)
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("failed to update amended order: order %s changed concurrently", order.ID)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,682 @@
+package orderbook
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// Auction reasons recorded in auctions.reason
+const (
+	AuctionOpening   = "opening"   // a newly active token's first trades
+	AuctionReopening = "reopening" // resuming a token after a trading halt
+)
+
+// Trading phases reported with the order book
+const (
+	PhaseContinuous = "continuous"
+	PhaseAuction    = "auction"
+	PhaseHalted     = "halted"
+)
+
+// ErrAuctionInProgress is returned when a token is already in a call auction
+var ErrAuctionInProgress = errors.New("token is already in a call auction")
+
+// ErrInvalidAuction is returned when an auction's reason or duration is not
+// acceptable
+var ErrInvalidAuction = errors.New("invalid auction")
+
+// ErrNotAllowedInAuction is returned for orders that cannot rest, which a
+// book in a call auction does not accept
+var ErrNotAllowedInAuction = errors.New("market, IOC and FOK orders are not accepted during a call auction")
+
+// auctionIndex is the unique index allowing one running auction per token
+const auctionIndex = "idx_auctions_running"
+
+// auctionState is the call auction a book is in
+type auctionState struct {
+	id     string
+	reason string
+	endsAt time.Time
+}
+
+// cross is a planned auction execution between a resting bid and ask. Bids
+// and asks of the same user are decremented against each other instead of
+// trading.
+type cross struct {
+	bid, ask  *bookOrder
+	quantity  int64
+	selfMatch bool
+}
+
+// uncrossPlan is the outcome of ending a call auction
+type uncrossPlan struct {
+	price   decimal.Decimal
+	volume  int64
+	crosses []cross
+	expired []*bookOrder
+}
+
+// auctionEntries returns one side's live resting orders in priority order,
+// and those past their expiry separately
+func (b *Book) auctionEntries(side string, now time.Time) (live, expiredOrders []*bookOrder) {
+	for _, level := range b.side(side) {
+		for e := level.orders.Front(); e != nil; e = e.Next() {
+			bo := e.Value.(*bookOrder)
+			if expired(bo.order, now) {
+				expiredOrders = append(expiredOrders, bo)
+				continue
+			}
+			live = append(live, bo)
+		}
+	}
+	return live, expiredOrders
+}
+
+// equilibrium returns the price at which uncrossing the book now would
+// execute the most volume, and that volume. Ties go to the price leaving the
+// smallest imbalance between the two sides; any price in the remaining range
+// executes the same, so the last trade price is used when it falls inside it
+// and the middle of the range otherwise, moved onto a tick toward the side
+// left with unmatched volume. Iceberg reserves count in full. The
+// volume is zero, and the price meaningless, when no orders cross.
+func (b *Book) equilibrium(now time.Time) (decimal.Decimal, int64) {
+	bids, _ := b.auctionEntries("bid", now)
+	asks, _ := b.auctionEntries("ask", now)
+	if len(bids) == 0 || len(asks) == 0 {
+		return decimal.Zero, 0
+	}
+
+	var prices []decimal.Decimal
+	seen := make(map[decimal.Decimal]bool)
+	for _, bo := range append(append([]*bookOrder{}, bids...), asks...) {
+		if !seen[bo.order.Price] {
+			seen[bo.order.Price] = true
+			prices = append(prices, bo.order.Price)
+		}
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+
+	var bestVolume, bestImbalance int64
+	var lo, hi decimal.Decimal
+	buyersLeft := false
+	for _, price := range prices {
+		var bidVolume, askVolume int64
+		for _, bo := range bids {
+			if bo.order.Price.Cmp(price) >= 0 {
+				bidVolume += bo.order.RemainingQuantity
+			}
+		}
+		for _, bo := range asks {
+			if bo.order.Price.Cmp(price) <= 0 {
+				askVolume += bo.order.RemainingQuantity
+			}
+		}
+
+		volume, imbalance := bidVolume, askVolume-bidVolume
+		if askVolume < bidVolume {
+			volume, imbalance = askVolume, bidVolume-askVolume
+		}
+
+		switch {
+		case volume > bestVolume || (volume == bestVolume && volume > 0 && imbalance < bestImbalance):
+			bestVolume, bestImbalance, lo, hi = volume, imbalance, price, price
+			buyersLeft = bidVolume > askVolume
+		case volume == bestVolume && volume > 0 && imbalance == bestImbalance:
+			hi = price
+		}
+	}
+
+	if bestVolume == 0 {
+		return decimal.Zero, 0
+	}
+	if b.lastPrice.IsPositive() {
+		return decimal.Min(decimal.Max(b.lastPrice, lo), hi), bestVolume
+	}
+	middle := b.rules.snapPrice(lo.Add(hi).DivInt(2, averagePriceRounding), buyersLeft)
+	return decimal.Min(decimal.Max(middle, lo), hi), bestVolume
+}
+
+// planUncross plans the executions that end a call auction without mutating
+// the book. Bids are walked best price first, then oldest first, and paired
+// with asks in the same way at the equilibrium price until either side has
+// nothing left that crosses it.
+func (b *Book) planUncross(now time.Time) uncrossPlan {
+	bids, expiredBids := b.auctionEntries("bid", now)
+	asks, expiredAsks := b.auctionEntries("ask", now)
+
+	plan := uncrossPlan{crosses: []cross{}, expired: append(expiredBids, expiredAsks...)}
+	plan.price, plan.volume = b.equilibrium(now)
+	if plan.volume == 0 {
+		return plan
+	}
+
+	used := make(map[*bookOrder]int64)
+	i, j := 0, 0
+	for i < len(bids) && j < len(asks) &&
+		bids[i].order.Price.Cmp(plan.price) >= 0 && asks[j].order.Price.Cmp(plan.price) <= 0 {
+		bid, ask := bids[i], asks[j]
+
+		quantity := bid.order.RemainingQuantity - used[bid]
+		if open := ask.order.RemainingQuantity - used[ask]; open < quantity {
+			quantity = open
+		}
+
+		plan.crosses = append(plan.crosses, cross{
+			bid:       bid,
+			ask:       ask,
+			quantity:  quantity,
+			selfMatch: bid.order.UserID == ask.order.UserID,
+		})
+
+		used[bid] += quantity
+		used[ask] += quantity
+		if used[bid] == bid.order.RemainingQuantity {
+			i++
+		}
+		if used[ask] == ask.order.RemainingQuantity {
+			j++
+		}
+	}
+
+	return plan
+}
+
+// auctionOutcome is everything an uncross does to one resting order
+type auctionOutcome struct {
+	entry     *bookOrder
+	filled    int64
+	decrement int64 // quantity removed by matching against the same user
+	fee       decimal.Decimal
+	release   decimal.Decimal // all reservation released, settled or not
+	unsettled decimal.Decimal // reservation released by self-matching, outside any trade
+}
+
+// auctionSettlement turns an uncross plan into trades at the uncross price,
+// the reservations each trade releases on both sides and the outcome for
+// every order involved. Both sides of an auction trade are charged their
+// maker rate, since neither took liquidity from the other.
+func auctionSettlement(tokenID string, plan uncrossPlan) ([]*models.Trade, []settlement, []*auctionOutcome) {
+	trades := []*models.Trade{}
+	settlements := []settlement{}
+	var outcomes []*auctionOutcome
+
+	// Releases are computed against each order's progressively updated copy
+	// so that the cross completing an order releases all it has left
+	states := make(map[*bookOrder]*models.Order)
+	byEntry := make(map[*bookOrder]*auctionOutcome)
+	outcomeFor := func(bo *bookOrder) (*models.Order, *auctionOutcome) {
+		if _, ok := states[bo]; !ok {
+			state := *bo.order
+			states[bo] = &state
+			byEntry[bo] = &auctionOutcome{entry: bo}
+			outcomes = append(outcomes, byEntry[bo])
+		}
+		return states[bo], byEntry[bo]
+	}
+
+	for _, c := range plan.crosses {
+		bidState, bidOutcome := outcomeFor(c.bid)
+		askState, askOutcome := outcomeFor(c.ask)
+
+		if c.selfMatch {
+			for _, side := range []struct {
+				state   *models.Order
+				outcome *auctionOutcome
+			}{{bidState, bidOutcome}, {askState, askOutcome}} {
+				release := side.state.LockedAmount
+				if c.quantity < side.state.RemainingQuantity {
+					release = decimal.Min(reservationFor(side.state, c.quantity), side.state.LockedAmount)
+				}
+				side.state.RemainingQuantity -= c.quantity
+				side.state.LockedAmount = side.state.LockedAmount.Sub(release)
+				side.outcome.decrement += c.quantity
+				side.outcome.release = side.outcome.release.Add(release)
+				side.outcome.unsettled = side.outcome.unsettled.Add(release)
+			}
+			continue
+		}
+
+		bid, ask := c.bid.order, c.ask.order
+		trade := &models.Trade{
+			ID:                  uuid.New().String(),
+			BuyerOrderID:        bid.ID,
+			SellerOrderID:       ask.ID,
+			BuyerID:             bid.UserID,
+			SellerID:            ask.UserID,
+			TokenID:             tokenID,
+			Price:               plan.price,
+			Quantity:            c.quantity,
+			TotalValue:          plan.price.MulInt(c.quantity),
+			BuyerFeeScheduleID:  bid.FeeScheduleID,
+			SellerFeeScheduleID: ask.FeeScheduleID,
+			ExecutedAt:          time.Now(),
+			SettlementStatus:    "pending",
+		}
+		trade.BuyerFee = trade.TotalValue.Mul(bid.MakerFeeRate, feeRounding)
+		trade.SellerFee = trade.TotalValue.Mul(ask.MakerFeeRate, feeRounding)
+		trade.PlatformFee = trade.BuyerFee.Add(trade.SellerFee)
+
+		s := settlement{
+			incomingRelease: releaseFor(bidState, c.quantity, spentBy("bid", trade)),
+			restingRelease:  releaseFor(askState, c.quantity, spentBy("ask", trade)),
+		}
+
+		bidState.RemainingQuantity -= c.quantity
+		bidState.LockedAmount = bidState.LockedAmount.Sub(s.incomingRelease)
+		bidOutcome.filled += c.quantity
+		bidOutcome.fee = bidOutcome.fee.Add(trade.BuyerFee)
+		bidOutcome.release = bidOutcome.release.Add(s.incomingRelease)
+
+		askState.RemainingQuantity -= c.quantity
+		askState.LockedAmount = askState.LockedAmount.Sub(s.restingRelease)
+		askOutcome.filled += c.quantity
+		askOutcome.fee = askOutcome.fee.Add(trade.SellerFee)
+		askOutcome.release = askOutcome.release.Add(s.restingRelease)
+
+		trades = append(trades, trade)
+		settlements = append(settlements, s)
+	}
+
+	return trades, settlements, outcomes
+}
+
+// StartAuction puts a token's book into a call auction that ends after
+// duration, or after the configured duration for the reason if duration is
+// zero. Orders keep being accepted but none match until the auction is
+// uncrossed.
+func (s *Service) StartAuction(tokenID, reason string, duration time.Duration) (*models.Auction, error) {
+	auction, err := s.newAuction(tokenID, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.auction != nil {
+		return nil, ErrAuctionInProgress
+	}
+	// A halted token re-opens with an auction when it resumes
+	if book.halt != nil {
+		return nil, ErrTradingHalted
+	}
+
+	tx, err := s.beginTokenTx(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := insertAuction(tx, auction); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	book.auction = &auctionState{id: auction.ID, reason: reason, endsAt: auction.EndsAt}
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(tokenID))
+
+	return auction, nil
+}
+
+// newAuction validates a call auction starting now, resolving a zero
+// duration to the configured one for the reason
+func (s *Service) newAuction(tokenID, reason string, duration time.Duration) (*models.Auction, error) {
+	if duration == 0 {
+		duration = s.openingAuctionDuration
+		if reason == AuctionReopening {
+			duration = s.reopeningAuctionDuration
+		}
+	}
+
+	if reason != AuctionOpening && reason != AuctionReopening {
+		return nil, fmt.Errorf("%w: reason must be opening or reopening", ErrInvalidAuction)
+	}
+	if duration < 0 {
+		return nil, fmt.Errorf("%w: duration must be positive", ErrInvalidAuction)
+	}
+
+	now := time.Now()
+	return &models.Auction{
+		TokenID:   tokenID,
+		Reason:    reason,
+		Status:    "running",
+		StartedAt: now,
+		EndsAt:    now.Add(duration),
+	}, nil
+}
+
+// insertAuction journals a new running auction and sets its ID
+func insertAuction(tx *sql.Tx, auction *models.Auction) error {
+	query := `
+		INSERT INTO auctions (token_id, reason, status, started_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	err := tx.QueryRow(query, auction.TokenID, auction.Reason, auction.Status, auction.StartedAt, auction.EndsAt).Scan(&auction.ID)
+	if isUniqueViolation(err, auctionIndex) {
+		return ErrAuctionInProgress
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start auction: %w", err)
+	}
+
+	return nil
+}
+
+// RunAuctions starts opening auctions for tokens that have become active,
+// re-opens halted tokens whose cooldown has passed and uncrosses auctions
+// that have ended, every interval until ctx is cancelled
+func (s *Service) RunAuctions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.StartOpeningAuctions(); err != nil {
+				log.Printf("Failed to start opening auctions: %v", err)
+			}
+			if resumed := s.ResumeHalts(); resumed > 0 {
+				log.Printf("🔔 Re-opened %d halted tokens", resumed)
+			}
+			if uncrossed := s.UncrossAuctions(); uncrossed > 0 {
+				log.Printf("🔔 Uncrossed %d call auctions", uncrossed)
+			}
+		}
+	}
+}
+
+// StartOpeningAuctions starts an opening auction for every active token that
+// has never had one, marking its book active with the token's market rules
+func (s *Service) StartOpeningAuctions() error {
+	query := `
+		SELECT t.id, t.tick_size, t.lot_size FROM tokens t
+		WHERE t.status = 'active'
+		  AND NOT EXISTS (SELECT 1 FROM auctions a WHERE a.token_id = t.id AND a.reason = $1)
+	`
+
+	rows, err := s.db.Query(query, AuctionOpening)
+	if err != nil {
+		return fmt.Errorf("failed to find tokens to open: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make(map[string]marketRules)
+	var tokenIDs []string
+	for rows.Next() {
+		var tokenID string
+		var tickSize *decimal.Decimal
+		var lotSize int64
+		if err := rows.Scan(&tokenID, &tickSize, &lotSize); err != nil {
+			return fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokenIDs = append(tokenIDs, tokenID)
+		rules[tokenID] = newMarketRules(tickSize, lotSize)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find tokens to open: %w", err)
+	}
+
+	for _, tokenID := range tokenIDs {
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.status = TokenActive
+		book.rules = rules[tokenID]
+		book.mu.Unlock()
+
+		if _, err := s.StartAuction(tokenID, AuctionOpening, 0); err != nil && !errors.Is(err, ErrAuctionInProgress) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UncrossAuctions ends every call auction whose end time has passed and
+// returns the number ended. Books that fail are logged and stay in auction
+// until the next check.
+func (s *Service) UncrossAuctions() int {
+	uncrossed := 0
+	for _, book := range s.engine.Books() {
+		ended, err := s.uncrossBook(book, time.Now())
+		if err != nil {
+			log.Printf("Failed to uncross auction for token %s: %v", book.tokenID, err)
+			continue
+		}
+		if ended {
+			uncrossed++
+		}
+	}
+	return uncrossed
+}
+
+// uncrossBook ends a book's call auction if it is due by now, reporting
+// whether it did
+func (s *Service) uncrossBook(book *Book, now time.Time) (bool, error) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.auction == nil || now.Before(book.auction.endsAt) {
+		return false, nil
+	}
+
+	return true, s.uncross(book, now)
+}
+
+// uncross executes a book's call auction at its equilibrium price, journals
+// the trades in one transaction and returns the book to continuous trading
+// once committed. Callers must hold book.mu.
+func (s *Service) uncross(book *Book, now time.Time) error {
+	plan := book.planUncross(now)
+	trades, settlements, outcomes := auctionSettlement(book.tokenID, plan)
+
+	tx, err := s.beginTokenTx(book.tokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Auction trades are journaled against the bid
+	var events orderEvents
+	for i, trade := range trades {
+		if err := insertTrade(tx, trade); err != nil {
+			return err
+		}
+		if err := settleTrade(tx, trade, "bid", settlements[i]); err != nil {
+			return err
+		}
+		events.add(&models.Order{ID: trade.BuyerOrderID, UserID: trade.BuyerID}, OrderEventMatched, trade)
+	}
+
+	updateQuery := `
+		UPDATE orders
+		SET quantity = quantity - $2,
+		    filled_quantity = filled_quantity + $3,
+		    remaining_quantity = $4,
+		    status = $5,
+		    cancel_reason = $6,
+		    fee_paid = fee_paid + $7,
+		    locked_amount = locked_amount - $8,
+		    requeued_at = COALESCE($10, requeued_at),
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status IN (` + liveStatuses + `)
+		  AND remaining_quantity = $9
+	`
+
+	for _, o := range outcomes {
+		order := o.entry.order
+		status, cancelReason := auctionStatus(order, o)
+
+		var requeuedAt *time.Time
+		if (fill{resting: o.entry, quantity: o.filled}).replenishes() {
+			now := time.Now()
+			requeuedAt = &now
+		}
+
+		result, err := tx.Exec(updateQuery,
+			order.ID, o.decrement, o.filled, order.RemainingQuantity-o.filled-o.decrement,
+			status, cancelReason, o.fee, o.release, order.RemainingQuantity, requeuedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update auction order: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to update auction order: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("auction order %s changed concurrently", order.ID)
+		}
+
+		if o.unsettled.IsPositive() {
+			if err := releaseFunds(tx, order.UserID, balanceCurrency(order), o.unsettled); err != nil {
+				return err
+			}
+		}
+
+		if o.decrement > 0 {
+			events.reduced(order, o.decrement)
+		}
+		if o.filled > 0 {
+			events.fill(order, order.FilledQuantity+o.filled, order.RemainingQuantity-o.filled-o.decrement)
+		}
+		if requeuedAt != nil {
+			events.requeued(order, *requeuedAt)
+		}
+		if status == "cancelled" {
+			events.cancelled(order, *cancelReason)
+		}
+	}
+
+	if err := journalExpiries(tx, plan.expired); err != nil {
+		return err
+	}
+	for _, bo := range plan.expired {
+		events.cancelled(bo.order, CancelReasonExpired)
+	}
+
+	var uncrossPrice *decimal.Decimal
+	if len(trades) > 0 {
+		uncrossPrice = &plan.price
+	}
+	volume := int64(0)
+	for _, trade := range trades {
+		volume += trade.Quantity
+	}
+
+	completeQuery := `
+		UPDATE auctions
+		SET status = 'completed', uncross_price = $2, uncross_volume = $3, completed_at = NOW()
+		WHERE id = $1 AND status = 'running'
+	`
+
+	if _, err := tx.Exec(completeQuery, book.auction.id, uncrossPrice, volume); err != nil {
+		return fmt.Errorf("failed to complete auction: %w", err)
+	}
+
+	if err := events.write(tx, book.tokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Apply the committed uncross to the book
+	for _, o := range outcomes {
+		bo := o.entry
+		bo.order.LockedAmount = bo.order.LockedAmount.Sub(o.release)
+		bo.order.FeePaid = bo.order.FeePaid.Add(o.fee)
+		if o.filled > 0 {
+			book.fill(bo, o.filled)
+		}
+		if o.decrement == 0 {
+			continue
+		}
+		if o.decrement == bo.order.RemainingQuantity {
+			cancelOrder(bo.order, CancelReasonSelfTrade)
+			book.remove(bo.order.ID)
+			continue
+		}
+		book.reduce(bo, o.decrement)
+	}
+	for _, bo := range plan.expired {
+		expireOrder(bo.order)
+		book.remove(bo.order.ID)
+	}
+	book.auction = nil
+	if len(trades) > 0 {
+		book.lastPrice = plan.price
+	}
+
+	// The uncross price is the new reference for price bands and the
+	// circuit breaker
+	book.prints = nil
+	book.recordPrints(trades, now, s.breakerWindow)
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(book.tokenID))
+
+	s.announce(book, events)
+
+	// The uncross sets the first price since the auction began, which may
+	// set off stop orders
+	if len(trades) > 0 {
+		s.evaluateTriggers(book)
+	}
+
+	return nil
+}
+
+// auctionStatus returns the status and cancel reason an order is journaled
+// with after an uncross. An order whose remainder is used up by matching
+// against its own user is cancelled by self-trade prevention.
+func auctionStatus(order *models.Order, o *auctionOutcome) (string, *string) {
+	remaining := order.RemainingQuantity - o.filled - o.decrement
+	switch {
+	case remaining == 0 && o.decrement > 0:
+		reason := CancelReasonSelfTrade
+		return "cancelled", &reason
+	case remaining == 0:
+		return "filled", nil
+	case o.filled > 0:
+		return "partially_filled", order.CancelReason
+	}
+	return order.Status, order.CancelReason
+}
+
+// auctionInfo describes a book's running call auction, or returns nil if it
+// is trading continuously. Callers must hold book.mu.
+func (b *Book) auctionInfo(now time.Time) *models.AuctionInfo {
+	if b.auction == nil {
+		return nil
+	}
+
+	info := &models.AuctionInfo{Reason: b.auction.reason, EndsAt: b.auction.endsAt}
+	if price, volume := b.equilibrium(now); volume > 0 {
+		info.IndicativePrice = &price
+		info.IndicativeVolume = volume
+	}
+	return info
+}
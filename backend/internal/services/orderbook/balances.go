@@ -0,0 +1,207 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// QuoteCurrency is the user_balances currency bids are paid in. Token
+// inventory is held under the token's ID.
+const QuoteCurrency = "USD"
+
+// ErrInsufficientFunds is returned when a user cannot cover an order
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// settlement is the reservation released by one trade on each side
+type settlement struct {
+	incomingRelease decimal.Decimal
+	restingRelease  decimal.Decimal
+}
+
+// balanceCurrency returns the currency an order reserves: quote for bids,
+// the token itself for asks
+func balanceCurrency(order *models.Order) string {
+	if order.Side == "bid" {
+		return QuoteCurrency
+	}
+	return order.TokenID
+}
+
+// reservationFor returns the funds a resting-capable order reserves for
+// quantity units. Bids reserve their limit price plus the fee per unit at the
+// order's fee rate, rounded up per unit so that any split of the order into fills is
+// covered; asks reserve the tokens themselves.
+func reservationFor(order *models.Order, quantity int64) decimal.Decimal {
+	if order.Side == "ask" {
+		return decimal.FromInt(quantity)
+	}
+	unitFee := order.Price.Mul(order.FeeRate, feeRounding)
+	return order.Price.Add(unitFee).MulInt(quantity)
+}
+
+// releaseFor returns the reservation a fill of quantity units releases from
+// an order. spent is what the fill actually costs the order's owner; market
+// bids reserve exactly their spend. An order that is completed by the fill
+// releases whatever it still has locked.
+func releaseFor(order *models.Order, quantity int64, spent decimal.Decimal) decimal.Decimal {
+	if quantity == order.RemainingQuantity {
+		return order.LockedAmount
+	}
+
+	release := spent
+	if order.Side == "ask" || !isMarket(order) {
+		release = reservationFor(order, quantity)
+	}
+	return decimal.Min(release, order.LockedAmount)
+}
+
+// spentBy returns what a trade costs one side: quote plus fee for the buyer,
+// tokens for the seller
+func spentBy(side string, trade *models.Trade) decimal.Decimal {
+	if side == "bid" {
+		return trade.TotalValue.Add(trade.BuyerFee)
+	}
+	return decimal.FromInt(trade.Quantity)
+}
+
+// planSettlements returns the funds an incoming order must reserve for the
+// quantity it had open before these fills, and the reservation each of its
+// trades releases on both sides. Market bids have no limit price, so they
+// reserve exactly what their fills cost.
+func planSettlements(order *models.Order, fills []fill, trades []*models.Trade) (decimal.Decimal, []settlement) {
+	open := order.RemainingQuantity + filledQuantity(fills)
+	reserved := reservationFor(order, open)
+	if order.Side == "bid" && isMarket(order) {
+		reserved = decimal.Zero
+		for _, trade := range trades {
+			reserved = reserved.Add(spentBy("bid", trade))
+		}
+	}
+
+	incoming := *order
+	incoming.RemainingQuantity = open
+	incoming.LockedAmount = reserved
+
+	settlements := make([]settlement, 0, len(fills))
+	for i, f := range fills {
+		trade := trades[i]
+		s := settlement{
+			incomingRelease: releaseFor(&incoming, f.quantity, spentBy(order.Side, trade)),
+			restingRelease:  releaseFor(f.resting.order, f.quantity, spentBy(f.resting.order.Side, trade)),
+		}
+
+		incoming.RemainingQuantity -= f.quantity
+		incoming.LockedAmount = incoming.LockedAmount.Sub(s.incomingRelease)
+		settlements = append(settlements, s)
+	}
+
+	return reserved, settlements
+}
+
+// reserveFunds locks amount of a user's available balance, failing with
+// ErrInsufficientFunds if balance minus locked does not cover it
+func reserveFunds(tx *sql.Tx, userID, currency string, amount decimal.Decimal) error {
+	query := `
+		UPDATE user_balances
+		SET locked = locked + $3, updated_at = NOW()
+		WHERE user_id = $1 AND currency = $2 AND balance - locked >= $3
+	`
+
+	result, err := tx.Exec(query, userID, currency, amount)
+	if err != nil {
+		return fmt.Errorf("failed to reserve funds: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to reserve funds: %w", err)
+	}
+	if rowsAffected == 0 {
+		if currency == QuoteCurrency {
+			return fmt.Errorf("%w: order requires %s %s available", ErrInsufficientFunds, amount, currency)
+		}
+		return fmt.Errorf("%w: order requires %s tokens available", ErrInsufficientFunds, amount)
+	}
+
+	return nil
+}
+
+// releaseFunds returns locked funds to a user's available balance
+func releaseFunds(tx *sql.Tx, userID, currency string, amount decimal.Decimal) error {
+	query := `
+		UPDATE user_balances
+		SET locked = locked - $3, updated_at = NOW()
+		WHERE user_id = $1 AND currency = $2
+	`
+
+	if _, err := tx.Exec(query, userID, currency, amount); err != nil {
+		return fmt.Errorf("failed to release funds: %w", err)
+	}
+
+	return nil
+}
+
+// settleTrade moves balances between buyer and seller for one trade and
+// releases the reservations it consumed
+func settleTrade(tx *sql.Tx, trade *models.Trade, incomingSide string, s settlement) error {
+	buyerRelease, sellerRelease := s.incomingRelease, s.restingRelease
+	if incomingSide == "ask" {
+		buyerRelease, sellerRelease = s.restingRelease, s.incomingRelease
+	}
+
+	debitQuery := `
+		UPDATE user_balances
+		SET balance = balance - $3, locked = locked - $4, updated_at = NOW()
+		WHERE user_id = $1 AND currency = $2
+	`
+
+	creditQuery := `
+		INSERT INTO user_balances (user_id, currency, balance)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, currency)
+		DO UPDATE SET balance = user_balances.balance + EXCLUDED.balance, updated_at = NOW()
+	`
+
+	debits := []struct {
+		userID, currency string
+		amount, release  decimal.Decimal
+	}{
+		{trade.BuyerID, QuoteCurrency, spentBy("bid", trade), buyerRelease},
+		{trade.SellerID, trade.TokenID, spentBy("ask", trade), sellerRelease},
+	}
+
+	for _, d := range debits {
+		result, err := tx.Exec(debitQuery, d.userID, d.currency, d.amount, d.release)
+		if err != nil {
+			return fmt.Errorf("failed to settle trade: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to settle trade: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("failed to settle trade: no %s balance for user %s", d.currency, d.userID)
+		}
+	}
+
+	credits := []struct {
+		userID, currency string
+		amount           decimal.Decimal
+	}{
+		{trade.BuyerID, trade.TokenID, decimal.FromInt(trade.Quantity)},
+		{trade.SellerID, QuoteCurrency, trade.TotalValue.Sub(trade.SellerFee)},
+	}
+
+	for _, c := range credits {
+		if _, err := tx.Exec(creditQuery, c.userID, c.currency, c.amount); err != nil {
+			return fmt.Errorf("failed to settle trade: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,318 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// Halt reasons recorded in trading_halts.reason
+const (
+	HaltCircuitBreaker = "circuit_breaker" // the price moved too far too fast
+	HaltAdmin          = "admin"           // halted by an administrator until resumed
+)
+
+// ErrTradingHalted is returned for orders on a token whose trading is halted
+var ErrTradingHalted = errors.New("trading is halted")
+
+// ErrNotHalted is returned when resuming a token whose trading is not halted
+var ErrNotHalted = errors.New("trading is not halted")
+
+// ErrOutsidePriceBand is returned for limit prices too far from the token's
+// reference price
+var ErrOutsidePriceBand = errors.New("price is outside the price band")
+
+// tradePrint is a trade remembered for the reference price and the circuit
+// breaker
+type tradePrint struct {
+	price    decimal.Decimal
+	quantity int64
+	at       time.Time
+}
+
+// haltState is the trading halt a book is in. A nil resumesAt lasts until
+// the halt is lifted by hand.
+type haltState struct {
+	id        string // empty until the halt is recorded
+	reason    string
+	message   string
+	haltedAt  time.Time
+	resumesAt *time.Time
+}
+
+// recordPrints remembers trades and forgets those older than window
+func (b *Book) recordPrints(trades []*models.Trade, now time.Time, window time.Duration) {
+	for _, trade := range trades {
+		b.prints = append(b.prints, tradePrint{price: trade.Price, quantity: trade.Quantity, at: trade.ExecutedAt})
+	}
+
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(b.prints) && b.prints[i].at.Before(cutoff) {
+		i++
+	}
+	b.prints = b.prints[i:]
+}
+
+// referencePrice returns the volume-weighted average price of the book's
+// remembered trades, or the last trade price if it has none. It is zero
+// before the first trade.
+func (b *Book) referencePrice() decimal.Decimal {
+	value := decimal.Zero
+	quantity := int64(0)
+	for _, p := range b.prints {
+		value = value.Add(p.price.MulInt(p.quantity))
+		quantity += p.quantity
+	}
+	if quantity == 0 {
+		return b.lastPrice
+	}
+	return value.DivInt(quantity, averagePriceRounding)
+}
+
+// breakerTripped reports whether the last trade price is more than move (a
+// fraction) away from any remembered trade, and returns the first such trade
+// price
+func (b *Book) breakerTripped(move decimal.Decimal) (decimal.Decimal, bool) {
+	for _, p := range b.prints {
+		limit := p.price.Mul(move, decimal.RoundDown)
+		if b.lastPrice.Sub(p.price).GreaterThan(limit) || p.price.Sub(b.lastPrice).GreaterThan(limit) {
+			return p.price, true
+		}
+	}
+	return decimal.Zero, false
+}
+
+// priceBand returns the range of limit prices a book accepts: the band
+// around its reference price. ok is false when any price is accepted, because
+// bands are disabled, the token has not traded yet or it is in a call
+// auction, which sets a new price. Callers must hold book.mu.
+func (s *Service) priceBand(book *Book, now time.Time) (lower, upper decimal.Decimal, ok bool) {
+	book.recordPrints(nil, now, s.breakerWindow)
+
+	reference := book.referencePrice()
+	if !s.priceBandPercent.IsPositive() || !reference.IsPositive() || book.auction != nil {
+		return decimal.Zero, decimal.Zero, false
+	}
+
+	offset := reference.Mul(s.priceBandPercent, decimal.RoundDown)
+	return reference.Sub(offset), reference.Add(offset), true
+}
+
+// checkPriceBand rejects a limit price outside the book's price band.
+// Callers must hold book.mu.
+func (s *Service) checkPriceBand(book *Book, price decimal.Decimal) error {
+	lower, upper, ok := s.priceBand(book, time.Now())
+	if ok && (price.LessThan(lower) || price.GreaterThan(upper)) {
+		return fmt.Errorf("%w: %s must be between %s and %s", ErrOutsidePriceBand, price, lower, upper)
+	}
+	return nil
+}
+
+// bandProtection caps how far a market order may sweep at the edge of the
+// book's price band, keeping any tighter protection it already has. Callers
+// must hold book.mu.
+func (s *Service) bandProtection(book *Book, order *models.Order) {
+	lower, upper, ok := s.priceBand(book, time.Now())
+	if !ok {
+		return
+	}
+
+	edge := upper
+	if order.Side == "ask" {
+		edge = lower
+	}
+	if order.ProtectionPrice == nil ||
+		(order.Side == "bid" && order.ProtectionPrice.GreaterThan(edge)) ||
+		(order.Side == "ask" && order.ProtectionPrice.LessThan(edge)) {
+		order.ProtectionPrice = &edge
+	}
+}
+
+// checkCircuitBreaker remembers a book's new trades and halts it for the
+// cooldown if its price has moved more than the breaker allows within the
+// window. The halt takes effect even if it cannot be recorded; it is then
+// pending, and recording it is retried on the next check and by the sweep
+// until it succeeds. Callers must hold book.mu.
+func (s *Service) checkCircuitBreaker(book *Book, trades []*models.Trade) {
+	now := time.Now()
+	book.recordPrints(trades, now, s.breakerWindow)
+
+	if book.halt != nil {
+		if err := s.recordPendingHalt(book); err != nil {
+			log.Printf("Failed to record trading halt for token %s, will retry: %v", book.tokenID, err)
+		}
+		return
+	}
+	if !s.breakerPercent.IsPositive() {
+		return
+	}
+
+	from, tripped := book.breakerTripped(s.breakerPercent)
+	if !tripped {
+		return
+	}
+
+	resumesAt := now.Add(s.haltCooldown)
+	halt := &haltState{
+		reason:    HaltCircuitBreaker,
+		message:   fmt.Sprintf("price moved from %s to %s within %s", from, book.lastPrice, s.breakerWindow),
+		haltedAt:  now,
+		resumesAt: &resumesAt,
+	}
+
+	if err := s.recordHalt(book.tokenID, halt); err != nil {
+		log.Printf("Failed to record trading halt for token %s, will retry: %v", book.tokenID, err)
+	}
+	book.halt = halt
+	log.Printf("🛑 Trading halted for token %s: %s", book.tokenID, halt.message)
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(book.tokenID))
+
+	s.publishHalt(book.tokenID, halt)
+}
+
+// recordHalt journals a new trading halt and sets its ID
+func (s *Service) recordHalt(tokenID string, halt *haltState) error {
+	query := `
+		INSERT INTO trading_halts (token_id, reason, message, halted_at, resumes_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	err := s.db.QueryRow(query, tokenID, halt.reason, halt.message, halt.haltedAt, halt.resumesAt).Scan(&halt.id)
+	if err != nil {
+		return fmt.Errorf("failed to record trading halt: %w", err)
+	}
+
+	return nil
+}
+
+// recordPendingHalt records a book's halt if it could not be recorded when it
+// began. Callers must hold book.mu.
+func (s *Service) recordPendingHalt(book *Book) error {
+	if book.halt == nil || book.halt.id != "" {
+		return nil
+	}
+
+	if err := s.recordHalt(book.tokenID, book.halt); err != nil {
+		return err
+	}
+	log.Printf("Recorded pending trading halt for token %s", book.tokenID)
+	return nil
+}
+
+// ResumeHalts records pending halts and re-opens every halted book whose
+// cooldown has passed with a call auction, and returns the number resumed.
+// Books that fail are logged and stay halted until the next check.
+func (s *Service) ResumeHalts() int {
+	resumed := 0
+	for _, book := range s.engine.Books() {
+		ok, err := s.resumeDue(book, time.Now())
+		if err != nil {
+			log.Printf("Failed to resume trading for token %s: %v", book.tokenID, err)
+			continue
+		}
+		if ok {
+			resumed++
+		}
+	}
+	return resumed
+}
+
+// resumeDue resumes a book whose halt has run its course by now, reporting
+// whether it did
+func (s *Service) resumeDue(book *Book, now time.Time) (bool, error) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.halt == nil {
+		return false, nil
+	}
+	if err := s.recordPendingHalt(book); err != nil {
+		return false, err
+	}
+	if book.halt.resumesAt == nil || now.Before(*book.halt.resumesAt) {
+		return false, nil
+	}
+
+	_, err := s.resume(book, "")
+	return err == nil, err
+}
+
+// resume lifts a book's halt, recording message as the reason if it has one,
+// and starts the re-opening auction in one transaction. A halt that is still
+// pending is recorded first, so no halt ends without a record. Callers must
+// hold book.mu.
+func (s *Service) resume(book *Book, message string) (*models.Auction, error) {
+	if err := s.recordPendingHalt(book); err != nil {
+		return nil, err
+	}
+
+	auction, err := s.newAuction(book.tokenID, AuctionReopening, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.beginTokenTx(book.tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := journalResume(tx, book.halt, message); err != nil {
+		return nil, err
+	}
+
+	if err := insertAuction(tx, auction); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	book.halt = nil
+	book.auction = &auctionState{id: auction.ID, reason: auction.Reason, endsAt: auction.EndsAt}
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(book.tokenID))
+
+	s.publish(&models.MarketStatusEvent{Type: EventResumed, TokenID: book.tokenID, Message: message, At: time.Now()})
+
+	return auction, nil
+}
+
+// journalResume records the end of a trading halt and why it ended, if
+// given
+func journalResume(tx *sql.Tx, halt *haltState, message string) error {
+	query := `UPDATE trading_halts SET resumed_at = NOW(), resume_message = NULLIF($2, '') WHERE id = $1 AND resumed_at IS NULL`
+	if _, err := tx.Exec(query, halt.id, message); err != nil {
+		return fmt.Errorf("failed to resume trading: %w", err)
+	}
+
+	return nil
+}
+
+// haltInfo describes a book's trading halt, or returns nil if it is not
+// halted. Callers must hold book.mu.
+func (b *Book) haltInfo() *models.HaltInfo {
+	if b.halt == nil {
+		return nil
+	}
+
+	return &models.HaltInfo{
+		Reason:     b.halt.reason,
+		Message:    b.halt.message,
+		HaltedAt:   b.halt.haltedAt,
+		ResumesAt:  b.halt.resumesAt,
+		Unrecorded: b.halt.id == "",
+	}
+}
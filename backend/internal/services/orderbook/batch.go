@@ -0,0 +1,243 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// ErrBatchTooLarge is returned when a batch holds more orders than allowed
+var ErrBatchTooLarge = errors.New("too many orders in batch")
+
+// ErrOrderNotFound is returned when a user has no order with the given ID
+var ErrOrderNotFound = errors.New("order not found")
+
+// PlaceOrders places a batch of orders and reports the outcome of each in
+// request order. Orders are grouped by token and each group is placed under
+// a single hold of its book's lock, so the book never shows part of a
+// group. An order that fails does not stop the rest of the batch.
+func (s *Service) PlaceOrders(orders []*models.Order) ([]*models.BatchOrderResult, error) {
+	if len(orders) > s.maxBatchOrders {
+		return nil, fmt.Errorf("%w: %d orders, at most %d allowed", ErrBatchTooLarge, len(orders), s.maxBatchOrders)
+	}
+
+	results := make([]*models.BatchOrderResult, len(orders))
+
+	// Tokens are placed in order of their first appearance in the batch
+	var tokens []string
+	byToken := make(map[string][]int)
+	for i, order := range orders {
+		if err := s.prepareOrder(order); err != nil {
+			results[i] = &models.BatchOrderResult{Error: err.Error(), Code: ErrorCode(err)}
+			continue
+		}
+		if _, ok := byToken[order.TokenID]; !ok {
+			tokens = append(tokens, order.TokenID)
+		}
+		byToken[order.TokenID] = append(byToken[order.TokenID], i)
+	}
+
+	for _, tokenID := range tokens {
+		s.placeGroup(s.engine.Book(tokenID), orders, byToken[tokenID], results)
+	}
+
+	return results, nil
+}
+
+// placeGroup places the batch orders at indexes, all on the same book, while
+// holding the book's lock once. Subscribers are told about the group as one
+// change once every order in it has been applied.
+func (s *Service) placeGroup(book *Book, orders []*models.Order, indexes []int, results []*models.BatchOrderResult) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	var events orderEvents
+	book.held = &events
+	for _, i := range indexes {
+		order, trades, err := s.placeOrder(book, orders[i])
+		if err != nil {
+			results[i] = &models.BatchOrderResult{Error: err.Error(), Code: ErrorCode(err)}
+			continue
+		}
+		results[i] = &models.BatchOrderResult{Order: order, Trades: trades}
+	}
+	book.held = nil
+
+	s.announce(book, events)
+}
+
+// CancelOrders cancels all of a user's open and dormant stop orders,
+// optionally only those for one token and/or one side, and returns the IDs
+// of the orders cancelled. Each token's orders are cancelled together; if a
+// token fails, the orders cancelled before it are returned with the error.
+func (s *Service) CancelOrders(userID string, tokenID, side *string) ([]string, error) {
+	query := `SELECT DISTINCT token_id FROM orders WHERE user_id = $1 AND status IN (` + liveStatuses + `, 'pending_trigger')`
+	args := []interface{}{userID}
+	if tokenID != nil {
+		args = append(args, *tokenID)
+		query += fmt.Sprintf(" AND token_id = $%d", len(args))
+	}
+	if side != nil {
+		args = append(args, *side)
+		query += fmt.Sprintf(" AND side = $%d", len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+	defer rows.Close()
+
+	var tokenIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to cancel orders: %w", err)
+		}
+		tokenIDs = append(tokenIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+
+	cancelled := []string{}
+	for _, id := range tokenIDs {
+		orderIDs, err := s.cancelTokenOrders(id, userID, side)
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, orderIDs...)
+	}
+
+	return cancelled, nil
+}
+
+// cancelTokenOrders cancels a user's orders on one token in a single
+// transaction and takes them off the book
+func (s *Service) cancelTokenOrders(tokenID, userID string, side *string) ([]string, error) {
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	tx, err := s.beginTokenTx(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Returns the reservation each order held before it was cleared
+	query := `
+		UPDATE orders o
+		SET status = 'cancelled', cancel_reason = $3, locked_amount = 0, updated_at = NOW()
+		FROM (
+			SELECT id, locked_amount FROM orders
+			WHERE user_id = $1 AND token_id = $2
+			  AND status IN (` + liveStatuses + `, 'pending_trigger')
+			  AND ($4::varchar IS NULL OR side = $4)
+			FOR UPDATE
+		) prev
+		WHERE o.id = prev.id
+		RETURNING o.id, o.side, prev.locked_amount
+	`
+
+	rows, err := tx.Query(query, userID, tokenID, CancelReasonUser, side)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+
+	orderIDs := []string{}
+	quoteReleased, tokensReleased := decimal.Zero, decimal.Zero
+	for rows.Next() {
+		var orderID, orderSide string
+		var locked decimal.Decimal
+		if err := rows.Scan(&orderID, &orderSide, &locked); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to cancel orders: %w", err)
+		}
+		orderIDs = append(orderIDs, orderID)
+		if orderSide == "bid" {
+			quoteReleased = quoteReleased.Add(locked)
+		} else {
+			tokensReleased = tokensReleased.Add(locked)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+
+	if quoteReleased.IsPositive() {
+		if err := releaseFunds(tx, userID, QuoteCurrency, quoteReleased); err != nil {
+			return nil, err
+		}
+	}
+	if tokensReleased.IsPositive() {
+		if err := releaseFunds(tx, userID, tokenID, tokensReleased); err != nil {
+			return nil, err
+		}
+	}
+
+	var events orderEvents
+	for _, orderID := range orderIDs {
+		events.cancelled(&models.Order{ID: orderID, UserID: userID}, CancelReasonUser)
+	}
+	if err := events.write(tx, tokenID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, orderID := range orderIDs {
+		if !book.remove(orderID) {
+			book.removeStop(orderID)
+		}
+	}
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(tokenID))
+
+	s.announce(book, events)
+
+	return orderIDs, nil
+}
+
+// GetOrderByClientID returns one of a user's orders by the client order ID
+// the user gave it
+func (s *Service) GetOrderByClientID(clientOrderID, userID string) (*models.Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE user_id = $1 AND client_order_id = $2`
+
+	order, err := scanOrder(s.db.QueryRow(query, userID, clientOrderID))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+
+	return order, nil
+}
+
+// CancelOrderByClientID cancels an order by the client order ID its owner
+// gave it, returning the order's ID
+func (s *Service) CancelOrderByClientID(clientOrderID, userID string) (string, error) {
+	var orderID string
+	err := s.db.QueryRow(`SELECT id FROM orders WHERE user_id = $1 AND client_order_id = $2`, userID, clientOrderID).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("order not found or cannot be cancelled")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to cancel order: %w", err)
+	}
+
+	if err := s.CancelOrder(orderID, userID); err != nil {
+		return "", err
+	}
+
+	return orderID, nil
+}
@@ -0,0 +1,66 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/services/restrictions"
+)
+
+// Error codes returned with orders rejected by creator trading restrictions
+const (
+	CodeCreatorTradingBlocked          = "CREATOR_TRADING_BLOCKED"
+	CodeCreatorRestrictionsUnavailable = "CREATOR_RESTRICTIONS_UNAVAILABLE"
+)
+
+// ErrCreatorTradingBlocked is returned for orders by a token's creator while
+// the token contract blocks the creator from trading it
+var ErrCreatorTradingBlocked = errors.New("creator trading is blocked")
+
+// ErrCreatorRestrictionsUnavailable is returned for orders by a token's
+// creator while the creator's restrictions are not known or out of date, so
+// they cannot be checked
+var ErrCreatorRestrictionsUnavailable = errors.New("creator trading restrictions are unavailable")
+
+// CreatorRestrictions resolves the restriction on a user's trading of a token
+// if the user is the token's creator, returning nil for anyone else
+type CreatorRestrictions interface {
+	RestrictionFor(userID, tokenID string) (*restrictions.Restriction, error)
+}
+
+// checkCreatorRestrictions rejects an order by a token's creator that the
+// token contract would not allow. Unlike the contract's AMM, which only
+// blocks the creator's buys, both sides are blocked here, so the creator
+// cannot sell into the book during the lockup either.
+func (s *Service) checkCreatorRestrictions(userID, tokenID string) error {
+	if s.creatorRestrictions == nil {
+		return nil
+	}
+
+	restriction, err := s.creatorRestrictions.RestrictionFor(userID, tokenID)
+	if errors.Is(err, restrictions.ErrNotSynced) || errors.Is(err, restrictions.ErrStale) {
+		return fmt.Errorf("%w: %v", ErrCreatorRestrictionsUnavailable, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if restriction != nil && !restriction.CanTrade(time.Now()) {
+		return fmt.Errorf("%w until %s", ErrCreatorTradingBlocked, restriction.TradingBlockEndsAt.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// ErrorCode returns the error code clients can match an order rejection on,
+// or "" if it has none
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrCreatorTradingBlocked):
+		return CodeCreatorTradingBlocked
+	case errors.Is(err, ErrCreatorRestrictionsUnavailable):
+		return CodeCreatorRestrictionsUnavailable
+	}
+	return ""
+}
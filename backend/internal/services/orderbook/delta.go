@@ -0,0 +1,92 @@
+package orderbook
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// ChecksumDepth is the number of levels per side covered by a book's
+// checksum
+const ChecksumDepth = 10
+
+// levelKey identifies a price level across its removal and re-creation
+type levelKey struct {
+	side  string
+	price decimal.Decimal
+}
+
+// touch records that a level's quantity or order count changed since the
+// book's last delta
+func (b *Book) touch(side string, price decimal.Decimal) {
+	b.changed[levelKey{side: side, price: price}] = struct{}{}
+}
+
+// flushChanges returns the levels changed since the last call at their
+// current quantity, best price first, with a zero quantity for levels that
+// have gone, and starts recording afresh
+func (b *Book) flushChanges() (bids, asks []models.OrderBookLevel) {
+	bids, asks = []models.OrderBookLevel{}, []models.OrderBookLevel{}
+	for key := range b.changed {
+		level := models.OrderBookLevel{Price: key.price}
+		if l := b.level(key.side, key.price); l != nil {
+			level.Quantity = l.quantity
+			level.Orders = l.orders.Len()
+		}
+		if key.side == "bid" {
+			bids = append(bids, level)
+		} else {
+			asks = append(asks, level)
+		}
+	}
+	b.changed = make(map[levelKey]struct{})
+
+	sort.Slice(bids, func(i, j int) bool { return bids[i].Price.GreaterThan(bids[j].Price) })
+	sort.Slice(asks, func(i, j int) bool { return asks[i].Price.LessThan(asks[j].Price) })
+	return bids, asks
+}
+
+// level returns the level at a price, or nil if there is none
+func (b *Book) level(side string, price decimal.Decimal) *priceLevel {
+	levels := b.side(side)
+	i := sort.Search(len(levels), func(i int) bool {
+		if side == "bid" {
+			return levels[i].price.Cmp(price) <= 0
+		}
+		return levels[i].price.Cmp(price) >= 0
+	})
+	if i < len(levels) && levels[i].price.Equal(price) {
+		return levels[i]
+	}
+	return nil
+}
+
+// depth returns the number of levels on the deeper side of the book
+func (b *Book) depth() int {
+	if len(b.bids) > len(b.asks) {
+		return len(b.bids)
+	}
+	return len(b.asks)
+}
+
+// Checksum returns the CRC-32 (IEEE) of the top ChecksumDepth levels of a
+// book, so clients can check a book they maintain from deltas against ours.
+// The checksummed string interleaves the levels best first as
+// bidPrice:bidQuantity:askPrice:askQuantity:..., skipping the side that has
+// run out, with prices written as they are in JSON.
+func Checksum(bids, asks []models.OrderBookLevel) uint32 {
+	parts := []string{}
+	for i := 0; i < ChecksumDepth; i++ {
+		if i < len(bids) {
+			parts = append(parts, bids[i].Price.String(), strconv.FormatInt(bids[i].Quantity, 10))
+		}
+		if i < len(asks) {
+			parts = append(parts, asks[i].Price.String(), strconv.FormatInt(asks[i].Quantity, 10))
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(parts, ":")))
+}
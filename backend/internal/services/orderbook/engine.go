@@ -0,0 +1,586 @@
+package orderbook
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// Engine holds one resident order book per token. Matching happens entirely
+// in memory; Postgres is only written to after a match has been decided.
+type Engine struct {
+	mu    sync.Mutex
+	books map[string]*Book
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		books: make(map[string]*Book),
+	}
+}
+
+// Books returns every order book the engine holds
+func (e *Engine) Books() []*Book {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	books := make([]*Book, 0, len(e.books))
+	for _, book := range e.books {
+		books = append(books, book)
+	}
+	return books
+}
+
+// Book returns the order book for a token, creating an empty one if needed.
+// Only tokens being loaded or traded should get a book; reads go through
+// View.
+func (e *Engine) Book(tokenID string) *Book {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	book, ok := e.books[tokenID]
+	if !ok {
+		book = newBook(tokenID)
+		e.books[tokenID] = book
+	}
+	return book
+}
+
+// View calls fn with a token's order book held. A token the engine holds no
+// book for is shown an empty book that is not kept, so reading cannot grow
+// the engine; no book is created for the token until fn returns.
+func (e *Engine) View(tokenID string, fn func(book *Book)) {
+	e.mu.Lock()
+	book, ok := e.books[tokenID]
+	if !ok {
+		defer e.mu.Unlock()
+		fn(newBook(tokenID))
+		return
+	}
+	e.mu.Unlock()
+
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	fn(book)
+}
+
+// Book is a price-time priority order book for a single token. Callers must
+// hold mu while reading or mutating the book.
+type Book struct {
+	mu sync.Mutex
+
+	tokenID   string
+	bids      []*priceLevel // best (highest) price first
+	asks      []*priceLevel // best (lowest) price first
+	orders    map[string]*bookOrder
+	stops     []*models.Order // dormant stop orders, oldest first
+	lastPrice decimal.Decimal
+	prints    []tradePrint  // trades within the circuit breaker window, oldest first
+	auction   *auctionState // set while the book is in a call auction
+	halt      *haltState    // set while trading is halted
+	rules     marketRules   // tick and lot sizes new orders must follow
+	status    string        // token status; empty until loaded
+
+	// Every change to the levels is numbered and published as a delta
+	sequence int64                 // number of the last change; carries on from the journal across restarts
+	changed  map[levelKey]struct{} // levels changed since the last delta
+	held     *orderEvents          // collects the events of a batch being placed, announced once it is all applied
+}
+
+// priceLevel is a FIFO queue of resting orders at a single price
+type priceLevel struct {
+	price    decimal.Decimal
+	quantity int64      // displayed quantity
+	orders   *list.List // of *bookOrder
+}
+
+type bookOrder struct {
+	order   *models.Order
+	level   *priceLevel
+	elem    *list.Element
+	visible int64 // displayed slice; the whole remainder unless an iceberg
+}
+
+// displaySlice returns the quantity an order shows when it is (re)queued:
+// its display quantity for icebergs, otherwise everything that remains
+func displaySlice(order *models.Order) int64 {
+	if order.DisplayQuantity != nil && *order.DisplayQuantity < order.RemainingQuantity {
+		return *order.DisplayQuantity
+	}
+	return order.RemainingQuantity
+}
+
+// fill is a planned execution against a resting order
+type fill struct {
+	resting  *bookOrder
+	price    decimal.Decimal
+	quantity int64
+}
+
+// replenishes reports whether the fill uses up the resting order's visible
+// slice and leaves a hidden reserve to show in its place
+func (f fill) replenishes() bool {
+	return f.quantity >= f.resting.visible && f.resting.order.RemainingQuantity > f.quantity
+}
+
+// prevention is a resting order of the incoming order's owner that
+// self-trade prevention cancels (quantity equals its remainder) or
+// decrements by quantity
+type prevention struct {
+	resting  *bookOrder
+	quantity int64
+}
+
+func (p prevention) cancels() bool {
+	return p.quantity == p.resting.order.RemainingQuantity
+}
+
+// matchPlan is the outcome of matching an incoming order
+type matchPlan struct {
+	fills      []fill
+	prevented  []prevention
+	expired    []*bookOrder // good-till-date orders past their expiry, cancelled instead of filled
+	decrement  int64        // quantity self-trade prevention removes from the incoming order
+	cancelSelf bool         // self-trade prevention cancels the incoming order
+}
+
+func newBook(tokenID string) *Book {
+	return &Book{
+		tokenID: tokenID,
+		bids:    []*priceLevel{},
+		asks:    []*priceLevel{},
+		orders:  make(map[string]*bookOrder),
+		rules:   defaultMarketRules,
+		changed: make(map[levelKey]struct{}),
+	}
+}
+
+// match plans the fills for an incoming order without mutating the book.
+// Resting orders are walked best price first, then oldest first. Resting
+// orders of the same user are handled according to the incoming order's
+// self-trade prevention mode instead of being filled, and orders past their
+// expiry that have not been swept yet are planned for cancellation.
+//
+// An iceberg only trades its displayed slice before going to the back of its
+// level with a fresh one, so it can be reached again after the orders queued
+// behind it. All of an iceberg's executions against one incoming order are
+// planned as a single fill.
+//
+// Nothing matches while the book is in a call auction, where orders rest
+// until the uncross, or while trading is halted.
+func (b *Book) match(order *models.Order) matchPlan {
+	plan := matchPlan{fills: []fill{}}
+	if b.auction != nil || b.halt != nil {
+		return plan
+	}
+	remaining := order.RemainingQuantity
+	now := time.Now()
+
+	// requeued is an iceberg waiting at the back of the level with a fresh
+	// slice; fill indexes its planned fill
+	type requeued struct {
+		resting *bookOrder
+		fill    int
+		hidden  int64
+	}
+
+	for _, level := range b.opposite(order.Side) {
+		if remaining == 0 || plan.cancelSelf || !crosses(order, level.price) {
+			break
+		}
+
+		queue := []requeued{}
+		for e := level.orders.Front(); e != nil && remaining > 0 && !plan.cancelSelf; e = e.Next() {
+			resting := e.Value.(*bookOrder)
+
+			if expired(resting.order, now) {
+				plan.expired = append(plan.expired, resting)
+				continue
+			}
+
+			if resting.order.UserID == order.UserID {
+				remaining -= plan.preventSelfTrade(order.STPMode, resting, remaining)
+				continue
+			}
+
+			quantity := remaining
+			if quantity > resting.visible {
+				quantity = resting.visible
+			}
+
+			plan.fills = append(plan.fills, fill{
+				resting:  resting,
+				price:    level.price,
+				quantity: quantity,
+			})
+			remaining -= quantity
+
+			if hidden := resting.order.RemainingQuantity - quantity; quantity == resting.visible && hidden > 0 {
+				queue = append(queue, requeued{resting: resting, fill: len(plan.fills) - 1, hidden: hidden})
+			}
+		}
+
+		for len(queue) > 0 && remaining > 0 && !plan.cancelSelf {
+			next := queue[0]
+			queue = queue[1:]
+
+			slice := *next.resting.order.DisplayQuantity
+			if slice > next.hidden {
+				slice = next.hidden
+			}
+			quantity := remaining
+			if quantity > slice {
+				quantity = slice
+			}
+
+			plan.fills[next.fill].quantity += quantity
+			remaining -= quantity
+
+			if next.hidden -= quantity; quantity == slice && next.hidden > 0 {
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	return plan
+}
+
+// preventSelfTrade plans the self-trade prevention action for a resting
+// order of the incoming order's owner. It returns the quantity removed from
+// the incoming order.
+func (p *matchPlan) preventSelfTrade(mode string, resting *bookOrder, remaining int64) int64 {
+	restingRemaining := resting.order.RemainingQuantity
+
+	switch mode {
+	case STPCancelOldest:
+		p.prevented = append(p.prevented, prevention{resting: resting, quantity: restingRemaining})
+	case STPCancelBoth:
+		p.prevented = append(p.prevented, prevention{resting: resting, quantity: restingRemaining})
+		p.cancelSelf = true
+	case STPDecrementAndCancel:
+		// The smaller order is cancelled and the larger one decremented by it
+		if restingRemaining > remaining {
+			p.prevented = append(p.prevented, prevention{resting: resting, quantity: remaining})
+			p.cancelSelf = true
+			return 0
+		}
+		p.prevented = append(p.prevented, prevention{resting: resting, quantity: restingRemaining})
+		if restingRemaining == remaining {
+			p.cancelSelf = true
+			return 0
+		}
+		p.decrement += restingRemaining
+		return restingRemaining
+	default: // STPCancelNewest
+		p.cancelSelf = true
+	}
+
+	return 0
+}
+
+// crosses reports whether an incoming order is willing to trade at price.
+// Market orders take any price up to their protection price, if one is set.
+func crosses(order *models.Order, price decimal.Decimal) bool {
+	limit := order.Price
+	if isMarket(order) {
+		if order.ProtectionPrice == nil {
+			return true
+		}
+		limit = *order.ProtectionPrice
+	}
+
+	if order.Side == "bid" {
+		return price.Cmp(limit) <= 0
+	}
+	return price.Cmp(limit) >= 0
+}
+
+// add rests an order at the back of its price level's queue
+func (b *Book) add(order *models.Order) {
+	levels := b.side(order.Side)
+
+	i := sort.Search(len(levels), func(i int) bool {
+		if order.Side == "bid" {
+			return levels[i].price.Cmp(order.Price) <= 0
+		}
+		return levels[i].price.Cmp(order.Price) >= 0
+	})
+
+	var level *priceLevel
+	if i < len(levels) && levels[i].price.Equal(order.Price) {
+		level = levels[i]
+	} else {
+		level = &priceLevel{price: order.Price, orders: list.New()}
+		levels = append(levels, nil)
+		copy(levels[i+1:], levels[i:])
+		levels[i] = level
+		b.setSide(order.Side, levels)
+	}
+
+	bo := &bookOrder{order: order, level: level, visible: displaySlice(order)}
+	bo.elem = level.orders.PushBack(bo)
+	level.quantity += bo.visible
+	b.orders[order.ID] = bo
+	b.touch(order.Side, order.Price)
+}
+
+// fill applies an execution to a resting order, removing it once exhausted.
+// An iceberg whose slice is used up is replenished from its hidden reserve
+// at the back of its level, as planned by match.
+func (b *Book) fill(bo *bookOrder, quantity int64) {
+	bo.order.FilledQuantity += quantity
+	b.touch(bo.order.Side, bo.level.price)
+
+	for quantity > 0 && bo.visible > 0 {
+		taken := quantity
+		if taken > bo.visible {
+			taken = bo.visible
+		}
+		bo.visible -= taken
+		bo.level.quantity -= taken
+		bo.order.RemainingQuantity -= taken
+		quantity -= taken
+
+		if bo.visible == 0 && bo.order.RemainingQuantity > 0 {
+			b.replenish(bo)
+		}
+	}
+
+	if bo.order.RemainingQuantity == 0 {
+		bo.order.Status = "filled"
+		b.unlink(bo)
+	} else {
+		bo.order.Status = "partially_filled"
+	}
+}
+
+// replenish shows a fresh slice of an iceberg's hidden reserve. The slice
+// loses its time priority and joins the back of the level.
+func (b *Book) replenish(bo *bookOrder) {
+	now := time.Now()
+	bo.order.RequeuedAt = &now
+	bo.visible = displaySlice(bo.order)
+	bo.level.quantity += bo.visible
+	bo.level.orders.MoveToBack(bo.elem)
+}
+
+// reduce decrements a resting order's size without filling it
+func (b *Book) reduce(bo *bookOrder, quantity int64) {
+	b.touch(bo.order.Side, bo.level.price)
+	bo.order.Quantity -= quantity
+	bo.order.RemainingQuantity -= quantity
+	if bo.visible > bo.order.RemainingQuantity {
+		bo.level.quantity -= bo.visible - bo.order.RemainingQuantity
+		bo.visible = bo.order.RemainingQuantity
+	}
+}
+
+// remove takes an order off the book, returning false if it is not resting
+func (b *Book) remove(orderID string) bool {
+	bo, ok := b.orders[orderID]
+	if !ok {
+		return false
+	}
+
+	b.removeEntry(bo)
+	return true
+}
+
+// removeEntry takes one queue entry off the book. An amended order is
+// re-added under the same ID before its previous entry is removed.
+func (b *Book) removeEntry(bo *bookOrder) {
+	bo.level.quantity -= bo.visible
+	b.unlink(bo)
+}
+
+func (b *Book) unlink(bo *bookOrder) {
+	b.touch(bo.order.Side, bo.level.price)
+	bo.level.orders.Remove(bo.elem)
+	if b.orders[bo.order.ID] == bo {
+		delete(b.orders, bo.order.ID)
+	}
+
+	if bo.level.orders.Len() > 0 {
+		return
+	}
+
+	levels := b.side(bo.order.Side)
+	for i, level := range levels {
+		if level == bo.level {
+			b.setSide(bo.order.Side, append(levels[:i], levels[i+1:]...))
+			break
+		}
+	}
+}
+
+// addStop parks a stop order until its trigger price is reached. Stops are
+// not part of the visible book.
+func (b *Book) addStop(order *models.Order) {
+	b.stops = append(b.stops, order)
+}
+
+// removeStop drops a dormant stop order, returning false if it is not parked
+func (b *Book) removeStop(orderID string) bool {
+	for i, stop := range b.stops {
+		if stop.ID == orderID {
+			b.stops = append(b.stops[:i], b.stops[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// nextTriggered returns the oldest stop order triggered by the last trade
+// price, or nil if there is none
+func (b *Book) nextTriggered() *models.Order {
+	for _, stop := range b.stops {
+		if stopTriggered(stop, b.lastPrice) {
+			return stop
+		}
+	}
+	return nil
+}
+
+// expiredOrders returns the resting and dormant stop orders whose expiry has
+// passed by now
+func (b *Book) expiredOrders(now time.Time) ([]*bookOrder, []*models.Order) {
+	resting := []*bookOrder{}
+	for _, bo := range b.orders {
+		if expired(bo.order, now) {
+			resting = append(resting, bo)
+		}
+	}
+
+	stops := []*models.Order{}
+	for _, stop := range b.stops {
+		if expired(stop, now) {
+			stops = append(stops, stop)
+		}
+	}
+
+	return resting, stops
+}
+
+// stopTriggered reports whether a stop order fires at the given last trade
+// price: buy stops once the price rises to the stop, sell stops once it
+// falls to it. Nothing fires before the first trade.
+func stopTriggered(order *models.Order, lastPrice decimal.Decimal) bool {
+	if order.StopPrice == nil || lastPrice.IsZero() {
+		return false
+	}
+	if order.Side == "bid" {
+		return lastPrice.Cmp(*order.StopPrice) >= 0
+	}
+	return lastPrice.Cmp(*order.StopPrice) <= 0
+}
+
+// trailUpdate is a planned move of a trailing stop's mark and stop price
+type trailUpdate struct {
+	stop      *models.Order
+	mark      decimal.Decimal
+	stopPrice decimal.Decimal
+}
+
+// trailStops plans the mark moves of dormant trailing stops at the last
+// trade price without mutating them. Sell stops follow the price up and buy
+// stops follow it down; a reversal leaves the mark where it is.
+func (b *Book) trailStops() []trailUpdate {
+	updates := []trailUpdate{}
+	if b.lastPrice.IsZero() {
+		return updates
+	}
+
+	for _, stop := range b.stops {
+		if stop.ExecutionType != "trailing_stop" {
+			continue
+		}
+		if stop.TrailMark != nil {
+			if stop.Side == "ask" && !b.lastPrice.GreaterThan(*stop.TrailMark) {
+				continue
+			}
+			if stop.Side == "bid" && !b.lastPrice.LessThan(*stop.TrailMark) {
+				continue
+			}
+		}
+
+		updates = append(updates, trailUpdate{
+			stop:      stop,
+			mark:      b.lastPrice,
+			stopPrice: trailingStopPrice(stop, b.lastPrice),
+		})
+	}
+	return updates
+}
+
+// trailingStopPrice returns the stop price of a trailing stop at a mark: the
+// trail distance below it for sells and above it for buys. Percentage
+// distances are rounded down. A sell stop trailing a mark by more than the
+// mark stops at zero, where it cannot trigger until the mark rises.
+func trailingStopPrice(order *models.Order, mark decimal.Decimal) decimal.Decimal {
+	distance := decimal.Zero
+	if order.TrailAmount != nil {
+		distance = *order.TrailAmount
+	} else if order.TrailPercent != nil {
+		distance = mark.Mul(order.TrailPercent.DivInt(100, decimal.RoundDown), decimal.RoundDown)
+	}
+
+	if order.Side == "ask" {
+		return decimal.Max(mark.Sub(distance), decimal.Zero)
+	}
+	return mark.Add(distance)
+}
+
+// liquidity returns the total resting quantity on one side of the book,
+// including iceberg reserves
+func (b *Book) liquidity(side string) int64 {
+	total := int64(0)
+	for _, bo := range b.orders {
+		if bo.order.Side == side {
+			total += bo.order.RemainingQuantity
+		}
+	}
+	return total
+}
+
+// snapshot aggregates the top depth levels of each side
+func (b *Book) snapshot(depth int) (bids, asks []models.OrderBookLevel) {
+	return aggregate(b.bids, depth), aggregate(b.asks, depth)
+}
+
+func aggregate(levels []*priceLevel, depth int) []models.OrderBookLevel {
+	result := []models.OrderBookLevel{}
+	for i := 0; i < len(levels) && i < depth; i++ {
+		result = append(result, models.OrderBookLevel{
+			Price:    levels[i].price,
+			Quantity: levels[i].quantity,
+			Orders:   levels[i].orders.Len(),
+		})
+	}
+	return result
+}
+
+func (b *Book) side(side string) []*priceLevel {
+	if side == "bid" {
+		return b.bids
+	}
+	return b.asks
+}
+
+func (b *Book) opposite(side string) []*priceLevel {
+	if side == "bid" {
+		return b.asks
+	}
+	return b.bids
+}
+
+func (b *Book) setSide(side string, levels []*priceLevel) {
+	if side == "bid" {
+		b.bids = levels
+	} else {
+		b.asks = levels
+	}
+}
@@ -0,0 +1,458 @@
+package orderbook
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRestingOrder(side, price string, quantity int64) *models.Order {
+	order := testutil.MockOrder(uuid.New().String(), "660e8400-e29b-41d4-a716-446655440001", side, decimal.MustParse(price), quantity)
+	order.ID = uuid.New().String()
+	return order
+}
+
+func TestEngineView(t *testing.T) {
+	engine := NewEngine()
+	book := engine.Book("listed")
+	book.add(newRestingOrder("bid", "2.45", 100))
+
+	var viewed *Book
+	engine.View("listed", func(b *Book) { viewed = b })
+	assert.Same(t, book, viewed)
+
+	// Unknown tokens are shown an empty book that is not kept
+	engine.View("unknown", func(b *Book) { viewed = b })
+	assert.Equal(t, "unknown", viewed.tokenID)
+	assert.Empty(t, viewed.orders)
+	assert.Len(t, engine.Books(), 1)
+}
+
+func TestBookLevelOrdering(t *testing.T) {
+	book := newBook("token")
+
+	book.add(newRestingOrder("bid", "2.43", 100))
+	book.add(newRestingOrder("bid", "2.45", 100))
+	book.add(newRestingOrder("bid", "2.44", 100))
+	book.add(newRestingOrder("ask", "2.48", 100))
+	book.add(newRestingOrder("ask", "2.46", 100))
+	book.add(newRestingOrder("ask", "2.47", 100))
+
+	bids, asks := book.snapshot(10)
+
+	assert.Equal(t, []string{"2.45", "2.44", "2.43"}, levelPrices(bids))
+	assert.Equal(t, []string{"2.46", "2.47", "2.48"}, levelPrices(asks))
+}
+
+func TestBookMatchPriceTimePriority(t *testing.T) {
+	book := newBook("token")
+
+	worse := newRestingOrder("ask", "2.47", 100)
+	older := newRestingOrder("ask", "2.46", 100)
+	newer := newRestingOrder("ask", "2.46", 100)
+	book.add(worse)
+	book.add(older)
+	book.add(newer)
+
+	incoming := &models.Order{Side: "bid", Price: decimal.MustParse("2.47"), RemainingQuantity: 250}
+	fills := book.match(incoming).fills
+
+	assert.Len(t, fills, 3)
+	assert.Equal(t, older.ID, fills[0].resting.order.ID)
+	assert.Equal(t, newer.ID, fills[1].resting.order.ID)
+	assert.Equal(t, worse.ID, fills[2].resting.order.ID)
+	assert.Equal(t, int64(50), fills[2].quantity)
+
+	// Planning a match must not change the book
+	_, asks := book.snapshot(10)
+	assert.Equal(t, int64(200), asks[0].Quantity)
+}
+
+func TestBookMatchRespectsLimitPrice(t *testing.T) {
+	book := newBook("token")
+	book.add(newRestingOrder("bid", "2.45", 100))
+	book.add(newRestingOrder("bid", "2.40", 100))
+
+	incoming := &models.Order{Side: "ask", Price: decimal.MustParse("2.42"), RemainingQuantity: 500}
+	fills := book.match(incoming).fills
+
+	assert.Len(t, fills, 1)
+	assert.Equal(t, decimal.MustParse("2.45"), fills[0].price)
+	assert.Equal(t, int64(100), fills[0].quantity)
+}
+
+func TestBookMatchSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           string
+		quantity       int64
+		wantFilled     int64
+		wantPrevented  int64 // quantity removed from the user's own resting ask
+		wantCancelsOwn bool
+		wantDecrement  int64
+		wantCancelSelf bool
+	}{
+		{name: "Cancel newest", mode: STPCancelNewest, quantity: 150, wantCancelSelf: true},
+		{name: "Cancel oldest", mode: STPCancelOldest, quantity: 150, wantFilled: 100, wantPrevented: 100, wantCancelsOwn: true},
+		{name: "Cancel both", mode: STPCancelBoth, quantity: 150, wantPrevented: 100, wantCancelsOwn: true, wantCancelSelf: true},
+		{name: "Decrement and cancel resting", mode: STPDecrementAndCancel, quantity: 150, wantFilled: 50, wantPrevented: 100, wantCancelsOwn: true, wantDecrement: 100},
+		{name: "Decrement resting and cancel incoming", mode: STPDecrementAndCancel, quantity: 60, wantPrevented: 60, wantCancelSelf: true},
+		{name: "Decrement and cancel equal sizes", mode: STPDecrementAndCancel, quantity: 100, wantPrevented: 100, wantCancelsOwn: true, wantCancelSelf: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := newBook("token")
+
+			own := newRestingOrder("ask", "2.46", 100)
+			other := newRestingOrder("ask", "2.46", 100)
+			book.add(own)
+			book.add(other)
+
+			incoming := &models.Order{
+				UserID:            own.UserID,
+				Side:              "bid",
+				Price:             decimal.MustParse("2.46"),
+				RemainingQuantity: tt.quantity,
+				STPMode:           tt.mode,
+			}
+			plan := book.match(incoming)
+
+			filled := int64(0)
+			for _, f := range plan.fills {
+				assert.Equal(t, other.ID, f.resting.order.ID)
+				filled += f.quantity
+			}
+			assert.Equal(t, tt.wantFilled, filled)
+
+			if tt.wantPrevented > 0 {
+				assert.Len(t, plan.prevented, 1)
+				assert.Equal(t, own.ID, plan.prevented[0].resting.order.ID)
+				assert.Equal(t, tt.wantPrevented, plan.prevented[0].quantity)
+				assert.Equal(t, tt.wantCancelsOwn, plan.prevented[0].cancels())
+			} else {
+				assert.Len(t, plan.prevented, 0)
+			}
+			assert.Equal(t, tt.wantDecrement, plan.decrement)
+			assert.Equal(t, tt.wantCancelSelf, plan.cancelSelf)
+		})
+	}
+}
+
+func TestBookFillAndRemove(t *testing.T) {
+	book := newBook("token")
+
+	first := newRestingOrder("ask", "2.46", 100)
+	second := newRestingOrder("ask", "2.46", 100)
+	book.add(first)
+	book.add(second)
+
+	book.fill(book.orders[first.ID], 40)
+	assert.Equal(t, "partially_filled", first.Status)
+
+	book.fill(book.orders[first.ID], 60)
+	assert.Equal(t, "filled", first.Status)
+	_, stillResting := book.orders[first.ID]
+	assert.False(t, stillResting)
+
+	_, asks := book.snapshot(10)
+	assert.Equal(t, int64(100), asks[0].Quantity)
+	assert.Equal(t, 1, asks[0].Orders)
+
+	assert.True(t, book.remove(second.ID))
+	assert.False(t, book.remove(second.ID))
+
+	_, asks = book.snapshot(10)
+	assert.Len(t, asks, 0)
+}
+
+func TestBookIcebergOrders(t *testing.T) {
+	newIceberg := func(price string, quantity, display int64) *models.Order {
+		order := newRestingOrder("ask", price, quantity)
+		order.DisplayQuantity = &display
+		return order
+	}
+	bid := func(quantity int64) *models.Order {
+		order := newRestingOrder("bid", "2.46", quantity)
+		order.ID = ""
+		return order
+	}
+
+	t.Run("shows only the displayed slice", func(t *testing.T) {
+		book := newBook("token")
+		book.add(newIceberg("2.46", 300, 100))
+		book.add(newRestingOrder("ask", "2.46", 50))
+
+		_, asks := book.snapshot(10)
+		assert.Equal(t, int64(150), asks[0].Quantity)
+		assert.Equal(t, int64(350), book.liquidity("ask"))
+	})
+
+	t.Run("reaches the hidden reserve after the rest of the level", func(t *testing.T) {
+		book := newBook("token")
+		iceberg := newIceberg("2.46", 300, 100)
+		behind := newRestingOrder("ask", "2.46", 50)
+		worse := newRestingOrder("ask", "2.47", 100)
+		book.add(iceberg)
+		book.add(behind)
+		book.add(worse)
+
+		fills := book.match(bid(250)).fills
+
+		assert.Len(t, fills, 2)
+		assert.Equal(t, iceberg, fills[0].resting.order)
+		assert.Equal(t, int64(200), fills[0].quantity)
+		assert.Equal(t, behind, fills[1].resting.order)
+		assert.Equal(t, int64(50), fills[1].quantity)
+
+		for _, f := range fills {
+			book.fill(f.resting, f.quantity)
+		}
+		_, asks := book.snapshot(10)
+		assert.Equal(t, int64(100), asks[0].Quantity)
+		assert.Equal(t, int64(100), iceberg.RemainingQuantity)
+		assert.Equal(t, "partially_filled", iceberg.Status)
+	})
+
+	t.Run("replenished slice loses time priority", func(t *testing.T) {
+		book := newBook("token")
+		iceberg := newIceberg("2.46", 300, 100)
+		behind := newRestingOrder("ask", "2.46", 100)
+		book.add(iceberg)
+		book.add(behind)
+
+		fills := book.match(bid(100)).fills
+		assert.Equal(t, iceberg, fills[0].resting.order)
+		book.fill(fills[0].resting, fills[0].quantity)
+
+		fills = book.match(bid(100)).fills
+		assert.Len(t, fills, 1)
+		assert.Equal(t, behind, fills[0].resting.order)
+	})
+}
+
+func TestBookExpiredOrders(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	book := newBook("token")
+	stale := newRestingOrder("ask", "2.45", 100)
+	stale.ExpiresAt = &past
+	live := newRestingOrder("ask", "2.46", 100)
+	live.ExpiresAt = &future
+	book.add(stale)
+	book.add(live)
+
+	staleStop := newRestingOrder("bid", "0", 100)
+	staleStop.ExpiresAt = &past
+	book.addStop(staleStop)
+	book.addStop(newRestingOrder("bid", "0", 100))
+
+	// Expired orders are planned for cancellation, never filled
+	incoming := &models.Order{Side: "bid", Price: decimal.MustParse("2.46"), RemainingQuantity: 150}
+	plan := book.match(incoming)
+	assert.Len(t, plan.fills, 1)
+	assert.Equal(t, live.ID, plan.fills[0].resting.order.ID)
+	assert.Len(t, plan.expired, 1)
+	assert.Equal(t, stale.ID, plan.expired[0].order.ID)
+
+	resting, stops := book.expiredOrders(time.Now())
+	assert.Len(t, resting, 1)
+	assert.Equal(t, stale.ID, resting[0].order.ID)
+	assert.Equal(t, []*models.Order{staleStop}, stops)
+
+	// Expiry is inclusive of the expiry time itself
+	assert.True(t, expired(live, future))
+	assert.False(t, expired(live, future.Add(-time.Second)))
+}
+
+func TestBookStopTriggers(t *testing.T) {
+	newStop := func(side, stopPrice string) *models.Order {
+		order := newRestingOrder(side, "0", 100)
+		order.ExecutionType = "stop_market"
+		price := decimal.MustParse(stopPrice)
+		order.StopPrice = &price
+		return order
+	}
+
+	book := newBook("token")
+	buyStop := newStop("bid", "2.50")
+	sellStop := newStop("ask", "2.40")
+	laterSellStop := newStop("ask", "2.45")
+	book.addStop(buyStop)
+	book.addStop(sellStop)
+	book.addStop(laterSellStop)
+
+	// Nothing fires before the first trade
+	assert.Nil(t, book.nextTriggered())
+
+	book.lastPrice = decimal.MustParse("2.46")
+	assert.Nil(t, book.nextTriggered())
+
+	book.lastPrice = decimal.MustParse("2.50")
+	assert.Equal(t, buyStop, book.nextTriggered())
+	assert.True(t, book.removeStop(buyStop.ID))
+	assert.False(t, book.removeStop(buyStop.ID))
+
+	// The oldest triggered stop goes first
+	book.lastPrice = decimal.MustParse("2.40")
+	assert.Equal(t, sellStop, book.nextTriggered())
+	book.removeStop(sellStop.ID)
+	assert.Equal(t, laterSellStop, book.nextTriggered())
+
+	_, asks := book.snapshot(10)
+	assert.Len(t, asks, 0)
+}
+
+func TestBookTrailStops(t *testing.T) {
+	amount := decimal.MustParse("0.10")
+	percent := decimal.MustParse("5")
+
+	sellStop := newRestingOrder("ask", "0", 100)
+	sellStop.ExecutionType = "trailing_stop"
+	sellStop.TrailAmount = &amount
+
+	buyStop := newRestingOrder("bid", "0", 100)
+	buyStop.ExecutionType = "trailing_stop"
+	buyStop.TrailPercent = &percent
+
+	book := newBook("token")
+	book.addStop(sellStop)
+	book.addStop(buyStop)
+
+	// Without a trade there is nothing to trail
+	assert.Len(t, book.trailStops(), 0)
+
+	// The first trade sets both marks
+	book.lastPrice = decimal.MustParse("2.00")
+	updates := book.trailStops()
+	assert.Len(t, updates, 2)
+	assert.Equal(t, decimal.MustParse("1.90"), updates[0].stopPrice)
+	assert.Equal(t, decimal.MustParse("2.10"), updates[1].stopPrice)
+	for _, u := range updates {
+		mark, stopPrice := u.mark, u.stopPrice
+		u.stop.TrailMark = &mark
+		u.stop.StopPrice = &stopPrice
+	}
+
+	// A rise moves only the sell stop's high-water mark
+	book.lastPrice = decimal.MustParse("2.20")
+	updates = book.trailStops()
+	assert.Len(t, updates, 1)
+	assert.Equal(t, sellStop, updates[0].stop)
+	assert.Equal(t, decimal.MustParse("2.10"), updates[0].stopPrice)
+
+	// A fall moves only the buy stop's low-water mark
+	book.lastPrice = decimal.MustParse("1.90")
+	updates = book.trailStops()
+	assert.Len(t, updates, 1)
+	assert.Equal(t, buyStop, updates[0].stop)
+	assert.Equal(t, decimal.MustParse("1.995"), updates[0].stopPrice)
+
+	// A sell stop trailing by more than the mark stays at zero
+	wide := decimal.MustParse("2.50")
+	sellStop.TrailAmount = &wide
+	assert.Equal(t, decimal.Zero, trailingStopPrice(sellStop, decimal.MustParse("2.20")))
+}
+
+func TestBookChanges(t *testing.T) {
+	book := newBook("token")
+
+	best := newRestingOrder("bid", "2.45", 100)
+	ask := newRestingOrder("ask", "2.46", 100)
+	book.add(best)
+	book.add(newRestingOrder("bid", "2.44", 100))
+	book.add(ask)
+
+	bids, asks := book.flushChanges()
+	assert.Equal(t, []string{"2.45", "2.44"}, levelPrices(bids))
+	assert.Equal(t, []string{"2.46"}, levelPrices(asks))
+
+	// A client keeps its own copy of the book from a snapshot and deltas
+	local := map[string]map[string]models.OrderBookLevel{"bid": {}, "ask": {}}
+	apply := func(bids, asks []models.OrderBookLevel) {
+		for side, levels := range map[string][]models.OrderBookLevel{"bid": bids, "ask": asks} {
+			for _, level := range levels {
+				if level.Quantity == 0 {
+					delete(local[side], level.Price.String())
+				} else {
+					local[side][level.Price.String()] = level
+				}
+			}
+		}
+	}
+	sorted := func(side string) []models.OrderBookLevel {
+		levels := []models.OrderBookLevel{}
+		for _, level := range local[side] {
+			levels = append(levels, level)
+		}
+		sort.Slice(levels, func(i, j int) bool {
+			if side == "bid" {
+				return levels[i].Price.GreaterThan(levels[j].Price)
+			}
+			return levels[i].Price.LessThan(levels[j].Price)
+		})
+		return levels
+	}
+	apply(book.snapshot(10))
+
+	book.fill(book.orders[ask.ID], 100)
+	book.reduce(book.orders[best.ID], 40)
+	book.add(newRestingOrder("bid", "2.43", 100))
+
+	bids, asks = book.flushChanges()
+	assert.Equal(t, []models.OrderBookLevel{
+		{Price: decimal.MustParse("2.45"), Quantity: 60, Orders: 1},
+		{Price: decimal.MustParse("2.43"), Quantity: 100, Orders: 1},
+	}, bids)
+	// The emptied level is sent with no quantity
+	assert.Equal(t, []models.OrderBookLevel{{Price: decimal.MustParse("2.46")}}, asks)
+
+	apply(bids, asks)
+	snapshotBids, snapshotAsks := book.snapshot(10)
+	assert.Equal(t, snapshotBids, sorted("bid"))
+	assert.Equal(t, snapshotAsks, sorted("ask"))
+	assert.Equal(t, Checksum(snapshotBids, snapshotAsks), Checksum(sorted("bid"), sorted("ask")))
+
+	// Nothing has changed since
+	bids, asks = book.flushChanges()
+	assert.Empty(t, bids)
+	assert.Empty(t, asks)
+}
+
+func TestChecksum(t *testing.T) {
+	bids := []models.OrderBookLevel{
+		{Price: decimal.MustParse("2.45"), Quantity: 100},
+		{Price: decimal.MustParse("2.44"), Quantity: 200},
+	}
+	asks := []models.OrderBookLevel{{Price: decimal.MustParse("2.46"), Quantity: 50}}
+
+	// CRC-32 of "2.45:100:2.46:50:2.44:200"
+	assert.Equal(t, uint32(185064303), Checksum(bids, asks))
+	assert.Equal(t, uint32(0), Checksum(nil, nil))
+
+	// Only the top levels are covered
+	deep := []models.OrderBookLevel{}
+	for i := 0; i < ChecksumDepth+1; i++ {
+		deep = append(deep, models.OrderBookLevel{Price: decimal.FromInt(int64(100 - i)), Quantity: 1})
+	}
+	changed := append([]models.OrderBookLevel{}, deep...)
+	changed[ChecksumDepth].Quantity = 2
+	assert.Equal(t, Checksum(deep, nil), Checksum(changed, nil))
+	changed[0].Quantity = 2
+	assert.NotEqual(t, Checksum(deep, nil), Checksum(changed, nil))
+}
+
+func levelPrices(levels []models.OrderBookLevel) []string {
+	prices := []string{}
+	for _, level := range levels {
+		prices = append(prices, level.Price.String())
+	}
+	return prices
+}
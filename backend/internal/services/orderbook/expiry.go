@@ -0,0 +1,153 @@
+package orderbook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// expired reports whether a good-till-date order's expiry has passed by now
+func expired(order *models.Order, now time.Time) bool {
+	return order.ExpiresAt != nil && !now.Before(*order.ExpiresAt)
+}
+
+// expireOrder marks an order as cancelled on expiry once its cancellation
+// has been journaled
+func expireOrder(order *models.Order) {
+	cancelOrder(order, CancelReasonExpired)
+	order.LockedAmount = decimal.Zero
+}
+
+// journalExpiries records the cancellation of expired resting orders and
+// releases their reservations. Like fills, each update is guarded on the
+// remaining quantity this book last saw.
+func journalExpiries(tx *sql.Tx, expiredOrders []*bookOrder) error {
+	query := `
+		UPDATE orders
+		SET status = 'cancelled', cancel_reason = $2, locked_amount = 0, updated_at = NOW()
+		WHERE id = $1
+		  AND status IN (` + liveStatuses + `)
+		  AND remaining_quantity = $3
+	`
+
+	for _, bo := range expiredOrders {
+		order := bo.order
+
+		result, err := tx.Exec(query, order.ID, CancelReasonExpired, order.RemainingQuantity)
+		if err != nil {
+			return fmt.Errorf("failed to expire order: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to expire order: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("expired order %s changed concurrently", order.ID)
+		}
+
+		if order.LockedAmount.IsPositive() {
+			if err := releaseFunds(tx, order.UserID, balanceCurrency(order), order.LockedAmount); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RunExpirySweeper expires good-till-date orders every interval until ctx is
+// cancelled
+func (s *Service) RunExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if expiredCount := s.ExpireOrders(); expiredCount > 0 {
+				log.Printf("⏰ Expired %d good-till-date orders", expiredCount)
+			}
+		}
+	}
+}
+
+// ExpireOrders cancels every resting and dormant stop order whose expiry has
+// passed and releases their reservations. It returns the number of orders
+// expired; books that fail are logged and retried on the next sweep.
+func (s *Service) ExpireOrders() int {
+	expiredCount := 0
+	for _, book := range s.engine.Books() {
+		count, err := s.expireBook(book, time.Now())
+		if err != nil {
+			log.Printf("Failed to expire orders for token %s: %v", book.tokenID, err)
+			continue
+		}
+		expiredCount += count
+	}
+	return expiredCount
+}
+
+// expireBook expires one book's orders in a single journal transaction and
+// removes them from the book once committed
+func (s *Service) expireBook(book *Book, now time.Time) (int, error) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	resting, stops := book.expiredOrders(now)
+	if len(resting) == 0 && len(stops) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.beginTokenTx(book.tokenID)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := journalExpiries(tx, resting); err != nil {
+		return 0, err
+	}
+
+	var events orderEvents
+	for _, bo := range resting {
+		events.cancelled(bo.order, CancelReasonExpired)
+	}
+	for _, stop := range stops {
+		if err := journalStopCancel(tx, stop, CancelReasonExpired); err != nil {
+			return 0, err
+		}
+		events.cancelled(stop, CancelReasonExpired)
+	}
+	if err := events.write(tx, book.tokenID); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, bo := range resting {
+		expireOrder(bo.order)
+		book.remove(bo.order.ID)
+	}
+	for _, stop := range stops {
+		expireOrder(stop)
+		book.removeStop(stop.ID)
+	}
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(book.tokenID))
+
+	s.announce(book, events)
+
+	return len(resting) + len(stops), nil
+}
@@ -0,0 +1,215 @@
+package orderbook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// Order event types recorded in order_events.event_type
+const (
+	OrderEventAccepted        = "accepted"         // a new order reached the book; data is the order
+	OrderEventAmended         = "amended"          // an order was replaced at a new price or size; data is the order
+	OrderEventTriggered       = "triggered"        // a stop order went live; data is the order
+	OrderEventMatched         = "matched"          // a trade; data is the trade
+	OrderEventPartiallyFilled = "partially_filled" // an order's fill after a trade
+	OrderEventFilled          = "filled"           // an order's last fill
+	OrderEventReduced         = "reduced"          // an order shrank without trading
+	OrderEventRequeued        = "requeued"         // an iceberg showed a fresh slice at the back of its level
+	OrderEventTrailed         = "trailed"          // a trailing stop moved its mark and stop price
+	OrderEventCancelled       = "cancelled"        // an order was cancelled
+	OrderEventExpired         = "expired"          // a good-till-date order was cancelled on expiry
+	OrderEventRejected        = "rejected"         // the book refused a new order, which was never stored
+	OrderEventSnapshot        = "snapshot"         // an order placed before the journal began; data is its state then
+)
+
+// orderFill is the data of a partially_filled or filled event
+type orderFill struct {
+	FilledQuantity    int64 `json:"filledQuantity"`
+	RemainingQuantity int64 `json:"remainingQuantity"`
+}
+
+// orderChange is the data of an event that changes an order without a trade
+type orderChange struct {
+	Reason   string        `json:"reason,omitempty"`   // cancelled, expired and rejected orders
+	Quantity int64         `json:"quantity,omitempty"` // reduced orders: the quantity removed
+	Order    *models.Order `json:"order,omitempty"`    // rejected orders: the order as refused
+}
+
+// orderRequeue is the data of a requeued event
+type orderRequeue struct {
+	RequeuedAt time.Time `json:"requeuedAt"`
+}
+
+// orderTrail is the data of a trailed event
+type orderTrail struct {
+	TrailMark decimal.Decimal `json:"trailMark"`
+	StopPrice decimal.Decimal `json:"stopPrice"`
+}
+
+// pendingEvent is an order event waiting to be appended to the journal. The
+// owner of the order is not journaled but is passed on to the listener.
+type pendingEvent struct {
+	OrderID string      `json:"orderId"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+	userID  string
+}
+
+// orderEvents collects the order events of one journal transaction. They are
+// appended to the token's journal with write just before it commits, so the
+// journal records exactly the changes that were committed.
+type orderEvents []pendingEvent
+
+func (e *orderEvents) add(order *models.Order, eventType string, data interface{}) {
+	*e = append(*e, pendingEvent{OrderID: order.ID, Type: eventType, Data: data, userID: order.UserID})
+}
+
+// order records an order as it is accepted, amended or triggered, before it
+// matches
+func (e *orderEvents) order(eventType string, order *models.Order) {
+	snapshot := *order
+	e.add(order, eventType, &snapshot)
+}
+
+// fills records each trade an incoming order made followed by the resting
+// order's resulting fill, then the incoming order's own fill
+func (e *orderEvents) fills(incoming *models.Order, fills []fill, trades []*models.Trade) {
+	filled := make(map[*bookOrder]int64)
+	for i, f := range fills {
+		e.add(incoming, OrderEventMatched, trades[i])
+
+		filled[f.resting] += f.quantity
+		resting := f.resting.order
+		e.fill(resting, resting.FilledQuantity+filled[f.resting], resting.RemainingQuantity-filled[f.resting])
+		if f.replenishes() {
+			e.requeued(resting, time.Now())
+		}
+	}
+
+	if len(fills) > 0 {
+		e.fill(incoming, incoming.FilledQuantity, incoming.RemainingQuantity)
+	}
+}
+
+// fill records an order's fill state after a trade
+func (e *orderEvents) fill(order *models.Order, filledQuantity, remainingQuantity int64) {
+	eventType := OrderEventPartiallyFilled
+	if remainingQuantity == 0 {
+		eventType = OrderEventFilled
+	}
+	e.add(order, eventType, orderFill{FilledQuantity: filledQuantity, RemainingQuantity: remainingQuantity})
+}
+
+// reduced records an order shrinking by quantity without trading
+func (e *orderEvents) reduced(order *models.Order, quantity int64) {
+	e.add(order, OrderEventReduced, orderChange{Quantity: quantity})
+}
+
+// requeued records an iceberg going to the back of its level with a fresh
+// slice
+func (e *orderEvents) requeued(order *models.Order, at time.Time) {
+	e.add(order, OrderEventRequeued, orderRequeue{RequeuedAt: at})
+}
+
+// trailed records a trailing stop's new mark and stop price
+func (e *orderEvents) trailed(order *models.Order, mark, stopPrice decimal.Decimal) {
+	e.add(order, OrderEventTrailed, orderTrail{TrailMark: mark, StopPrice: stopPrice})
+}
+
+// cancelled records an order's cancellation; cancellations on expiry are
+// recorded as expired
+func (e *orderEvents) cancelled(order *models.Order, reason string) {
+	eventType := OrderEventCancelled
+	if reason == CancelReasonExpired {
+		eventType = OrderEventExpired
+	}
+	e.add(order, eventType, orderChange{Reason: reason})
+}
+
+// rejected records an order the book refused
+func (e *orderEvents) rejected(order *models.Order, reason string) {
+	snapshot := *order
+	e.add(order, OrderEventRejected, orderChange{Reason: reason, Order: &snapshot})
+}
+
+// write appends the events to the token's journal, numbering them after the
+// token's last event. Journal transactions hold the token's advisory lock, so
+// no other writer can take the same numbers.
+func (e orderEvents) write(tx *sql.Tx, tokenID string) error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode order events: %w", err)
+	}
+
+	query := `
+		INSERT INTO order_events (token_id, sequence, order_id, event_type, data)
+		SELECT $1, last.sequence + e.n, (e.event->>'orderId')::uuid, e.event->>'type', e.event->'data'
+		FROM jsonb_array_elements($2::jsonb) WITH ORDINALITY AS e(event, n),
+		     (SELECT COALESCE(MAX(sequence), 0) AS sequence FROM order_events WHERE token_id = $1) last
+	`
+
+	if _, err := tx.Exec(query, tokenID, string(data)); err != nil {
+		return fmt.Errorf("failed to journal order events: %w", err)
+	}
+
+	return nil
+}
+
+// isRejection reports whether err is the book refusing an order, as opposed
+// to a failure to process it
+func isRejection(err error) bool {
+	for _, target := range []error{
+		ErrTradingHalted, ErrTokenNotActive, ErrPriceNotOnTick, ErrQuantityNotInLots,
+		ErrOutsidePriceBand, ErrNotAllowedInAuction, ErrPostOnlyWouldCross,
+		ErrInsufficientFunds, ErrDuplicateClientOrderID, ErrTrailTooWide,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// journalRejection records an order the book refused in its own transaction.
+// Refused orders are never stored, so the journal is their only record.
+func (s *Service) journalRejection(order *models.Order, reason string) error {
+	tx, err := s.beginTokenTx(order.TokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var events orderEvents
+	events.rejected(order, reason)
+	if err := events.write(tx, order.TokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// logRejection journals a refused order, logging rather than returning any
+// failure so the caller still sees why the order was refused
+func (s *Service) logRejection(order *models.Order, err error) {
+	if !isRejection(err) {
+		return
+	}
+	if jerr := s.journalRejection(order, err.Error()); jerr != nil {
+		log.Printf("Failed to journal rejected order %s: %v", order.ID, jerr)
+	}
+}
@@ -0,0 +1,119 @@
+package orderbook
+
+import (
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// UpdateDepth is the number of price levels per side in a BookUpdate
+const UpdateDepth = 20
+
+// Listener is told about every committed change to a book. BookChanged is
+// called once the change has been applied, with the book's lock held, so
+// updates for a token arrive in commit order; it must not block or call back
+// into the Service.
+type Listener interface {
+	BookChanged(update *BookUpdate)
+}
+
+// BookUpdate is one committed change to a token's book: the order events it
+// journaled, the trades among them, the book as it now stands and, if the
+// change moved any levels, the delta numbered with the book's new sequence
+type BookUpdate struct {
+	TokenID string
+	Orders  []OrderChange
+	Trades  []*models.Trade
+	Book    *models.OrderBook // UpdateDepth levels per side
+	Delta   *models.OrderBookDelta
+}
+
+// OrderChange is an order event of a BookUpdate, with the order's owner
+type OrderChange struct {
+	OrderID string
+	UserID  string
+	Type    string // one of the OrderEvent types other than matched
+
+	Order             *models.Order // accepted, amended and triggered: the order as it joined the book
+	FilledQuantity    int64         // partially_filled and filled
+	RemainingQuantity int64         // partially_filled and filled
+	Quantity          int64         // reduced: the quantity removed
+	Reason            string        // cancelled and expired
+}
+
+// SetListener sets the listener told about committed book changes. It must
+// be set before the service takes orders.
+func (s *Service) SetListener(listener Listener) {
+	s.listener = listener
+}
+
+// ObserveOrderBook calls fn with a token's live book, bypassing the cache,
+// with depth levels per side or the whole book if depth is not positive.
+// The book is held while fn runs, so every update the listener is told about
+// after fn returns is newer than the book fn saw. fn may call into the
+// listener but not back into the Service.
+func (s *Service) ObserveOrderBook(tokenID string, depth int, fn func(book *models.OrderBook)) {
+	s.engine.View(tokenID, func(book *Book) {
+		fn(s.orderBook(book, depth))
+	})
+}
+
+// announce numbers a committed change to a book's levels and tells the
+// listener about the change. While a batch is being placed the change is
+// held back and announced with the rest of the batch. Callers must hold
+// book.mu and have applied the change.
+func (s *Service) announce(book *Book, events orderEvents) {
+	if book.held != nil {
+		*book.held = append(*book.held, events...)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	bids, asks := book.flushChanges()
+	moved := len(bids) > 0 || len(asks) > 0
+	if moved {
+		book.sequence++
+	}
+
+	if s.listener == nil {
+		return
+	}
+
+	update := &BookUpdate{
+		TokenID: book.tokenID,
+		Orders:  []OrderChange{},
+		Trades:  []*models.Trade{},
+		Book:    s.orderBook(book, UpdateDepth),
+	}
+	if moved {
+		update.Delta = &models.OrderBookDelta{
+			TokenID:   book.tokenID,
+			Sequence:  book.sequence,
+			Bids:      bids,
+			Asks:      asks,
+			LastPrice: book.lastPrice,
+			Checksum:  update.Book.Checksum,
+			UpdatedAt: update.Book.UpdatedAt,
+		}
+	}
+
+	for _, e := range events {
+		change := OrderChange{OrderID: e.OrderID, UserID: e.userID, Type: e.Type}
+		switch data := e.Data.(type) {
+		case *models.Trade:
+			update.Trades = append(update.Trades, data)
+			continue
+		case *models.Order:
+			change.Order = data
+		case orderFill:
+			change.FilledQuantity = data.FilledQuantity
+			change.RemainingQuantity = data.RemainingQuantity
+		case orderChange:
+			change.Quantity = data.Quantity
+			change.Reason = data.Reason
+		}
+		update.Orders = append(update.Orders, change)
+	}
+
+	s.listener.BookChanged(update)
+}
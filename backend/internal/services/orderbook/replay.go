@@ -0,0 +1,405 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// replay is the state rebuilt from a token's order journal
+type replay struct {
+	tokenID    string
+	orders     map[string]*models.Order
+	joined     map[string]int64 // sequence at which each order last joined the back of its level
+	trades     []*models.Trade
+	rejected   int
+	events     int
+	last       int64     // sequence of the last event applied
+	start      time.Time // when the journal took its snapshot of earlier orders, if it did
+	mismatches []models.JournalMismatch
+}
+
+// replayJournal rebuilds a token's orders and trades by applying its order
+// events in sequence. The result depends on nothing but the events, so
+// replaying the same journal always gives the same state. Gaps in the
+// sequence and events that disagree with the state before them are reported
+// as mismatches.
+func replayJournal(tokenID string, events []*models.OrderEvent) (*replay, error) {
+	r := &replay{
+		tokenID: tokenID,
+		orders:  make(map[string]*models.Order),
+		joined:  make(map[string]int64),
+	}
+
+	for _, event := range events {
+		if err := r.apply(event); err != nil {
+			return nil, fmt.Errorf("failed to replay event %d: %w", event.Sequence, err)
+		}
+	}
+
+	return r, nil
+}
+
+// apply applies one event to the replayed state
+func (r *replay) apply(event *models.OrderEvent) error {
+	r.events++
+	if expected := r.last + 1; event.Sequence != expected {
+		r.mismatch("sequence", strconv.FormatInt(expected, 10), "sequence", strconv.FormatInt(event.Sequence, 10), "")
+	}
+	r.last = event.Sequence
+
+	switch event.Type {
+	case OrderEventSnapshot, OrderEventAccepted, OrderEventAmended, OrderEventTriggered:
+		var order models.Order
+		if err := json.Unmarshal(event.Data, &order); err != nil {
+			return err
+		}
+		r.orders[order.ID] = &order
+		r.joined[order.ID] = event.Sequence
+		if event.Type == OrderEventSnapshot && event.CreatedAt.After(r.start) {
+			r.start = event.CreatedAt
+		}
+
+	case OrderEventMatched:
+		var trade models.Trade
+		if err := json.Unmarshal(event.Data, &trade); err != nil {
+			return err
+		}
+		r.trades = append(r.trades, &trade)
+		r.applyFill(trade.BuyerOrderID, trade.Quantity, trade.BuyerFee)
+		r.applyFill(trade.SellerOrderID, trade.Quantity, trade.SellerFee)
+
+	case OrderEventPartiallyFilled, OrderEventFilled:
+		var f orderFill
+		if err := json.Unmarshal(event.Data, &f); err != nil {
+			return err
+		}
+		if order := r.order(event.OrderID); order != nil {
+			r.compare("event", order.ID, "filledQuantity", f.FilledQuantity, order.FilledQuantity)
+			r.compare("event", order.ID, "remainingQuantity", f.RemainingQuantity, order.RemainingQuantity)
+		}
+
+	case OrderEventReduced:
+		var change orderChange
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			return err
+		}
+		if order := r.order(event.OrderID); order != nil {
+			order.Quantity -= change.Quantity
+			order.RemainingQuantity -= change.Quantity
+		}
+
+	case OrderEventRequeued:
+		var requeue orderRequeue
+		if err := json.Unmarshal(event.Data, &requeue); err != nil {
+			return err
+		}
+		if order := r.order(event.OrderID); order != nil {
+			order.RequeuedAt = &requeue.RequeuedAt
+			r.joined[order.ID] = event.Sequence
+		}
+
+	case OrderEventTrailed:
+		var trail orderTrail
+		if err := json.Unmarshal(event.Data, &trail); err != nil {
+			return err
+		}
+		if order := r.order(event.OrderID); order != nil {
+			order.TrailMark = &trail.TrailMark
+			order.StopPrice = &trail.StopPrice
+		}
+
+	case OrderEventCancelled, OrderEventExpired:
+		var change orderChange
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			return err
+		}
+		if order := r.order(event.OrderID); order != nil {
+			cancelOrder(order, change.Reason)
+		}
+
+	case OrderEventRejected:
+		r.rejected++
+
+	default:
+		r.mismatch("event", event.OrderID, "type", event.Type, "")
+	}
+
+	return nil
+}
+
+// order returns a replayed order, reporting events for orders the journal
+// never accepted
+func (r *replay) order(orderID string) *models.Order {
+	order, ok := r.orders[orderID]
+	if !ok {
+		r.mismatch("event", orderID, "order", "not accepted", "")
+	}
+	return order
+}
+
+// applyFill applies one side of a trade to a replayed order
+func (r *replay) applyFill(orderID string, quantity int64, fee decimal.Decimal) {
+	order := r.order(orderID)
+	if order == nil {
+		return
+	}
+
+	order.FilledQuantity += quantity
+	order.RemainingQuantity -= quantity
+	order.FeePaid = order.FeePaid.Add(fee)
+	order.Status = "partially_filled"
+	if order.RemainingQuantity == 0 {
+		order.Status = "filled"
+	}
+}
+
+// book rests the replayed live orders on a new book in the order they last
+// joined it, and parks the dormant stops
+func (r *replay) book() *Book {
+	ids := make([]string, 0, len(r.orders))
+	for id := range r.orders {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return r.joined[ids[i]] < r.joined[ids[j]] })
+
+	book := newBook(r.tokenID)
+	for _, id := range ids {
+		order := *r.orders[id]
+		switch order.Status {
+		case "open", "partially_filled", "triggered":
+			book.add(&order)
+		case "pending_trigger":
+			book.addStop(&order)
+		}
+	}
+	return book
+}
+
+func (r *replay) mismatch(kind, id, field, journal, table string) {
+	r.mismatches = append(r.mismatches, models.JournalMismatch{Kind: kind, ID: id, Field: field, Journal: journal, Table: table})
+}
+
+// compare reports a field whose journal and table values differ
+func (r *replay) compare(kind, id, field string, journal, table interface{}) {
+	j, t := fmt.Sprint(journal), fmt.Sprint(table)
+	if j != t {
+		r.mismatch(kind, id, field, j, t)
+	}
+}
+
+// JournalTokens returns the tokens that have an order journal
+func (s *Service) JournalTokens() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT token_id FROM order_events ORDER BY token_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journals: %w", err)
+	}
+	defer rows.Close()
+
+	tokenIDs := []string{}
+	for rows.Next() {
+		var tokenID string
+		if err := rows.Scan(&tokenID); err != nil {
+			return nil, fmt.Errorf("failed to scan journal: %w", err)
+		}
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list journals: %w", err)
+	}
+
+	return tokenIDs, nil
+}
+
+// VerifyJournal replays a token's order journal and diffs the rebuilt orders
+// and trades against the orders and trades tables. Trades executed before the
+// journal's snapshot of earlier orders are not journaled and are skipped.
+func (s *Service) VerifyJournal(tokenID string) (*models.JournalReport, error) {
+	events, err := s.loadJournal(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := replayJournal(tokenID, events)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.diffOrders(r); err != nil {
+		return nil, err
+	}
+	if err := s.diffTrades(r); err != nil {
+		return nil, err
+	}
+
+	bids, asks := r.book().snapshot(math.MaxInt)
+	return &models.JournalReport{
+		TokenID:    tokenID,
+		Events:     r.events,
+		Orders:     len(r.orders),
+		Trades:     len(r.trades),
+		Rejected:   r.rejected,
+		Bids:       bids,
+		Asks:       asks,
+		Mismatches: append([]models.JournalMismatch{}, r.mismatches...),
+	}, nil
+}
+
+// loadJournal reads a token's order events in sequence
+func (s *Service) loadJournal(tokenID string) ([]*models.OrderEvent, error) {
+	query := `
+		SELECT sequence, order_id, event_type, data, created_at
+		FROM order_events
+		WHERE token_id = $1
+		ORDER BY sequence ASC
+	`
+
+	rows, err := s.db.Query(query, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load journal: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*models.OrderEvent{}
+	for rows.Next() {
+		event := &models.OrderEvent{TokenID: tokenID}
+		var data []byte
+		if err := rows.Scan(&event.Sequence, &event.OrderID, &event.Type, &data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order event: %w", err)
+		}
+		event.Data = data
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load journal: %w", err)
+	}
+
+	return events, nil
+}
+
+// diffOrders compares the replayed orders with the token's orders table
+func (s *Service) diffOrders(r *replay) error {
+	query := `
+		SELECT id, status, COALESCE(cancel_reason, ''), price, quantity,
+		       filled_quantity, remaining_quantity, fee_paid
+		FROM orders
+		WHERE token_id = $1
+	`
+
+	rows, err := s.db.Query(query, r.tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to load orders: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var stored models.Order
+		var cancelReason string
+		if err := rows.Scan(&stored.ID, &stored.Status, &cancelReason, &stored.Price, &stored.Quantity,
+			&stored.FilledQuantity, &stored.RemainingQuantity, &stored.FeePaid); err != nil {
+			return fmt.Errorf("failed to scan order: %w", err)
+		}
+		seen[stored.ID] = true
+
+		order, ok := r.orders[stored.ID]
+		if !ok {
+			r.mismatch("order", stored.ID, "order", "missing", "present")
+			continue
+		}
+
+		replayedReason := ""
+		if order.CancelReason != nil {
+			replayedReason = *order.CancelReason
+		}
+		r.compare("order", order.ID, "status", order.Status, stored.Status)
+		r.compare("order", order.ID, "cancelReason", replayedReason, cancelReason)
+		r.compare("order", order.ID, "price", order.Price, stored.Price)
+		r.compare("order", order.ID, "quantity", order.Quantity, stored.Quantity)
+		r.compare("order", order.ID, "filledQuantity", order.FilledQuantity, stored.FilledQuantity)
+		r.compare("order", order.ID, "remainingQuantity", order.RemainingQuantity, stored.RemainingQuantity)
+		r.compare("order", order.ID, "feePaid", order.FeePaid, stored.FeePaid)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load orders: %w", err)
+	}
+
+	for _, id := range sortedKeys(r.orders) {
+		if !seen[id] {
+			r.mismatch("order", id, "order", "present", "missing")
+		}
+	}
+
+	return nil
+}
+
+// diffTrades compares the replayed trades with the token's trades table
+func (s *Service) diffTrades(r *replay) error {
+	query := `
+		SELECT id, buyer_order_id, seller_order_id, price, quantity, buyer_fee, seller_fee
+		FROM trades
+		WHERE token_id = $1 AND executed_at > $2
+	`
+
+	rows, err := s.db.Query(query, r.tokenID, r.start)
+	if err != nil {
+		return fmt.Errorf("failed to load trades: %w", err)
+	}
+	defer rows.Close()
+
+	replayed := make(map[string]*models.Trade, len(r.trades))
+	for _, trade := range r.trades {
+		replayed[trade.ID] = trade
+	}
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var stored models.Trade
+		if err := rows.Scan(&stored.ID, &stored.BuyerOrderID, &stored.SellerOrderID, &stored.Price,
+			&stored.Quantity, &stored.BuyerFee, &stored.SellerFee); err != nil {
+			return fmt.Errorf("failed to scan trade: %w", err)
+		}
+		seen[stored.ID] = true
+
+		trade, ok := replayed[stored.ID]
+		if !ok {
+			r.mismatch("trade", stored.ID, "trade", "missing", "present")
+			continue
+		}
+
+		r.compare("trade", trade.ID, "buyerOrderId", trade.BuyerOrderID, stored.BuyerOrderID)
+		r.compare("trade", trade.ID, "sellerOrderId", trade.SellerOrderID, stored.SellerOrderID)
+		r.compare("trade", trade.ID, "price", trade.Price, stored.Price)
+		r.compare("trade", trade.ID, "quantity", trade.Quantity, stored.Quantity)
+		r.compare("trade", trade.ID, "buyerFee", trade.BuyerFee, stored.BuyerFee)
+		r.compare("trade", trade.ID, "sellerFee", trade.SellerFee, stored.SellerFee)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load trades: %w", err)
+	}
+
+	for _, trade := range r.trades {
+		if !seen[trade.ID] {
+			r.mismatch("trade", trade.ID, "trade", "present", "missing")
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns a map's keys in order, for reports that read the same
+// on every run
+func sortedKeys(orders map[string]*models.Order) []string {
+	keys := make([]string, 0, len(orders))
+	for key := range orders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,207 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// DefaultTickSizes are the price increments of tokens without a tick size of
+// their own, coarser as the price rises so that each tick is a similar
+// fraction of the price
+var DefaultTickSizes = []models.TickTier{
+	{MinPrice: decimal.Zero, TickSize: decimal.New(1, 4)},       // 0.0001 below 0.10
+	{MinPrice: decimal.New(10, 2), TickSize: decimal.New(1, 3)}, // 0.001 from 0.10
+	{MinPrice: decimal.FromInt(1), TickSize: decimal.New(1, 2)}, // 0.01 from 1.00
+}
+
+// ErrPriceNotOnTick is returned for prices that are not a multiple of the
+// tick size at that price
+var ErrPriceNotOnTick = errors.New("price is not a multiple of the tick size")
+
+// ErrQuantityNotInLots is returned for quantities that are not a multiple of
+// the token's lot size
+var ErrQuantityNotInLots = errors.New("quantity is not a multiple of the lot size")
+
+// ErrInvalidMarketRules is returned for a tick size or lot size that is not
+// positive
+var ErrInvalidMarketRules = errors.New("invalid market rules")
+
+// ErrTokenNotFound is returned when a token does not exist
+var ErrTokenNotFound = errors.New("token not found")
+
+// marketRules are the price and quantity increments a book accepts. A nil
+// tickSize uses DefaultTickSizes.
+type marketRules struct {
+	tickSize *decimal.Decimal
+	lotSize  int64
+}
+
+// defaultMarketRules apply to tokens that have not configured their own
+var defaultMarketRules = marketRules{lotSize: 1}
+
+// tickTiers returns the tick sizes of the rules by price band, lowest band
+// first
+func (r marketRules) tickTiers() []models.TickTier {
+	if r.tickSize == nil {
+		return DefaultTickSizes
+	}
+	return []models.TickTier{{MinPrice: decimal.Zero, TickSize: *r.tickSize}}
+}
+
+// tickAt returns the tick size that applies at price
+func (r marketRules) tickAt(price decimal.Decimal) decimal.Decimal {
+	tiers := r.tickTiers()
+	tick := tiers[0].TickSize
+	for _, tier := range tiers[1:] {
+		if price.LessThan(tier.MinPrice) {
+			break
+		}
+		tick = tier.TickSize
+	}
+	return tick
+}
+
+// snapPrice moves a positive price onto the tick that applies at it,
+// rounding up or down
+func (r marketRules) snapPrice(price decimal.Decimal, up bool) decimal.Decimal {
+	tick := r.tickAt(price).Units()
+	units := price.Units() - price.Units()%tick
+	if up && units != price.Units() {
+		units += tick
+	}
+	return decimal.FromUnits(units)
+}
+
+// checkPrice rejects a price that is not on a tick
+func (r marketRules) checkPrice(price decimal.Decimal) error {
+	tick := r.tickAt(price)
+	if price.Units()%tick.Units() != 0 {
+		return fmt.Errorf("%w: %s is not a multiple of %s", ErrPriceNotOnTick, price, tick)
+	}
+	return nil
+}
+
+// checkQuantity rejects a quantity that is not a whole number of lots
+func (r marketRules) checkQuantity(quantity int64) error {
+	if quantity%r.lotSize != 0 {
+		return fmt.Errorf("%w: %d is not a multiple of %d", ErrQuantityNotInLots, quantity, r.lotSize)
+	}
+	return nil
+}
+
+// checkOrder rejects an order whose limit price, quantity or display
+// quantity does not follow the rules
+func (r marketRules) checkOrder(order *models.Order) error {
+	if liveExecutionType(order.ExecutionType) == "limit" {
+		if err := r.checkPrice(order.Price); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkQuantity(order.Quantity); err != nil {
+		return err
+	}
+
+	if order.DisplayQuantity != nil {
+		if err := r.checkQuantity(*order.DisplayQuantity); err != nil {
+			return fmt.Errorf("display quantity: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// newMarketRules builds a token's rules from its tokens row
+func newMarketRules(tickSize *decimal.Decimal, lotSize int64) marketRules {
+	if lotSize <= 0 {
+		lotSize = 1
+	}
+	return marketRules{tickSize: tickSize, lotSize: lotSize}
+}
+
+// GetMarketInfo returns the trading rules of a token, so clients can round
+// prices and quantities before placing orders. A token whose book has not
+// been loaded is read from the database without giving it a book.
+func (s *Service) GetMarketInfo(tokenID string) (*models.MarketInfo, error) {
+	var info *models.MarketInfo
+	s.engine.View(tokenID, func(book *Book) {
+		if book.status != "" {
+			info = s.marketInfo(book)
+		}
+	})
+	if info != nil {
+		return info, nil
+	}
+
+	book := newBook(tokenID)
+	if err := s.loadToken(book); err != nil {
+		return nil, err
+	}
+	return s.marketInfo(book), nil
+}
+
+// marketInfo describes a book's trading rules. Callers must hold book.mu.
+func (s *Service) marketInfo(book *Book) *models.MarketInfo {
+	info := &models.MarketInfo{
+		TokenID:   book.tokenID,
+		Status:    book.status,
+		TickSizes: book.rules.tickTiers(),
+		LotSize:   book.rules.lotSize,
+		Phase:     PhaseContinuous,
+	}
+	if book.auction != nil {
+		info.Phase = PhaseAuction
+	}
+	if book.halt != nil {
+		info.Phase = PhaseHalted
+	}
+	if lower, upper, ok := s.priceBand(book, time.Now()); ok {
+		info.PriceBand = &models.PriceBand{Lower: lower, Upper: upper}
+	}
+
+	return info
+}
+
+// UpdateMarketRules sets a token's tick size and lot size. A nil tick size
+// returns the token to DefaultTickSizes. Orders already resting keep their
+// price and quantity.
+func (s *Service) UpdateMarketRules(tokenID string, tickSize *decimal.Decimal, lotSize int64) (*models.MarketInfo, error) {
+	if tickSize != nil && !tickSize.IsPositive() {
+		return nil, fmt.Errorf("%w: tick size must be positive", ErrInvalidMarketRules)
+	}
+	if lotSize <= 0 {
+		return nil, fmt.Errorf("%w: lot size must be positive", ErrInvalidMarketRules)
+	}
+
+	if err := s.setMarketRules(tokenID, tickSize, lotSize); err != nil {
+		return nil, err
+	}
+
+	return s.GetMarketInfo(tokenID)
+}
+
+// setMarketRules saves a token's rules and applies them to its book
+func (s *Service) setMarketRules(tokenID string, tickSize *decimal.Decimal, lotSize int64) error {
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	var status string
+	err := s.db.QueryRow(`UPDATE tokens SET tick_size = $2, lot_size = $3 WHERE id = $1 RETURNING status`, tokenID, tickSize, lotSize).
+		Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update market rules: %w", err)
+	}
+
+	book.status = status
+	book.rules = newMarketRules(tickSize, lotSize)
+	return nil
+}
@@ -2,140 +2,509 @@ package orderbook
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/config"
 	"github.com/peoplecoin/backend/internal/database"
+	"github.com/peoplecoin/backend/internal/decimal"
 	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/fees"
 )
 
+// Each fill charges the incoming order the taker rate and the resting order
+// the maker rate. These built-in rates apply when no fee schedule is in
+// effect.
+var (
+	TakerFeeRate = decimal.New(5, 3) // 0.5%
+	MakerFeeRate = decimal.New(3, 3) // 0.3%
+)
+
+// ErrPostOnlyWouldCross is returned when a post-only order set to reject
+// would match on arrival
+var ErrPostOnlyWouldCross = errors.New("post-only order would match immediately")
+
+// ErrDuplicateClientOrderID is returned when a user reuses a client order ID
+var ErrDuplicateClientOrderID = errors.New("duplicate client order ID")
+
+// MaxClientOrderIDLength is the longest client order ID accepted
+const MaxClientOrderIDLength = 64
+
+// clientOrderIDIndex is the unique index on (user_id, client_order_id)
+const clientOrderIDIndex = "idx_orders_user_client_order_id"
+
+// Post-only modes: what happens to a post-only order that would match
 const (
-	TakerFeeRate = 0.005 // 0.5%
-	MakerFeeRate = 0.003 // 0.3%
+	PostOnlyReject  = "reject"  // reject the order
+	PostOnlyReprice = "reprice" // rest it one tick away from the best opposite price
 )
 
-type Service struct {
-	db    *database.DB
-	redis *cache.RedisClient
-}
+// Fees are rounded up to the smallest unit so the platform never collects
+// less than the quoted rate; average prices are rounded half-even.
+const (
+	feeRounding          = decimal.RoundUp
+	averagePriceRounding = decimal.RoundHalfEven
+)
 
-func NewService(db *database.DB, redis *cache.RedisClient) *Service {
-	return &Service{
-		db:    db,
-		redis: redis,
+// Cancel reasons recorded in orders.cancel_reason
+const (
+	CancelReasonUser         = "user_cancelled"
+	CancelReasonIOCRemainder = "ioc_remainder"
+	CancelReasonFOKUnfilled  = "fok_unfilled"
+	CancelReasonNoLiquidity  = "insufficient_liquidity"
+	CancelReasonProtection   = "price_protection"
+	CancelReasonSelfTrade    = "self_trade_prevented"
+	CancelReasonNoFunds      = "insufficient_funds"
+	CancelReasonExpired      = "expired"
+	CancelReasonSuspended    = "token_suspended"
+)
+
+// liveStatuses are the statuses of orders resting on the book, for use in
+// SQL status lists
+const liveStatuses = `'open', 'partially_filled', 'triggered'`
+
+// Self-trade prevention modes, applied when an incoming order would match a
+// resting order of the same user
+const (
+	STPCancelNewest       = "cancel_newest"        // cancel the incoming order
+	STPCancelOldest       = "cancel_oldest"        // cancel the resting order
+	STPCancelBoth         = "cancel_both"          // cancel both orders
+	STPDecrementAndCancel = "decrement_and_cancel" // decrement the larger order by the smaller, cancel the smaller
+)
+
+// ValidSTPMode reports whether mode is one of the self-trade prevention modes
+func ValidSTPMode(mode string) bool {
+	switch mode {
+	case STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrementAndCancel:
+		return true
 	}
+	return false
 }
 
-// GetOrderBook returns the current order book for a token
-func (s *Service) GetOrderBook(tokenID string, depth int) (*models.OrderBook, error) {
-	if depth <= 0 {
-		depth = 20
-	}
+// FeeSchedules resolves the fee rates that apply to a user's orders on a
+// token, returning nil if no schedule is in effect
+type FeeSchedules interface {
+	RatesFor(userID, tokenID string) (*fees.Rates, error)
+}
 
-	// Try cache first
-	cacheKey := cache.OrderBookKey(tokenID)
-	var orderBook models.OrderBook
+type Service struct {
+	db                  *database.DB
+	redis               *cache.RedisClient
+	engine              *Engine
+	feeSchedules        FeeSchedules
+	creatorRestrictions CreatorRestrictions
+	listener            Listener
+
+	defaultSTPMode           string
+	maxBatchOrders           int
+	openingAuctionDuration   time.Duration
+	reopeningAuctionDuration time.Duration
+
+	// Price bands and the circuit breaker; zero fractions disable them
+	priceBandPercent decimal.Decimal // fraction of the reference price limit orders may stray
+	breakerPercent   decimal.Decimal // fraction the price may move within breakerWindow
+	breakerWindow    time.Duration
+	haltCooldown     time.Duration
+}
 
-	err := s.redis.GetJSON(cacheKey, &orderBook)
-	if err == nil {
-		return &orderBook, nil
+// NewService creates the order book service. Orders are charged the
+// built-in fee rates if feeSchedules is nil, and creators trade freely if
+// creatorRestrictions is nil.
+func NewService(db *database.DB, redis *cache.RedisClient, cfg *config.Config, feeSchedules FeeSchedules, creatorRestrictions CreatorRestrictions) *Service {
+	return &Service{
+		db:                       db,
+		redis:                    redis,
+		engine:                   NewEngine(),
+		feeSchedules:             feeSchedules,
+		creatorRestrictions:      creatorRestrictions,
+		defaultSTPMode:           cfg.Trading.DefaultSTPMode,
+		maxBatchOrders:           cfg.Trading.MaxBatchOrders,
+		openingAuctionDuration:   time.Duration(cfg.Trading.OpeningAuctionDuration) * time.Second,
+		reopeningAuctionDuration: time.Duration(cfg.Trading.ReopeningAuctionDuration) * time.Second,
+		priceBandPercent:         decimal.New(int64(cfg.Trading.PriceBandPercent), 2),
+		breakerPercent:           decimal.New(int64(cfg.Trading.CircuitBreakerPercent), 2),
+		breakerWindow:            time.Duration(cfg.Trading.CircuitBreakerWindow) * time.Second,
+		haltCooldown:             time.Duration(cfg.Trading.HaltCooldown) * time.Second,
 	}
+}
 
-	// Build order book from database
-	orderBook = models.OrderBook{
-		TokenID:   tokenID,
-		Bids:      []models.OrderBookLevel{},
-		Asks:      []models.OrderBookLevel{},
-		UpdatedAt: time.Now(),
+// orderColumns is the column list scanned by scanOrder
+const orderColumns = `
+	id, user_id, token_id, order_type, side, price, quantity,
+	filled_quantity, remaining_quantity, execution_type, time_in_force,
+	status, cancel_reason, fee_rate, maker_fee_rate, fee_schedule_id,
+	fee_paid, locked_amount, stp_mode, stop_price, triggered_at,
+	trail_amount, trail_percent, trail_mark, display_quantity, post_only,
+	expires_at, requeued_at, client_order_id, created_at, updated_at
+`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (*models.Order, error) {
+	var order models.Order
+	err := row.Scan(
+		&order.ID, &order.UserID, &order.TokenID, &order.OrderType, &order.Side,
+		&order.Price, &order.Quantity, &order.FilledQuantity, &order.RemainingQuantity,
+		&order.ExecutionType, &order.TimeInForce, &order.Status, &order.CancelReason,
+		&order.FeeRate, &order.MakerFeeRate, &order.FeeScheduleID, &order.FeePaid,
+		&order.LockedAmount, &order.STPMode, &order.StopPrice, &order.TriggeredAt, &order.TrailAmount, &order.TrailPercent,
+		&order.TrailMark, &order.DisplayQuantity, &order.PostOnly, &order.ExpiresAt,
+		&order.RequeuedAt, &order.ClientOrderID, &order.CreatedAt, &order.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
 	}
+	return &order, nil
+}
 
-	// Get bids (buy orders) - grouped by price, descending
-	bidsQuery := `
-		SELECT price, SUM(remaining_quantity) as total_quantity, COUNT(*) as order_count
+// LoadOrderBooks rebuilds the in-memory order books from the resting and
+// dormant stop orders journaled in the database. It must run once on startup
+// before any orders are accepted.
+func (s *Service) LoadOrderBooks() error {
+	query := `
+		SELECT ` + orderColumns + `
 		FROM orders
-		WHERE token_id = $1 AND side = 'bid' AND status = 'open'
-		GROUP BY price
-		ORDER BY price DESC
-		LIMIT $2
+		WHERE status IN (` + liveStatuses + `, 'pending_trigger')
+		ORDER BY COALESCE(requeued_at, triggered_at, created_at) ASC
 	`
 
-	rows, err := s.db.Query(bidsQuery, tokenID, depth)
+	rows, err := s.db.Query(query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch bids: %w", err)
+		return fmt.Errorf("failed to load resting orders: %w", err)
 	}
 	defer rows.Close()
 
+	count := 0
 	for rows.Next() {
-		var level models.OrderBookLevel
-		if err := rows.Scan(&level.Price, &level.Quantity, &level.Orders); err != nil {
-			continue
+		order, err := scanOrder(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan resting order: %w", err)
+		}
+
+		book := s.engine.Book(order.TokenID)
+		book.mu.Lock()
+		if order.Status == "pending_trigger" {
+			book.addStop(order)
+		} else {
+			book.add(order)
 		}
-		orderBook.Bids = append(orderBook.Bids, level)
+		book.mu.Unlock()
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load resting orders: %w", err)
 	}
 
-	// Get asks (sell orders) - grouped by price, ascending
-	asksQuery := `
-		SELECT price, SUM(remaining_quantity) as total_quantity, COUNT(*) as order_count
-		FROM orders
-		WHERE token_id = $1 AND side = 'ask' AND status = 'open'
-		GROUP BY price
-		ORDER BY price ASC
-		LIMIT $2
+	// Restore the last trade price of every token
+	lastPriceQuery := `
+		SELECT DISTINCT ON (token_id) token_id, price
+		FROM trades
+		ORDER BY token_id, executed_at DESC
 	`
 
-	rows, err = s.db.Query(asksQuery, tokenID, depth)
+	priceRows, err := s.db.Query(lastPriceQuery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch asks: %w", err)
+		return fmt.Errorf("failed to load last prices: %w", err)
 	}
-	defer rows.Close()
+	defer priceRows.Close()
 
-	for rows.Next() {
-		var level models.OrderBookLevel
-		if err := rows.Scan(&level.Price, &level.Quantity, &level.Orders); err != nil {
-			continue
+	for priceRows.Next() {
+		var tokenID string
+		var price decimal.Decimal
+		if err := priceRows.Scan(&tokenID, &price); err != nil {
+			return fmt.Errorf("failed to scan last price: %w", err)
 		}
-		orderBook.Asks = append(orderBook.Asks, level)
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.lastPrice = price
+		book.mu.Unlock()
 	}
 
-	// Calculate spread
-	if len(orderBook.Bids) > 0 && len(orderBook.Asks) > 0 {
-		orderBook.Spread = orderBook.Asks[0].Price - orderBook.Bids[0].Price
+	if err := priceRows.Err(); err != nil {
+		return fmt.Errorf("failed to load last prices: %w", err)
 	}
 
-	// Get last trade price
-	lastPriceQuery := `
-		SELECT price FROM trades
-		WHERE token_id = $1
-		ORDER BY executed_at DESC
-		LIMIT 1
+	// Books in a call auction stay in it until it is uncrossed
+	auctionRows, err := s.db.Query(`SELECT id, token_id, reason, ends_at FROM auctions WHERE status = 'running'`)
+	if err != nil {
+		return fmt.Errorf("failed to load auctions: %w", err)
+	}
+	defer auctionRows.Close()
+
+	for auctionRows.Next() {
+		var tokenID string
+		var auction auctionState
+		if err := auctionRows.Scan(&auction.id, &tokenID, &auction.reason, &auction.endsAt); err != nil {
+			return fmt.Errorf("failed to scan auction: %w", err)
+		}
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.auction = &auction
+		book.mu.Unlock()
+	}
+
+	if err := auctionRows.Err(); err != nil {
+		return fmt.Errorf("failed to load auctions: %w", err)
+	}
+
+	// Halted books stay halted until they resume
+	haltQuery := `
+		SELECT id, token_id, reason, COALESCE(message, ''), halted_at, resumes_at
+		FROM trading_halts
+		WHERE resumed_at IS NULL
 	`
 
-	_ = s.db.QueryRow(lastPriceQuery, tokenID).Scan(&orderBook.LastPrice)
+	haltRows, err := s.db.Query(haltQuery)
+	if err != nil {
+		return fmt.Errorf("failed to load trading halts: %w", err)
+	}
+	defer haltRows.Close()
+
+	for haltRows.Next() {
+		var tokenID string
+		var halt haltState
+		if err := haltRows.Scan(&halt.id, &tokenID, &halt.reason, &halt.message, &halt.haltedAt, &halt.resumesAt); err != nil {
+			return fmt.Errorf("failed to scan trading halt: %w", err)
+		}
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.halt = &halt
+		book.mu.Unlock()
+	}
+	if err := haltRows.Err(); err != nil {
+		return fmt.Errorf("failed to load trading halts: %w", err)
+	}
+
+	// Every token's status and market rules; tokens listed later are loaded
+	// when first traded
+	tokenRows, err := s.db.Query(`SELECT id, status, tick_size, lot_size FROM tokens`)
+	if err != nil {
+		return fmt.Errorf("failed to load tokens: %w", err)
+	}
+	defer tokenRows.Close()
+
+	for tokenRows.Next() {
+		var tokenID, status string
+		var tickSize *decimal.Decimal
+		var lotSize int64
+		if err := tokenRows.Scan(&tokenID, &status, &tickSize, &lotSize); err != nil {
+			return fmt.Errorf("failed to scan token: %w", err)
+		}
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.status = status
+		book.rules = newMarketRules(tickSize, lotSize)
+		book.mu.Unlock()
+	}
+	if err := tokenRows.Err(); err != nil {
+		return fmt.Errorf("failed to load tokens: %w", err)
+	}
+
+	// Recent trades set the reference price for price bands and the circuit
+	// breaker
+	now := time.Now()
+	printRows, err := s.db.Query(`
+		SELECT token_id, price, quantity, executed_at
+		FROM trades
+		WHERE executed_at > $1
+		ORDER BY executed_at ASC
+	`, now.Add(-s.breakerWindow))
+	if err != nil {
+		return fmt.Errorf("failed to load recent trades: %w", err)
+	}
+	defer printRows.Close()
+
+	for printRows.Next() {
+		var tokenID string
+		var trade models.Trade
+		if err := printRows.Scan(&tokenID, &trade.Price, &trade.Quantity, &trade.ExecutedAt); err != nil {
+			return fmt.Errorf("failed to scan recent trade: %w", err)
+		}
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.recordPrints([]*models.Trade{&trade}, now, s.breakerWindow)
+		book.mu.Unlock()
+	}
+	if err := printRows.Err(); err != nil {
+		return fmt.Errorf("failed to load recent trades: %w", err)
+	}
+
+	// Book sequences carry on from the journal, which numbers every change at
+	// least once, so they keep increasing across restarts
+	sequenceRows, err := s.db.Query(`SELECT token_id, MAX(sequence) FROM order_events GROUP BY token_id`)
+	if err != nil {
+		return fmt.Errorf("failed to load journal sequences: %w", err)
+	}
+	defer sequenceRows.Close()
+
+	for sequenceRows.Next() {
+		var tokenID string
+		var sequence int64
+		if err := sequenceRows.Scan(&tokenID, &sequence); err != nil {
+			return fmt.Errorf("failed to scan journal sequence: %w", err)
+		}
+
+		book := s.engine.Book(tokenID)
+		book.mu.Lock()
+		book.sequence = sequence
+		book.mu.Unlock()
+	}
+	if err := sequenceRows.Err(); err != nil {
+		return fmt.Errorf("failed to load journal sequences: %w", err)
+	}
+
+	// The restored levels are the starting point, not changes to publish
+	for _, book := range s.engine.Books() {
+		book.mu.Lock()
+		book.flushChanges()
+		book.mu.Unlock()
+	}
+
+	log.Printf("✅ Order books restored (%d resting and stop orders)", count)
+
+	return nil
+}
+
+// GetOrderBook returns the current order book for a token
+func (s *Service) GetOrderBook(tokenID string, depth int) (*models.OrderBook, error) {
+	if depth <= 0 {
+		depth = 20
+	}
+
+	// Try cache first
+	cacheKey := cache.OrderBookKey(tokenID)
+	var orderBook models.OrderBook
+
+	err := s.redis.GetJSON(cacheKey, &orderBook)
+	if err == nil {
+		return &orderBook, nil
+	}
+
+	// Build order book from the matching engine
+	var live *models.OrderBook
+	s.engine.View(tokenID, func(book *Book) {
+		live = s.orderBook(book, depth)
+	})
 
 	// Cache order book
-	_ = s.redis.SetJSON(cacheKey, orderBook, cache.OrderBookTTL)
+	_ = s.redis.SetJSON(cacheKey, live, cache.OrderBookTTL)
+
+	return live, nil
+}
 
-	return &orderBook, nil
+// GetOrderBookSnapshot returns a token's whole order book straight from the
+// matching engine, numbered with the sequence of its last change so clients
+// can apply the deltas that follow
+func (s *Service) GetOrderBookSnapshot(tokenID string) *models.OrderBook {
+	var snapshot *models.OrderBook
+	s.engine.View(tokenID, func(book *Book) {
+		snapshot = s.orderBook(book, 0)
+	})
+	return snapshot
+}
+
+// orderBook builds a book's published view, the whole book if depth is not
+// positive. Callers must hold book.mu.
+func (s *Service) orderBook(book *Book, depth int) *models.OrderBook {
+	if depth <= 0 {
+		depth = book.depth()
+	}
+	bids, asks := book.snapshot(depth)
+	top, bottom := book.snapshot(ChecksumDepth)
+	now := time.Now()
+
+	orderBook := &models.OrderBook{
+		TokenID:   book.tokenID,
+		Bids:      bids,
+		Asks:      asks,
+		LastPrice: book.lastPrice,
+		Phase:     PhaseContinuous,
+		Auction:   book.auctionInfo(now),
+		Halt:      book.haltInfo(),
+		Sequence:  book.sequence,
+		Checksum:  Checksum(top, bottom),
+		UpdatedAt: now,
+	}
+	if orderBook.Auction != nil {
+		orderBook.Phase = PhaseAuction
+	}
+	if orderBook.Halt != nil {
+		orderBook.Phase = PhaseHalted
+	}
+
+	// Calculate spread
+	if len(orderBook.Bids) > 0 && len(orderBook.Asks) > 0 {
+		orderBook.Spread = orderBook.Asks[0].Price.Sub(orderBook.Bids[0].Price)
+	}
+
+	return orderBook
 }
 
 // CreateOrder creates a new order and attempts to match it
 func (s *Service) CreateOrder(order *models.Order) (*models.Order, []*models.Trade, error) {
+	if err := s.prepareOrder(order); err != nil {
+		return nil, nil, err
+	}
+
+	// Matching for a token is serialized on its book
+	book := s.engine.Book(order.TokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	return s.placeOrder(book, order)
+}
+
+// prepareOrder validates a new order, checks its user may trade the token
+// and resolves its fee rates. It does not touch the book.
+func (s *Service) prepareOrder(order *models.Order) error {
+	if order.STPMode == "" {
+		order.STPMode = s.defaultSTPMode
+	}
+
 	// Validate order
 	if err := s.validateOrder(order); err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	// Start transaction
-	tx, err := s.db.Begin()
+	if err := s.checkCreatorRestrictions(order.UserID, order.TokenID); err != nil {
+		return err
+	}
+
+	// Rates are fixed when the order is placed; later schedule changes do
+	// not reprice it
+	return s.resolveFees(order)
+}
+
+// placeOrder accepts a prepared order onto its book and matches it. Orders
+// the book refuses are journaled as rejected. Callers must hold book.mu.
+func (s *Service) placeOrder(book *Book, order *models.Order) (*models.Order, []*models.Trade, error) {
+	placed, trades, err := s.acceptOrder(book, order)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to start transaction: %w", err)
+		s.logRejection(order, err)
+		return nil, nil, err
 	}
-	defer tx.Rollback()
 
+	return placed, trades, nil
+}
+
+// acceptOrder checks a prepared order against its book and executes it
+func (s *Service) acceptOrder(book *Book, order *models.Order) (*models.Order, []*models.Trade, error) {
 	// Set default values
+	if order.TimeInForce == "" {
+		order.TimeInForce = "GTC"
+	}
 	order.ID = uuid.New().String()
 	order.RemainingQuantity = order.Quantity
 	order.FilledQuantity = 0
@@ -143,344 +512,772 @@ func (s *Service) CreateOrder(order *models.Order) (*models.Order, []*models.Tra
 	order.CreatedAt = time.Now()
 	order.UpdatedAt = time.Now()
 
-	// Determine fee rate (taker for market orders, maker for limit orders)
-	if order.ExecutionType == "market" {
-		order.FeeRate = TakerFeeRate
-	} else {
-		order.FeeRate = MakerFeeRate
+	if err := s.checkTradable(book); err != nil {
+		return nil, nil, err
+	}
+	if book.halt != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTradingHalted, book.halt.message)
 	}
 
-	// Try to match order
-	trades, err := s.matchOrder(tx, order)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to match order: %w", err)
-	}
-
-	// Insert order into database if not fully filled
-	if order.RemainingQuantity > 0 {
-		insertQuery := `
-			INSERT INTO orders (
-				id, user_id, token_id, order_type, side, price, quantity,
-				filled_quantity, remaining_quantity, execution_type, time_in_force,
-				status, fee_rate, fee_paid, created_at, updated_at
-			)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-		`
+	// Prices must be on a tick and quantities whole lots
+	if err := book.rules.checkOrder(order); err != nil {
+		return nil, nil, err
+	}
 
-		_, err = tx.Exec(insertQuery,
-			order.ID, order.UserID, order.TokenID, order.OrderType, order.Side,
-			order.Price, order.Quantity, order.FilledQuantity, order.RemainingQuantity,
-			order.ExecutionType, order.TimeInForce, order.Status, order.FeeRate,
-			order.FeePaid, order.CreatedAt, order.UpdatedAt,
-		)
+	// Limit prices must lie within the band around the reference price
+	if liveExecutionType(order.ExecutionType) == "limit" {
+		if err := s.checkPriceBand(book, order.Price); err != nil {
+			return nil, nil, err
+		}
+	}
 
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to insert order: %w", err)
+	// Trailing stops start trailing from the last trade price, or from the
+	// first trade if there has been none
+	if order.ExecutionType == "trailing_stop" && book.lastPrice.IsPositive() {
+		if order.Side == "ask" && order.TrailAmount != nil && !order.TrailAmount.LessThan(book.lastPrice) {
+			return nil, nil, fmt.Errorf("%w: trail amount %s, last trade %s", ErrTrailTooWide, *order.TrailAmount, book.lastPrice)
 		}
+		mark, stopPrice := book.lastPrice, trailingStopPrice(order, book.lastPrice)
+		order.TrailMark = &mark
+		order.StopPrice = &stopPrice
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	// Stop orders stay dormant until the last trade price reaches the stop,
+	// and through a call auction, which sets no price until it ends
+	if isStop(order) {
+		if book.auction != nil || !stopTriggered(order, book.lastPrice) {
+			if err := s.placeStop(book, order); err != nil {
+				return nil, nil, err
+			}
+			return order, []*models.Trade{}, nil
+		}
+		activateStop(order)
 	}
 
-	// Invalidate order book cache
-	_ = s.redis.Delete(cache.OrderBookKey(order.TokenID))
+	// Orders in a call auction must be able to rest until the uncross
+	if book.auction != nil && (isMarket(order) || order.TimeInForce == "IOC" || order.TimeInForce == "FOK") {
+		return nil, nil, ErrNotAllowedInAuction
+	}
+
+	// Post-only orders must rest without taking liquidity
+	if order.PostOnly {
+		if err := s.applyPostOnly(book, order); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	trades, err := s.execute(book, order, OrderEventAccepted, insertOrder, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Trades move the last price, which may set off stop orders
+	if len(trades) > 0 {
+		s.evaluateTriggers(book)
+	}
 
 	return order, trades, nil
 }
 
-// matchOrder implements the order matching engine
-func (s *Service) matchOrder(tx *sql.Tx, newOrder *models.Order) ([]*models.Trade, error) {
-	trades := []*models.Trade{}
+// resolveFees sets the rates an order is charged from the fee schedule in
+// effect for its user and token. Fees are charged per fill by liquidity role,
+// so the order's fee rate is the taker rate unless it can only ever make
+// liquidity.
+func (s *Service) resolveFees(order *models.Order) error {
+	order.FeeRate = TakerFeeRate
+	order.MakerFeeRate = MakerFeeRate
+	order.FeeScheduleID = nil
+
+	if s.feeSchedules != nil {
+		rates, err := s.feeSchedules.RatesFor(order.UserID, order.TokenID)
+		if err != nil {
+			return err
+		}
+		if rates != nil {
+			scheduleID := rates.ScheduleID
+			order.FeeRate = rates.Taker
+			order.MakerFeeRate = rates.Maker
+			order.FeeScheduleID = &scheduleID
+		}
+	}
 
-	// Determine opposite side
-	oppositeSide := "ask"
-	if newOrder.Side == "ask" {
-		oppositeSide = "bid"
+	if order.PostOnly {
+		order.FeeRate = order.MakerFeeRate
 	}
 
-	// Get matching orders from database
-	var matchQuery string
-	if newOrder.Side == "bid" {
-		// For buy orders, get sell orders with price <= our price
-		matchQuery = `
-			SELECT id, user_id, price, remaining_quantity, fee_rate
-			FROM orders
-			WHERE token_id = $1 AND side = $2 AND status = 'open'
-			  AND price <= $3
-			ORDER BY price ASC, created_at ASC
-		`
-	} else {
-		// For sell orders, get buy orders with price >= our price
-		matchQuery = `
-			SELECT id, user_id, price, remaining_quantity, fee_rate
-			FROM orders
-			WHERE token_id = $1 AND side = $2 AND status = 'open'
-			  AND price >= $3
-			ORDER BY price DESC, created_at ASC
-		`
+	return nil
+}
+
+// execute matches a live order against the book, journals the outcome with
+// journalOrder, starting its order events with an event of type opening, and
+// applies it to the book once committed. Any funds the order already holds
+// locked count towards its reservation. replaced is the book entry of an
+// amended order, taken off the book with the rest of the change, or nil.
+func (s *Service) execute(book *Book, order *models.Order, opening string, journalOrder func(*sql.Tx, *models.Order) error, replaced *bookOrder) ([]*models.Trade, error) {
+	alreadyLocked := order.LockedAmount
+
+	// Market orders sweep up to a protection price derived from the best
+	// opposite price when only a slippage tolerance is given
+	if isMarket(order) && order.ProtectionPrice == nil && order.MaxSlippageBps != nil {
+		if levels := book.opposite(order.Side); len(levels) > 0 {
+			protection := protectionPrice(order.Side, levels[0].price, *order.MaxSlippageBps)
+			order.ProtectionPrice = &protection
+		}
+	}
+
+	// Nor do they sweep beyond the price band
+	if isMarket(order) {
+		s.bandProtection(book, order)
+	}
+
+	// Try to match order
+	plan := book.match(order)
+	fills := plan.fills
+
+	// Fill-or-kill orders are killed outright unless fully matchable
+	if order.TimeInForce == "FOK" && (plan.cancelSelf || filledQuantity(fills) < order.Quantity-plan.decrement) {
+		cancelOrder(order, CancelReasonFOKUnfilled)
+		if err := s.journalRejection(order, CancelReasonFOKUnfilled); err != nil {
+			return nil, err
+		}
+		return []*models.Trade{}, nil
 	}
 
-	rows, err := tx.Query(matchQuery, newOrder.TokenID, oppositeSide, newOrder.Price)
+	// Decrement-and-cancel shrinks the incoming order by the self-matched size
+	order.Quantity -= plan.decrement
+	order.RemainingQuantity -= plan.decrement
+
+	var events orderEvents
+	events.order(opening, order)
+
+	trades := s.buildTrades(order, fills)
+
+	if plan.cancelSelf {
+		cancelOrder(order, CancelReasonSelfTrade)
+	}
+
+	// Market and immediate-or-cancel orders never rest on the book
+	if order.RemainingQuantity > 0 && order.Status != "cancelled" {
+		if isMarket(order) {
+			reason := CancelReasonNoLiquidity
+			if order.ProtectionPrice != nil && book.liquidity(oppositeSide(order.Side)) > order.FilledQuantity {
+				reason = CancelReasonProtection
+			}
+			cancelOrder(order, reason)
+		} else if order.TimeInForce == "IOC" {
+			cancelOrder(order, CancelReasonIOCRemainder)
+		}
+	}
+
+	// Reserve the order's funds; trades release them as they settle and
+	// whatever a finished order has left is returned
+	reserved, settlements := planSettlements(order, fills, trades)
+	order.LockedAmount = reserved
+	for _, st := range settlements {
+		order.LockedAmount = order.LockedAmount.Sub(st.incomingRelease)
+	}
+	unused := decimal.Zero
+	if order.Status == "filled" || order.Status == "cancelled" {
+		unused, order.LockedAmount = order.LockedAmount, decimal.Zero
+	}
+	if excess := alreadyLocked.Sub(reserved); excess.IsPositive() {
+		unused = unused.Add(excess)
+	}
+
+	for _, p := range plan.prevented {
+		if p.cancels() {
+			events.cancelled(p.resting.order, CancelReasonSelfTrade)
+		} else {
+			events.reduced(p.resting.order, p.quantity)
+		}
+	}
+	for _, bo := range plan.expired {
+		events.cancelled(bo.order, CancelReasonExpired)
+	}
+	events.fills(order, fills, trades)
+	if order.Status == "cancelled" {
+		events.cancelled(order, *order.CancelReason)
+	}
+
+	// Journal the result before touching the in-memory book
+	tx, err := s.beginTokenTx(order.TokenID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	for rows.Next() && newOrder.RemainingQuantity > 0 {
-		var matchingOrder struct {
-			ID                string
-			UserID            string
-			Price             float64
-			RemainingQuantity int64
-			FeeRate           float64
+	if toReserve := reserved.Sub(alreadyLocked); toReserve.IsPositive() {
+		if err := reserveFunds(tx, order.UserID, balanceCurrency(order), toReserve); err != nil {
+			return nil, err
 		}
+	}
 
-		if err := rows.Scan(
-			&matchingOrder.ID,
-			&matchingOrder.UserID,
-			&matchingOrder.Price,
-			&matchingOrder.RemainingQuantity,
-			&matchingOrder.FeeRate,
-		); err != nil {
-			continue
+	if err := journalOrder(tx, order); err != nil {
+		return nil, err
+	}
+
+	if err := journalFills(tx, order.Side, fills, trades, settlements); err != nil {
+		return nil, err
+	}
+
+	if err := journalPreventions(tx, plan.prevented); err != nil {
+		return nil, err
+	}
+
+	if err := journalExpiries(tx, plan.expired); err != nil {
+		return nil, err
+	}
+
+	if unused.IsPositive() {
+		if err := releaseFunds(tx, order.UserID, balanceCurrency(order), unused); err != nil {
+			return nil, err
 		}
+	}
 
-		// Determine match quantity
-		matchQuantity := newOrder.RemainingQuantity
-		if matchQuantity > matchingOrder.RemainingQuantity {
-			matchQuantity = matchingOrder.RemainingQuantity
+	if err := events.write(tx, order.TokenID); err != nil {
+		return nil, err
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Apply the committed match to the book
+	for i, f := range fills {
+		f.resting.order.LockedAmount = f.resting.order.LockedAmount.Sub(settlements[i].restingRelease)
+		f.resting.order.FeePaid = f.resting.order.FeePaid.Add(feeFor(f.resting.order.Side, trades[i]))
+		book.fill(f.resting, f.quantity)
+	}
+	for _, p := range plan.prevented {
+		if p.cancels() {
+			cancelOrder(p.resting.order, CancelReasonSelfTrade)
+			book.remove(p.resting.order.ID)
+			continue
 		}
+		p.resting.order.LockedAmount = p.resting.order.LockedAmount.Sub(preventionRelease(p))
+		book.reduce(p.resting, p.quantity)
+	}
+	for _, bo := range plan.expired {
+		expireOrder(bo.order)
+		book.remove(bo.order.ID)
+	}
+	if len(trades) > 0 {
+		book.lastPrice = trades[len(trades)-1].Price
+	}
+	if replaced != nil {
+		book.removeEntry(replaced)
+	}
+	if order.RemainingQuantity > 0 && order.Status != "cancelled" {
+		resting := *order
+		book.add(&resting)
+	}
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(order.TokenID))
+
+	// A price that moved too far too fast halts the book
+	if len(trades) > 0 {
+		s.checkCircuitBreaker(book, trades)
+	}
+
+	s.announce(book, events)
+
+	return trades, nil
+}
+
+// applyPostOnly keeps a post-only order from matching on arrival: it is
+// rejected, or repriced one tick inside the best opposite price. The new
+// price must be on a tick and within the price band like the one submitted.
+// Orders that would not match, and orders placed during a call auction, where
+// nothing matches on arrival, are left as they are. Callers must hold
+// book.mu.
+func (s *Service) applyPostOnly(book *Book, order *models.Order) error {
+	levels := book.opposite(order.Side)
+	if book.auction != nil || len(levels) == 0 || !crosses(order, levels[0].price) {
+		return nil
+	}
+
+	if order.PostOnlyMode != PostOnlyReprice {
+		return fmt.Errorf("%w: best %s is %s", ErrPostOnlyWouldCross, oppositeSide(order.Side), levels[0].price)
+	}
+
+	tick := book.rules.tickAt(levels[0].price)
+	price := levels[0].price.Add(tick)
+	if order.Side == "bid" {
+		price = levels[0].price.Sub(tick)
+	}
+	if !price.IsPositive() {
+		return fmt.Errorf("%w: no price one tick away from %s", ErrPostOnlyWouldCross, levels[0].price)
+	}
+	if _, ok := price.TryMulInt(order.Quantity); !ok {
+		return fmt.Errorf("order value is too large")
+	}
+	if err := book.rules.checkPrice(price); err != nil {
+		return fmt.Errorf("repriced post-only order: %w", err)
+	}
+	if err := s.checkPriceBand(book, price); err != nil {
+		return fmt.Errorf("repriced post-only order: %w", err)
+	}
+
+	order.Price = price
+	return nil
+}
+
+// protectionPrice is the worst price a market order may reach given a
+// slippage tolerance in basis points from the best opposite price. The
+// tolerance is rounded inward so it is never exceeded.
+func protectionPrice(side string, bestPrice decimal.Decimal, maxSlippageBps int) decimal.Decimal {
+	slippage := bestPrice.Mul(decimal.New(int64(maxSlippageBps), 4), decimal.RoundDown)
+	if side == "bid" {
+		return bestPrice.Add(slippage)
+	}
+	return bestPrice.Sub(slippage)
+}
+
+func oppositeSide(side string) string {
+	if side == "bid" {
+		return "ask"
+	}
+	return "bid"
+}
+
+// filledQuantity sums the quantity of a set of planned fills
+func filledQuantity(fills []fill) int64 {
+	total := int64(0)
+	for _, f := range fills {
+		total += f.quantity
+	}
+	return total
+}
+
+// cancelOrder marks an order as cancelled with a reason
+func cancelOrder(order *models.Order, reason string) {
+	order.Status = "cancelled"
+	order.CancelReason = &reason
+}
+
+// buildTrades turns planned fills into trades and updates the incoming
+// order's fill state. The book itself is left untouched.
+func (s *Service) buildTrades(newOrder *models.Order, fills []fill) []*models.Trade {
+	trades := make([]*models.Trade, 0, len(fills))
+	filledValue := decimal.Zero
+
+	for _, f := range fills {
+		matchingOrder := f.resting.order
 
 		// Execute trade at matching order's price
 		trade := &models.Trade{
-			ID:            uuid.New().String(),
-			TokenID:       newOrder.TokenID,
-			Price:         matchingOrder.Price,
-			Quantity:      matchQuantity,
-			TotalValue:    float64(matchQuantity) * matchingOrder.Price,
-			ExecutedAt:    time.Now(),
+			ID:               uuid.New().String(),
+			TokenID:          newOrder.TokenID,
+			Price:            f.price,
+			Quantity:         f.quantity,
+			TotalValue:       f.price.MulInt(f.quantity),
+			ExecutedAt:       time.Now(),
 			SettlementStatus: "pending",
 		}
 
-		// Assign buyer and seller
+		// Assign buyer and seller; the incoming order takes liquidity at its
+		// taker rate and the resting order makes it at its maker rate, each
+		// as resolved when the order was placed
+		takerFee := trade.TotalValue.Mul(newOrder.FeeRate, feeRounding)
+		makerFee := trade.TotalValue.Mul(matchingOrder.MakerFeeRate, feeRounding)
 		if newOrder.Side == "bid" {
 			trade.BuyerOrderID = newOrder.ID
 			trade.SellerOrderID = matchingOrder.ID
 			trade.BuyerID = newOrder.UserID
 			trade.SellerID = matchingOrder.UserID
-			trade.BuyerFee = trade.TotalValue * newOrder.FeeRate
-			trade.SellerFee = trade.TotalValue * matchingOrder.FeeRate
+			trade.BuyerFee = takerFee
+			trade.SellerFee = makerFee
+			trade.BuyerFeeScheduleID = newOrder.FeeScheduleID
+			trade.SellerFeeScheduleID = matchingOrder.FeeScheduleID
 		} else {
 			trade.BuyerOrderID = matchingOrder.ID
 			trade.SellerOrderID = newOrder.ID
 			trade.BuyerID = matchingOrder.UserID
 			trade.SellerID = newOrder.UserID
-			trade.BuyerFee = trade.TotalValue * matchingOrder.FeeRate
-			trade.SellerFee = trade.TotalValue * newOrder.FeeRate
+			trade.BuyerFee = makerFee
+			trade.SellerFee = takerFee
+			trade.BuyerFeeScheduleID = matchingOrder.FeeScheduleID
+			trade.SellerFeeScheduleID = newOrder.FeeScheduleID
 		}
 
-		trade.PlatformFee = trade.BuyerFee + trade.SellerFee
+		trade.PlatformFee = trade.BuyerFee.Add(trade.SellerFee)
 
-		// Insert trade
-		insertTradeQuery := `
-			INSERT INTO trades (
-				id, buyer_order_id, seller_order_id, buyer_id, seller_id, token_id,
-				price, quantity, total_value, buyer_fee, seller_fee, platform_fee,
-				settlement_status, executed_at
-			)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
-		`
+		// Update new order
+		filledValue = filledValue.Add(trade.TotalValue)
+		newOrder.FilledQuantity += f.quantity
+		newOrder.RemainingQuantity -= f.quantity
+		newOrder.FeePaid = newOrder.FeePaid.Add(feeFor(newOrder.Side, trade))
+
+		if newOrder.RemainingQuantity == 0 {
+			newOrder.Status = "filled"
+		} else if newOrder.FilledQuantity > 0 {
+			newOrder.Status = "partially_filled"
+		}
+
+		trades = append(trades, trade)
+	}
+
+	if matched := filledQuantity(fills); matched > 0 {
+		averagePrice := filledValue.DivInt(matched, averagePriceRounding)
+		newOrder.AveragePrice = &averagePrice
+	}
+
+	return trades
+}
+
+// feeFor returns the fee a trade charges one side: the buyer fee for bids,
+// the seller fee for asks
+func feeFor(side string, trade *models.Trade) decimal.Decimal {
+	if side == "bid" {
+		return trade.BuyerFee
+	}
+	return trade.SellerFee
+}
+
+// beginTokenTx starts a journal transaction holding the token's advisory
+// lock, so that writers in other processes are serialized with this one
+func (s *Service) beginTokenTx(tokenID string) (*sql.Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, tokenID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to lock token: %w", err)
+	}
+
+	return tx, nil
+}
 
-		_, err = tx.Exec(insertTradeQuery,
-			trade.ID, trade.BuyerOrderID, trade.SellerOrderID, trade.BuyerID,
-			trade.SellerID, trade.TokenID, trade.Price, trade.Quantity,
-			trade.TotalValue, trade.BuyerFee, trade.SellerFee, trade.PlatformFee,
-			trade.SettlementStatus, trade.ExecutedAt,
+// insertOrder journals a newly accepted order
+func insertOrder(tx *sql.Tx, order *models.Order) error {
+	insertQuery := `
+		INSERT INTO orders (
+			id, user_id, token_id, order_type, side, price, quantity,
+			filled_quantity, remaining_quantity, execution_type, time_in_force,
+			status, cancel_reason, fee_rate, maker_fee_rate, fee_schedule_id,
+			fee_paid, locked_amount, stp_mode, stop_price, triggered_at,
+			trail_amount, trail_percent, trail_mark, display_quantity, post_only,
+			expires_at, client_order_id, created_at, updated_at
 		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30)
+	`
 
-		if err != nil {
-			log.Printf("Failed to insert trade: %v", err)
-			continue
+	_, err := tx.Exec(insertQuery,
+		order.ID, order.UserID, order.TokenID, order.OrderType, order.Side,
+		order.Price, order.Quantity, order.FilledQuantity, order.RemainingQuantity,
+		order.ExecutionType, order.TimeInForce, order.Status, order.CancelReason,
+		order.FeeRate, order.MakerFeeRate, order.FeeScheduleID, order.FeePaid,
+		order.LockedAmount, order.STPMode, order.StopPrice, order.TriggeredAt,
+		order.TrailAmount, order.TrailPercent, order.TrailMark, order.DisplayQuantity,
+		order.PostOnly, order.ExpiresAt, order.ClientOrderID, order.CreatedAt, order.UpdatedAt,
+	)
+	if isUniqueViolation(err, clientOrderIDIndex) {
+		return fmt.Errorf("%w: %s", ErrDuplicateClientOrderID, *order.ClientOrderID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert order: %w", err)
+	}
+
+	return nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation of
+// the named index
+func isUniqueViolation(err error, index string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == index
+}
+
+// journalFills writes trades, the resulting resting order updates and the
+// balance settlement of each trade
+func journalFills(tx *sql.Tx, incomingSide string, fills []fill, trades []*models.Trade, settlements []settlement) error {
+	updateMatchingQuery := `
+		UPDATE orders
+		SET filled_quantity = filled_quantity + $1,
+		    remaining_quantity = $2,
+		    status = $3,
+		    fee_paid = fee_paid + $4,
+		    updated_at = $5,
+		    locked_amount = locked_amount - $8,
+		    requeued_at = COALESCE($9, requeued_at)
+		WHERE id = $6
+		  AND status IN (` + liveStatuses + `)
+		  AND remaining_quantity = $7
+	`
+
+	for i, f := range fills {
+		trade := trades[i]
+
+		if err := insertTrade(tx, trade); err != nil {
+			return err
 		}
 
 		// Update matching order
-		newMatchingRemaining := matchingOrder.RemainingQuantity - matchQuantity
+		newMatchingRemaining := f.resting.order.RemainingQuantity - f.quantity
 		newMatchingStatus := "partially_filled"
 		if newMatchingRemaining == 0 {
 			newMatchingStatus = "filled"
 		}
 
-		updateMatchingQuery := `
-			UPDATE orders
-			SET filled_quantity = filled_quantity + $1,
-			    remaining_quantity = $2,
-			    status = $3,
-			    fee_paid = fee_paid + $4,
-			    updated_at = $5
-			WHERE id = $6
-		`
+		// An iceberg showing a fresh slice goes to the back of its level,
+		// which restoring the book has to reproduce
+		now := time.Now()
+		var requeuedAt *time.Time
+		if f.replenishes() {
+			requeuedAt = &now
+		}
 
-		_, err = tx.Exec(updateMatchingQuery,
-			matchQuantity,
+		// The remaining quantity guard aborts the match if the resting order
+		// was changed by anyone other than this book
+		result, err := tx.Exec(updateMatchingQuery,
+			f.quantity,
 			newMatchingRemaining,
 			newMatchingStatus,
-			trade.SellerFee, // Fee for matching order
-			time.Now(),
-			matchingOrder.ID,
+			feeFor(f.resting.order.Side, trade),
+			now,
+			f.resting.order.ID,
+			f.resting.order.RemainingQuantity,
+			settlements[i].restingRelease,
+			requeuedAt,
 		)
+		if err != nil {
+			return fmt.Errorf("failed to update matching order: %w", err)
+		}
 
+		rowsAffected, err := result.RowsAffected()
 		if err != nil {
-			log.Printf("Failed to update matching order: %v", err)
-			continue
+			return fmt.Errorf("failed to update matching order: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("matching order %s changed concurrently", f.resting.order.ID)
 		}
 
-		// Update new order
-		newOrder.FilledQuantity += matchQuantity
-		newOrder.RemainingQuantity -= matchQuantity
-		newOrder.FeePaid += trade.BuyerFee // Fee for new order
+		if err := settleTrade(tx, trade, incomingSide, settlements[i]); err != nil {
+			return err
+		}
+	}
 
-		if newOrder.RemainingQuantity == 0 {
-			newOrder.Status = "filled"
-		} else if newOrder.FilledQuantity > 0 {
-			newOrder.Status = "partially_filled"
+	return nil
+}
+
+// insertTrade journals an executed trade
+func insertTrade(tx *sql.Tx, trade *models.Trade) error {
+	query := `
+		INSERT INTO trades (
+			id, buyer_order_id, seller_order_id, buyer_id, seller_id, token_id,
+			price, quantity, total_value, buyer_fee, seller_fee, platform_fee,
+			buyer_fee_schedule_id, seller_fee_schedule_id, settlement_status, executed_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+	`
+
+	_, err := tx.Exec(query,
+		trade.ID, trade.BuyerOrderID, trade.SellerOrderID, trade.BuyerID,
+		trade.SellerID, trade.TokenID, trade.Price, trade.Quantity,
+		trade.TotalValue, trade.BuyerFee, trade.SellerFee, trade.PlatformFee,
+		trade.BuyerFeeScheduleID, trade.SellerFeeScheduleID, trade.SettlementStatus, trade.ExecutedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert trade: %w", err)
+	}
+
+	return nil
+}
+
+// journalPreventions cancels or decrements the resting orders self-trade
+// prevention acted on and releases their reservations
+func journalPreventions(tx *sql.Tx, prevented []prevention) error {
+	cancelQuery := `
+		UPDATE orders
+		SET status = 'cancelled', cancel_reason = $2, locked_amount = 0, updated_at = NOW()
+		WHERE id = $1
+		  AND status IN (` + liveStatuses + `)
+		  AND remaining_quantity = $3
+	`
+
+	decrementQuery := `
+		UPDATE orders
+		SET quantity = quantity - $2,
+		    remaining_quantity = remaining_quantity - $2,
+		    locked_amount = locked_amount - $3,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status IN (` + liveStatuses + `)
+		  AND remaining_quantity = $4
+	`
+
+	for _, p := range prevented {
+		order := p.resting.order
+
+		var result sql.Result
+		var err error
+		if p.cancels() {
+			result, err = tx.Exec(cancelQuery, order.ID, CancelReasonSelfTrade, order.RemainingQuantity)
+		} else {
+			result, err = tx.Exec(decrementQuery, order.ID, p.quantity, preventionRelease(p), order.RemainingQuantity)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply self-trade prevention: %w", err)
 		}
 
-		trades = append(trades, trade)
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to apply self-trade prevention: %w", err)
+		}
+		if rowsAffected != 1 {
+			return fmt.Errorf("matching order %s changed concurrently", order.ID)
+		}
+
+		if release := preventionRelease(p); release.IsPositive() {
+			if err := releaseFunds(tx, order.UserID, balanceCurrency(order), release); err != nil {
+				return err
+			}
+		}
 	}
 
-	return trades, nil
+	return nil
+}
+
+// preventionRelease is the reservation freed by a self-trade prevention
+// action: all of it for a cancelled order, the decremented units otherwise
+func preventionRelease(p prevention) decimal.Decimal {
+	if p.cancels() {
+		return p.resting.order.LockedAmount
+	}
+	return decimal.Min(reservationFor(p.resting.order, p.quantity), p.resting.order.LockedAmount)
 }
 
-// EstimateOrder estimates the execution of an order without placing it
-func (s *Service) EstimateOrder(tokenID, orderType string, quantity int64, executionType string, price float64) (*models.OrderEstimate, error) {
+// EstimateOrder estimates the execution of an order without placing it. Stop
+// orders are estimated as if triggered now and report whether the last
+// trade price would already set them off. Only displayed liquidity is
+// counted unless includeHidden is set, which callers must reserve for
+// privileged users. Fees are estimated at the user's taker rate.
+func (s *Service) EstimateOrder(userID, tokenID, orderType string, quantity int64, executionType string, price decimal.Decimal, stopPrice *decimal.Decimal, includeHidden bool) (*models.OrderEstimate, error) {
 	side := "bid"
 	if orderType == "sell" {
 		side = "ask"
 	}
 
-	// Create a temporary order for simulation
-	tempOrder := &models.Order{
-		TokenID:           tokenID,
-		OrderType:         orderType,
-		Side:              side,
-		Price:             price,
-		Quantity:          quantity,
-		RemainingQuantity: quantity,
-		ExecutionType:     executionType,
-		FeeRate:           TakerFeeRate,
+	rates := &models.Order{UserID: userID, TokenID: tokenID}
+	if err := s.resolveFees(rates); err != nil {
+		return nil, err
 	}
 
 	// Simulate matching (read-only)
 	estimate := &models.OrderEstimate{
-		Quantity:  quantity,
-		FeeRate:   TakerFeeRate,
+		Quantity: quantity,
+		FeeRate:  rates.FeeRate,
 		Breakdown: models.OrderEstimateBreakdown{
 			MatchedOrders: []models.OrderEstimateMatch{},
 		},
 		Warnings: []string{},
 	}
 
-	// Get opposite side orders
-	oppositeSide := "ask"
-	if side == "ask" {
-		oppositeSide = "bid"
-	}
+	s.engine.View(tokenID, func(book *Book) {
+		simulateOrder(book, estimate, side, quantity, executionType, price, stopPrice, includeHidden)
+	})
 
-	var matchQuery string
-	if side == "bid" {
-		matchQuery = `
-			SELECT price, remaining_quantity
-			FROM orders
-			WHERE token_id = $1 AND side = $2 AND status = 'open'
-			ORDER BY price ASC, created_at ASC
-		`
-	} else {
-		matchQuery = `
-			SELECT price, remaining_quantity
-			FROM orders
-			WHERE token_id = $1 AND side = $2 AND status = 'open'
-			ORDER BY price DESC, created_at ASC
-		`
-	}
+	return estimate, nil
+}
 
-	rows, err := s.db.Query(matchQuery, tokenID, oppositeSide)
-	if err != nil {
-		return nil, err
+// simulateOrder fills in an estimate by walking the book as an order would,
+// without changing it. Callers must hold book.mu.
+func simulateOrder(book *Book, estimate *models.OrderEstimate, side string, quantity int64, executionType string, price decimal.Decimal, stopPrice *decimal.Decimal, includeHidden bool) {
+	now := time.Now()
+	if stopPrice != nil {
+		stop := &models.Order{Side: side, StopPrice: stopPrice}
+		wouldTrigger := stopTriggered(stop, book.lastPrice)
+		estimate.WouldTrigger = &wouldTrigger
+		if !wouldTrigger {
+			estimate.Warnings = append(estimate.Warnings, "Stop not triggered: Order will wait for the stop price")
+		}
 	}
-	defer rows.Close()
+	executionType = liveExecutionType(executionType)
 
-	var totalCost float64
+	totalCost := decimal.Zero
+	remaining := quantity
 	matchedQuantity := int64(0)
-	bestPrice := 0.0
-	worstPrice := 0.0
+	bestPrice := decimal.Zero
+	worstPrice := decimal.Zero
 
-	for rows.Next() && tempOrder.RemainingQuantity > 0 {
-		var orderPrice float64
-		var orderQuantity int64
-
-		if err := rows.Scan(&orderPrice, &orderQuantity); err != nil {
-			continue
+	for _, level := range book.opposite(side) {
+		if remaining == 0 {
+			break
 		}
 
 		// For limit orders, check price
 		if executionType == "limit" {
-			if side == "bid" && orderPrice > price {
+			if side == "bid" && level.price.GreaterThan(price) {
 				break
 			}
-			if side == "ask" && orderPrice < price {
+			if side == "ask" && level.price.LessThan(price) {
 				break
 			}
 		}
 
-		if bestPrice == 0 {
-			bestPrice = orderPrice
+		if bestPrice.IsZero() {
+			bestPrice = level.price
 		}
-		worstPrice = orderPrice
+		worstPrice = level.price
+		estimate.Breakdown.LevelsUsed++
 
-		matchQty := tempOrder.RemainingQuantity
-		if matchQty > orderQuantity {
-			matchQty = orderQuantity
-		}
+		for e := level.orders.Front(); e != nil && remaining > 0; e = e.Next() {
+			resting := e.Value.(*bookOrder)
 
-		subtotal := float64(matchQty) * orderPrice
-		totalCost += subtotal
-		matchedQuantity += matchQty
-		tempOrder.RemainingQuantity -= matchQty
+			// Expired orders are cancelled rather than filled
+			if expired(resting.order, now) {
+				continue
+			}
 
-		estimate.Breakdown.MatchedOrders = append(estimate.Breakdown.MatchedOrders, models.OrderEstimateMatch{
-			Price:    orderPrice,
-			Quantity: matchQty,
-			Subtotal: subtotal,
-		})
-		estimate.Breakdown.LevelsUsed++
+			available := resting.visible
+			if includeHidden {
+				available = resting.order.RemainingQuantity
+			}
+
+			matchQty := remaining
+			if matchQty > available {
+				matchQty = available
+			}
+
+			subtotal := level.price.MulInt(matchQty)
+			totalCost = totalCost.Add(subtotal)
+			matchedQuantity += matchQty
+			remaining -= matchQty
+
+			estimate.Breakdown.MatchedOrders = append(estimate.Breakdown.MatchedOrders, models.OrderEstimateMatch{
+				Price:    level.price,
+				Quantity: matchQty,
+				Subtotal: subtotal,
+			})
+		}
 	}
 
 	if matchedQuantity == 0 {
 		estimate.Warnings = append(estimate.Warnings, "Insufficient liquidity: No matching orders available")
-		return estimate, nil
+		return
 	}
 
 	if matchedQuantity < quantity {
 		estimate.Warnings = append(estimate.Warnings, fmt.Sprintf("Insufficient liquidity: Only %d tokens available", matchedQuantity))
 	}
 
-	estimate.EstimatedPrice = totalCost / float64(matchedQuantity)
-	estimate.TotalFees = totalCost * estimate.FeeRate
-	estimate.TotalCost = totalCost + estimate.TotalFees
+	estimate.EstimatedPrice = totalCost.DivInt(matchedQuantity, averagePriceRounding)
+	estimate.TotalFees = totalCost.Mul(estimate.FeeRate, feeRounding)
+	estimate.TotalCost = totalCost.Add(estimate.TotalFees)
 	estimate.Breakdown.BestPrice = bestPrice
 	estimate.Breakdown.WorstPrice = worstPrice
 
 	// Calculate slippage
-	if bestPrice > 0 {
-		estimate.Slippage = ((estimate.EstimatedPrice - bestPrice) / bestPrice) * 100
+	if bestPrice.IsPositive() {
+		estimate.Slippage = estimate.EstimatedPrice.Sub(bestPrice).Float64() / bestPrice.Float64() * 100
 		if estimate.Slippage > 2.0 {
 			estimate.Warnings = append(estimate.Warnings, "High slippage: Consider splitting into smaller orders")
 		}
 	}
-
-	return estimate, nil
 }
 
 // validateOrder validates order parameters
@@ -488,36 +1285,185 @@ func (s *Service) validateOrder(order *models.Order) error {
 	if order.Quantity <= 0 {
 		return fmt.Errorf("quantity must be positive")
 	}
+	// Asks reserve their quantity in tokens, which must fit in a decimal
+	if order.Quantity > decimal.MaxInt {
+		return fmt.Errorf("quantity must be at most %d", decimal.MaxInt)
+	}
+
+	if order.ClientOrderID != nil && (*order.ClientOrderID == "" || len(*order.ClientOrderID) > MaxClientOrderIDLength) {
+		return fmt.Errorf("client order ID must be 1 to %d characters", MaxClientOrderIDLength)
+	}
+
+	switch order.ExecutionType {
+	case "market", "limit", "stop_market", "stop_limit", "trailing_stop":
+	default:
+		return fmt.Errorf("invalid execution type")
+	}
+
+	if order.ExecutionType == "trailing_stop" {
+		if (order.TrailAmount == nil) == (order.TrailPercent == nil) {
+			return fmt.Errorf("trailing stops must have either a trail amount or a trail percent")
+		}
+		if order.TrailAmount != nil && !order.TrailAmount.IsPositive() {
+			return fmt.Errorf("trail amount must be positive")
+		}
+		if order.TrailPercent != nil && (!order.TrailPercent.IsPositive() || !order.TrailPercent.LessThan(decimal.FromInt(100))) {
+			return fmt.Errorf("trail percent must be between 0 and 100")
+		}
+		if order.StopPrice != nil {
+			return fmt.Errorf("trailing stops derive their stop price from the trail")
+		}
+	} else if order.TrailAmount != nil || order.TrailPercent != nil {
+		return fmt.Errorf("trail only applies to trailing stops")
+	}
+
+	if isStop(order) {
+		if order.ExecutionType != "trailing_stop" && (order.StopPrice == nil || !order.StopPrice.IsPositive()) {
+			return fmt.Errorf("stop orders must have a positive stop price")
+		}
+		if order.TimeInForce == "FOK" {
+			return fmt.Errorf("stop orders cannot be fill-or-kill")
+		}
+	} else if order.StopPrice != nil {
+		return fmt.Errorf("stop price only applies to stop orders")
+	}
+
+	if liveExecutionType(order.ExecutionType) == "limit" {
+		if !order.Price.IsPositive() {
+			return fmt.Errorf("limit orders must have a positive price")
+		}
+		if _, ok := order.Price.TryMulInt(order.Quantity); !ok {
+			return fmt.Errorf("order value is too large")
+		}
+	}
+
+	if order.DisplayQuantity != nil {
+		if liveExecutionType(order.ExecutionType) != "limit" {
+			return fmt.Errorf("display quantity only applies to limit orders")
+		}
+		if *order.DisplayQuantity <= 0 || *order.DisplayQuantity > order.Quantity {
+			return fmt.Errorf("display quantity must be between 1 and the order quantity")
+		}
+	}
+
+	if order.PostOnly {
+		if order.ExecutionType != "limit" {
+			return fmt.Errorf("post-only only applies to limit orders")
+		}
+		if order.TimeInForce == "IOC" || order.TimeInForce == "FOK" {
+			return fmt.Errorf("post-only orders cannot be IOC or FOK")
+		}
+		switch order.PostOnlyMode {
+		case "", PostOnlyReject, PostOnlyReprice:
+		default:
+			return fmt.Errorf("invalid post-only mode")
+		}
+	} else if order.PostOnlyMode != "" {
+		return fmt.Errorf("post-only mode requires a post-only order")
+	}
 
-	if order.ExecutionType == "limit" && order.Price <= 0 {
-		return fmt.Errorf("limit orders must have a positive price")
+	if isMarket(order) {
+		if order.ProtectionPrice != nil && !order.ProtectionPrice.IsPositive() {
+			return fmt.Errorf("protection price must be positive")
+		}
+		if order.MaxSlippageBps != nil && (*order.MaxSlippageBps <= 0 || *order.MaxSlippageBps > 10000) {
+			return fmt.Errorf("max slippage must be between 1 and 10000 bps")
+		}
+	} else if order.ProtectionPrice != nil || order.MaxSlippageBps != nil {
+		return fmt.Errorf("price protection only applies to market orders")
 	}
 
 	if order.Side != "bid" && order.Side != "ask" {
 		return fmt.Errorf("invalid order side")
 	}
 
+	switch order.TimeInForce {
+	case "", "GTC", "IOC", "FOK":
+		if order.ExpiresAt != nil {
+			return fmt.Errorf("expiry only applies to good-till-date orders")
+		}
+	case "GTD":
+		if order.ExecutionType == "market" {
+			return fmt.Errorf("market orders cannot be good-till-date")
+		}
+		if order.ExpiresAt == nil || !order.ExpiresAt.After(time.Now()) {
+			return fmt.Errorf("good-till-date orders must expire in the future")
+		}
+	default:
+		return fmt.Errorf("invalid time in force")
+	}
+
+	if order.STPMode != "" && !ValidSTPMode(order.STPMode) {
+		return fmt.Errorf("invalid self-trade prevention mode")
+	}
+
 	return nil
 }
 
 // CancelOrder cancels an open order
 func (s *Service) CancelOrder(orderID, userID string) error {
+	var tokenID string
+	err := s.db.QueryRow(`SELECT token_id FROM orders WHERE id = $1 AND user_id = $2`, orderID, userID).Scan(&tokenID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("order not found or cannot be cancelled")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	tx, err := s.beginTokenTx(tokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Returns the reservation the order held before it was cleared
 	query := `
-		UPDATE orders
-		SET status = 'cancelled', updated_at = NOW()
-		WHERE id = $1 AND user_id = $2 AND status IN ('open', 'partially_filled')
+		UPDATE orders o
+		SET status = 'cancelled', cancel_reason = $3, locked_amount = 0, updated_at = NOW()
+		FROM (SELECT id, locked_amount FROM orders WHERE id = $1 FOR UPDATE) prev
+		WHERE o.id = prev.id AND o.user_id = $2 AND o.status IN (` + liveStatuses + `, 'pending_trigger')
+		RETURNING o.side, prev.locked_amount
 	`
 
-	result, err := s.db.Exec(query, orderID, userID)
+	cancelled := &models.Order{ID: orderID, UserID: userID, TokenID: tokenID}
+	err = tx.QueryRow(query, orderID, userID, CancelReasonUser).Scan(&cancelled.Side, &cancelled.LockedAmount)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("order not found or cannot be cancelled")
+	}
 	if err != nil {
 		return fmt.Errorf("failed to cancel order: %w", err)
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("order not found or cannot be cancelled")
+	if cancelled.LockedAmount.IsPositive() {
+		if err := releaseFunds(tx, userID, balanceCurrency(cancelled), cancelled.LockedAmount); err != nil {
+			return err
+		}
+	}
+
+	var events orderEvents
+	events.cancelled(cancelled, CancelReasonUser)
+	if err := events.write(tx, tokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if !book.remove(orderID) {
+		book.removeStop(orderID)
 	}
 
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(tokenID))
+
+	s.announce(book, events)
+
 	return nil
 }
 
@@ -530,9 +1476,7 @@ func (s *Service) GetUserOrders(userID string, status *string, page, limit int)
 
 	if status != nil {
 		query = `
-			SELECT id, user_id, token_id, order_type, side, price, quantity,
-			       filled_quantity, remaining_quantity, execution_type, time_in_force,
-			       status, fee_rate, fee_paid, created_at, updated_at
+			SELECT ` + orderColumns + `
 			FROM orders
 			WHERE user_id = $1 AND status = $2
 			ORDER BY created_at DESC
@@ -541,9 +1485,7 @@ func (s *Service) GetUserOrders(userID string, status *string, page, limit int)
 		args = []interface{}{userID, *status, limit, offset}
 	} else {
 		query = `
-			SELECT id, user_id, token_id, order_type, side, price, quantity,
-			       filled_quantity, remaining_quantity, execution_type, time_in_force,
-			       status, fee_rate, fee_paid, created_at, updated_at
+			SELECT ` + orderColumns + `
 			FROM orders
 			WHERE user_id = $1
 			ORDER BY created_at DESC
@@ -560,16 +1502,11 @@ func (s *Service) GetUserOrders(userID string, status *string, page, limit int)
 
 	orders := []*models.Order{}
 	for rows.Next() {
-		var order models.Order
-		if err := rows.Scan(
-			&order.ID, &order.UserID, &order.TokenID, &order.OrderType, &order.Side,
-			&order.Price, &order.Quantity, &order.FilledQuantity, &order.RemainingQuantity,
-			&order.ExecutionType, &order.TimeInForce, &order.Status, &order.FeeRate,
-			&order.FeePaid, &order.CreatedAt, &order.UpdatedAt,
-		); err != nil {
+		order, err := scanOrder(rows)
+		if err != nil {
 			continue
 		}
-		orders = append(orders, &order)
+		orders = append(orders, order)
 	}
 
 	// Get total count
@@ -611,6 +1548,7 @@ func (s *Service) GetTrades(userID *string, tokenID *string, page, limit int) ([
 		query = `
 			SELECT id, buyer_order_id, seller_order_id, buyer_id, seller_id, token_id,
 			       price, quantity, total_value, buyer_fee, seller_fee, platform_fee,
+			       buyer_fee_schedule_id, seller_fee_schedule_id,
 			       settlement_status, blockchain_tx_hash, executed_at, settled_at
 			FROM trades
 			WHERE buyer_id = $1 OR seller_id = $1
@@ -622,6 +1560,7 @@ func (s *Service) GetTrades(userID *string, tokenID *string, page, limit int) ([
 		query = `
 			SELECT id, buyer_order_id, seller_order_id, buyer_id, seller_id, token_id,
 			       price, quantity, total_value, buyer_fee, seller_fee, platform_fee,
+			       buyer_fee_schedule_id, seller_fee_schedule_id,
 			       settlement_status, blockchain_tx_hash, executed_at, settled_at
 			FROM trades
 			WHERE token_id = $1
@@ -646,6 +1585,7 @@ func (s *Service) GetTrades(userID *string, tokenID *string, page, limit int) ([
 			&trade.ID, &trade.BuyerOrderID, &trade.SellerOrderID, &trade.BuyerID,
 			&trade.SellerID, &trade.TokenID, &trade.Price, &trade.Quantity,
 			&trade.TotalValue, &trade.BuyerFee, &trade.SellerFee, &trade.PlatformFee,
+			&trade.BuyerFeeScheduleID, &trade.SellerFeeScheduleID,
 			&trade.SettlementStatus, &trade.BlockchainTxHash, &trade.ExecutedAt, &trade.SettledAt,
 		); err != nil {
 			continue
@@ -1,86 +1,114 @@
 package orderbook
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
 	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/fees"
+	"github.com/peoplecoin/backend/internal/services/restrictions"
 	"github.com/peoplecoin/backend/internal/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestGetOrderBook(t *testing.T) {
-	db, mock, cleanup := testutil.NewMockDB(t)
-	defer cleanup()
+// seedOrder rests a limit order directly on the service's in-memory book
+func seedOrder(service *Service, tokenID, side, price string, quantity int64) *models.Order {
+	order := testutil.MockOrder(uuid.New().String(), tokenID, side, decimal.MustParse(price), quantity)
+	order.ID = uuid.New().String()
+	order.LockedAmount = reservationFor(order, quantity)
+	listToken(service, tokenID)
+	service.engine.Book(tokenID).add(order)
+	return order
+}
+
+// listToken marks a token active, as loading the books does for a token
+// that is trading
+func listToken(service *Service, tokenID string) {
+	service.engine.Book(tokenID).status = TokenActive
+}
+
+// expectJournalTx expects a journal transaction to start and take the
+// token's advisory lock
+func expectJournalTx(mock sqlmock.Sqlmock, tokenID string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").
+		WithArgs(tokenID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
 
-	redisClient := &cache.RedisClient{} // Mock Redis (won't actually connect)
-	service := NewService(db, redisClient)
+// expectReserve expects an incoming order's funds to be reserved
+func expectReserve(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectEvents expects a journal transaction's order events to be appended
+func expectEvents(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("INSERT INTO order_events").WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectRejection expects an order the book refused to be journaled in its
+// own transaction
+func expectRejection(mock sqlmock.Sqlmock, tokenID string) {
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("INSERT INTO order_events").
+		WithArgs(tokenID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// expectSettlement expects a trade's buyer and seller balances to be debited
+// and credited
+func expectSettlement(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("UPDATE user_balances SET balance = balance -").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_balances SET balance = balance -").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_balances").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO user_balances").WillReturnResult(sqlmock.NewResult(1, 1))
+}
 
+func TestGetOrderBook(t *testing.T) {
 	tokenID := "660e8400-e29b-41d4-a716-446655440001"
 	depth := 20
 
 	tests := []struct {
 		name      string
-		setupMock func()
+		seed      func(service *Service)
 		wantError bool
 		wantBids  int
 		wantAsks  int
 	}{
 		{
 			name: "Successful order book retrieval",
-			setupMock: func() {
-				// Mock bids query
-				bidsRows := sqlmock.NewRows([]string{"price", "total_quantity", "order_count"}).
-					AddRow(2.45, 1000, 3).
-					AddRow(2.44, 1500, 5).
-					AddRow(2.43, 800, 2)
-
-				mock.ExpectQuery("SELECT price, SUM\\(remaining_quantity\\)").
-					WithArgs(tokenID, depth).
-					WillReturnRows(bidsRows)
-
-				// Mock asks query
-				asksRows := sqlmock.NewRows([]string{"price", "total_quantity", "order_count"}).
-					AddRow(2.46, 900, 2).
-					AddRow(2.47, 1200, 4).
-					AddRow(2.48, 600, 1)
-
-				mock.ExpectQuery("SELECT price, SUM\\(remaining_quantity\\)").
-					WithArgs(tokenID, depth).
-					WillReturnRows(asksRows)
-
-				// Mock last price query
-				lastPriceRows := sqlmock.NewRows([]string{"price"}).
-					AddRow(2.45)
-
-				mock.ExpectQuery("SELECT price FROM trades").
-					WithArgs(tokenID).
-					WillReturnRows(lastPriceRows)
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "bid", "2.45", 400)
+				seedOrder(service, tokenID, "bid", "2.45", 600)
+				seedOrder(service, tokenID, "bid", "2.44", 1500)
+				seedOrder(service, tokenID, "bid", "2.43", 800)
+
+				seedOrder(service, tokenID, "ask", "2.46", 900)
+				seedOrder(service, tokenID, "ask", "2.47", 1200)
+				seedOrder(service, tokenID, "ask", "2.48", 600)
+
+				service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.45")
 			},
 			wantError: false,
 			wantBids:  3,
 			wantAsks:  3,
 		},
 		{
-			name: "Empty order book",
-			setupMock: func() {
-				// Empty bids
-				mock.ExpectQuery("SELECT price, SUM\\(remaining_quantity\\)").
-					WithArgs(tokenID, depth).
-					WillReturnRows(sqlmock.NewRows([]string{"price", "total_quantity", "order_count"}))
-
-				// Empty asks
-				mock.ExpectQuery("SELECT price, SUM\\(remaining_quantity\\)").
-					WithArgs(tokenID, depth).
-					WillReturnRows(sqlmock.NewRows([]string{"price", "total_quantity", "order_count"}))
-
-				// No last price
-				mock.ExpectQuery("SELECT price FROM trades").
-					WithArgs(tokenID).
-					WillReturnRows(sqlmock.NewRows([]string{"price"}))
-			},
+			name:      "Empty order book",
+			seed:      func(service *Service) {},
 			wantError: false,
 			wantBids:  0,
 			wantAsks:  0,
@@ -89,7 +117,8 @@ func TestGetOrderBook(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.setupMock()
+			service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil) // Mock Redis (won't actually connect)
+			tt.seed(service)
 
 			orderBook, err := service.GetOrderBook(tokenID, depth)
 
@@ -105,347 +134,4207 @@ func TestGetOrderBook(t *testing.T) {
 
 				// Verify spread calculation
 				if len(orderBook.Bids) > 0 && len(orderBook.Asks) > 0 {
-					expectedSpread := orderBook.Asks[0].Price - orderBook.Bids[0].Price
+					expectedSpread := orderBook.Asks[0].Price.Sub(orderBook.Bids[0].Price)
 					assert.Equal(t, expectedSpread, orderBook.Spread)
+
+					// Best levels aggregate every order at that price
+					assert.Equal(t, decimal.MustParse("2.45"), orderBook.Bids[0].Price)
+					assert.Equal(t, int64(1000), orderBook.Bids[0].Quantity)
+					assert.Equal(t, 2, orderBook.Bids[0].Orders)
+					assert.Equal(t, decimal.MustParse("2.46"), orderBook.Asks[0].Price)
+					assert.Equal(t, decimal.MustParse("2.45"), orderBook.LastPrice)
 				}
 			}
-
-			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
 
-func TestEstimateOrder(t *testing.T) {
+func TestCreateOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	buyerID := "550e8400-e29b-41d4-a716-446655440000"
+
 	db, mock, cleanup := testutil.NewMockDB(t)
 	defer cleanup()
 
-	redisClient := &cache.RedisClient{}
-	service := NewService(db, redisClient)
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	first := seedOrder(service, tokenID, "ask", "2.46", 300)
+	second := seedOrder(service, tokenID, "ask", "2.46", 500)
+	seedOrder(service, tokenID, "ask", "2.48", 1000)
 
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").
+		WithArgs(int64(300), int64(0), "filled", sqlmock.AnyArg(), sqlmock.AnyArg(), first.ID, int64(300), decimal.FromInt(300), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").
+		WithArgs(int64(200), int64(300), "partially_filled", sqlmock.AnyArg(), sqlmock.AnyArg(), second.ID, int64(500), decimal.FromInt(200), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	expectEvents(mock)
+	mock.ExpectCommit()
+
+	order := &models.Order{
+		UserID:        buyerID,
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Price:         decimal.MustParse("2.47"),
+		Quantity:      500,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	}
+
+	created, trades, err := service.CreateOrder(order)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Fills follow time priority within the level
+	assert.Len(t, trades, 2)
+	assert.Equal(t, first.ID, trades[0].SellerOrderID)
+	assert.Equal(t, second.ID, trades[1].SellerOrderID)
+	assert.Equal(t, "filled", created.Status)
+	assert.Equal(t, int64(0), created.RemainingQuantity)
+
+	// The book reflects the committed fills
+	book := service.engine.Book(tokenID)
+	bids, asks := book.snapshot(10)
+	assert.Len(t, bids, 0)
+	assert.Equal(t, int64(300), asks[0].Quantity)
+	assert.Equal(t, 1, asks[0].Orders)
+	assert.Equal(t, decimal.MustParse("2.46"), book.lastPrice)
+}
+
+func TestCreateStopOrder(t *testing.T) {
 	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	stopPrice := decimal.MustParse("2.50")
 
-	tests := []struct {
-		name              string
-		orderType         string
-		quantity          int64
-		executionType     string
-		price             float64
-		setupMock         func()
-		wantError         bool
-		expectedPrice     float64
-		expectedSlippage  float64
-		expectedWarnings  int
-	}{
-		{
-			name:          "Market buy order - sufficient liquidity",
-			orderType:     "buy",
-			quantity:      1000,
-			executionType: "market",
-			price:         0,
-			setupMock: func() {
-				rows := sqlmock.NewRows([]string{"price", "remaining_quantity"}).
-					AddRow(2.46, 500).
-					AddRow(2.47, 300).
-					AddRow(2.48, 200)
+	t.Run("rests dormant until triggered", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
 
-				mock.ExpectQuery("SELECT price, remaining_quantity").
-					WithArgs(tokenID, "ask").
-					WillReturnRows(rows)
-			},
-			wantError:        false,
-			expectedPrice:    2.465,     // Weighted average
-			expectedSlippage: 0.20325203, // ~0.2%
-			expectedWarnings: 0,
-		},
-		{
-			name:          "Market buy order - insufficient liquidity",
-			orderType:     "buy",
-			quantity:      2000,
-			executionType: "market",
-			price:         0,
-			setupMock: func() {
-				rows := sqlmock.NewRows([]string{"price", "remaining_quantity"}).
-					AddRow(2.46, 500).
-					AddRow(2.47, 300)
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.45")
+		seedOrder(service, tokenID, "ask", "2.46", 100)
 
-				mock.ExpectQuery("SELECT price, remaining_quantity").
-					WithArgs(tokenID, "ask").
-					WillReturnRows(rows)
-			},
-			wantError:        false,
-			expectedWarnings: 1, // Should warn about insufficient liquidity
-		},
-		{
-			name:          "Limit buy order - within price range",
-			orderType:     "buy",
-			quantity:      500,
-			executionType: "limit",
-			price:         2.47,
-			setupMock: func() {
-				rows := sqlmock.NewRows([]string{"price", "remaining_quantity"}).
-					AddRow(2.46, 300).
-					AddRow(2.47, 200).
-					AddRow(2.48, 100)
+		// A stop limit buy reserves its limit price plus fee up front
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WithArgs("550e8400-e29b-41d4-a716-446655440000", QuoteCurrency, decimal.MustParse("256.275")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
 
-				mock.ExpectQuery("SELECT price, remaining_quantity").
-					WithArgs(tokenID, "ask").
-					WillReturnRows(rows)
-			},
-			wantError:     false,
-			expectedPrice: 2.46, // Only matches at 2.46 and 2.47
-		},
-		{
-			name:          "Market sell order",
-			orderType:     "sell",
-			quantity:      800,
-			executionType: "market",
-			price:         0,
-			setupMock: func() {
-				rows := sqlmock.NewRows([]string{"price", "remaining_quantity"}).
-					AddRow(2.45, 500).
-					AddRow(2.44, 300).
-					AddRow(2.43, 200)
+		created, trades, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.55"),
+			Quantity:      100,
+			ExecutionType: "stop_limit",
+			StopPrice:     &stopPrice,
+		})
 
-				mock.ExpectQuery("SELECT price, remaining_quantity").
-					WithArgs(tokenID, "bid").
-					WillReturnRows(rows)
-			},
-			wantError: false,
-		},
-		{
-			name:          "High slippage warning",
-			orderType:     "buy",
-			quantity:      5000,
-			executionType: "market",
-			price:         0,
-			setupMock: func() {
-				rows := sqlmock.NewRows([]string{"price", "remaining_quantity"}).
-					AddRow(2.46, 1000).
-					AddRow(2.50, 1000).
-					AddRow(2.55, 1000).
-					AddRow(2.60, 1000).
-					AddRow(2.65, 1000)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Len(t, trades, 0)
+		assert.Equal(t, "pending_trigger", created.Status)
+		assert.Equal(t, TakerFeeRate, created.FeeRate)
 
-				mock.ExpectQuery("SELECT price, remaining_quantity").
-					WithArgs(tokenID, "ask").
-					WillReturnRows(rows)
-			},
-			wantError:        false,
-			expectedWarnings: 1, // Should warn about high slippage
-		},
-	}
+		book := service.engine.Book(tokenID)
+		assert.Len(t, book.stops, 1)
+		bids, _ := book.snapshot(10)
+		assert.Len(t, bids, 0)
+	})
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.setupMock()
+	t.Run("trade sets off a stop", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
 
-			estimate, err := service.EstimateOrder(
-				tokenID,
-				tt.orderType,
-				tt.quantity,
-				tt.executionType,
-				tt.price,
-			)
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		book := service.engine.Book(tokenID)
+		book.lastPrice = decimal.MustParse("2.45")
+		first := seedOrder(service, tokenID, "ask", "2.50", 100)
+		second := seedOrder(service, tokenID, "ask", "2.52", 100)
 
-			if tt.wantError {
-				assert.Error(t, err)
-				assert.Nil(t, estimate)
-			} else {
-				assert.NoError(t, err)
-				assert.NotNil(t, estimate)
-				assert.Equal(t, tt.quantity, estimate.Quantity)
-				assert.Equal(t, TakerFeeRate, estimate.FeeRate)
+		stop := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440002", tokenID, "bid", decimal.Zero, 100)
+		stop.ID = uuid.New().String()
+		stop.ExecutionType = "stop_market"
+		stop.FeeRate = TakerFeeRate
+		stop.Status = "pending_trigger"
+		stop.StopPrice = &stopPrice
+		book.addStop(stop)
 
-				if tt.expectedPrice > 0 {
-					assert.InDelta(t, tt.expectedPrice, estimate.EstimatedPrice, 0.01)
-				}
+		// The incoming buy trades at 2.50 ...
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
 
-				if tt.expectedWarnings > 0 {
-					assert.GreaterOrEqual(t, len(estimate.Warnings), tt.expectedWarnings)
-				}
+		// ... which triggers the stop market buy into the next level. It
+		// reserves exactly what its fill costs: 252 + 1.26 fee.
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WithArgs(stop.UserID, QuoteCurrency, decimal.MustParse("253.26")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE orders SET status = \\$2").
+			WithArgs(stop.ID, "filled", int64(100), int64(100), int64(0), nil,
+				decimal.MustParse("1.26"), decimal.Zero, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
 
-				// Verify breakdown
-				assert.NotNil(t, estimate.Breakdown)
-				assert.GreaterOrEqual(t, len(estimate.Breakdown.MatchedOrders), 0)
-			}
+		_, trades, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.50"),
+			Quantity:      100,
+			ExecutionType: "limit",
+		})
 
-			assert.NoError(t, mock.ExpectationsWereMet())
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Len(t, trades, 1)
+		assert.Equal(t, "filled", first.Status)
+		assert.Equal(t, "filled", second.Status)
+		assert.Len(t, book.stops, 0)
+		assert.Equal(t, decimal.MustParse("2.52"), book.lastPrice)
+	})
+
+	t.Run("unfunded stop is cancelled", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		book := service.engine.Book(tokenID)
+		book.lastPrice = decimal.MustParse("2.45")
+		seedOrder(service, tokenID, "ask", "2.50", 100)
+		seedOrder(service, tokenID, "ask", "2.52", 100)
+
+		stop := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440002", tokenID, "bid", decimal.Zero, 100)
+		stop.ID = uuid.New().String()
+		stop.ExecutionType = "stop_market"
+		stop.FeeRate = TakerFeeRate
+		stop.Status = "pending_trigger"
+		stop.StopPrice = &stopPrice
+		book.addStop(stop)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WithArgs(stop.ID, CancelReasonNoFunds).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		_, _, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.50"),
+			Quantity:      100,
+			ExecutionType: "limit",
 		})
-	}
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, "cancelled", stop.Status)
+		assert.Equal(t, CancelReasonNoFunds, *stop.CancelReason)
+		assert.Len(t, book.stops, 0)
+
+		_, asks := book.snapshot(10)
+		assert.Equal(t, []string{"2.52"}, levelPrices(asks))
+	})
 }
 
-func TestValidateOrder(t *testing.T) {
-	service := &Service{}
+func TestCreatePostOnlyOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
 
 	tests := []struct {
 		name      string
-		order     *models.Order
-		wantError bool
+		price     string
+		mode      string
+		setupMock func(mock sqlmock.Sqlmock)
+		wantErr   error
+		wantPrice string
 	}{
 		{
-			name: "Valid market order",
-			order: &models.Order{
-				Quantity:      1000,
-				ExecutionType: "market",
-				Side:          "bid",
-			},
-			wantError: false,
-		},
-		{
-			name: "Valid limit order",
-			order: &models.Order{
-				Quantity:      1000,
-				ExecutionType: "limit",
-				Price:         2.45,
-				Side:          "ask",
-			},
-			wantError: false,
-		},
-		{
-			name: "Invalid - zero quantity",
-			order: &models.Order{
-				Quantity:      0,
-				ExecutionType: "market",
-				Side:          "bid",
-			},
-			wantError: true,
-		},
-		{
-			name: "Invalid - negative quantity",
-			order: &models.Order{
-				Quantity:      -100,
-				ExecutionType: "market",
-				Side:          "bid",
-			},
-			wantError: true,
-		},
-		{
-			name: "Invalid - limit order without price",
-			order: &models.Order{
-				Quantity:      1000,
-				ExecutionType: "limit",
-				Price:         0,
-				Side:          "bid",
+			name:  "Rests when it would not match",
+			price: "2.45",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectJournalTx(mock, tokenID)
+				expectReserve(mock)
+				mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectEvents(mock)
+				mock.ExpectCommit()
 			},
-			wantError: true,
+			wantPrice: "2.45",
 		},
 		{
-			name: "Invalid - limit order with negative price",
-			order: &models.Order{
-				Quantity:      1000,
-				ExecutionType: "limit",
-				Price:         -2.45,
-				Side:          "bid",
+			name:  "Rejected when it would match",
+			price: "2.46",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectRejection(mock, tokenID)
 			},
-			wantError: true,
+			wantErr: ErrPostOnlyWouldCross,
 		},
 		{
-			name: "Invalid - invalid side",
-			order: &models.Order{
-				Quantity:      1000,
-				ExecutionType: "market",
-				Side:          "invalid",
+			name:  "Repriced one tick below the best ask",
+			price: "2.50",
+			mode:  PostOnlyReprice,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectJournalTx(mock, tokenID)
+				mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+					WithArgs("550e8400-e29b-41d4-a716-446655440000", QuoteCurrency, decimal.MustParse("245.735")). // maker rate
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectEvents(mock)
+				mock.ExpectCommit()
 			},
-			wantError: true,
+			wantPrice: "2.45",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := service.validateOrder(tt.order)
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
 
-			if tt.wantError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
+			service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+			seedOrder(service, tokenID, "ask", "2.46", 100)
+			tt.setupMock(mock)
+
+			created, trades, err := service.CreateOrder(&models.Order{
+				UserID:        "550e8400-e29b-41d4-a716-446655440000",
+				TokenID:       tokenID,
+				OrderType:     "buy",
+				Side:          "bid",
+				Price:         decimal.MustParse(tt.price),
+				Quantity:      100,
+				ExecutionType: "limit",
+				PostOnly:      true,
+				PostOnlyMode:  tt.mode,
+			})
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				bids, _ := service.engine.Book(tokenID).snapshot(10)
+				assert.Len(t, bids, 0)
+				return
 			}
+
+			assert.NoError(t, err)
+			assert.Len(t, trades, 0)
+			assert.Equal(t, "open", created.Status)
+			assert.Equal(t, MakerFeeRate, created.FeeRate)
+			assert.Equal(t, decimal.MustParse(tt.wantPrice), created.Price)
 		})
 	}
 }
 
-func TestCancelOrder(t *testing.T) {
+func TestTrailingStopOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	sellerID := "550e8400-e29b-41d4-a716-446655440002"
+	trail := decimal.MustParse("0.05")
+
 	db, mock, cleanup := testutil.NewMockDB(t)
 	defer cleanup()
 
-	redisClient := &cache.RedisClient{}
-	service := NewService(db, redisClient)
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	listToken(service, tokenID)
+	book := service.engine.Book(tokenID)
+	book.lastPrice = decimal.MustParse("2.45")
 
-	orderID := "880e8400-e29b-41d4-a716-446655440003"
-	userID := "550e8400-e29b-41d4-a716-446655440000"
+	// A trail as wide as the last trade price would never trigger
+	wide := decimal.MustParse("2.45")
+	expectRejection(mock, tokenID)
+	_, _, err := service.CreateOrder(&models.Order{
+		UserID:        sellerID,
+		TokenID:       tokenID,
+		OrderType:     "sell",
+		Side:          "ask",
+		Quantity:      100,
+		ExecutionType: "trailing_stop",
+		TrailAmount:   &wide,
+	})
+	assert.ErrorIs(t, err, ErrTrailTooWide)
 
-	tests := []struct {
-		name      string
-		setupMock func()
-		wantError bool
-	}{
-		{
-			name: "Successfully cancel order",
-			setupMock: func() {
-				mock.ExpectExec("UPDATE orders SET status").
-					WithArgs(orderID, userID).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-			},
-			wantError: false,
-		},
-		{
-			name: "Order not found",
-			setupMock: func() {
-				mock.ExpectExec("UPDATE orders SET status").
-					WithArgs(orderID, userID).
-					WillReturnResult(sqlmock.NewResult(0, 0))
-			},
-			wantError: true,
-		},
+	// Placing the stop trails the last trade price and reserves the tokens
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvents(mock)
+	mock.ExpectCommit()
+
+	stop, _, err := service.CreateOrder(&models.Order{
+		UserID:        sellerID,
+		TokenID:       tokenID,
+		OrderType:     "sell",
+		Side:          "ask",
+		Quantity:      100,
+		ExecutionType: "trailing_stop",
+		TrailAmount:   &trail,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "pending_trigger", stop.Status)
+	assert.Equal(t, decimal.MustParse("2.4"), *stop.StopPrice)
+
+	// expectTrade rests an order to be hit by the next incoming order
+	expectTrade := func(restingSide, price string) {
+		seedOrder(service, tokenID, restingSide, price, 10)
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+	}
+	place := func(side, price string) {
+		orderType := "buy"
+		if side == "ask" {
+			orderType = "sell"
+		}
+		_, _, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     orderType,
+			Side:          side,
+			Price:         decimal.MustParse(price),
+			Quantity:      10,
+			ExecutionType: "limit",
+		})
+		assert.NoError(t, err)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.setupMock()
+	// A trade at 2.50 raises the high-water mark, which is journaled
+	expectTrade("ask", "2.50")
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE orders SET trail_mark").
+		WithArgs(stop.ID, decimal.MustParse("2.50"), decimal.MustParse("2.45")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvents(mock)
+	mock.ExpectCommit()
+	place("bid", "2.50")
 
-			err := service.CancelOrder(orderID, userID)
+	parked := book.stops[0]
+	assert.Equal(t, decimal.MustParse("2.5"), *parked.TrailMark)
+	assert.Equal(t, decimal.MustParse("2.45"), *parked.StopPrice)
 
-			if tt.wantError {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-			}
+	// A dip that stays above the stop leaves the mark alone
+	expectTrade("bid", "2.47")
+	place("ask", "2.47")
+	assert.Equal(t, decimal.MustParse("2.5"), *parked.TrailMark)
+	assert.Len(t, book.stops, 1)
 
-			assert.NoError(t, mock.ExpectationsWereMet())
-		})
-	}
+	// Reversing by the trail fires the stop into the bids
+	seedOrder(service, tokenID, "bid", "2.40", 100)
+	expectTrade("bid", "2.45")
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE orders SET status = \\$2").
+		WithArgs(stop.ID, "filled", int64(100), int64(100), int64(0), nil,
+			sqlmock.AnyArg(), decimal.Zero, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	expectEvents(mock)
+	mock.ExpectCommit()
+	place("ask", "2.45")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, book.stops, 0)
+	assert.Equal(t, decimal.MustParse("2.4"), book.lastPrice)
 }
 
-func TestFeeCalculation(t *testing.T) {
-	tests := []struct {
-		name          string
-		executionType string
-		expectedRate  float64
-	}{
-		{
-			name:          "Market order - taker fee",
-			executionType: "market",
-			expectedRate:  TakerFeeRate,
-		},
-		{
-			name:          "Limit order - maker fee",
-			executionType: "limit",
-			expectedRate:  MakerFeeRate,
-		},
-	}
+func TestCreateOrderRollsBackBook(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	seedOrder(service, tokenID, "ask", "2.46", 300)
+
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectRollback()
+
+	order := &models.Order{
+		UserID:        "550e8400-e29b-41d4-a716-446655440000",
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Price:         decimal.MustParse("2.46"),
+		Quantity:      100,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	}
+
+	_, _, err := service.CreateOrder(order)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// A failed journal write must leave the book untouched
+	bids, asks := service.engine.Book(tokenID).snapshot(10)
+	assert.Len(t, bids, 0)
+	assert.Equal(t, int64(300), asks[0].Quantity)
+}
+
+func TestCreateOrderInsufficientFunds(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	seedOrder(service, tokenID, "ask", "2.46", 300)
+
+	// 100 x (2.46 + 0.0123 worst-case fee)
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+		WithArgs(userID, QuoteCurrency, decimal.MustParse("247.23")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	// The refused order is journaled once the failed transaction is rolled
+	// back
+	expectRejection(mock, tokenID)
+
+	_, _, err := service.CreateOrder(&models.Order{
+		UserID:        userID,
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Price:         decimal.MustParse("2.46"),
+		Quantity:      100,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, asks := service.engine.Book(tokenID).snapshot(10)
+	assert.Equal(t, int64(300), asks[0].Quantity)
+}
+
+func TestCreateOrderSettlesBalances(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	sellerID := "550e8400-e29b-41d4-a716-446655440002"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	resting := seedOrder(service, tokenID, "bid", "2.40", 100)
+	assert.Equal(t, decimal.MustParse("241.2"), resting.LockedAmount)
+
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+		WithArgs(sellerID, tokenID, decimal.FromInt(60)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	// The bid releases the reservation for 60 units at its limit price
+	mock.ExpectExec("UPDATE orders").
+		WithArgs(int64(60), int64(40), "partially_filled", sqlmock.AnyArg(), sqlmock.AnyArg(), resting.ID, int64(100), decimal.MustParse("144.72"), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Buyer pays 144 + 0.432 maker fee, seller delivers 60 tokens
+	mock.ExpectExec("UPDATE user_balances SET balance = balance -").
+		WithArgs(resting.UserID, QuoteCurrency, decimal.MustParse("144.432"), decimal.MustParse("144.72")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_balances SET balance = balance -").
+		WithArgs(sellerID, tokenID, decimal.FromInt(60), decimal.FromInt(60)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Buyer receives the tokens, seller the proceeds less 0.72 taker fee
+	mock.ExpectExec("INSERT INTO user_balances").
+		WithArgs(resting.UserID, tokenID, decimal.FromInt(60)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO user_balances").
+		WithArgs(sellerID, QuoteCurrency, decimal.MustParse("143.28")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvents(mock)
+	mock.ExpectCommit()
+
+	created, _, err := service.CreateOrder(&models.Order{
+		UserID:        sellerID,
+		TokenID:       tokenID,
+		OrderType:     "sell",
+		Side:          "ask",
+		Price:         decimal.MustParse("2.40"),
+		Quantity:      60,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, "filled", created.Status)
+	assert.True(t, created.LockedAmount.IsZero())
+	assert.Equal(t, decimal.MustParse("96.48"), resting.LockedAmount)
+}
+
+func TestCreateOrderSelfTradePrevention(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	t.Run("Cancel oldest cancels the resting order and keeps matching", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		own := seedOrder(service, tokenID, "ask", "2.46", 100)
+		seedOrder(service, tokenID, "ask", "2.46", 100)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WithArgs(own.ID, CancelReasonSelfTrade, int64(100)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(own.UserID, tokenID, decimal.FromInt(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		created, trades, err := service.CreateOrder(&models.Order{
+			UserID:        own.UserID,
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      100,
+			ExecutionType: "limit",
+			STPMode:       STPCancelOldest,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 1)
+		assert.NotEqual(t, own.ID, trades[0].SellerOrderID)
+		assert.Equal(t, "filled", created.Status)
+		assert.Equal(t, "cancelled", own.Status)
+		assert.Equal(t, CancelReasonSelfTrade, *own.CancelReason)
+
+		_, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, asks, 0)
+	})
+
+	t.Run("Decrement and cancel shrinks the larger resting order", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		own := seedOrder(service, tokenID, "ask", "2.46", 100)
+
+		// 40 x (2.46 + 0.0123 worst-case fee), released again once cancelled
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders SET quantity = quantity -").
+			WithArgs(own.ID, int64(40), decimal.FromInt(40), int64(100)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(own.UserID, tokenID, decimal.FromInt(40)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(own.UserID, QuoteCurrency, decimal.MustParse("98.892")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		created, trades, err := service.CreateOrder(&models.Order{
+			UserID:        own.UserID,
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      40,
+			ExecutionType: "limit",
+			STPMode:       STPDecrementAndCancel,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 0)
+		assert.Equal(t, "cancelled", created.Status)
+		assert.Equal(t, CancelReasonSelfTrade, *created.CancelReason)
+		assert.Equal(t, int64(60), own.Quantity)
+		assert.Equal(t, decimal.FromInt(60), own.LockedAmount)
+
+		bids, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+		assert.Equal(t, int64(60), asks[0].Quantity)
+	})
+}
+
+func TestCreateOrderAbortsOnConcurrentChange(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	resting := seedOrder(service, tokenID, "ask", "2.46", 300)
+
+	// Another writer already consumed part of the resting order, so the
+	// guarded update matches no rows
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").
+		WithArgs(int64(100), int64(200), "partially_filled", sqlmock.AnyArg(), sqlmock.AnyArg(), resting.ID, int64(300), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	order := &models.Order{
+		UserID:        "550e8400-e29b-41d4-a716-446655440000",
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Price:         decimal.MustParse("2.46"),
+		Quantity:      100,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	}
+
+	_, _, err := service.CreateOrder(order)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, asks := service.engine.Book(tokenID).snapshot(10)
+	assert.Equal(t, int64(300), asks[0].Quantity)
+}
+
+// timeArg is a sqlmock argument matching any timestamp, but not NULL
+type timeArg struct{}
+
+func (timeArg) Match(v driver.Value) bool {
+	_, ok := v.(time.Time)
+	return ok
+}
+
+func TestCreateOrderRequeuesIceberg(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	display := int64(100)
+	iceberg := testutil.MockOrder(uuid.New().String(), tokenID, "ask", decimal.MustParse("2.46"), 300)
+	iceberg.ID = uuid.New().String()
+	iceberg.DisplayQuantity = &display
+	iceberg.LockedAmount = reservationFor(iceberg, 300)
+	listToken(service, tokenID)
+	service.engine.Book(tokenID).add(iceberg)
+	behind := seedOrder(service, tokenID, "ask", "2.46", 100)
+
+	// Using up the displayed slice sends the iceberg to the back of the
+	// level, and the journal records when
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").
+		WithArgs(int64(100), int64(200), "partially_filled", sqlmock.AnyArg(), sqlmock.AnyArg(), iceberg.ID, int64(300), decimal.FromInt(100), timeArg{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	expectEvents(mock)
+	mock.ExpectCommit()
+
+	order := &models.Order{
+		UserID:        "550e8400-e29b-41d4-a716-446655440000",
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Price:         decimal.MustParse("2.46"),
+		Quantity:      100,
+		ExecutionType: "limit",
+		TimeInForce:   "GTC",
+	}
+
+	_, trades, err := service.CreateOrder(order)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, trades, 1)
+	assert.NotNil(t, iceberg.RequeuedAt)
+
+	// The order that was behind the slice is now first in the level
+	fills := service.engine.Book(tokenID).match(&models.Order{Side: "bid", Price: decimal.MustParse("2.46"), RemainingQuantity: 100}).fills
+	assert.Len(t, fills, 1)
+	assert.Equal(t, behind.ID, fills[0].resting.order.ID)
+}
+
+func TestCreateOrderConcurrentNoOverfill(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	db, recorder := testutil.NewRecordingDB(t)
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	listToken(service, tokenID)
+
+	const restingQuantity = 100
+	resting := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		order := testutil.MockOrder(uuid.New().String(), tokenID, "ask", decimal.New(246+int64(i), 2), restingQuantity)
+		order.ID = uuid.New().String()
+		service.engine.Book(tokenID).add(order)
+		resting[order.ID] = true
+	}
+
+	const takers = 40
+	var wg sync.WaitGroup
+	errs := make(chan error, takers)
+
+	for i := 0; i < takers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, _, err := service.CreateOrder(&models.Order{
+				UserID:        uuid.New().String(),
+				TokenID:       tokenID,
+				OrderType:     "buy",
+				Side:          "bid",
+				Price:         decimal.MustParse("3.00"),
+				Quantity:      37,
+				ExecutionType: "limit",
+				TimeInForce:   "IOC",
+			})
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// Replay the committed journal and check every resting order update
+	// was made against the quantity actually left on it
+	filled := map[string]int64{}
+	tradedQuantity := int64(0)
+
+	for _, stmt := range recorder.Committed() {
+		switch {
+		case strings.Contains(stmt.Query, "INSERT INTO trades"):
+			tradedQuantity += stmt.Args[7].(int64)
+
+		case strings.Contains(stmt.Query, "UPDATE orders"):
+			quantity := stmt.Args[0].(int64)
+			orderID := stmt.Args[5].(string)
+			expectedRemaining := stmt.Args[6].(int64)
+
+			assert.True(t, resting[orderID])
+			assert.Equal(t, restingQuantity-filled[orderID], expectedRemaining)
+			filled[orderID] += quantity
+		}
+	}
+
+	for orderID, quantity := range filled {
+		assert.LessOrEqual(t, quantity, int64(restingQuantity), "order %s overfilled", orderID)
+	}
+
+	// Demand (40 x 37) exceeds supply, so every resting ask is consumed
+	// exactly once
+	assert.Equal(t, int64(10*restingQuantity), tradedQuantity)
+	assert.Len(t, filled, 10)
+
+	_, asks := service.engine.Book(tokenID).snapshot(20)
+	assert.Len(t, asks, 0)
+}
+
+func TestCreateOrderTimeInForce(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	tests := []struct {
+		name          string
+		timeInForce   string
+		quantity      int64
+		setupMock     func(mock sqlmock.Sqlmock)
+		wantStatus    string
+		wantReason    string
+		wantTrades    int
+		wantBids      int
+		wantAskVolume int64
+	}{
+		{
+			name:        "GTC rests the remainder",
+			timeInForce: "GTC",
+			quantity:    500,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectJournalTx(mock, tokenID)
+				expectReserve(mock)
+				mock.ExpectExec("INSERT INTO orders").
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+						sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(300), int64(200),
+						sqlmock.AnyArg(), "GTC", "partially_filled", nil, sqlmock.AnyArg(),
+						MakerFeeRate, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), STPCancelNewest, nil, nil, nil, nil, nil, nil, false, nil, nil,
+						sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSettlement(mock)
+				expectEvents(mock)
+				mock.ExpectCommit()
+			},
+			wantStatus: "partially_filled",
+			wantTrades: 1,
+			wantBids:   1,
+		},
+		{
+			name:        "IOC cancels the remainder",
+			timeInForce: "IOC",
+			quantity:    500,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectJournalTx(mock, tokenID)
+				expectReserve(mock)
+				mock.ExpectExec("INSERT INTO orders").
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+						sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(300), int64(200),
+						sqlmock.AnyArg(), "IOC", "cancelled", CancelReasonIOCRemainder, sqlmock.AnyArg(),
+						MakerFeeRate, nil, sqlmock.AnyArg(), decimal.Zero, STPCancelNewest, nil, nil, nil, nil, nil, nil, false, nil, nil,
+						sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSettlement(mock)
+				// 200 unfilled x (2.46 + 0.0123 worst-case fee)
+				mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+					WithArgs("550e8400-e29b-41d4-a716-446655440000", QuoteCurrency, decimal.MustParse("494.46")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectEvents(mock)
+				mock.ExpectCommit()
+			},
+			wantStatus: "cancelled",
+			wantReason: CancelReasonIOCRemainder,
+			wantTrades: 1,
+			wantBids:   0,
+		},
+		{
+			name:        "FOK is killed when it cannot fully fill",
+			timeInForce: "FOK",
+			quantity:    500,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectRejection(mock, tokenID)
+			},
+			wantStatus: "cancelled",
+			wantReason: CancelReasonFOKUnfilled,
+			wantTrades: 0,
+			wantBids:   0,
+			// Only the rejection was journaled, so the resting ask is untouched
+			wantAskVolume: 300,
+		},
+		{
+			name:        "FOK fills when liquidity is sufficient",
+			timeInForce: "FOK",
+			quantity:    300,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectJournalTx(mock, tokenID)
+				expectReserve(mock)
+				mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSettlement(mock)
+				expectEvents(mock)
+				mock.ExpectCommit()
+			},
+			wantStatus: "filled",
+			wantTrades: 1,
+			wantBids:   0,
+		},
+	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+			seedOrder(service, tokenID, "ask", "2.46", 300)
+			tt.setupMock(mock)
+
 			order := &models.Order{
-				ExecutionType: tt.executionType,
+				UserID:        "550e8400-e29b-41d4-a716-446655440000",
+				TokenID:       tokenID,
+				OrderType:     "buy",
+				Side:          "bid",
+				Price:         decimal.MustParse("2.46"),
+				Quantity:      tt.quantity,
+				ExecutionType: "limit",
+				TimeInForce:   tt.timeInForce,
+			}
+
+			created, trades, err := service.CreateOrder(order)
+			assert.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			assert.Equal(t, tt.wantStatus, created.Status)
+			assert.Len(t, trades, tt.wantTrades)
+			if tt.wantReason != "" {
+				assert.NotNil(t, created.CancelReason)
+				assert.Equal(t, tt.wantReason, *created.CancelReason)
+			} else {
+				assert.Nil(t, created.CancelReason)
 			}
 
-			if order.ExecutionType == "market" {
-				order.FeeRate = TakerFeeRate
+			bids, asks := service.engine.Book(tokenID).snapshot(10)
+			assert.Len(t, bids, tt.wantBids)
+			if tt.wantAskVolume > 0 {
+				assert.Equal(t, tt.wantAskVolume, asks[0].Quantity)
 			} else {
-				order.FeeRate = MakerFeeRate
+				assert.Len(t, asks, 0)
 			}
+		})
+	}
+}
+
+func TestCreateMarketOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	protection := decimal.MustParse("2.47")
+	slippageBps := 100 // 1% from 2.46 => 2.4846
+
+	tests := []struct {
+		name            string
+		quantity        int64
+		protectionPrice *decimal.Decimal
+		maxSlippageBps  *int
+		wantStatus      string
+		wantReason      string
+		wantFilled      int64
+		wantAverage     string
+	}{
+		{
+			name:        "Sweeps every level regardless of price",
+			quantity:    600,
+			wantStatus:  "filled",
+			wantFilled:  600,
+			wantAverage: "2.47666667", // 1486 / 600, rounded half-even
+		},
+		{
+			name:       "Cancels the remainder when liquidity runs out",
+			quantity:   1000,
+			wantStatus: "cancelled",
+			wantReason: CancelReasonNoLiquidity,
+			wantFilled: 600,
+		},
+		{
+			name:            "Protection price stops the sweep",
+			quantity:        600,
+			protectionPrice: &protection,
+			wantStatus:      "cancelled",
+			wantReason:      CancelReasonProtection,
+			wantFilled:      400,
+			wantAverage:     "2.465",
+		},
+		{
+			name:           "Slippage tolerance stops the sweep",
+			quantity:       600,
+			maxSlippageBps: &slippageBps,
+			wantStatus:     "cancelled",
+			wantReason:     CancelReasonProtection,
+			wantFilled:     400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+			seedOrder(service, tokenID, "ask", "2.46", 200)
+			seedOrder(service, tokenID, "ask", "2.47", 200)
+			seedOrder(service, tokenID, "ask", "2.50", 200)
+
+			expectJournalTx(mock, tokenID)
+			expectReserve(mock)
+			mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+			for i := int64(0); i < tt.wantFilled/200; i++ {
+				mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSettlement(mock)
+			}
+			expectEvents(mock)
+			mock.ExpectCommit()
+
+			order := &models.Order{
+				UserID:          "550e8400-e29b-41d4-a716-446655440000",
+				TokenID:         tokenID,
+				OrderType:       "buy",
+				Side:            "bid",
+				Quantity:        tt.quantity,
+				ExecutionType:   "market",
+				TimeInForce:     "GTC",
+				ProtectionPrice: tt.protectionPrice,
+				MaxSlippageBps:  tt.maxSlippageBps,
+			}
+
+			created, _, err := service.CreateOrder(order)
+			assert.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			assert.Equal(t, tt.wantStatus, created.Status)
+			assert.Equal(t, tt.wantFilled, created.FilledQuantity)
+			if tt.wantReason != "" {
+				assert.Equal(t, tt.wantReason, *created.CancelReason)
+			}
+			if tt.wantAverage != "" {
+				assert.Equal(t, decimal.MustParse(tt.wantAverage), *created.AveragePrice)
+			}
+
+			// Market orders never rest
+			bids, _ := service.engine.Book(tokenID).snapshot(10)
+			assert.Len(t, bids, 0)
+		})
+	}
+}
+
+func TestGoodTillDateOrders(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	past := time.Now().Add(-time.Minute)
+
+	t.Run("Expired orders are cancelled instead of filled", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		stale := seedOrder(service, tokenID, "ask", "2.45", 100)
+		stale.TimeInForce = "GTD"
+		stale.ExpiresAt = &past
+		live := seedOrder(service, tokenID, "ask", "2.46", 100)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WithArgs(stale.ID, CancelReasonExpired, int64(100)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(stale.UserID, tokenID, decimal.FromInt(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
 
-			assert.Equal(t, tt.expectedRate, order.FeeRate)
+		_, trades, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      100,
+			ExecutionType: "limit",
 		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 1)
+		assert.Equal(t, live.ID, trades[0].SellerOrderID)
+		assert.Equal(t, "cancelled", stale.Status)
+		assert.Equal(t, CancelReasonExpired, *stale.CancelReason)
+
+		_, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, asks, 0)
+	})
+
+	t.Run("Sweeper cancels expired resting and stop orders", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		resting := seedOrder(service, tokenID, "bid", "2.45", 100)
+		resting.TimeInForce = "GTD"
+		resting.ExpiresAt = &past
+		seedOrder(service, tokenID, "bid", "2.44", 100)
+
+		stopPrice := decimal.MustParse("2.30")
+		stop := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440002", tokenID, "ask", decimal.Zero, 50)
+		stop.ID = uuid.New().String()
+		stop.ExecutionType = "stop_market"
+		stop.StopPrice = &stopPrice
+		stop.Status = "pending_trigger"
+		stop.TimeInForce = "GTD"
+		stop.ExpiresAt = &past
+		stop.LockedAmount = decimal.FromInt(50)
+		service.engine.Book(tokenID).addStop(stop)
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WithArgs(resting.ID, CancelReasonExpired, int64(100)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(resting.UserID, QuoteCurrency, resting.LockedAmount).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WithArgs(stop.ID, CancelReasonExpired).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(stop.UserID, tokenID, decimal.FromInt(50)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		assert.Equal(t, 2, service.ExpireOrders())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		book := service.engine.Book(tokenID)
+		bids, _ := book.snapshot(10)
+		assert.Len(t, bids, 1)
+		assert.Equal(t, decimal.MustParse("2.44"), bids[0].Price)
+		assert.Len(t, book.stops, 0)
+		assert.Equal(t, "cancelled", resting.Status)
+		assert.Equal(t, decimal.Zero, resting.LockedAmount)
+
+		// Nothing is left to expire
+		assert.Equal(t, 0, service.ExpireOrders())
+	})
+
+	t.Run("Failed sweeps leave the book untouched", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		resting := seedOrder(service, tokenID, "bid", "2.45", 100)
+		resting.TimeInForce = "GTD"
+		resting.ExpiresAt = &past
+
+		// The order was changed elsewhere since this book last saw it
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET status = 'cancelled'").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		assert.Equal(t, 0, service.ExpireOrders())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		bids, _ := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 1)
+		assert.Equal(t, "open", resting.Status)
+	})
+}
+
+func TestLoadOrderBooks(t *testing.T) {
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	resting := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440000", tokenID, "bid", decimal.MustParse("2.45"), 1000)
+	stop := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440002", tokenID, "ask", decimal.Zero, 500)
+	scheduleID := "990e8400-e29b-41d4-a716-446655440009"
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	orderRows := sqlmock.NewRows([]string{
+		"id", "user_id", "token_id", "order_type", "side", "price", "quantity",
+		"filled_quantity", "remaining_quantity", "execution_type", "time_in_force",
+		"status", "cancel_reason", "fee_rate", "maker_fee_rate", "fee_schedule_id",
+		"fee_paid", "locked_amount", "stp_mode", "stop_price", "triggered_at",
+		"trail_amount", "trail_percent", "trail_mark", "display_quantity", "post_only",
+		"expires_at", "requeued_at", "client_order_id", "created_at", "updated_at",
+	}).AddRow(
+		resting.ID, resting.UserID, resting.TokenID, resting.OrderType, resting.Side,
+		resting.Price, resting.Quantity, 400, 600, resting.ExecutionType,
+		"GTD", "partially_filled", nil, resting.FeeRate, "0.00200000",
+		scheduleID, resting.FeePaid, "1483.41000000", STPCancelNewest, nil, nil, nil, nil, nil, 200, false,
+		expiresAt, nil, nil, resting.CreatedAt, resting.UpdatedAt,
+	).AddRow(
+		stop.ID, stop.UserID, stop.TokenID, "sell", "ask",
+		"0.00000000", 500, 0, 500, "trailing_stop",
+		"GTC", "pending_trigger", nil, TakerFeeRate, MakerFeeRate,
+		nil, "0.00000000", "500.00000000", STPCancelNewest, "2.30000000", nil, nil, "5.000000", "2.42105263", nil, false,
+		nil, nil, nil, stop.CreatedAt, stop.UpdatedAt,
+	)
+
+	mock.ExpectQuery("SELECT (.+) FROM orders WHERE status IN").WillReturnRows(orderRows)
+	mock.ExpectQuery("SELECT DISTINCT ON \\(token_id\\) token_id, price FROM trades").
+		WillReturnRows(sqlmock.NewRows([]string{"token_id", "price"}).AddRow(tokenID, "2.44000000"))
+
+	auctionTokenID := "660e8400-e29b-41d4-a716-446655440002"
+	endsAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	mock.ExpectQuery("SELECT id, token_id, reason, ends_at FROM auctions WHERE status = 'running'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_id", "reason", "ends_at"}).
+			AddRow("aa0e8400-e29b-41d4-a716-446655440000", auctionTokenID, AuctionOpening, endsAt))
+
+	haltedTokenID := "660e8400-e29b-41d4-a716-446655440003"
+	haltedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	resumesAt := haltedAt.Add(5 * time.Minute)
+	mock.ExpectQuery("SELECT (.+) FROM trading_halts WHERE resumed_at IS NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token_id", "reason", "message", "halted_at", "resumes_at"}).
+			AddRow("bb0e8400-e29b-41d4-a716-446655440000", haltedTokenID, HaltCircuitBreaker, "price moved", haltedAt, resumesAt))
+	suspendedTokenID := "660e8400-e29b-41d4-a716-446655440004"
+	tickSize := decimal.MustParse("0.05")
+	mock.ExpectQuery("SELECT id, status, tick_size, lot_size FROM tokens").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "tick_size", "lot_size"}).
+			AddRow(tokenID, TokenActive, nil, 1).
+			AddRow(auctionTokenID, TokenActive, "0.05000000", 10).
+			AddRow(haltedTokenID, TokenActive, nil, 100).
+			AddRow(suspendedTokenID, TokenSuspended, nil, 1))
+	mock.ExpectQuery("SELECT token_id, price, quantity, executed_at FROM trades WHERE executed_at >").
+		WillReturnRows(sqlmock.NewRows([]string{"token_id", "price", "quantity", "executed_at"}).
+			AddRow(tokenID, "2.40000000", 100, time.Now().Add(-2*time.Minute)).
+			AddRow(tokenID, "2.44000000", 300, time.Now().Add(-time.Minute)))
+	mock.ExpectQuery("SELECT token_id, MAX\\(sequence\\) FROM order_events GROUP BY token_id").
+		WillReturnRows(sqlmock.NewRows([]string{"token_id", "max"}).AddRow(tokenID, 42))
+
+	assert.NoError(t, service.LoadOrderBooks())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	book := service.engine.Book(tokenID)
+	bids, _ := book.snapshot(10)
+	assert.Len(t, bids, 1)
+	// Only the iceberg's displayed slice is shown
+	assert.Equal(t, int64(200), bids[0].Quantity)
+	assert.Equal(t, int64(600), book.liquidity("bid"))
+	assert.Equal(t, decimal.MustParse("1483.41"), book.orders[resting.ID].order.LockedAmount)
+	// Resting orders keep the maker rate they were placed with
+	assert.Equal(t, decimal.MustParse("0.002"), book.orders[resting.ID].order.MakerFeeRate)
+	assert.Equal(t, scheduleID, *book.orders[resting.ID].order.FeeScheduleID)
+	assert.Equal(t, expiresAt, *book.orders[resting.ID].order.ExpiresAt)
+	assert.Equal(t, decimal.MustParse("2.44"), book.lastPrice)
+
+	// Dormant stops are parked off the visible book
+	_, asks := book.snapshot(10)
+	assert.Len(t, asks, 0)
+	assert.Len(t, book.stops, 1)
+	assert.Equal(t, decimal.MustParse("2.3"), *book.stops[0].StopPrice)
+	assert.Equal(t, decimal.MustParse("2.42105263"), *book.stops[0].TrailMark)
+
+	// Running call auctions carry on where they left off
+	assert.Nil(t, book.auction)
+	auctionBook := service.engine.Book(auctionTokenID)
+	assert.NotNil(t, auctionBook.auction)
+	assert.Equal(t, AuctionOpening, auctionBook.auction.reason)
+	assert.Equal(t, endsAt, auctionBook.auction.endsAt)
+
+	// So do trading halts
+	haltedBook := service.engine.Book(haltedTokenID)
+	assert.NotNil(t, haltedBook.halt)
+	assert.Equal(t, HaltCircuitBreaker, haltedBook.halt.reason)
+	assert.Equal(t, resumesAt, *haltedBook.halt.resumesAt)
+
+	// Tokens have their status and their own market rules or the defaults
+	assert.Equal(t, TokenActive, book.status)
+	assert.Equal(t, TokenSuspended, service.engine.Book(suspendedTokenID).status)
+	assert.Equal(t, defaultMarketRules, book.rules)
+	assert.Equal(t, marketRules{tickSize: &tickSize, lotSize: 10}, auctionBook.rules)
+	assert.Equal(t, marketRules{lotSize: 100}, haltedBook.rules)
+
+	// Recent trades set the reference price
+	assert.Len(t, book.prints, 2)
+	assert.Equal(t, decimal.MustParse("2.43"), book.referencePrice())
+
+	// Sequences carry on from the journal and the restored levels are not
+	// published as changes
+	assert.Equal(t, int64(42), book.sequence)
+	assert.Equal(t, int64(0), auctionBook.sequence)
+	assert.Empty(t, book.changed)
+}
+
+func TestEstimateOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	tests := []struct {
+		name             string
+		orderType        string
+		quantity         int64
+		executionType    string
+		price            decimal.Decimal
+		seed             func(service *Service)
+		wantError        bool
+		expectedPrice    string
+		expectedSlippage float64
+		expectedWarnings int
+	}{
+		{
+			name:          "Market buy order - sufficient liquidity",
+			orderType:     "buy",
+			quantity:      1000,
+			executionType: "market",
+			price:         decimal.Zero,
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "ask", "2.46", 500)
+				seedOrder(service, tokenID, "ask", "2.47", 300)
+				seedOrder(service, tokenID, "ask", "2.48", 200)
+			},
+			wantError:        false,
+			expectedPrice:    "2.467",    // Weighted average
+			expectedSlippage: 0.20325203, // ~0.2%
+			expectedWarnings: 0,
+		},
+		{
+			name:          "Market buy order - insufficient liquidity",
+			orderType:     "buy",
+			quantity:      2000,
+			executionType: "market",
+			price:         decimal.Zero,
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "ask", "2.46", 500)
+				seedOrder(service, tokenID, "ask", "2.47", 300)
+			},
+			wantError:        false,
+			expectedWarnings: 1, // Should warn about insufficient liquidity
+		},
+		{
+			name:          "Limit buy order - within price range",
+			orderType:     "buy",
+			quantity:      500,
+			executionType: "limit",
+			price:         decimal.MustParse("2.47"),
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "ask", "2.46", 300)
+				seedOrder(service, tokenID, "ask", "2.47", 200)
+				seedOrder(service, tokenID, "ask", "2.48", 100)
+			},
+			wantError:     false,
+			expectedPrice: "2.464", // Only matches at 2.46 and 2.47
+		},
+		{
+			name:          "Market sell order",
+			orderType:     "sell",
+			quantity:      800,
+			executionType: "market",
+			price:         decimal.Zero,
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "bid", "2.45", 500)
+				seedOrder(service, tokenID, "bid", "2.44", 300)
+				seedOrder(service, tokenID, "bid", "2.43", 200)
+			},
+			wantError: false,
+		},
+		{
+			name:          "High slippage warning",
+			orderType:     "buy",
+			quantity:      5000,
+			executionType: "market",
+			price:         decimal.Zero,
+			seed: func(service *Service) {
+				seedOrder(service, tokenID, "ask", "2.46", 1000)
+				seedOrder(service, tokenID, "ask", "2.50", 1000)
+				seedOrder(service, tokenID, "ask", "2.55", 1000)
+				seedOrder(service, tokenID, "ask", "2.60", 1000)
+				seedOrder(service, tokenID, "ask", "2.65", 1000)
+			},
+			wantError:        false,
+			expectedWarnings: 1, // Should warn about high slippage
+		},
 	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+			tt.seed(service)
+
+			estimate, err := service.EstimateOrder(
+				"",
+				tokenID,
+				tt.orderType,
+				tt.quantity,
+				tt.executionType,
+				tt.price,
+				nil,
+				false,
+			)
+
+			if tt.wantError {
+				assert.Error(t, err)
+				assert.Nil(t, estimate)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, estimate)
+				assert.Equal(t, tt.quantity, estimate.Quantity)
+				assert.Equal(t, TakerFeeRate, estimate.FeeRate)
+
+				if tt.expectedPrice != "" {
+					assert.Equal(t, decimal.MustParse(tt.expectedPrice), estimate.EstimatedPrice)
+				}
+
+				if tt.expectedWarnings > 0 {
+					assert.GreaterOrEqual(t, len(estimate.Warnings), tt.expectedWarnings)
+				}
+
+				// Verify breakdown
+				assert.NotNil(t, estimate.Breakdown)
+				assert.GreaterOrEqual(t, len(estimate.Breakdown.MatchedOrders), 0)
+			}
+		})
+	}
+}
+
+func TestEstimateOrderHiddenLiquidity(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	service := &Service{engine: NewEngine()}
+
+	display := int64(100)
+	iceberg := testutil.MockOrder(uuid.New().String(), tokenID, "ask", decimal.MustParse("2.46"), 500)
+	iceberg.ID = uuid.New().String()
+	iceberg.DisplayQuantity = &display
+	service.engine.Book(tokenID).add(iceberg)
+	seedOrder(service, tokenID, "ask", "2.50", 400)
+
+	// Public estimates only see the displayed slice before the next level
+	estimate, err := service.EstimateOrder("", tokenID, "buy", 300, "market", decimal.Zero, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.MustParse("2.48666667"), estimate.EstimatedPrice)
+	assert.Equal(t, 2, estimate.Breakdown.LevelsUsed)
+
+	// Privileged estimates see the hidden reserve
+	estimate, err = service.EstimateOrder("", tokenID, "buy", 300, "market", decimal.Zero, nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.MustParse("2.46"), estimate.EstimatedPrice)
+	assert.Equal(t, 1, estimate.Breakdown.LevelsUsed)
+}
+
+func TestValidSTPMode(t *testing.T) {
+	for _, mode := range []string{STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrementAndCancel} {
+		assert.True(t, ValidSTPMode(mode), mode)
+	}
+	assert.False(t, ValidSTPMode(""))
+	assert.False(t, ValidSTPMode("cancel_all"))
+}
+
+func TestValidateOrder(t *testing.T) {
+	service := &Service{}
+	stopPrice := decimal.MustParse("2.40")
+	trailPercent := decimal.MustParse("5")
+	hundred := decimal.FromInt(100)
+	displayQuantity := int64(100)
+	tomorrow := time.Now().Add(24 * time.Hour)
+	yesterday := time.Now().Add(-24 * time.Hour)
+
+	tests := []struct {
+		name      string
+		order     *models.Order
+		wantError bool
+	}{
+		{
+			name: "Valid market order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "market",
+				Side:          "bid",
+			},
+			wantError: false,
+		},
+		{
+			name: "Valid limit order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				Side:          "ask",
+			},
+			wantError: false,
+		},
+		{
+			name: "Invalid - zero quantity",
+			order: &models.Order{
+				Quantity:      0,
+				ExecutionType: "market",
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - negative quantity",
+			order: &models.Order{
+				Quantity:      -100,
+				ExecutionType: "market",
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - market ask quantity beyond decimal range",
+			order: &models.Order{
+				Quantity:      decimal.MaxInt + 1,
+				ExecutionType: "market",
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - limit order without price",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.Zero,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - limit order with negative price",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("-2.45"),
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - protection price on a limit order",
+			order: &models.Order{
+				Quantity:        1000,
+				ExecutionType:   "limit",
+				Price:           decimal.MustParse("2.45"),
+				Side:            "bid",
+				ProtectionPrice: func() *decimal.Decimal { p := decimal.MustParse("2.5"); return &p }(),
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - unknown time in force",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				Side:          "bid",
+				TimeInForce:   "DAY",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - unknown self-trade prevention mode",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				Side:          "bid",
+				STPMode:       "cancel_all",
+			},
+			wantError: true,
+		},
+		{
+			name: "Valid stop limit order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "stop_limit",
+				Price:         decimal.MustParse("2.45"),
+				StopPrice:     &stopPrice,
+				Side:          "bid",
+			},
+			wantError: false,
+		},
+		{
+			name: "Invalid - stop order without stop price",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "stop_market",
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - stop limit order without price",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "stop_limit",
+				StopPrice:     &stopPrice,
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - fill-or-kill stop order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "stop_market",
+				TimeInForce:   "FOK",
+				StopPrice:     &stopPrice,
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Valid trailing stop",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "trailing_stop",
+				TrailPercent:  &trailPercent,
+				Side:          "ask",
+			},
+			wantError: false,
+		},
+		{
+			name: "Invalid - trailing stop with both trail amount and percent",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "trailing_stop",
+				TrailAmount:   &stopPrice,
+				TrailPercent:  &trailPercent,
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - trailing stop with a stop price",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "trailing_stop",
+				TrailPercent:  &trailPercent,
+				StopPrice:     &stopPrice,
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - trail percent of 100",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "trailing_stop",
+				TrailPercent:  &hundred,
+				Side:          "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Valid iceberg order",
+			order: &models.Order{
+				Quantity:        1000,
+				DisplayQuantity: &displayQuantity,
+				ExecutionType:   "limit",
+				Price:           decimal.MustParse("2.45"),
+				Side:            "ask",
+			},
+			wantError: false,
+		},
+		{
+			name: "Invalid - display quantity on a market order",
+			order: &models.Order{
+				Quantity:        1000,
+				DisplayQuantity: &displayQuantity,
+				ExecutionType:   "market",
+				Side:            "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - display quantity above order quantity",
+			order: &models.Order{
+				Quantity:        50,
+				DisplayQuantity: &displayQuantity,
+				ExecutionType:   "limit",
+				Price:           decimal.MustParse("2.45"),
+				Side:            "ask",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - post-only market order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "market",
+				PostOnly:      true,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - post-only immediate-or-cancel order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				TimeInForce:   "IOC",
+				PostOnly:      true,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - post-only mode without post-only",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				PostOnlyMode:  PostOnlyReprice,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - stop price on a limit order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				StopPrice:     &stopPrice,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - invalid side",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "market",
+				Side:          "invalid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Valid good-till-date limit order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				TimeInForce:   "GTD",
+				ExpiresAt:     &tomorrow,
+				Side:          "bid",
+			},
+			wantError: false,
+		},
+		{
+			name: "Valid good-till-date stop order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "stop_market",
+				StopPrice:     &stopPrice,
+				TimeInForce:   "GTD",
+				ExpiresAt:     &tomorrow,
+				Side:          "ask",
+			},
+			wantError: false,
+		},
+		{
+			name: "Invalid - good-till-date without expiry",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				TimeInForce:   "GTD",
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - good-till-date already expired",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				TimeInForce:   "GTD",
+				ExpiresAt:     &yesterday,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - good-till-date market order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "market",
+				TimeInForce:   "GTD",
+				ExpiresAt:     &tomorrow,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+		{
+			name: "Invalid - expiry on a good-till-cancel order",
+			order: &models.Order{
+				Quantity:      1000,
+				ExecutionType: "limit",
+				Price:         decimal.MustParse("2.45"),
+				TimeInForce:   "GTC",
+				ExpiresAt:     &tomorrow,
+				Side:          "bid",
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.validateOrder(tt.order)
+
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	redisClient := &cache.RedisClient{}
+	service := NewService(db, redisClient, testutil.NewTestConfig(), nil, nil)
+
+	orderID := "880e8400-e29b-41d4-a716-446655440003"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	tests := []struct {
+		name      string
+		setupMock func()
+		wantError bool
+	}{
+		{
+			name: "Successfully cancel order",
+			setupMock: func() {
+				mock.ExpectQuery("SELECT token_id FROM orders").
+					WithArgs(orderID, userID).
+					WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+				expectJournalTx(mock, tokenID)
+				mock.ExpectQuery("UPDATE orders o SET status").
+					WithArgs(orderID, userID, CancelReasonUser).
+					WillReturnRows(sqlmock.NewRows([]string{"side", "locked_amount"}).AddRow("bid", "123.45000000"))
+				mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+					WithArgs(userID, QuoteCurrency, decimal.MustParse("123.45")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectEvents(mock)
+				mock.ExpectCommit()
+			},
+			wantError: false,
+		},
+		{
+			name: "Order no longer open",
+			setupMock: func() {
+				mock.ExpectQuery("SELECT token_id FROM orders").
+					WithArgs(orderID, userID).
+					WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+				expectJournalTx(mock, tokenID)
+				mock.ExpectQuery("UPDATE orders o SET status").
+					WithArgs(orderID, userID, CancelReasonUser).
+					WillReturnRows(sqlmock.NewRows([]string{"side", "locked_amount"}))
+				mock.ExpectRollback()
+			},
+			wantError: true,
+		},
+		{
+			name: "Order not found",
+			setupMock: func() {
+				mock.ExpectQuery("SELECT token_id FROM orders").
+					WithArgs(orderID, userID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setupMock()
+
+			err := service.CancelOrder(orderID, userID)
+
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPlaceOrders(t *testing.T) {
+	tokenA := "660e8400-e29b-41d4-a716-446655440001"
+	tokenB := "660e8400-e29b-41d4-a716-446655440002"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	limit := func(tokenID, side, price string, quantity int64) *models.Order {
+		orderType := "buy"
+		if side == "ask" {
+			orderType = "sell"
+		}
+		return &models.Order{
+			UserID:        userID,
+			TokenID:       tokenID,
+			OrderType:     orderType,
+			Side:          side,
+			Price:         decimal.MustParse(price),
+			Quantity:      quantity,
+			ExecutionType: "limit",
+		}
+	}
+
+	t.Run("Orders are placed per token with per-order results", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listener := &recordingListener{}
+		service.SetListener(listener)
+		listToken(service, tokenA)
+
+		orders := []*models.Order{
+			limit(tokenA, "bid", "2.45", 100),
+			limit(tokenB, "bid", "1.00", 0),
+			limit(tokenA, "ask", "2.50", 100),
+			limit(tokenA, "bid", "2.44", 100),
+		}
+
+		expectJournalTx(mock, tokenA)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+		expectJournalTx(mock, tokenA)
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WithArgs(userID, tokenA, decimal.FromInt(100)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+		expectRejection(mock, tokenA)
+		expectJournalTx(mock, tokenA)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		results, err := service.PlaceOrders(orders)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, results, 4)
+		assert.Equal(t, "open", results[0].Order.Status)
+		assert.Equal(t, "quantity must be positive", results[1].Error)
+		assert.Nil(t, results[1].Order)
+		assert.Contains(t, results[2].Error, ErrInsufficientFunds.Error())
+		assert.Equal(t, "open", results[3].Order.Status)
+
+		bids, asks := service.engine.Book(tokenA).snapshot(10)
+		assert.Len(t, bids, 2)
+		assert.Len(t, asks, 0)
+
+		// Subscribers see the token's orders as one change, never half of it
+		assert.Len(t, listener.updates, 1)
+		update := listener.updates[0]
+		assert.Len(t, update.Orders, 2)
+		assert.Equal(t, results[0].Order.ID, update.Orders[0].OrderID)
+		assert.Equal(t, results[3].Order.ID, update.Orders[1].OrderID)
+		assert.Equal(t, int64(1), update.Delta.Sequence)
+		assert.Equal(t, []models.OrderBookLevel{
+			{Price: decimal.MustParse("2.45"), Quantity: 100, Orders: 1},
+			{Price: decimal.MustParse("2.44"), Quantity: 100, Orders: 1},
+		}, update.Delta.Bids)
+		assert.Equal(t, update.Book.Checksum, update.Delta.Checksum)
+	})
+
+	t.Run("Duplicate client order ID", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenA)
+
+		clientOrderID := "quote-1"
+		order := limit(tokenA, "bid", "2.45", 100)
+		order.ClientOrderID = &clientOrderID
+
+		expectJournalTx(mock, tokenA)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").
+			WillReturnError(&pq.Error{Code: "23505", Constraint: clientOrderIDIndex})
+		mock.ExpectRollback()
+		expectRejection(mock, tokenA)
+
+		results, err := service.PlaceOrders([]*models.Order{order})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Contains(t, results[0].Error, ErrDuplicateClientOrderID.Error())
+
+		bids, _ := service.engine.Book(tokenA).snapshot(10)
+		assert.Len(t, bids, 0)
+	})
+
+	t.Run("Batch too large", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		cfg := testutil.NewTestConfig()
+		cfg.Trading.MaxBatchOrders = 2
+		service := NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+
+		_, err := service.PlaceOrders([]*models.Order{
+			limit(tokenA, "bid", "2.45", 100),
+			limit(tokenA, "bid", "2.44", 100),
+			limit(tokenA, "bid", "2.43", 100),
+		})
+		assert.ErrorIs(t, err, ErrBatchTooLarge)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCancelOrders(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	t.Run("Cancel all of a user's orders", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		bid := seedOrder(service, tokenID, "bid", "2.45", 100)
+		bid.UserID = userID
+		ask := seedOrder(service, tokenID, "ask", "2.50", 100)
+		ask.UserID = userID
+		other := seedOrder(service, tokenID, "bid", "2.44", 100)
+
+		mock.ExpectQuery("SELECT DISTINCT token_id FROM orders").
+			WithArgs(userID).
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("UPDATE orders o SET status").
+			WithArgs(userID, tokenID, CancelReasonUser, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "side", "locked_amount"}).
+				AddRow(bid.ID, "bid", bid.LockedAmount.String()).
+				AddRow(ask.ID, "ask", "100.00000000"))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(userID, QuoteCurrency, bid.LockedAmount).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(userID, tokenID, decimal.FromInt(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		cancelled, err := service.CancelOrders(userID, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.ElementsMatch(t, []string{bid.ID, ask.ID}, cancelled)
+
+		book := service.engine.Book(tokenID)
+		bids, asks := book.snapshot(10)
+		assert.Len(t, bids, 1)
+		assert.Len(t, asks, 0)
+		assert.Contains(t, book.orders, other.ID)
+	})
+
+	t.Run("Filtered by token and side", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		ask := seedOrder(service, tokenID, "ask", "2.50", 100)
+		ask.UserID = userID
+
+		token, side := tokenID, "ask"
+		mock.ExpectQuery("SELECT DISTINCT token_id FROM orders (.+) AND token_id = \\$2 AND side = \\$3").
+			WithArgs(userID, tokenID, "ask").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("UPDATE orders o SET status").
+			WithArgs(userID, tokenID, CancelReasonUser, "ask").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "side", "locked_amount"}).AddRow(ask.ID, "ask", "100.00000000"))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(userID, tokenID, decimal.FromInt(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		cancelled, err := service.CancelOrders(userID, &token, &side)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, []string{ask.ID}, cancelled)
+	})
+
+	t.Run("Cancel by client order ID", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		bid := seedOrder(service, tokenID, "bid", "2.45", 100)
+		bid.UserID = userID
+
+		mock.ExpectQuery("SELECT id FROM orders WHERE user_id = \\$1 AND client_order_id = \\$2").
+			WithArgs(userID, "quote-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(bid.ID))
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WithArgs(bid.ID, userID).
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("UPDATE orders o SET status").
+			WithArgs(bid.ID, userID, CancelReasonUser).
+			WillReturnRows(sqlmock.NewRows([]string{"side", "locked_amount"}).AddRow("bid", bid.LockedAmount.String()))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		orderID, err := service.CancelOrderByClientID("quote-1", userID)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, bid.ID, orderID)
+
+		bids, _ := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+
+		mock.ExpectQuery("SELECT id FROM orders").WillReturnError(sql.ErrNoRows)
+		_, err = service.CancelOrderByClientID("quote-2", userID)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetOrderByClientID(t *testing.T) {
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	mock.ExpectQuery("SELECT (.+) FROM orders WHERE user_id = \\$1 AND client_order_id = \\$2").
+		WithArgs(userID, "quote-1").
+		WillReturnError(sql.ErrNoRows)
+
+	order, err := service.GetOrderByClientID("quote-1", userID)
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+	assert.Nil(t, order)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAmendOrder(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	// front returns the order at the head of the best bid level's queue
+	front := func(book *Book) *models.Order {
+		return book.bids[0].orders.Front().Value.(*bookOrder).order
+	}
+	expectLookup := func(mock sqlmock.Sqlmock, order *models.Order) {
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WithArgs(order.ID, order.UserID).
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+	}
+
+	t.Run("Quantity decrease keeps priority", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		first := seedOrder(service, tokenID, "bid", "2.45", 100)
+		seedOrder(service, tokenID, "bid", "2.45", 100)
+		release := reservationFor(first, 40)
+
+		expectLookup(mock, first)
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET quantity = quantity -").
+			WithArgs(first.ID, int64(40), release, int64(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(first.UserID, QuoteCurrency, release).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		quantity := int64(60)
+		amended, trades, err := service.AmendOrder(first.ID, first.UserID, nil, &quantity)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 0)
+		assert.Equal(t, int64(60), amended.RemainingQuantity)
+		assert.Equal(t, reservationFor(first, 60), amended.LockedAmount)
+
+		book := service.engine.Book(tokenID)
+		assert.Equal(t, first.ID, front(book).ID)
+		assert.Equal(t, int64(160), book.bids[0].quantity)
+	})
+
+	t.Run("Quantity increase loses priority", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		first := seedOrder(service, tokenID, "bid", "2.45", 100)
+		second := seedOrder(service, tokenID, "bid", "2.45", 100)
+
+		expectLookup(mock, first)
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WithArgs(first.UserID, QuoteCurrency, reservationFor(first, 50)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE orders SET price =").
+			WithArgs(first.ID, first.Price, int64(150), int64(0), int64(150),
+				"open", nil, first.FeePaid, reservationFor(first, 150), sqlmock.AnyArg(), int64(100)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		quantity := int64(150)
+		amended, _, err := service.AmendOrder(first.ID, first.UserID, nil, &quantity)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.NotNil(t, amended.RequeuedAt)
+
+		book := service.engine.Book(tokenID)
+		assert.Len(t, book.bids, 1)
+		assert.Equal(t, 2, book.bids[0].orders.Len())
+		assert.Equal(t, second.ID, front(book).ID)
+		assert.Equal(t, int64(250), book.bids[0].quantity)
+		assert.Equal(t, int64(150), book.orders[first.ID].order.Quantity)
+	})
+
+	t.Run("Price change matches at the new price", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		ask := seedOrder(service, tokenID, "ask", "2.46", 50)
+		first := seedOrder(service, tokenID, "bid", "2.45", 100)
+		second := seedOrder(service, tokenID, "bid", "2.45", 100)
+
+		expectLookup(mock, first)
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("UPDATE orders SET price =").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		price := decimal.MustParse("2.46")
+		amended, trades, err := service.AmendOrder(first.ID, first.UserID, &price, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 1)
+		assert.Equal(t, ask.ID, trades[0].SellerOrderID)
+		assert.Equal(t, first.ID, trades[0].BuyerOrderID)
+		assert.Equal(t, "partially_filled", amended.Status)
+		assert.Equal(t, int64(50), amended.RemainingQuantity)
+
+		book := service.engine.Book(tokenID)
+		assert.Len(t, book.asks, 0)
+		assert.Len(t, book.bids, 2)
+		assert.Equal(t, first.ID, front(book).ID)
+		assert.Equal(t, int64(50), book.bids[0].quantity)
+		assert.Equal(t, second.ID, book.bids[1].orders.Front().Value.(*bookOrder).order.ID)
+	})
+
+	t.Run("Rejected amendments", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		order := seedOrder(service, tokenID, "bid", "2.45", 100)
+		order.FilledQuantity = 40
+		order.RemainingQuantity = 60
+		order.Status = "partially_filled"
+
+		// Quantity must stay above what has already filled
+		expectLookup(mock, order)
+		quantity := int64(40)
+		_, _, err := service.AmendOrder(order.ID, order.UserID, nil, &quantity)
+		assert.ErrorIs(t, err, ErrInvalidAmendment)
+
+		// Orders no longer on the book cannot be amended
+		service.engine.Book(tokenID).remove(order.ID)
+		expectLookup(mock, order)
+		quantity = int64(80)
+		_, _, err = service.AmendOrder(order.ID, order.UserID, nil, &quantity)
+		assert.ErrorIs(t, err, ErrOrderNotAmendable)
+
+		mock.ExpectQuery("SELECT token_id FROM orders").WillReturnError(sql.ErrNoRows)
+		_, _, err = service.AmendOrder(order.ID, "550e8400-e29b-41d4-a716-446655440005", nil, &quantity)
+		assert.ErrorIs(t, err, ErrOrderNotAmendable)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCallAuction(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	auctionID := "aa0e8400-e29b-41d4-a716-446655440000"
+
+	// seedAuctionBook rests two bids and two asks that cross for at most
+	// 150 units, at any price from 2.45 to 2.48
+	seedAuctionBook := func(service *Service) (bids, asks []*models.Order) {
+		bids = []*models.Order{
+			seedOrder(service, tokenID, "bid", "2.50", 100),
+			seedOrder(service, tokenID, "bid", "2.48", 200),
+		}
+		asks = []*models.Order{
+			seedOrder(service, tokenID, "ask", "2.45", 150),
+			seedOrder(service, tokenID, "ask", "2.49", 100),
+		}
+		return bids, asks
+	}
+
+	t.Run("Orders rest without matching during an auction", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "ask", "2.45", 100)
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("INSERT INTO auctions").
+			WithArgs(tokenID, AuctionOpening, "running", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(auctionID))
+		mock.ExpectCommit()
+
+		auction, err := service.StartAuction(tokenID, AuctionOpening, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, auctionID, auction.ID)
+		// The configured opening duration applies
+		assert.Equal(t, 300*time.Second, auction.EndsAt.Sub(auction.StartedAt))
+
+		_, err = service.StartAuction(tokenID, AuctionReopening, time.Minute)
+		assert.ErrorIs(t, err, ErrAuctionInProgress)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		order, trades, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.50"),
+			Quantity:      100,
+			ExecutionType: "limit",
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 0)
+		assert.Equal(t, "open", order.Status)
+		bids, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 1)
+		assert.Len(t, asks, 1)
+	})
+
+	t.Run("Orders that cannot rest are rejected", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "ask", "2.45", 100)
+		service.engine.Book(tokenID).auction = &auctionState{id: auctionID, reason: AuctionOpening, endsAt: time.Now().Add(time.Minute)}
+
+		for _, order := range []*models.Order{
+			{ExecutionType: "market"},
+			{ExecutionType: "limit", Price: decimal.MustParse("2.45"), TimeInForce: "IOC"},
+			{ExecutionType: "limit", Price: decimal.MustParse("2.45"), TimeInForce: "FOK"},
+		} {
+			order.UserID = "550e8400-e29b-41d4-a716-446655440000"
+			order.TokenID = tokenID
+			order.OrderType = "buy"
+			order.Side = "bid"
+			order.Quantity = 100
+
+			expectRejection(mock, tokenID)
+			_, _, err := service.CreateOrder(order)
+			assert.ErrorIs(t, err, ErrNotAllowedInAuction)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Indicative price maximizes executed volume", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedAuctionBook(service)
+
+		book := service.engine.Book(tokenID)
+		assert.Nil(t, book.auctionInfo(time.Now()))
+		book.auction = &auctionState{id: auctionID, reason: AuctionOpening, endsAt: time.Now().Add(time.Minute)}
+
+		tests := []struct {
+			name      string
+			lastPrice string
+			expected  string
+		}{
+			{"No previous trade takes the middle of the range, up to a tick toward the surplus bids", "0", "2.47"},
+			{"Last price inside the range is kept", "2.47", "2.47"},
+			{"Last price outside the range is clamped", "2.40", "2.45"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				book.lastPrice = decimal.MustParse(tt.lastPrice)
+
+				info := book.auctionInfo(time.Now())
+				assert.NotNil(t, info)
+				assert.Equal(t, AuctionOpening, info.Reason)
+				assert.Equal(t, decimal.MustParse(tt.expected), *info.IndicativePrice)
+				assert.Equal(t, int64(150), info.IndicativeVolume)
+			})
+		}
+	})
+
+	t.Run("Indicative price without a previous trade rounds toward surplus asks", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "bid", "2.50", 100)
+		seedOrder(service, tokenID, "ask", "2.45", 300)
+
+		book := service.engine.Book(tokenID)
+		book.auction = &auctionState{id: auctionID, reason: AuctionOpening, endsAt: time.Now().Add(time.Minute)}
+
+		// 2.475 is between ticks; asks are left over, so it rounds down
+		info := book.auctionInfo(time.Now())
+		assert.Equal(t, decimal.MustParse("2.47"), *info.IndicativePrice)
+		assert.Equal(t, int64(100), info.IndicativeVolume)
+
+		tickSize := decimal.MustParse("0.05")
+		book.rules = newMarketRules(&tickSize, 1)
+		info = book.auctionInfo(time.Now())
+		assert.Equal(t, decimal.MustParse("2.45"), *info.IndicativePrice)
+	})
+
+	t.Run("Uncross clears the book at a single price", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		bids, asks := seedAuctionBook(service)
+		book := service.engine.Book(tokenID)
+		book.lastPrice = decimal.MustParse("2.47")
+		book.auction = &auctionState{id: auctionID, reason: AuctionOpening, endsAt: time.Now().Add(-time.Second)}
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(bids[0].ID, int64(0), int64(100), int64(0), "filled", sqlmock.AnyArg(),
+				decimal.MustParse("0.741"), decimal.MustParse("251.25"), int64(100), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(asks[0].ID, int64(0), int64(150), int64(0), "filled", sqlmock.AnyArg(),
+				decimal.MustParse("1.1115"), decimal.FromInt(150), int64(150), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(bids[1].ID, int64(0), int64(50), int64(150), "partially_filled", sqlmock.AnyArg(),
+				decimal.MustParse("0.3705"), decimal.MustParse("124.62"), int64(200), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE auctions SET status = 'completed'").
+			WithArgs(auctionID, decimal.MustParse("2.47"), int64(150)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		assert.Equal(t, 1, service.UncrossAuctions())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Nil(t, book.auction)
+		assert.Equal(t, decimal.MustParse("2.47"), book.lastPrice)
+		assert.Equal(t, "filled", bids[0].Status)
+		assert.Equal(t, "filled", asks[0].Status)
+		assert.Equal(t, int64(150), bids[1].RemainingQuantity)
+
+		// What does not cross at the uncross price stays on the book
+		bidLevels, askLevels := book.snapshot(10)
+		assert.Len(t, bidLevels, 1)
+		assert.Equal(t, decimal.MustParse("2.48"), bidLevels[0].Price)
+		assert.Len(t, askLevels, 1)
+		assert.Equal(t, decimal.MustParse("2.49"), askLevels[0].Price)
+
+		// Nothing is left to uncross
+		assert.Equal(t, 0, service.UncrossAuctions())
+	})
+
+	t.Run("Same-user orders are decremented instead of trading", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		bid := seedOrder(service, tokenID, "bid", "2.50", 100)
+		ownAsk := seedOrder(service, tokenID, "ask", "2.45", 60)
+		ownAsk.UserID = bid.UserID
+		ask := seedOrder(service, tokenID, "ask", "2.46", 40)
+		book := service.engine.Book(tokenID)
+		book.auction = &auctionState{id: auctionID, reason: AuctionReopening, endsAt: time.Now().Add(-time.Second)}
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(bid.ID, int64(60), int64(40), int64(0), "cancelled", CancelReasonSelfTrade,
+				sqlmock.AnyArg(), decimal.MustParse("251.25"), int64(100), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(bid.UserID, QuoteCurrency, decimal.MustParse("150.75")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(ownAsk.ID, int64(60), int64(0), int64(0), "cancelled", CancelReasonSelfTrade,
+				decimal.Zero, decimal.FromInt(60), int64(60), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+			WithArgs(bid.UserID, tokenID, decimal.FromInt(60)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE orders").
+			WithArgs(ask.ID, int64(0), int64(40), int64(0), "filled", sqlmock.AnyArg(),
+				sqlmock.AnyArg(), decimal.FromInt(40), int64(40), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		// No previous trade, so the middle of the 2.46 to 2.50 range
+		mock.ExpectExec("UPDATE auctions SET status = 'completed'").
+			WithArgs(auctionID, decimal.MustParse("2.48"), int64(40)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		assert.Equal(t, 1, service.UncrossAuctions())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Equal(t, "cancelled", bid.Status)
+		assert.Equal(t, CancelReasonSelfTrade, *bid.CancelReason)
+		assert.Equal(t, int64(40), bid.FilledQuantity)
+		assert.Equal(t, "cancelled", ownAsk.Status)
+		assert.Equal(t, "filled", ask.Status)
+
+		bidLevels, askLevels := book.snapshot(10)
+		assert.Len(t, bidLevels, 0)
+		assert.Len(t, askLevels, 0)
+	})
+
+	t.Run("Failed uncross keeps the auction running", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedAuctionBook(service)
+		book := service.engine.Book(tokenID)
+		book.auction = &auctionState{id: auctionID, reason: AuctionOpening, endsAt: time.Now().Add(-time.Second)}
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("INSERT INTO trades").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		assert.Equal(t, 0, service.UncrossAuctions())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.NotNil(t, book.auction)
+		assert.Equal(t, int64(300), book.liquidity("bid"))
+		assert.Equal(t, int64(250), book.liquidity("ask"))
+	})
+}
+
+func TestPriceBands(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	cfg := testutil.NewTestConfig()
+	cfg.Trading.PriceBandPercent = 10
+
+	t.Run("Limit orders outside the band are rejected", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+		listToken(service, tokenID)
+		// The band is 10% either side of the last price, 1.80 to 2.20
+		service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.00")
+
+		tests := []struct {
+			name          string
+			side          string
+			executionType string
+			price         string
+		}{
+			{"Bid above the band", "bid", "limit", "2.21"},
+			{"Ask below the band", "ask", "limit", "1.79"},
+			{"Stop limit above the band", "bid", "stop_limit", "2.50"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				order := testutil.MockOrder(userID, tokenID, tt.side, decimal.MustParse(tt.price), 100)
+				order.ExecutionType = tt.executionType
+				if tt.executionType == "stop_limit" {
+					stopPrice := decimal.MustParse("2.10")
+					order.StopPrice = &stopPrice
+				}
+
+				expectRejection(mock, tokenID)
+				_, _, err := service.CreateOrder(order)
+				assert.ErrorIs(t, err, ErrOutsidePriceBand)
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+		}
+	})
+
+	t.Run("Reference price is the volume-weighted average of recent trades", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, cfg, nil, nil)
+		book := service.engine.Book(tokenID)
+		book.lastPrice = decimal.MustParse("3.00")
+		book.recordPrints([]*models.Trade{
+			// Too old to count
+			{Price: decimal.MustParse("9.00"), Quantity: 1000, ExecutedAt: time.Now().Add(-time.Hour)},
+			{Price: decimal.MustParse("2.00"), Quantity: 300, ExecutedAt: time.Now().Add(-2 * time.Minute)},
+			{Price: decimal.MustParse("3.00"), Quantity: 100, ExecutedAt: time.Now().Add(-time.Minute)},
+		}, time.Now(), service.breakerWindow)
+
+		lower, upper, ok := service.priceBand(book, time.Now())
+		assert.True(t, ok)
+		assert.Equal(t, decimal.MustParse("2.25"), book.referencePrice())
+		assert.Equal(t, decimal.MustParse("2.025"), lower)
+		assert.Equal(t, decimal.MustParse("2.475"), upper)
+	})
+
+	t.Run("No band before the first trade or during an auction", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, cfg, nil, nil)
+		book := service.engine.Book(tokenID)
+
+		_, _, ok := service.priceBand(book, time.Now())
+		assert.False(t, ok)
+
+		book.lastPrice = decimal.MustParse("2.00")
+		book.auction = &auctionState{reason: AuctionReopening, endsAt: time.Now().Add(time.Minute)}
+		_, _, ok = service.priceBand(book, time.Now())
+		assert.False(t, ok)
+	})
+
+	t.Run("Market orders stop at the band edge", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+		seedOrder(service, tokenID, "ask", "2.10", 100)
+		seedOrder(service, tokenID, "ask", "2.30", 100)
+		service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.00")
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		order, trades, err := service.CreateOrder(&models.Order{
+			UserID:        userID,
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Quantity:      200,
+			ExecutionType: "market",
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 1)
+		assert.Equal(t, decimal.MustParse("2.10"), trades[0].Price)
+		assert.Equal(t, decimal.MustParse("2.20"), *order.ProtectionPrice)
+		assert.Equal(t, "cancelled", order.Status)
+		assert.Equal(t, CancelReasonProtection, *order.CancelReason)
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	haltID := "bb0e8400-e29b-41d4-a716-446655440000"
+
+	cfg := testutil.NewTestConfig()
+	cfg.Trading.CircuitBreakerPercent = 20
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+	book := service.engine.Book(tokenID)
+	book.lastPrice = decimal.MustParse("2.00")
+	book.recordPrints([]*models.Trade{
+		{Price: decimal.MustParse("2.00"), Quantity: 100, ExecutedAt: time.Now().Add(-time.Minute)},
+	}, time.Now(), service.breakerWindow)
+	seedOrder(service, tokenID, "ask", "2.50", 100)
+
+	// A trade 25% above the price a minute ago trips the breaker
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	expectEvents(mock)
+	mock.ExpectCommit()
+	mock.ExpectQuery("INSERT INTO trading_halts").
+		WithArgs(tokenID, HaltCircuitBreaker, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(haltID))
+
+	_, trades, err := service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.50"), 100))
+	assert.NoError(t, err)
+	assert.Len(t, trades, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	orderBook, err := service.GetOrderBook(tokenID, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseHalted, orderBook.Phase)
+	assert.Equal(t, HaltCircuitBreaker, orderBook.Halt.Reason)
+	assert.Equal(t, 5*time.Minute, orderBook.Halt.ResumesAt.Sub(orderBook.Halt.HaltedAt))
+
+	// Halted tokens take no new orders or amendments; cancels still work
+	resting := seedOrder(service, tokenID, "ask", "2.60", 100)
+	expectRejection(mock, tokenID)
+	_, _, err = service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.60"), 100))
+	assert.ErrorIs(t, err, ErrTradingHalted)
+	quantity := int64(50)
+	_, _, err = service.AmendOrder(resting.ID, resting.UserID, nil, &quantity)
+	assert.Error(t, err)
+
+	// Nothing resumes before the cooldown has passed
+	assert.Equal(t, 0, service.ResumeHalts())
+
+	// After it, the token re-opens with a call auction
+	past := time.Now().Add(-time.Second)
+	book.halt.resumesAt = &past
+
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE trading_halts SET resumed_at = NOW\\(\\)").
+		WithArgs(haltID, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO auctions").
+		WithArgs(tokenID, AuctionReopening, "running", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("aa0e8400-e29b-41d4-a716-446655440000"))
+	mock.ExpectCommit()
+
+	assert.Equal(t, 1, service.ResumeHalts())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Nil(t, book.halt)
+	assert.NotNil(t, book.auction)
+	assert.Equal(t, AuctionReopening, book.auction.reason)
+	assert.Equal(t, 2*time.Minute, book.auction.endsAt.Sub(time.Now()).Round(time.Minute))
+}
+
+func TestCircuitBreakerRetriesHaltRecord(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	haltID := "bb0e8400-e29b-41d4-a716-446655440000"
+
+	cfg := testutil.NewTestConfig()
+	cfg.Trading.CircuitBreakerPercent = 20
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+	book := service.engine.Book(tokenID)
+	book.lastPrice = decimal.MustParse("2.00")
+	book.recordPrints([]*models.Trade{
+		{Price: decimal.MustParse("2.00"), Quantity: 100, ExecutedAt: time.Now().Add(-time.Minute)},
+	}, time.Now(), service.breakerWindow)
+	seedOrder(service, tokenID, "ask", "2.50", 100)
+
+	// The halt takes effect even though it cannot be recorded
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSettlement(mock)
+	expectEvents(mock)
+	mock.ExpectCommit()
+	mock.ExpectQuery("INSERT INTO trading_halts").WillReturnError(sql.ErrConnDone)
+
+	_, _, err := service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.50"), 100))
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	orderBook, err := service.GetOrderBook(tokenID, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, PhaseHalted, orderBook.Phase)
+	assert.True(t, orderBook.Halt.Unrecorded)
+
+	// The sweep retries recording it, and the halt stays pending while it
+	// fails
+	mock.ExpectQuery("INSERT INTO trading_halts").WillReturnError(sql.ErrConnDone)
+	assert.Equal(t, 0, service.ResumeHalts())
+	assert.NotNil(t, book.halt)
+	assert.Empty(t, book.halt.id)
+
+	mock.ExpectQuery("INSERT INTO trading_halts").
+		WithArgs(tokenID, HaltCircuitBreaker, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(haltID))
+	assert.Equal(t, 0, service.ResumeHalts())
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, haltID, book.halt.id)
+	assert.False(t, book.haltInfo().Unrecorded)
+
+	// Once recorded, the halt ends like any other
+	past := time.Now().Add(-time.Second)
+	book.halt.resumesAt = &past
+
+	expectJournalTx(mock, tokenID)
+	mock.ExpectExec("UPDATE trading_halts SET resumed_at = NOW\\(\\)").
+		WithArgs(haltID, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO auctions").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("aa0e8400-e29b-41d4-a716-446655440000"))
+	mock.ExpectCommit()
+
+	assert.Equal(t, 1, service.ResumeHalts())
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Nil(t, book.halt)
+}
+
+func TestTokenStatus(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	expectToken := func(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+		mock.ExpectQuery("SELECT status, tick_size, lot_size FROM tokens WHERE id = \\$1").
+			WithArgs(tokenID).
+			WillReturnRows(rows)
+	}
+
+	t.Run("Orders on unknown tokens are rejected", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		expectToken(mock, sqlmock.NewRows([]string{"status", "tick_size", "lot_size"}))
+
+		_, _, err := service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Orders on tokens that are not active are rejected", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		expectToken(mock, sqlmock.NewRows([]string{"status", "tick_size", "lot_size"}).AddRow("pending", "0.05000000", 10))
+		expectRejection(mock, tokenID)
+
+		_, _, err := service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.ErrorIs(t, err, ErrTokenNotActive)
+		// The token is loaded once, with its market rules
+		expectRejection(mock, tokenID)
+		_, _, err = service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.ErrorIs(t, err, ErrTokenNotActive)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, int64(10), service.engine.Book(tokenID).rules.lotSize)
+	})
+
+	t.Run("Suspension can cancel resting orders", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		bid := seedOrder(service, tokenID, "bid", "2.45", 100)
+		ask := seedOrder(service, tokenID, "ask", "2.50", 100)
+		otherBid := seedOrder(service, tokenID, "bid", "2.40", 100)
+		otherBid.UserID = bid.UserID
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE tokens SET status = \\$2 WHERE id = \\$1").
+			WithArgs(tokenID, TokenSuspended).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("UPDATE orders o SET status = 'cancelled'").
+			WithArgs(tokenID, CancelReasonSuspended).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "side", "locked_amount"}).
+				AddRow(bid.ID, bid.UserID, "bid", bid.LockedAmount).
+				AddRow(ask.ID, ask.UserID, "ask", ask.LockedAmount).
+				AddRow(otherBid.ID, otherBid.UserID, "bid", otherBid.LockedAmount))
+		// Each user's reservation is released once per currency, in user order
+		first, second := bid, ask
+		if ask.UserID < bid.UserID {
+			first, second = ask, bid
+		}
+		for _, o := range []*models.Order{first, second} {
+			currency, amount := tokenID, ask.LockedAmount
+			if o == bid {
+				currency, amount = QuoteCurrency, bid.LockedAmount.Add(otherBid.LockedAmount)
+			}
+			mock.ExpectExec("UPDATE user_balances SET locked = locked -").
+				WithArgs(o.UserID, currency, amount).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		cancelled, err := service.SetTokenStatus(tokenID, TokenSuspended, true)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.ElementsMatch(t, []string{bid.ID, ask.ID, otherBid.ID}, cancelled)
+
+		bids, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+		assert.Len(t, asks, 0)
+
+		expectRejection(mock, tokenID)
+		_, _, err = service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.ErrorIs(t, err, ErrTokenNotActive)
+
+		// Reactivating takes orders again
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE tokens SET status").
+			WithArgs(tokenID, TokenActive).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		cancelled, err = service.SetTokenStatus(tokenID, TokenActive, false)
+		assert.NoError(t, err)
+		assert.Len(t, cancelled, 0)
+		_, _, err = service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Suspension keeps resting orders unless asked", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "bid", "2.45", 100)
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE tokens SET status").
+			WithArgs(tokenID, TokenSuspended).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		_, err := service.SetTokenStatus(tokenID, TokenSuspended, false)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		bids, _ := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 1)
+	})
+
+	t.Run("Invalid status changes", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+
+		_, err := service.SetTokenStatus(tokenID, "pending", false)
+		assert.ErrorIs(t, err, ErrInvalidTokenStatus)
+		_, err = service.SetTokenStatus(tokenID, TokenActive, true)
+		assert.ErrorIs(t, err, ErrInvalidTokenStatus)
+
+		listToken(service, tokenID)
+		service.engine.Book(tokenID).auction = &auctionState{reason: AuctionOpening, endsAt: time.Now().Add(time.Minute)}
+		_, err = service.SetTokenStatus(tokenID, TokenSuspended, false)
+		assert.ErrorIs(t, err, ErrAuctionInProgress)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown tokens get no book", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		for i := 0; i < 3; i++ {
+			expectToken(mock, sqlmock.NewRows([]string{"status", "tick_size", "lot_size"}))
+		}
+
+		_, err := service.HaltTrading(tokenID, "unknown")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		_, err = service.ResumeTrading(tokenID, "unknown")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		_, err = service.SetTokenStatus(tokenID, TokenSuspended, false)
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Empty(t, service.engine.Books())
+	})
+
+	t.Run("Status changes load the token into a new book", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		expectToken(mock, sqlmock.NewRows([]string{"status", "tick_size", "lot_size"}).AddRow(TokenActive, "0.05000000", 10))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE tokens SET status").
+			WithArgs(tokenID, TokenSuspended).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		_, err := service.SetTokenStatus(tokenID, TokenSuspended, false)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		book := service.engine.Book(tokenID)
+		assert.Equal(t, TokenSuspended, book.status)
+		assert.Equal(t, int64(10), book.rules.lotSize)
+	})
+
+	t.Run("Admin halt and resume", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenID)
+		haltID := "bb0e8400-e29b-41d4-a716-446655440000"
+
+		_, err := service.ResumeTrading(tokenID, "")
+		assert.ErrorIs(t, err, ErrNotHalted)
+
+		mock.ExpectQuery("INSERT INTO trading_halts").
+			WithArgs(tokenID, HaltAdmin, "pending announcement", sqlmock.AnyArg(), nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(haltID))
+
+		halt, err := service.HaltTrading(tokenID, "pending announcement")
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, HaltAdmin, halt.Reason)
+		assert.Equal(t, "pending announcement", halt.Message)
+		assert.Nil(t, halt.ResumesAt)
+
+		expectRejection(mock, tokenID)
+		_, _, err = service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.ErrorIs(t, err, ErrTradingHalted)
+		_, err = service.HaltTrading(tokenID, "again")
+		assert.ErrorIs(t, err, ErrTradingHalted)
+
+		// Admin halts never resume on their own
+		assert.Equal(t, 0, service.ResumeHalts())
+
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE trading_halts SET resumed_at = NOW\\(\\), resume_message").
+			WithArgs(haltID, "announcement published").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("INSERT INTO auctions").
+			WithArgs(tokenID, AuctionReopening, "running", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("aa0e8400-e29b-41d4-a716-446655440000"))
+		mock.ExpectCommit()
+
+		auction, err := service.ResumeTrading(tokenID, "announcement published")
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, AuctionReopening, auction.Reason)
+
+		// Nor can a token be halted during its call auction
+		_, err = service.HaltTrading(tokenID, "again")
+		assert.ErrorIs(t, err, ErrAuctionInProgress)
+	})
+}
+
+func TestMarketRules(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+
+	t.Run("Default tick sizes depend on the price", func(t *testing.T) {
+		tests := []struct {
+			price string
+			tick  string
+		}{
+			{"0.05", "0.0001"},
+			{"0.0999", "0.0001"},
+			{"0.10", "0.001"},
+			{"0.999", "0.001"},
+			{"1.00", "0.01"},
+			{"150.75", "0.01"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.price, func(t *testing.T) {
+				assert.Equal(t, decimal.MustParse(tt.tick), defaultMarketRules.tickAt(decimal.MustParse(tt.price)))
+			})
+		}
+	})
+
+	t.Run("Orders off tick or lot are rejected", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenID)
+		tickSize := decimal.MustParse("0.05")
+		service.engine.Book(tokenID).rules = newMarketRules(&tickSize, 10)
+
+		displayQuantity := int64(15)
+		tests := []struct {
+			name    string
+			modify  func(*models.Order)
+			wantErr error
+		}{
+			{"Price off tick", func(o *models.Order) { o.Price = decimal.MustParse("2.42") }, ErrPriceNotOnTick},
+			{"Stop limit price off tick", func(o *models.Order) {
+				o.ExecutionType = "stop_limit"
+				o.Price = decimal.MustParse("2.42")
+				stopPrice := decimal.MustParse("2.40")
+				o.StopPrice = &stopPrice
+			}, ErrPriceNotOnTick},
+			{"Quantity off lot", func(o *models.Order) { o.Quantity = 105 }, ErrQuantityNotInLots},
+			{"Display quantity off lot", func(o *models.Order) { o.DisplayQuantity = &displayQuantity }, ErrQuantityNotInLots},
+			{"Market quantity off lot", func(o *models.Order) {
+				o.ExecutionType = "market"
+				o.Price = decimal.Zero
+				o.Quantity = 7
+			}, ErrQuantityNotInLots},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				order := testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100)
+				tt.modify(order)
+
+				expectRejection(mock, tokenID)
+				_, _, err := service.CreateOrder(order)
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+		}
+	})
+
+	t.Run("Orders on tick and lot are accepted", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenID)
+		tickSize := decimal.MustParse("0.05")
+		service.engine.Book(tokenID).rules = newMarketRules(&tickSize, 10)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		order, _, err := service.CreateOrder(testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.45"), 100))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, "open", order.Status)
+	})
+
+	t.Run("Post-only orders reprice by the tick at the opposite price", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "ask", "0.50", 100)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		order := testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("0.52"), 100)
+		order.PostOnly = true
+		order.PostOnlyMode = PostOnlyReprice
+
+		placed, _, err := service.CreateOrder(order)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, decimal.MustParse("0.499"), placed.Price)
+	})
+
+	t.Run("Repriced post-only orders must follow the rules", func(t *testing.T) {
+		// An ask resting from before the tick size grew leaves no price one
+		// tick inside it that is on the new tick
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "ask", "2.47", 100)
+		tickSize := decimal.MustParse("0.05")
+		service.engine.Book(tokenID).rules = newMarketRules(&tickSize, 10)
+
+		order := testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.50"), 100)
+		order.PostOnly = true
+		order.PostOnlyMode = PostOnlyReprice
+
+		expectRejection(mock, tokenID)
+		_, _, err := service.CreateOrder(order)
+		assert.ErrorIs(t, err, ErrPriceNotOnTick)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// Nor may the new price leave the price band
+		cfg := testutil.NewTestConfig()
+		cfg.Trading.PriceBandPercent = 10
+		db, mock, cleanup = testutil.NewMockDB(t)
+		defer cleanup()
+
+		service = NewService(db, &cache.RedisClient{}, cfg, nil, nil)
+		seedOrder(service, tokenID, "ask", "2.00", 100)
+		service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.50")
+
+		order = testutil.MockOrder(userID, tokenID, "bid", decimal.MustParse("2.50"), 100)
+		order.PostOnly = true
+		order.PostOnlyMode = PostOnlyReprice
+
+		expectRejection(mock, tokenID)
+		_, _, err = service.CreateOrder(order)
+		assert.ErrorIs(t, err, ErrOutsidePriceBand)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		bids, _ := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+	})
+
+	t.Run("Amendments must follow the rules", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		resting := seedOrder(service, tokenID, "bid", "2.45", 100)
+		tickSize := decimal.MustParse("0.05")
+		service.engine.Book(tokenID).rules = newMarketRules(&tickSize, 10)
+
+		expectLookup := func() {
+			mock.ExpectQuery("SELECT token_id FROM orders").
+				WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		}
+
+		expectLookup()
+		price := decimal.MustParse("2.47")
+		_, _, err := service.AmendOrder(resting.ID, resting.UserID, &price, nil)
+		assert.ErrorIs(t, err, ErrPriceNotOnTick)
+
+		expectLookup()
+		quantity := int64(95)
+		_, _, err = service.AmendOrder(resting.ID, resting.UserID, nil, &quantity)
+		assert.ErrorIs(t, err, ErrQuantityNotInLots)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Market info", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		cfg.Trading.PriceBandPercent = 10
+		service := NewService(nil, &cache.RedisClient{}, cfg, nil, nil)
+		listToken(service, tokenID)
+
+		info, err := service.GetMarketInfo(tokenID)
+		assert.NoError(t, err)
+		assert.Equal(t, TokenActive, info.Status)
+		assert.Equal(t, DefaultTickSizes, info.TickSizes)
+		assert.Equal(t, int64(1), info.LotSize)
+		assert.Equal(t, PhaseContinuous, info.Phase)
+		assert.Nil(t, info.PriceBand)
+
+		service.engine.Book(tokenID).lastPrice = decimal.MustParse("2.00")
+		info, err = service.GetMarketInfo(tokenID)
+		assert.NoError(t, err)
+		assert.Equal(t, &models.PriceBand{Lower: decimal.MustParse("1.80"), Upper: decimal.MustParse("2.20")}, info.PriceBand)
+	})
+
+	t.Run("Market info of a token without a book", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		tickSize := decimal.MustParse("0.05")
+
+		mock.ExpectQuery("SELECT status, tick_size, lot_size FROM tokens WHERE id = \\$1").
+			WithArgs(tokenID).
+			WillReturnRows(sqlmock.NewRows([]string{"status", "tick_size", "lot_size"}).AddRow(TokenActive, &tickSize, int64(10)))
+
+		info, err := service.GetMarketInfo(tokenID)
+		assert.NoError(t, err)
+		assert.Equal(t, TokenActive, info.Status)
+		assert.Equal(t, []models.TickTier{{MinPrice: decimal.Zero, TickSize: tickSize}}, info.TickSizes)
+		assert.Equal(t, int64(10), info.LotSize)
+
+		missingID := "660e8400-e29b-41d4-a716-446655440099"
+		mock.ExpectQuery("SELECT status, tick_size, lot_size FROM tokens WHERE id = \\$1").
+			WithArgs(missingID).
+			WillReturnError(sql.ErrNoRows)
+
+		_, err = service.GetMarketInfo(missingID)
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		// Reading market info does not give a token a book
+		assert.Empty(t, service.engine.Books())
+	})
+
+	t.Run("Update market rules", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		tickSize := decimal.MustParse("0.05")
+
+		mock.ExpectQuery("UPDATE tokens SET tick_size = \\$2, lot_size = \\$3 WHERE id = \\$1 RETURNING status").
+			WithArgs(tokenID, &tickSize, int64(10)).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(TokenActive))
+
+		info, err := service.UpdateMarketRules(tokenID, &tickSize, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, TokenActive, info.Status)
+		assert.Equal(t, []models.TickTier{{MinPrice: decimal.Zero, TickSize: tickSize}}, info.TickSizes)
+		assert.Equal(t, int64(10), info.LotSize)
+
+		missingID := "660e8400-e29b-41d4-a716-446655440099"
+		mock.ExpectQuery("UPDATE tokens SET tick_size").
+			WithArgs(missingID, nil, int64(1)).
+			WillReturnError(sql.ErrNoRows)
+
+		_, err = service.UpdateMarketRules(missingID, nil, 1)
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		_, err = service.UpdateMarketRules(tokenID, nil, 0)
+		assert.ErrorIs(t, err, ErrInvalidMarketRules)
+		zero := decimal.Zero
+		_, err = service.UpdateMarketRules(tokenID, &zero, 1)
+		assert.ErrorIs(t, err, ErrInvalidMarketRules)
+	})
+}
+
+func TestFeeCalculation(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	tests := []struct {
+		name          string
+		incomingSide  string
+		executionType string
+		wantBuyerFee  decimal.Decimal
+		wantSellerFee decimal.Decimal
+	}{
+		{
+			name:          "Incoming buy takes, resting sell makes",
+			incomingSide:  "bid",
+			executionType: "market",
+			wantBuyerFee:  decimal.MustParse("1.23"),  // 246 × 0.5%
+			wantSellerFee: decimal.MustParse("0.738"), // 246 × 0.3%
+		},
+		{
+			name:          "Incoming sell takes, resting buy makes",
+			incomingSide:  "ask",
+			executionType: "limit",
+			wantBuyerFee:  decimal.MustParse("0.738"),
+			wantSellerFee: decimal.MustParse("1.23"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{engine: NewEngine()}
+			seedOrder(service, tokenID, oppositeSide(tt.incomingSide), "2.46", 100)
+
+			incoming := testutil.MockOrder("550e8400-e29b-41d4-a716-446655440000", tokenID, tt.incomingSide, decimal.MustParse("2.46"), 100)
+			incoming.ExecutionType = tt.executionType
+
+			trades := service.buildTrades(incoming, service.engine.Book(tokenID).match(incoming).fills)
+
+			assert.Len(t, trades, 1)
+			assert.Equal(t, tt.wantBuyerFee, trades[0].BuyerFee)
+			assert.Equal(t, tt.wantSellerFee, trades[0].SellerFee)
+			assert.Equal(t, tt.wantBuyerFee.Add(tt.wantSellerFee), trades[0].PlatformFee)
+		})
+	}
+}
+
+func TestFeeAttribution(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	takerFee := decimal.MustParse("1.23")  // 246 × 0.5%
+	makerFee := decimal.MustParse("0.738") // 246 × 0.3%
+
+	tests := []struct {
+		name         string
+		orderType    string
+		incomingSide string
+	}{
+		{name: "Buyer takes from a resting seller", orderType: "buy", incomingSide: "bid"},
+		{name: "Seller takes from a resting buyer", orderType: "sell", incomingSide: "ask"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+			resting := seedOrder(service, tokenID, oppositeSide(tt.incomingSide), "2.46", 100)
+
+			buyerFee, sellerFee := takerFee, makerFee
+			if tt.incomingSide == "ask" {
+				buyerFee, sellerFee = makerFee, takerFee
+			}
+
+			expectJournalTx(mock, tokenID)
+			expectReserve(mock)
+			mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO trades").
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(100),
+					decimal.MustParse("246"), buyerFee, sellerFee, takerFee.Add(makerFee),
+					nil, nil, "pending", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			// The resting order is charged the maker fee whichever side it is on
+			mock.ExpectExec("UPDATE orders").
+				WithArgs(int64(100), int64(0), "filled", makerFee, sqlmock.AnyArg(),
+					resting.ID, int64(100), sqlmock.AnyArg(), nil).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			expectSettlement(mock)
+			expectEvents(mock)
+			mock.ExpectCommit()
+
+			created, trades, err := service.CreateOrder(&models.Order{
+				UserID:        "550e8400-e29b-41d4-a716-446655440000",
+				TokenID:       tokenID,
+				OrderType:     tt.orderType,
+				Side:          tt.incomingSide,
+				Price:         decimal.MustParse("2.46"),
+				Quantity:      100,
+				ExecutionType: "limit",
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			assert.Len(t, trades, 1)
+			assert.Equal(t, buyerFee, trades[0].BuyerFee)
+			assert.Equal(t, sellerFee, trades[0].SellerFee)
+			assert.Equal(t, takerFee, created.FeePaid)
+			assert.Equal(t, makerFee, resting.FeePaid)
+		})
+	}
+}
+
+// stubFeeSchedules resolves every user and token to the same rates
+type stubFeeSchedules struct {
+	rates *fees.Rates
+	err   error
+}
+
+func (s stubFeeSchedules) RatesFor(userID, tokenID string) (*fees.Rates, error) {
+	return s.rates, s.err
+}
+
+func TestFeeSchedules(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	incomingSchedule := "990e8400-e29b-41d4-a716-446655440009"
+	restingSchedule := "990e8400-e29b-41d4-a716-446655440008"
+
+	t.Run("Each side pays the rates resolved when its order was placed", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), stubFeeSchedules{
+			rates: &fees.Rates{
+				ScheduleID: incomingSchedule,
+				Version:    2,
+				Maker:      decimal.MustParse("0.001"),
+				Taker:      decimal.MustParse("0.002"),
+			},
+		}, nil)
+		resting := seedOrder(service, tokenID, "ask", "2.46", 100)
+		resting.MakerFeeRate = decimal.MustParse("0.0005")
+		resting.FeeScheduleID = &restingSchedule
+
+		takerFee := decimal.MustParse("0.492") // 246 × 0.2%
+		makerFee := decimal.MustParse("0.123") // 246 × 0.05%
+
+		expectJournalTx(mock, tokenID)
+		// Reserved at the scheduled taker rate
+		mock.ExpectExec("UPDATE user_balances SET locked = locked \\+").
+			WithArgs("550e8400-e29b-41d4-a716-446655440000", QuoteCurrency, decimal.MustParse("246.492")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(100),
+				decimal.MustParse("246"), takerFee, makerFee, takerFee.Add(makerFee),
+				incomingSchedule, restingSchedule, "pending", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		created, trades, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      100,
+			ExecutionType: "limit",
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Len(t, trades, 1)
+		assert.Equal(t, decimal.MustParse("0.002"), created.FeeRate)
+		assert.Equal(t, decimal.MustParse("0.001"), created.MakerFeeRate)
+		assert.Equal(t, incomingSchedule, *created.FeeScheduleID)
+		assert.Equal(t, takerFee, created.FeePaid)
+		assert.Equal(t, makerFee, resting.FeePaid)
+	})
+
+	t.Run("Unresolvable rates reject the order", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), stubFeeSchedules{
+			err: errors.New("failed to get fee schedule: connection refused"),
+		}, nil)
+
+		_, _, err := service.CreateOrder(&models.Order{
+			UserID:        "550e8400-e29b-41d4-a716-446655440000",
+			TokenID:       tokenID,
+			OrderType:     "buy",
+			Side:          "bid",
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      100,
+			ExecutionType: "limit",
+		})
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		bids, _ := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+	})
+}
+
+func TestFeeRounding(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+
+	db, mock, cleanup := testutil.NewMockDB(t)
+	defer cleanup()
+
+	service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+	seedOrder(service, tokenID, "ask", "0.00000333", 7)
+	seedOrder(service, tokenID, "ask", "1.23456789", 1)
+
+	expectJournalTx(mock, tokenID)
+	expectReserve(mock)
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+	}
+	expectEvents(mock)
+	mock.ExpectCommit()
+
+	created, trades, err := service.CreateOrder(&models.Order{
+		UserID:        "550e8400-e29b-41d4-a716-446655440000",
+		TokenID:       tokenID,
+		OrderType:     "buy",
+		Side:          "bid",
+		Quantity:      8,
+		ExecutionType: "market",
+		TimeInForce:   "GTC",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, trades, 2)
+
+	// Fractional fees round up to the next 1e-8 unit
+	expected := []struct {
+		totalValue, buyerFee, sellerFee string
+	}{
+		{"0.00002331", "0.00000012", "0.00000007"},
+		{"1.23456789", "0.00617284", "0.00370371"},
+	}
+
+	feePaid := decimal.Zero
+	for i, trade := range trades {
+		assert.Equal(t, decimal.MustParse(expected[i].totalValue), trade.TotalValue)
+		assert.Equal(t, decimal.MustParse(expected[i].buyerFee), trade.BuyerFee)
+		assert.Equal(t, decimal.MustParse(expected[i].sellerFee), trade.SellerFee)
+		assert.Equal(t, trade.BuyerFee.Add(trade.SellerFee), trade.PlatformFee)
+		feePaid = feePaid.Add(trade.BuyerFee)
+	}
+
+	// The order's fee reconciles exactly with its fills
+	assert.Equal(t, feePaid, created.FeePaid)
+	assert.Equal(t, decimal.MustParse("0.00617296"), created.FeePaid)
+}
+
+// stubCreatorRestrictions resolves every user and token to the same
+// restriction
+type stubCreatorRestrictions struct {
+	restriction *restrictions.Restriction
+	err         error
+}
+
+func (s stubCreatorRestrictions) RestrictionFor(userID, tokenID string) (*restrictions.Restriction, error) {
+	return s.restriction, s.err
+}
+
+func TestCreatorRestrictions(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	creatorID := "550e8400-e29b-41d4-a716-446655440000"
+
+	newOrder := func(side string) *models.Order {
+		orderType := "buy"
+		if side == "ask" {
+			orderType = "sell"
+		}
+		return &models.Order{
+			UserID:        creatorID,
+			TokenID:       tokenID,
+			OrderType:     orderType,
+			Side:          side,
+			Price:         decimal.MustParse("2.46"),
+			Quantity:      100,
+			ExecutionType: "limit",
+			TimeInForce:   "GTC",
+		}
+	}
+
+	t.Run("Creator cannot trade either side during the lockup", func(t *testing.T) {
+		endsAt := time.Now().Add(24 * time.Hour)
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			restriction: &restrictions.Restriction{TokenID: tokenID, TradingBlockEndsAt: endsAt},
+		})
+		listToken(service, tokenID)
+
+		for _, side := range []string{"bid", "ask"} {
+			_, _, err := service.CreateOrder(newOrder(side))
+			assert.ErrorIs(t, err, ErrCreatorTradingBlocked)
+			assert.Equal(t, CodeCreatorTradingBlocked, ErrorCode(err))
+		}
+
+		bids, asks := service.engine.Book(tokenID).snapshot(10)
+		assert.Len(t, bids, 0)
+		assert.Len(t, asks, 0)
+	})
+
+	t.Run("Creator trades once the lockup has ended", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			restriction: &restrictions.Restriction{TokenID: tokenID, TradingBlockEndsAt: time.Now().Add(-time.Minute)},
+		})
+		listToken(service, tokenID)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		_, _, err := service.CreateOrder(newOrder("ask"))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Creator orders are rejected until restrictions are synced", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			err: restrictions.ErrNotSynced,
+		})
+		listToken(service, tokenID)
+
+		_, _, err := service.CreateOrder(newOrder("ask"))
+		assert.ErrorIs(t, err, ErrCreatorRestrictionsUnavailable)
+		assert.Equal(t, CodeCreatorRestrictionsUnavailable, ErrorCode(err))
+	})
+
+	t.Run("Creator orders are rejected while restrictions are out of date", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			err: restrictions.ErrStale,
+		})
+		listToken(service, tokenID)
+
+		_, _, err := service.CreateOrder(newOrder("ask"))
+		assert.ErrorIs(t, err, ErrCreatorRestrictionsUnavailable)
+	})
+
+	t.Run("Batch results carry the rejection", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			restriction: &restrictions.Restriction{TokenID: tokenID, TradingBlockEndsAt: time.Now().Add(time.Hour)},
+		})
+		listToken(service, tokenID)
+
+		results, err := service.PlaceOrders([]*models.Order{newOrder("ask")})
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+		assert.Equal(t, CodeCreatorTradingBlocked, results[0].Code)
+	})
+
+	t.Run("Creator cannot amend during the lockup", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, stubCreatorRestrictions{
+			restriction: &restrictions.Restriction{TokenID: tokenID, TradingBlockEndsAt: time.Now().Add(time.Hour)},
+		})
+		resting := seedOrder(service, tokenID, "ask", "2.46", 100)
+
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+
+		quantity := int64(50)
+		_, _, err := service.AmendOrder(resting.ID, resting.UserID, nil, &quantity)
+		assert.ErrorIs(t, err, ErrCreatorTradingBlocked)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Equal(t, int64(100), resting.RemainingQuantity)
+	})
+}
+
+// journalCapture is a sqlmock argument that keeps each batch of order events
+// written to the journal, numbering them as the database would
+type journalCapture struct {
+	tokenID string
+	events  []*models.OrderEvent
+}
+
+func (c *journalCapture) Match(v driver.Value) bool {
+	var batch []struct {
+		OrderID string          `json:"orderId"`
+		Type    string          `json:"type"`
+		Data    json.RawMessage `json:"data"`
+	}
+	data, ok := v.(string)
+	if !ok || json.Unmarshal([]byte(data), &batch) != nil {
+		return false
+	}
+
+	for _, e := range batch {
+		c.events = append(c.events, &models.OrderEvent{
+			Sequence:  int64(len(c.events) + 1),
+			TokenID:   c.tokenID,
+			OrderID:   e.OrderID,
+			Type:      e.Type,
+			Data:      e.Data,
+			CreatedAt: time.Now(),
+		})
+	}
+	return true
+}
+
+// expect expects a batch of order events to be captured
+func (c *journalCapture) expect(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("INSERT INTO order_events").
+		WithArgs(c.tokenID, c).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestOrderJournal(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	buyerID := "550e8400-e29b-41d4-a716-446655440000"
+	sellerID := "550e8400-e29b-41d4-a716-446655440002"
+
+	t.Run("Replaying the journal rebuilds the book", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenID)
+		journal := &journalCapture{tokenID: tokenID}
+
+		place := func(userID, side, price string, quantity int64, timeInForce string) *models.Order {
+			order := testutil.MockOrder(userID, tokenID, side, decimal.MustParse(price), quantity)
+			order.TimeInForce = timeInForce
+			placed, _, err := service.CreateOrder(order)
+			assert.NoError(t, err)
+			return placed
+		}
+		expectAccepted := func() {
+			expectJournalTx(mock, tokenID)
+			expectReserve(mock)
+			mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+			journal.expect(mock)
+			mock.ExpectCommit()
+		}
+
+		expectAccepted()
+		filledAsk := place(sellerID, "ask", "2.46", 100, "GTC")
+		expectAccepted()
+		cancelledAsk := place(sellerID, "ask", "2.50", 50, "GTC")
+
+		// A fill-or-kill order that cannot fill is only journaled
+		expectJournalTx(mock, tokenID)
+		journal.expect(mock)
+		mock.ExpectCommit()
+		killed := place(buyerID, "bid", "2.46", 200, "FOK")
+		assert.Equal(t, CancelReasonFOKUnfilled, *killed.CancelReason)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		journal.expect(mock)
+		mock.ExpectCommit()
+		bid := place(buyerID, "bid", "2.46", 150, "GTC")
+
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET quantity = quantity -").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").WillReturnResult(sqlmock.NewResult(0, 1))
+		journal.expect(mock)
+		mock.ExpectCommit()
+		quantity := int64(120)
+		_, _, err := service.AmendOrder(bid.ID, buyerID, nil, &quantity)
+		assert.NoError(t, err)
+
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("UPDATE orders o SET status").
+			WillReturnRows(sqlmock.NewRows([]string{"side", "locked_amount"}).AddRow("ask", "50"))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").WillReturnResult(sqlmock.NewResult(0, 1))
+		journal.expect(mock)
+		mock.ExpectCommit()
+		assert.NoError(t, service.CancelOrder(cancelledAsk.ID, sellerID))
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		r, err := replayJournal(tokenID, journal.events)
+		assert.NoError(t, err)
+		assert.Empty(t, r.mismatches)
+		assert.Equal(t, 1, r.rejected)
+		assert.Len(t, r.trades, 1)
+
+		assert.Equal(t, "filled", r.orders[filledAsk.ID].Status)
+		assert.Equal(t, "cancelled", r.orders[cancelledAsk.ID].Status)
+		assert.Equal(t, CancelReasonUser, *r.orders[cancelledAsk.ID].CancelReason)
+		replayed := r.orders[bid.ID]
+		assert.Equal(t, "partially_filled", replayed.Status)
+		assert.Equal(t, int64(120), replayed.Quantity)
+		assert.Equal(t, int64(100), replayed.FilledQuantity)
+		assert.Equal(t, int64(20), replayed.RemainingQuantity)
+
+		book := service.engine.Book(tokenID)
+		assert.Equal(t, book.orders[bid.ID].order.FeePaid, replayed.FeePaid)
+
+		// The rebuilt book matches the live one level for level
+		bids, asks := book.snapshot(10)
+		replayedBids, replayedAsks := r.book().snapshot(10)
+		assert.Equal(t, bids, replayedBids)
+		assert.Equal(t, asks, replayedAsks)
+
+		// Replay depends only on the events
+		again, err := replayJournal(tokenID, journal.events)
+		assert.NoError(t, err)
+		assert.Equal(t, r.orders, again.orders)
+	})
+
+	t.Run("Replay applies trailed stops and requeued icebergs", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listToken(service, tokenID)
+		book := service.engine.Book(tokenID)
+		book.lastPrice = decimal.MustParse("2.45")
+		journal := &journalCapture{tokenID: tokenID}
+
+		expectAccepted := func() {
+			expectJournalTx(mock, tokenID)
+			expectReserve(mock)
+			mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+			journal.expect(mock)
+			mock.ExpectCommit()
+		}
+
+		trail := decimal.MustParse("0.05")
+		expectAccepted()
+		stop, _, err := service.CreateOrder(&models.Order{
+			UserID:        sellerID,
+			TokenID:       tokenID,
+			OrderType:     "sell",
+			Side:          "ask",
+			Quantity:      100,
+			ExecutionType: "trailing_stop",
+			TrailAmount:   &trail,
+		})
+		assert.NoError(t, err)
+
+		display := int64(10)
+		iceberg := testutil.MockOrder(sellerID, tokenID, "ask", decimal.MustParse("2.50"), 30)
+		iceberg.DisplayQuantity = &display
+		expectAccepted()
+		iceberg, _, err = service.CreateOrder(iceberg)
+		assert.NoError(t, err)
+
+		behind := testutil.MockOrder(uuid.New().String(), tokenID, "ask", decimal.MustParse("2.50"), 10)
+		expectAccepted()
+		behind, _, err = service.CreateOrder(behind)
+		assert.NoError(t, err)
+
+		// Taking the iceberg's slice requeues it behind the other ask, and
+		// the trade at 2.50 raises the stop's mark
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		journal.expect(mock)
+		mock.ExpectCommit()
+		expectJournalTx(mock, tokenID)
+		mock.ExpectExec("UPDATE orders SET trail_mark").WillReturnResult(sqlmock.NewResult(0, 1))
+		journal.expect(mock)
+		mock.ExpectCommit()
+		_, _, err = service.CreateOrder(testutil.MockOrder(buyerID, tokenID, "bid", decimal.MustParse("2.50"), 10))
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		types := make([]string, len(journal.events))
+		for i, e := range journal.events {
+			types[i] = e.Type
+		}
+		assert.Contains(t, types, OrderEventRequeued)
+		assert.Equal(t, OrderEventTrailed, types[len(types)-1])
+
+		r, err := replayJournal(tokenID, journal.events)
+		assert.NoError(t, err)
+		assert.Empty(t, r.mismatches)
+
+		assert.NotNil(t, r.orders[iceberg.ID].RequeuedAt)
+		assert.Equal(t, decimal.MustParse("2.5"), *r.orders[stop.ID].TrailMark)
+		assert.Equal(t, decimal.MustParse("2.45"), *r.orders[stop.ID].StopPrice)
+
+		// The rebuilt book keeps the requeued iceberg behind the other ask
+		// and parks the stop at its trailed price
+		replayed := r.book()
+		fills := replayed.match(&models.Order{Side: "bid", Price: decimal.MustParse("2.50"), RemainingQuantity: 10}).fills
+		assert.Len(t, fills, 1)
+		assert.Equal(t, behind.ID, fills[0].resting.order.ID)
+		assert.Len(t, replayed.stops, 1)
+		assert.Equal(t, *book.stops[0].StopPrice, *replayed.stops[0].StopPrice)
+
+		bids, asks := book.snapshot(10)
+		replayedBids, replayedAsks := replayed.snapshot(10)
+		assert.Equal(t, bids, replayedBids)
+		assert.Equal(t, asks, replayedAsks)
+	})
+
+	t.Run("Gaps and disagreeing fills are reported", func(t *testing.T) {
+		orderID := "770e8400-e29b-41d4-a716-446655440000"
+		events := []*models.OrderEvent{
+			{Sequence: 1, OrderID: orderID, Type: OrderEventAccepted,
+				Data: json.RawMessage(`{"id":"` + orderID + `","side":"bid","price":2.46,"quantity":100,"remainingQuantity":100,"status":"open"}`)},
+			{Sequence: 3, OrderID: orderID, Type: OrderEventPartiallyFilled,
+				Data: json.RawMessage(`{"filledQuantity":40,"remainingQuantity":60}`)},
+		}
+
+		r, err := replayJournal(tokenID, events)
+		assert.NoError(t, err)
+		assert.Equal(t, []models.JournalMismatch{
+			{Kind: "sequence", ID: "2", Field: "sequence", Journal: "3"},
+			{Kind: "event", ID: orderID, Field: "filledQuantity", Journal: "40", Table: "0"},
+			{Kind: "event", ID: orderID, Field: "remainingQuantity", Journal: "60", Table: "100"},
+		}, r.mismatches)
+	})
+
+	t.Run("Verify diffs the replay against the tables", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		orderID := "770e8400-e29b-41d4-a716-446655440000"
+		snapshotAt := time.Now().Add(-time.Hour)
+
+		mock.ExpectQuery("SELECT sequence, order_id, event_type, data, created_at FROM order_events").
+			WithArgs(tokenID).
+			WillReturnRows(sqlmock.NewRows([]string{"sequence", "order_id", "event_type", "data", "created_at"}).
+				AddRow(1, orderID, OrderEventSnapshot,
+					`{"id":"`+orderID+`","side":"bid","price":2.46,"quantity":100,"remainingQuantity":100,"status":"open","feePaid":0}`,
+					snapshotAt))
+		mock.ExpectQuery("SELECT id, status").
+			WithArgs(tokenID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status", "cancel_reason", "price", "quantity",
+				"filled_quantity", "remaining_quantity", "fee_paid"}).
+				AddRow(orderID, "cancelled", CancelReasonUser, "2.46000000", 100, 0, 100, "0"))
+		// Only trades after the snapshot were journaled
+		mock.ExpectQuery("SELECT id, buyer_order_id, seller_order_id").
+			WithArgs(tokenID, snapshotAt).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "buyer_order_id", "seller_order_id", "price",
+				"quantity", "buyer_fee", "seller_fee"}))
+
+		report, err := service.VerifyJournal(tokenID)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		assert.Equal(t, 1, report.Events)
+		assert.Equal(t, 1, report.Orders)
+		assert.Len(t, report.Bids, 1)
+		assert.Equal(t, []models.JournalMismatch{
+			{Kind: "order", ID: orderID, Field: "status", Journal: "open", Table: "cancelled"},
+			{Kind: "order", ID: orderID, Field: "cancelReason", Journal: "", Table: CancelReasonUser},
+		}, report.Mismatches)
+	})
+}
+
+// recordingListener keeps the book updates it is told about
+type recordingListener struct {
+	updates []*BookUpdate
+}
+
+func (l *recordingListener) BookChanged(update *BookUpdate) {
+	l.updates = append(l.updates, update)
+}
+
+func TestListener(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	sellerID := "550e8400-e29b-41d4-a716-446655440002"
+
+	t.Run("Committed changes are announced with their owners", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listener := &recordingListener{}
+		service.SetListener(listener)
+		resting := seedOrder(service, tokenID, "bid", "2.40", 100)
+
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO trades").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		expectSettlement(mock)
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		created, trades, err := service.CreateOrder(testutil.MockOrder(sellerID, tokenID, "ask", decimal.MustParse("2.40"), 60))
+		assert.NoError(t, err)
+		assert.Len(t, listener.updates, 1)
+
+		update := listener.updates[0]
+		assert.Equal(t, tokenID, update.TokenID)
+		assert.Equal(t, trades, update.Trades)
+		assert.Equal(t, []OrderChange{
+			{OrderID: created.ID, UserID: sellerID, Type: OrderEventAccepted, Order: update.Orders[0].Order},
+			{OrderID: resting.ID, UserID: resting.UserID, Type: OrderEventPartiallyFilled, FilledQuantity: 60, RemainingQuantity: 40},
+			{OrderID: created.ID, UserID: sellerID, Type: OrderEventFilled, FilledQuantity: 60, RemainingQuantity: 0},
+		}, update.Orders)
+		// The accepted order is as it joined the book, before it traded
+		assert.Equal(t, int64(60), update.Orders[0].Order.RemainingQuantity)
+		assert.Len(t, update.Book.Bids, 1)
+		assert.Equal(t, int64(40), update.Book.Bids[0].Quantity)
+		assert.Equal(t, decimal.MustParse("2.40"), update.Book.LastPrice)
+
+		// The change to the levels is numbered and sent as a delta
+		assert.Equal(t, int64(1), update.Book.Sequence)
+		assert.Equal(t, int64(1), update.Delta.Sequence)
+		assert.Equal(t, []models.OrderBookLevel{{Price: decimal.MustParse("2.40"), Quantity: 40, Orders: 1}}, update.Delta.Bids)
+		assert.Empty(t, update.Delta.Asks)
+		assert.Equal(t, update.Book.Checksum, update.Delta.Checksum)
+
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		mock.ExpectQuery("UPDATE orders o SET status").
+			WillReturnRows(sqlmock.NewRows([]string{"side", "locked_amount"}).AddRow("bid", "96.48000000"))
+		mock.ExpectExec("UPDATE user_balances SET locked = locked -").WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		assert.NoError(t, service.CancelOrder(resting.ID, resting.UserID))
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Len(t, listener.updates, 2)
+
+		update = listener.updates[1]
+		assert.Equal(t, []OrderChange{
+			{OrderID: resting.ID, UserID: resting.UserID, Type: OrderEventCancelled, Reason: CancelReasonUser},
+		}, update.Orders)
+		assert.Empty(t, update.Trades)
+		assert.Empty(t, update.Book.Bids)
+		assert.Equal(t, int64(2), update.Delta.Sequence)
+		assert.Equal(t, []models.OrderBookLevel{{Price: decimal.MustParse("2.40")}}, update.Delta.Bids)
+
+		snapshot := service.GetOrderBookSnapshot(tokenID)
+		assert.Equal(t, int64(2), snapshot.Sequence)
+		assert.Equal(t, update.Delta.Checksum, snapshot.Checksum)
+	})
+
+	t.Run("Amendments are announced without the previous entry", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listener := &recordingListener{}
+		service.SetListener(listener)
+		resting := seedOrder(service, tokenID, "bid", "2.40", 100)
+
+		mock.ExpectQuery("SELECT token_id FROM orders").
+			WillReturnRows(sqlmock.NewRows([]string{"token_id"}).AddRow(tokenID))
+		expectJournalTx(mock, tokenID)
+		expectReserve(mock)
+		mock.ExpectExec("UPDATE orders SET price =").WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvents(mock)
+		mock.ExpectCommit()
+
+		price := decimal.MustParse("2.41")
+		_, _, err := service.AmendOrder(resting.ID, resting.UserID, &price, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Len(t, listener.updates, 1)
+
+		// The order moves from one level to the other in a single delta
+		update := listener.updates[0]
+		assert.Equal(t, []models.OrderBookLevel{{Price: decimal.MustParse("2.41"), Quantity: 100, Orders: 1}}, update.Book.Bids)
+		assert.Equal(t, int64(1), update.Delta.Sequence)
+		assert.Equal(t, []models.OrderBookLevel{
+			{Price: decimal.MustParse("2.41"), Quantity: 100, Orders: 1},
+			{Price: decimal.MustParse("2.40")},
+		}, update.Delta.Bids)
+		assert.Equal(t, Checksum(update.Book.Bids, update.Book.Asks), update.Delta.Checksum)
+
+		snapshot := service.GetOrderBookSnapshot(tokenID)
+		assert.Equal(t, int64(1), snapshot.Sequence)
+		assert.Equal(t, update.Delta.Checksum, snapshot.Checksum)
+	})
+
+	t.Run("Rejected orders are not announced", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		listener := &recordingListener{}
+		service.SetListener(listener)
+		service.engine.Book(tokenID).status = TokenSuspended
+		expectRejection(mock, tokenID)
+
+		_, _, err := service.CreateOrder(testutil.MockOrder(sellerID, tokenID, "ask", decimal.MustParse("2.40"), 60))
+		assert.ErrorIs(t, err, ErrTokenNotActive)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.Empty(t, listener.updates)
+	})
+
+	t.Run("Observers see the live book", func(t *testing.T) {
+		service := NewService(nil, &cache.RedisClient{}, testutil.NewTestConfig(), nil, nil)
+		seedOrder(service, tokenID, "ask", "2.46", 100)
+
+		var observed *models.OrderBook
+		service.ObserveOrderBook(tokenID, UpdateDepth, func(book *models.OrderBook) {
+			observed = book
+		})
+		assert.Len(t, observed.Asks, 1)
+		assert.Equal(t, int64(100), observed.Asks[0].Quantity)
+	})
 }
@@ -0,0 +1,320 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/cache"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// Token statuses, from tokens.status. Only active tokens can be traded;
+// tokens are also pending or deployed before they list.
+const (
+	TokenActive    = "active"
+	TokenSuspended = "suspended"
+)
+
+// Market status events published on cache.MarketStatusChannel
+const (
+	EventHalted  = "halted"
+	EventResumed = "resumed"
+	EventStatus  = "status"
+)
+
+// ErrTokenNotActive is returned for orders on a token that is not open for
+// trading
+var ErrTokenNotActive = errors.New("token is not open for trading")
+
+// ErrInvalidTokenStatus is returned when a token is set to a status other
+// than active or suspended
+var ErrInvalidTokenStatus = errors.New("invalid token status")
+
+// checkTradable rejects orders on a book whose token does not exist or is not
+// active, loading the token on first use. Callers must hold book.mu.
+func (s *Service) checkTradable(book *Book) error {
+	if book.status == "" {
+		if err := s.loadToken(book); err != nil {
+			return err
+		}
+	}
+
+	if book.status != TokenActive {
+		return fmt.Errorf("%w: token is %s", ErrTokenNotActive, book.status)
+	}
+
+	return nil
+}
+
+// loadToken sets a book's token status and market rules from its tokens row.
+// Callers must hold book.mu.
+func (s *Service) loadToken(book *Book) error {
+	var status string
+	var tickSize *decimal.Decimal
+	var lotSize int64
+
+	err := s.db.QueryRow(`SELECT status, tick_size, lot_size FROM tokens WHERE id = $1`, book.tokenID).
+		Scan(&status, &tickSize, &lotSize)
+	if err == sql.ErrNoRows {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load token: %w", err)
+	}
+
+	book.status = status
+	book.rules = newMarketRules(tickSize, lotSize)
+	return nil
+}
+
+// tokenBook returns a token's book with its token loaded. The token is
+// checked before the engine is asked for the book, so no book is created for
+// a token that does not exist.
+func (s *Service) tokenBook(tokenID string) (*Book, error) {
+	loaded := false
+	s.engine.View(tokenID, func(book *Book) {
+		loaded = book.status != ""
+	})
+	if loaded {
+		return s.engine.Book(tokenID), nil
+	}
+
+	token := newBook(tokenID)
+	if err := s.loadToken(token); err != nil {
+		return nil, err
+	}
+
+	book := s.engine.Book(tokenID)
+	book.mu.Lock()
+	if book.status == "" {
+		book.status, book.rules = token.status, token.rules
+	}
+	book.mu.Unlock()
+	return book, nil
+}
+
+// HaltTrading halts a token until it is resumed by hand, recording why. A
+// token in a call auction cannot be halted until the auction has ended.
+func (s *Service) HaltTrading(tokenID, message string) (*models.HaltInfo, error) {
+	book, err := s.tokenBook(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.halt != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTradingHalted, book.halt.message)
+	}
+	if book.auction != nil {
+		return nil, ErrAuctionInProgress
+	}
+
+	halt := &haltState{
+		reason:   HaltAdmin,
+		message:  message,
+		haltedAt: time.Now(),
+	}
+	if err := s.recordHalt(tokenID, halt); err != nil {
+		return nil, err
+	}
+	book.halt = halt
+	log.Printf("🛑 Trading halted for token %s: %s", tokenID, message)
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(tokenID))
+
+	s.publishHalt(tokenID, halt)
+
+	return book.haltInfo(), nil
+}
+
+// ResumeTrading lifts a token's halt, whatever its cause, and re-opens it
+// with a call auction, recording why
+func (s *Service) ResumeTrading(tokenID, message string) (*models.Auction, error) {
+	book, err := s.tokenBook(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.halt == nil {
+		return nil, ErrNotHalted
+	}
+
+	return s.resume(book, message)
+}
+
+// SetTokenStatus activates or suspends a token. Suspending stops new orders;
+// with cancelOrders it also cancels every resting and dormant stop order on
+// the token and releases their reservations, returning their IDs. A token in
+// a call auction cannot be suspended until the auction has ended.
+func (s *Service) SetTokenStatus(tokenID, status string, cancelOrders bool) ([]string, error) {
+	if status != TokenActive && status != TokenSuspended {
+		return nil, fmt.Errorf("%w: status must be active or suspended", ErrInvalidTokenStatus)
+	}
+	if cancelOrders && status != TokenSuspended {
+		return nil, fmt.Errorf("%w: orders are only cancelled on suspension", ErrInvalidTokenStatus)
+	}
+
+	book, err := s.tokenBook(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if book.auction != nil && status == TokenSuspended {
+		return nil, ErrAuctionInProgress
+	}
+
+	tx, err := s.beginTokenTx(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE tokens SET status = $2 WHERE id = $1`, tokenID, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update token status: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update token status: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	cancelled := []string{}
+	var events orderEvents
+	if cancelOrders {
+		orders, err := cancelAllOrders(tx, tokenID, CancelReasonSuspended)
+		if err != nil {
+			return nil, err
+		}
+		for _, order := range orders {
+			cancelled = append(cancelled, order.ID)
+			events.cancelled(order, CancelReasonSuspended)
+		}
+	}
+	if err := events.write(tx, tokenID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	book.status = status
+	for _, orderID := range cancelled {
+		if !book.remove(orderID) {
+			book.removeStop(orderID)
+		}
+	}
+	log.Printf("🔔 Token %s is now %s (%d orders cancelled)", tokenID, status, len(cancelled))
+
+	// Invalidate order book cache
+	_ = s.redis.Delete(cache.OrderBookKey(tokenID))
+
+	s.announce(book, events)
+	s.publish(&models.MarketStatusEvent{Type: EventStatus, TokenID: tokenID, Status: status, At: time.Now()})
+
+	return cancelled, nil
+}
+
+// cancelAllOrders cancels every live and dormant stop order on a token, of
+// every user, and releases their reservations. It returns the orders
+// cancelled, with only their ID and owner set.
+func cancelAllOrders(tx *sql.Tx, tokenID, reason string) ([]*models.Order, error) {
+	// Returns the reservation each order held before it was cleared
+	query := `
+		UPDATE orders o
+		SET status = 'cancelled', cancel_reason = $2, locked_amount = 0, updated_at = NOW()
+		FROM (
+			SELECT id, locked_amount FROM orders
+			WHERE token_id = $1
+			  AND status IN (` + liveStatuses + `, 'pending_trigger')
+			FOR UPDATE
+		) prev
+		WHERE o.id = prev.id
+		RETURNING o.id, o.user_id, o.side, prev.locked_amount
+	`
+
+	rows, err := tx.Query(query, tokenID, reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+
+	type balance struct{ userID, currency string }
+	released := make(map[balance]decimal.Decimal)
+	orders := []*models.Order{}
+	for rows.Next() {
+		var orderID, userID, side string
+		var locked decimal.Decimal
+		if err := rows.Scan(&orderID, &userID, &side, &locked); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to cancel orders: %w", err)
+		}
+		orders = append(orders, &models.Order{ID: orderID, UserID: userID})
+
+		key := balance{userID, tokenID}
+		if side == "bid" {
+			key.currency = QuoteCurrency
+		}
+		released[key] = released[key].Add(locked)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to cancel orders: %w", err)
+	}
+
+	// Balances are released in a fixed order so concurrent transactions
+	// lock them in the same order
+	keys := make([]balance, 0, len(released))
+	for key := range released {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].userID != keys[j].userID {
+			return keys[i].userID < keys[j].userID
+		}
+		return keys[i].currency < keys[j].currency
+	})
+
+	for _, key := range keys {
+		if amount := released[key]; amount.IsPositive() {
+			if err := releaseFunds(tx, key.userID, key.currency, amount); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return orders, nil
+}
+
+// publishHalt announces a trading halt
+func (s *Service) publishHalt(tokenID string, halt *haltState) {
+	s.publish(&models.MarketStatusEvent{
+		Type:    EventHalted,
+		TokenID: tokenID,
+		Reason:  halt.reason,
+		Message: halt.message,
+		At:      halt.haltedAt,
+	})
+}
+
+// publish announces a market status event to clients. Failures are logged;
+// the order book shows the current state either way.
+func (s *Service) publish(event *models.MarketStatusEvent) {
+	if err := s.redis.Publish(cache.MarketStatusChannel, event); err != nil {
+		log.Printf("Failed to publish %s event for token %s: %v", event.Type, event.TokenID, err)
+	}
+}
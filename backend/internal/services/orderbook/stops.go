@@ -0,0 +1,284 @@
+package orderbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+)
+
+// ErrTrailTooWide is returned for a trailing sell stop whose trail amount
+// would put its stop price at or below zero
+var ErrTrailTooWide = errors.New("trail amount must be less than the last trade price")
+
+// liveExecutionType returns the execution type a stop order trades as once
+// triggered. Other execution types are returned unchanged.
+func liveExecutionType(executionType string) string {
+	switch executionType {
+	case "stop_market", "trailing_stop":
+		return "market"
+	case "stop_limit":
+		return "limit"
+	}
+	return executionType
+}
+
+// isStop reports whether an order waits for a trigger price
+func isStop(order *models.Order) bool {
+	switch order.ExecutionType {
+	case "stop_market", "stop_limit", "trailing_stop":
+		return true
+	}
+	return false
+}
+
+// isMarket reports whether an order trades as a market order
+func isMarket(order *models.Order) bool {
+	return liveExecutionType(order.ExecutionType) == "market"
+}
+
+// activateStop marks a stop order as triggered
+func activateStop(order *models.Order) {
+	now := time.Now()
+	order.Status = "triggered"
+	order.TriggeredAt = &now
+	order.UpdatedAt = now
+}
+
+// placeStop journals a dormant stop order and parks it on the book. Stop
+// limit orders and sell stops reserve their funds up front; stop market buys
+// have no price to reserve against and are funded when they trigger.
+func (s *Service) placeStop(book *Book, order *models.Order) error {
+	order.Status = "pending_trigger"
+	if order.Side == "ask" || !isMarket(order) {
+		order.LockedAmount = reservationFor(order, order.Quantity)
+	}
+
+	tx, err := s.beginTokenTx(order.TokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if order.LockedAmount.IsPositive() {
+		if err := reserveFunds(tx, order.UserID, balanceCurrency(order), order.LockedAmount); err != nil {
+			return err
+		}
+	}
+
+	if err := insertOrder(tx, order); err != nil {
+		return err
+	}
+
+	var events orderEvents
+	events.order(OrderEventAccepted, order)
+	if err := events.write(tx, order.TokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	stop := *order
+	book.addStop(&stop)
+
+	s.announce(book, events)
+
+	return nil
+}
+
+// evaluateTriggers trails trailing stops to the book's last trade price and
+// executes every stop order it sets off. Trades made by triggered stops move
+// the price again, so the book is re-checked until no stop fires. Callers
+// must hold book.mu.
+func (s *Service) evaluateTriggers(book *Book) {
+	var failed []*models.Order
+
+	// A halt stops the cascade; stops stay parked until trading resumes
+	for book.halt == nil {
+		s.trailStops(book)
+
+		stop := book.nextTriggered()
+		if stop == nil {
+			break
+		}
+		book.removeStop(stop.ID)
+
+		// A good-till-date stop that expired before it fired never trades
+		if expired(stop, time.Now()) {
+			if err := s.cancelStop(book, stop, CancelReasonExpired); err != nil {
+				log.Printf("Failed to cancel expired stop order %s: %v", stop.ID, err)
+				failed = append(failed, stop)
+			}
+			continue
+		}
+
+		order := *stop
+		activateStop(&order)
+
+		_, err := s.execute(book, &order, OrderEventTriggered, updateTriggeredOrder, nil)
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, ErrInsufficientFunds) {
+			if err := s.cancelStop(book, stop, CancelReasonNoFunds); err != nil {
+				log.Printf("Failed to cancel unfunded stop order %s: %v", stop.ID, err)
+				failed = append(failed, stop)
+			}
+			continue
+		}
+
+		log.Printf("Failed to execute triggered stop order %s: %v", stop.ID, err)
+		failed = append(failed, stop)
+	}
+
+	// Stops that could not be executed stay parked for the next trade
+	for _, stop := range failed {
+		book.addStop(stop)
+	}
+}
+
+// trailStops moves the marks of trailing stops that the last trade price has
+// moved in their favour. The new marks are journaled before they are applied
+// so that they survive restarts; if that fails the stops keep trailing their
+// previous marks.
+func (s *Service) trailStops(book *Book) {
+	updates := book.trailStops()
+	if len(updates) == 0 {
+		return
+	}
+
+	if err := s.journalTrail(book.tokenID, updates); err != nil {
+		log.Printf("Failed to trail stop orders for token %s: %v", book.tokenID, err)
+		return
+	}
+
+	for _, u := range updates {
+		mark, stopPrice := u.mark, u.stopPrice
+		u.stop.TrailMark = &mark
+		u.stop.StopPrice = &stopPrice
+	}
+}
+
+// journalTrail records new trailing stop marks and stop prices, with a
+// trailed event for each
+func (s *Service) journalTrail(tokenID string, updates []trailUpdate) error {
+	tx, err := s.beginTokenTx(tokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE orders
+		SET trail_mark = $2, stop_price = $3, updated_at = NOW()
+		WHERE id = $1 AND status = 'pending_trigger'
+	`
+
+	var events orderEvents
+	for _, u := range updates {
+		if _, err := tx.Exec(query, u.stop.ID, u.mark, u.stopPrice); err != nil {
+			return fmt.Errorf("failed to update trailing stop: %w", err)
+		}
+		events.trailed(u.stop, u.mark, u.stopPrice)
+	}
+
+	if err := events.write(tx, tokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// updateTriggeredOrder journals the execution of a triggered stop order,
+// failing if the stop is no longer pending
+func updateTriggeredOrder(tx *sql.Tx, order *models.Order) error {
+	query := `
+		UPDATE orders
+		SET status = $2, quantity = $3, filled_quantity = $4, remaining_quantity = $5,
+		    cancel_reason = $6, fee_paid = $7, locked_amount = $8, triggered_at = $9,
+		    updated_at = NOW()
+		WHERE id = $1 AND status = 'pending_trigger'
+	`
+
+	result, err := tx.Exec(query,
+		order.ID, order.Status, order.Quantity, order.FilledQuantity, order.RemainingQuantity,
+		order.CancelReason, order.FeePaid, order.LockedAmount, order.TriggeredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update triggered order: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update triggered order: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("failed to update triggered order: order %s is no longer pending", order.ID)
+	}
+
+	return nil
+}
+
+// cancelStop cancels a dormant stop order that has already been taken off
+// the book and releases its reservation
+func (s *Service) cancelStop(book *Book, stop *models.Order, reason string) error {
+	tx, err := s.beginTokenTx(stop.TokenID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := journalStopCancel(tx, stop, reason); err != nil {
+		return err
+	}
+
+	var events orderEvents
+	events.cancelled(stop, reason)
+	if err := events.write(tx, stop.TokenID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	cancelOrder(stop, reason)
+	stop.LockedAmount = decimal.Zero
+
+	s.announce(book, events)
+
+	return nil
+}
+
+// journalStopCancel records the cancellation of a dormant stop order and
+// releases its reservation
+func journalStopCancel(tx *sql.Tx, stop *models.Order, reason string) error {
+	query := `
+		UPDATE orders
+		SET status = 'cancelled', cancel_reason = $2, locked_amount = 0, updated_at = NOW()
+		WHERE id = $1 AND status = 'pending_trigger'
+	`
+
+	if _, err := tx.Exec(query, stop.ID, reason); err != nil {
+		return fmt.Errorf("failed to cancel stop order: %w", err)
+	}
+
+	if stop.LockedAmount.IsPositive() {
+		if err := releaseFunds(tx, stop.UserID, balanceCurrency(stop), stop.LockedAmount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package restrictions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/peoplecoin/backend/internal/blockchain/sui"
+	"github.com/peoplecoin/backend/internal/database"
+)
+
+// ErrNotSynced is returned for a token whose creator restrictions have not
+// been mirrored from chain yet
+var ErrNotSynced = errors.New("creator trading restrictions have not been synced")
+
+// ErrStale is returned for a token whose creator restrictions were last
+// mirrored from chain longer ago than the service trusts them for
+var ErrStale = errors.New("creator trading restrictions are out of date")
+
+// ErrTokenNotFound is returned when setting the registry of an unknown token
+var ErrTokenNotFound = errors.New("token not found")
+
+// ErrRegistryUnreadable is returned when a token registry cannot be read from
+// chain, because the address is not a registry or the node failed
+var ErrRegistryUnreadable = errors.New("token registry could not be read")
+
+// Restriction is a token's creator trading restriction, mirrored from its
+// TokenRegistry
+type Restriction struct {
+	TokenID            string
+	TradingBlockEndsAt time.Time
+	SyncedAt           time.Time
+}
+
+// CanTrade reports whether the creator may trade at now, like
+// creator_token::can_creator_trade
+func (r *Restriction) CanTrade(now time.Time) bool {
+	return !now.Before(r.TradingBlockEndsAt)
+}
+
+// ChainReader reads a token's creator trading restrictions from chain
+type ChainReader interface {
+	GetTradingRestrictions(registryAddress string) (*sui.TradingRestrictions, error)
+}
+
+type Service struct {
+	db     *database.DB
+	chain  ChainReader
+	maxAge time.Duration // how long a sync is trusted for; zero trusts it forever
+}
+
+// NewService creates the restrictions service. Restrictions last synced more
+// than maxAge ago are not trusted; a zero maxAge trusts them however old.
+func NewService(db *database.DB, chain ChainReader, maxAge time.Duration) *Service {
+	return &Service{db: db, chain: chain, maxAge: maxAge}
+}
+
+// RestrictionFor returns the restriction on a user's trading of a token if
+// the user is the token's creator, identified through creators.user_id. It
+// returns nil for anyone else and for tokens with no registry on record,
+// which have no contract restriction to mirror. It returns ErrNotSynced for
+// a creator whose restriction is not known yet, and ErrStale for one whose
+// restriction has not been synced within the service's max age.
+func (s *Service) RestrictionFor(userID, tokenID string) (*Restriction, error) {
+	query := `
+		SELECT t.registry_address, r.trading_block_end_date, r.synced_at
+		FROM tokens t
+		JOIN creators c ON c.id = t.creator_id
+		LEFT JOIN creator_trading_restrictions r ON r.token_id = t.id
+		WHERE t.id = $1 AND c.user_id = $2
+	`
+
+	var registryAddress *string
+	var endsAt, syncedAt *time.Time
+	err := s.db.QueryRow(query, tokenID, userID).Scan(&registryAddress, &endsAt, &syncedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get creator restrictions: %w", err)
+	}
+	if registryAddress == nil {
+		return nil, nil
+	}
+	if endsAt == nil {
+		return nil, ErrNotSynced
+	}
+	if s.maxAge > 0 && time.Since(*syncedAt) > s.maxAge {
+		return nil, fmt.Errorf("%w: last synced at %s", ErrStale, syncedAt.UTC().Format(time.RFC3339))
+	}
+
+	return &Restriction{TokenID: tokenID, TradingBlockEndsAt: *endsAt, SyncedAt: *syncedAt}, nil
+}
+
+// SetRegistry records the TokenRegistry object of a token and mirrors its
+// creator trading restrictions straight away. The registry is read from
+// chain first, so an address that is not a registry is refused and leaves
+// the token as it was.
+func (s *Service) SetRegistry(tokenID, registryAddress string) (*Restriction, error) {
+	restrictions, err := s.chain.GetTradingRestrictions(registryAddress)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRegistryUnreadable, err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE tokens SET registry_address = $2 WHERE id = $1`, tokenID, registryAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set token registry: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set token registry: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	var syncedAt time.Time
+	if err := tx.QueryRow(upsertQuery+` RETURNING synced_at`, tokenID, restrictions.Creator,
+		restrictions.TradingBlockEndDate, restrictions.TradingBlockDurationDays).Scan(&syncedAt); err != nil {
+		return nil, fmt.Errorf("failed to save creator restrictions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &Restriction{TokenID: tokenID, TradingBlockEndsAt: restrictions.TradingBlockEndDate, SyncedAt: syncedAt}, nil
+}
+
+// Sync mirrors the creator trading restrictions of every token with a
+// registry on chain into creator_trading_restrictions, returning the number
+// of tokens synced. Tokens that fail are logged and retried on the next
+// sync.
+func (s *Service) Sync() (int, error) {
+	rows, err := s.db.Query(`SELECT id, registry_address FROM tokens WHERE registry_address IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find token registries: %w", err)
+	}
+	defer rows.Close()
+
+	registries := make(map[string]string)
+	var tokenIDs []string
+	for rows.Next() {
+		var tokenID, registryAddress string
+		if err := rows.Scan(&tokenID, &registryAddress); err != nil {
+			return 0, fmt.Errorf("failed to scan token registry: %w", err)
+		}
+		tokenIDs = append(tokenIDs, tokenID)
+		registries[tokenID] = registryAddress
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to find token registries: %w", err)
+	}
+
+	synced := 0
+	for _, tokenID := range tokenIDs {
+		if err := s.syncToken(tokenID, registries[tokenID]); err != nil {
+			log.Printf("Failed to sync creator restrictions for token %s: %v", tokenID, err)
+			continue
+		}
+		synced++
+	}
+
+	return synced, nil
+}
+
+// upsertQuery saves a token's creator trading restrictions as synced now
+const upsertQuery = `
+	INSERT INTO creator_trading_restrictions
+		(token_id, creator_address, trading_block_end_date, trading_block_duration_days, synced_at)
+	VALUES ($1, $2, $3, $4, NOW())
+	ON CONFLICT (token_id) DO UPDATE
+	SET creator_address = EXCLUDED.creator_address,
+	    trading_block_end_date = EXCLUDED.trading_block_end_date,
+	    trading_block_duration_days = EXCLUDED.trading_block_duration_days,
+	    synced_at = EXCLUDED.synced_at
+`
+
+// syncToken mirrors one token's creator trading restrictions
+func (s *Service) syncToken(tokenID, registryAddress string) error {
+	restrictions, err := s.chain.GetTradingRestrictions(registryAddress)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(upsertQuery, tokenID, restrictions.Creator, restrictions.TradingBlockEndDate, restrictions.TradingBlockDurationDays)
+	if err != nil {
+		return fmt.Errorf("failed to save creator restrictions: %w", err)
+	}
+
+	return nil
+}
+
+// Run syncs the restrictions from chain now and every interval until ctx is
+// cancelled
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Sync(); err != nil {
+			log.Printf("Failed to sync creator restrictions: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
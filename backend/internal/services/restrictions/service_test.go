@@ -0,0 +1,213 @@
+package restrictions
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/peoplecoin/backend/internal/blockchain/sui"
+	"github.com/peoplecoin/backend/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubChain returns the restrictions of each registry, or an error for
+// registries it does not know
+type stubChain map[string]*sui.TradingRestrictions
+
+func (s stubChain) GetTradingRestrictions(registryAddress string) (*sui.TradingRestrictions, error) {
+	restrictions, ok := s[registryAddress]
+	if !ok {
+		return nil, errors.New("failed to get registry object: not found")
+	}
+	return restrictions, nil
+}
+
+func TestRestrictionFor(t *testing.T) {
+	userID := "550e8400-e29b-41d4-a716-446655440000"
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	registry := "0xregistry1"
+	endsAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	syncedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	columns := []string{"registry_address", "trading_block_end_date", "synced_at"}
+
+	tests := []struct {
+		name            string
+		setupMock       func(mock sqlmock.Sqlmock)
+		wantRestriction *Restriction
+		wantError       error
+	}{
+		{
+			name: "Creator with a synced restriction",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.registry_address, r.trading_block_end_date, r.synced_at").
+					WithArgs(tokenID, userID).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(registry, endsAt, syncedAt))
+			},
+			wantRestriction: &Restriction{TokenID: tokenID, TradingBlockEndsAt: endsAt, SyncedAt: syncedAt},
+		},
+		{
+			name: "User is not the creator",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.registry_address, r.trading_block_end_date, r.synced_at").
+					WithArgs(tokenID, userID).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantRestriction: nil,
+		},
+		{
+			name: "Token without a registry",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.registry_address, r.trading_block_end_date, r.synced_at").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(nil, nil, nil))
+			},
+			wantRestriction: nil,
+		},
+		{
+			name: "Creator whose restriction has not been synced",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.registry_address, r.trading_block_end_date, r.synced_at").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(registry, nil, nil))
+			},
+			wantError: ErrNotSynced,
+		},
+		{
+			name: "Creator whose restriction is out of date",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT t.registry_address, r.trading_block_end_date, r.synced_at").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(registry, endsAt, time.Now().Add(-2*time.Hour)))
+			},
+			wantError: ErrStale,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.NewMockDB(t)
+			defer cleanup()
+
+			service := NewService(db, stubChain{}, time.Hour)
+			tt.setupMock(mock)
+
+			restriction, err := service.RestrictionFor(userID, tokenID)
+
+			if tt.wantError != nil {
+				assert.ErrorIs(t, err, tt.wantError)
+				assert.Nil(t, restriction)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantRestriction, restriction)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCanTrade(t *testing.T) {
+	endsAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	restriction := &Restriction{TradingBlockEndsAt: endsAt}
+
+	assert.False(t, restriction.CanTrade(endsAt.Add(-time.Millisecond)))
+	assert.True(t, restriction.CanTrade(endsAt))
+	assert.True(t, restriction.CanTrade(endsAt.Add(time.Hour)))
+}
+
+func TestSync(t *testing.T) {
+	endsAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	chain := stubChain{
+		"0xregistry1": {Creator: "0xcreator1", TradingBlockEndDate: endsAt, TradingBlockDurationDays: 30},
+	}
+
+	t.Run("Upserts each registry and skips those that fail", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, chain, time.Hour)
+
+		mock.ExpectQuery("SELECT id, registry_address FROM tokens").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "registry_address"}).
+				AddRow("token-1", "0xregistry1").
+				AddRow("token-2", "0xmissing"))
+		mock.ExpectExec("INSERT INTO creator_trading_restrictions").
+			WithArgs("token-1", "0xcreator1", endsAt, 30).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		synced, err := service.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, synced)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Database error", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, chain, time.Hour)
+
+		mock.ExpectQuery("SELECT id, registry_address FROM tokens").
+			WillReturnError(sql.ErrConnDone)
+
+		_, err := service.Sync()
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestSetRegistry(t *testing.T) {
+	tokenID := "660e8400-e29b-41d4-a716-446655440001"
+	endsAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	syncedAt := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	chain := stubChain{
+		"0xregistry1": {Creator: "0xcreator1", TradingBlockEndDate: endsAt, TradingBlockDurationDays: 30},
+	}
+
+	t.Run("Records the registry and syncs it", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, chain, time.Hour)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE tokens SET registry_address").
+			WithArgs(tokenID, "0xregistry1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("INSERT INTO creator_trading_restrictions").
+			WithArgs(tokenID, "0xcreator1", endsAt, 30).
+			WillReturnRows(sqlmock.NewRows([]string{"synced_at"}).AddRow(syncedAt))
+		mock.ExpectCommit()
+
+		restriction, err := service.SetRegistry(tokenID, "0xregistry1")
+		assert.NoError(t, err)
+		assert.Equal(t, &Restriction{TokenID: tokenID, TradingBlockEndsAt: endsAt, SyncedAt: syncedAt}, restriction)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Unreadable registries are refused", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, chain, time.Hour)
+
+		_, err := service.SetRegistry(tokenID, "0xmissing")
+		assert.ErrorIs(t, err, ErrRegistryUnreadable)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		db, mock, cleanup := testutil.NewMockDB(t)
+		defer cleanup()
+
+		service := NewService(db, chain, time.Hour)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE tokens SET registry_address").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		_, err := service.SetRegistry(tokenID, "0xregistry1")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
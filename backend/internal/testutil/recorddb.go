@@ -0,0 +1,151 @@
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/peoplecoin/backend/internal/database"
+)
+
+// Statement is a statement executed against a RecordingDB
+type Statement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// Recorder collects the statements of committed transactions. Every
+// statement succeeds and affects one row; queries return no rows.
+// Unlike sqlmock it needs no expectations, which makes it suitable for
+// concurrency tests where the order of statements is not deterministic.
+type Recorder struct {
+	mu        sync.Mutex
+	committed []Statement
+}
+
+// NewRecordingDB creates a database backed by a Recorder
+func NewRecordingDB(t *testing.T) (*database.DB, *Recorder) {
+	recorder := &Recorder{}
+	db := sql.OpenDB(&recordingConnector{recorder: recorder})
+	t.Cleanup(func() { db.Close() })
+
+	return &database.DB{DB: db}, recorder
+}
+
+// Committed returns the statements of all committed transactions in
+// commit order
+func (r *Recorder) Committed() []Statement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Statement{}, r.committed...)
+}
+
+func (r *Recorder) commit(statements []Statement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.committed = append(r.committed, statements...)
+}
+
+type recordingConnector struct {
+	recorder *Recorder
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{recorder: c.recorder}, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver {
+	return recordingDriver{connector: c}
+}
+
+type recordingDriver struct {
+	connector *recordingConnector
+}
+
+func (d recordingDriver) Open(string) (driver.Conn, error) {
+	return d.connector.Connect(context.Background())
+}
+
+// recordingConn doubles as its own transaction
+type recordingConn struct {
+	recorder *Recorder
+	inTx     bool
+	pending  []Statement
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{conn: c, query: query}, nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.inTx = true
+	c.pending = nil
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	c.recorder.commit(c.pending)
+	c.inTx = false
+	c.pending = nil
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	c.inTx = false
+	c.pending = nil
+	return nil
+}
+
+func (c *recordingConn) record(statement Statement) {
+	if c.inTx {
+		c.pending = append(c.pending, statement)
+		return
+	}
+	c.recorder.commit([]Statement{statement})
+}
+
+type recordingStmt struct {
+	conn  *recordingConn
+	query string
+}
+
+func (s *recordingStmt) Close() error {
+	return nil
+}
+
+func (s *recordingStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.record(Statement{Query: s.query, Args: args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.record(Statement{Query: s.query, Args: args})
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string {
+	return []string{}
+}
+
+func (emptyRows) Close() error {
+	return nil
+}
+
+func (emptyRows) Next([]driver.Value) error {
+	return io.EOF
+}
@@ -1,13 +1,13 @@
 package testutil
 
 import (
-	"database/sql"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/peoplecoin/backend/internal/database"
 	"github.com/peoplecoin/backend/internal/config"
+	"github.com/peoplecoin/backend/internal/database"
+	"github.com/peoplecoin/backend/internal/decimal"
 	"github.com/peoplecoin/backend/internal/models"
 )
 
@@ -44,6 +44,20 @@ func NewTestConfig() *config.Config {
 			Expiration:        3600,
 			RefreshExpiration: 604800,
 		},
+		Trading: config.TradingConfig{
+			DefaultSTPMode:           "cancel_newest",
+			MaxBatchOrders:           50,
+			OpeningAuctionDuration:   300,
+			ReopeningAuctionDuration: 120,
+			CircuitBreakerWindow:     300,
+			HaltCooldown:             300,
+			RestrictionMaxAge:        1800,
+		},
+		WebSocket: config.WebSocketConfig{
+			PingInterval:     30,
+			SendBuffer:       256,
+			MaxSubscriptions: 100,
+		},
 	}
 }
 
@@ -84,7 +98,7 @@ func MockToken() *models.Token {
 }
 
 // MockOrder creates a mock order for testing
-func MockOrder(userID, tokenID string, side string, price float64, quantity int64) *models.Order {
+func MockOrder(userID, tokenID string, side string, price decimal.Decimal, quantity int64) *models.Order {
 	now := time.Now()
 	orderType := "buy"
 	if side == "ask" {
@@ -104,8 +118,9 @@ func MockOrder(userID, tokenID string, side string, price float64, quantity int6
 		ExecutionType:     "limit",
 		TimeInForce:       "GTC",
 		Status:            "open",
-		FeeRate:           0.003,
-		FeePaid:           0,
+		FeeRate:           decimal.New(5, 3),
+		MakerFeeRate:      decimal.New(3, 3),
+		FeePaid:           decimal.Zero,
 		CreatedAt:         now,
 		UpdatedAt:         now,
 	}
@@ -0,0 +1,203 @@
+package ws
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/peoplecoin/backend/internal/middleware"
+)
+
+const (
+	// writeWait is how long a write to a client may take
+	writeWait = 10 * time.Second
+
+	// maxMessageSize is the largest message a client may send
+	maxMessageSize = 4096
+)
+
+// client is one WebSocket connection. Its read pump handles the client's
+// requests and its write pump is the only writer of messages to the
+// connection, sending what is queued for it and the heartbeat pings.
+type client struct {
+	gateway *Gateway
+	conn    *websocket.Conn
+	queue   chan []byte
+
+	done      chan struct{} // closed once the client is being disconnected
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+
+	// Guarded by gateway.mu
+	userID     string
+	expiresAt  time.Time // zero if the access token does not expire
+	topics     map[topic]bool
+	userOrders bool
+}
+
+func newClient(g *Gateway, conn *websocket.Conn) *client {
+	return &client{
+		gateway: g,
+		conn:    conn,
+		queue:   make(chan []byte, g.cfg.WebSocket.SendBuffer),
+		done:    make(chan struct{}),
+		topics:  make(map[topic]bool),
+	}
+}
+
+// expired reports whether the client's access token has expired. Callers
+// must hold gateway.mu.
+func (c *client) expired() bool {
+	return !c.expiresAt.IsZero() && time.Now().After(c.expiresAt)
+}
+
+// subscriptions counts the client's channels. Callers must hold gateway.mu.
+func (c *client) subscriptions() int {
+	n := len(c.topics)
+	if c.userOrders {
+		n++
+	}
+	return n
+}
+
+// send queues a message for the client without blocking. A client whose
+// queue is full has fallen too far behind and is disconnected.
+func (c *client) send(message []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	select {
+	case c.queue <- message:
+	default:
+		c.close(websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+// sendMessage encodes and queues a message for the client
+func (c *client) sendMessage(v interface{}) {
+	if message, ok := encode(v); ok {
+		c.send(message)
+	}
+}
+
+// sendError queues an error message for the client
+func (c *client) sendError(code, message string) {
+	c.sendMessage(&errorMessage{Type: "error", Code: code, Message: message})
+}
+
+// close disconnects the client, sending it a close frame with the given code
+// and reason. Only the first call has any effect.
+func (c *client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// readPump handles the client's requests until the connection fails, then
+// removes the client from the gateway. A client that answers no ping for two
+// ping intervals is treated as gone.
+func (c *client) readPump() {
+	defer func() {
+		c.gateway.unregister(c)
+		c.close(websocket.CloseNormalClosure, "")
+		c.gateway.wg.Done()
+	}()
+
+	pongWait := 2 * c.gateway.pingInterval
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.handle(data)
+	}
+}
+
+// writePump sends queued messages and pings until the client is closed, then
+// sends the close frame and closes the connection
+func (c *client) writePump() {
+	ticker := time.NewTicker(c.gateway.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.gateway.wg.Done()
+	}()
+
+	for {
+		select {
+		case message := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// handle answers one request from the client
+func (c *client) handle(data []byte) {
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.sendError(CodeInvalidMessage, "Message must be a JSON object")
+		return
+	}
+
+	switch req.Type {
+	case "auth":
+		claims, err := middleware.ParseToken(c.gateway.cfg, req.Token)
+		if err != nil {
+			c.sendError(CodeUnauthorized, "Invalid or expired token")
+			return
+		}
+		c.gateway.authenticate(c, claims)
+		c.sendMessage(&ackMessage{Type: "authenticated", UserID: claims.UserID})
+	case "subscribe":
+		if err := c.gateway.subscribe(c, &req); err != nil {
+			c.sendError(errorCode(err), err.Error())
+		}
+	case "unsubscribe":
+		if err := c.gateway.unsubscribe(c, &req); err != nil {
+			c.sendError(errorCode(err), err.Error())
+		}
+	case "ping":
+		c.sendMessage(&ackMessage{Type: "pong"})
+	default:
+		c.sendError(CodeInvalidMessage, "Unknown message type")
+	}
+}
+
+// errorCode maps a refused subscription to its error code
+func errorCode(err error) string {
+	switch err {
+	case errNotAuthenticated:
+		return CodeUnauthorized
+	case errTooManySubscriptions:
+		return CodeTooManySubscriptions
+	default:
+		return CodeInvalidChannel
+	}
+}
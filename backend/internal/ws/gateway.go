@@ -0,0 +1,391 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/peoplecoin/backend/internal/config"
+	"github.com/peoplecoin/backend/internal/middleware"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/orderbook"
+)
+
+// BookSource provides the live order books subscribers start from
+type BookSource interface {
+	ObserveOrderBook(tokenID string, depth int, fn func(book *models.OrderBook))
+}
+
+// topic is a public channel of one token
+type topic struct {
+	channel string
+	tokenID string
+}
+
+// Gateway serves the WebSocket API. Clients subscribe to channels over a
+// connection and the gateway pushes them the order book changes it is told
+// about as the order book service's listener.
+type Gateway struct {
+	cfg          *config.Config
+	books        BookSource
+	upgrade      websocket.Upgrader
+	pingInterval time.Duration
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	topics  map[topic]map[*client]struct{}
+	users   map[string]map[*client]struct{} // user_orders subscribers by user
+	closed  bool
+	wg      sync.WaitGroup // one per running client pump
+}
+
+// NewGateway creates a gateway serving books from the given source
+func NewGateway(cfg *config.Config, books BookSource) *Gateway {
+	g := &Gateway{
+		cfg:          cfg,
+		books:        books,
+		pingInterval: time.Duration(cfg.WebSocket.PingInterval) * time.Second,
+		clients:      make(map[*client]struct{}),
+		topics:       make(map[topic]map[*client]struct{}),
+		users:        make(map[string]map[*client]struct{}),
+	}
+	g.upgrade = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     g.checkOrigin,
+	}
+	return g
+}
+
+// checkOrigin accepts connections from the origins allowed by CORS and from
+// clients that send no origin, which are not browsers
+func (g *Gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range g.cfg.CORS.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP upgrades a request to a WebSocket connection. A bearer token in
+// the Authorization header authenticates the connection up front; browsers,
+// which cannot set the header, send an auth message instead.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var claims *middleware.Claims
+	if header := r.Header.Get("Authorization"); header != "" {
+		var err error
+		claims, err = middleware.ParseToken(g.cfg, strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	g.mu.Lock()
+	closed := g.closed
+	g.mu.Unlock()
+	if closed {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := g.upgrade.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied to the request
+		return
+	}
+
+	c := newClient(g, conn)
+	if claims != nil {
+		g.authenticate(c, claims)
+	}
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
+	g.clients[c] = struct{}{}
+	g.wg.Add(2)
+	g.mu.Unlock()
+
+	go c.writePump()
+	go c.readPump()
+}
+
+// Shutdown closes every connection with a going away close frame and waits
+// for the clients to finish, forcing the connections closed if ctx ends
+// first. New connections are refused from the moment it is called.
+// http.Server.Shutdown does not close hijacked connections, so this must be
+// called alongside it.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	for c := range g.clients {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		for c := range g.clients {
+			c.conn.Close()
+		}
+		g.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// BookChanged pushes a committed book change to the clients subscribed to
+// the token's channels and to the owners of the orders it changed. Clients
+// that cannot keep up are dropped rather than blocking the order book.
+func (g *Gateway) BookChanged(update *orderbook.BookUpdate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.publish(topic{ChannelOrderBook, update.TokenID}, &orderBookMessage{Type: "orderbook_update", OrderBook: update.Book})
+	if update.Delta != nil {
+		g.publish(topic{ChannelDeltas, update.TokenID}, &orderBookDeltaMessage{Type: "orderbook_delta", OrderBookDelta: update.Delta})
+	}
+
+	for _, trade := range update.Trades {
+		g.publish(topic{ChannelTrades, update.TokenID}, newTradeMessage(trade))
+	}
+
+	if len(update.Trades) > 0 {
+		last := update.Trades[len(update.Trades)-1]
+		g.publish(topic{ChannelPrice, update.TokenID}, &priceMessage{
+			Type:      "price_update",
+			TokenID:   update.TokenID,
+			Price:     last.Price,
+			Timestamp: last.ExecutedAt,
+		})
+	}
+
+	for _, change := range update.Orders {
+		subscribers := g.users[change.UserID]
+		if len(subscribers) == 0 {
+			continue
+		}
+		message, ok := encode(newOrderMessage(update.TokenID, change, update.Book.UpdatedAt))
+		if !ok {
+			continue
+		}
+		for c := range subscribers {
+			if c.expired() {
+				g.unsubscribeUser(c)
+				c.sendError(CodeUnauthorized, "Access token expired, authenticate again to resubscribe")
+				continue
+			}
+			c.send(message)
+		}
+	}
+}
+
+// publish sends a message to a topic's subscribers. Callers must hold g.mu.
+func (g *Gateway) publish(t topic, v interface{}) {
+	subscribers := g.topics[t]
+	if len(subscribers) == 0 {
+		return
+	}
+	message, ok := encode(v)
+	if !ok {
+		return
+	}
+	for c := range subscribers {
+		c.send(message)
+	}
+}
+
+var (
+	errInvalidChannel       = errors.New("unknown channel")
+	errInvalidTokenID       = errors.New("tokenId must be a token ID")
+	errNotAuthenticated     = errors.New("authentication required")
+	errTooManySubscriptions = errors.New("subscription limit reached")
+)
+
+// subscribe adds a client to a channel, acknowledging it and sending the
+// channel's current state, if it has one, for the client to start from
+func (g *Gateway) subscribe(c *client, req *request) error {
+	if req.Channel == ChannelUserOrders {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if c.userID == "" || c.expired() {
+			return errNotAuthenticated
+		}
+		if !c.userOrders {
+			if c.subscriptions() >= g.cfg.WebSocket.MaxSubscriptions {
+				return errTooManySubscriptions
+			}
+			if g.users[c.userID] == nil {
+				g.users[c.userID] = make(map[*client]struct{})
+			}
+			g.users[c.userID][c] = struct{}{}
+			c.userOrders = true
+		}
+		c.sendMessage(&ackMessage{Type: "subscribed", Channel: req.Channel})
+		return nil
+	}
+
+	t, err := toTopic(req)
+	if err != nil {
+		return err
+	}
+
+	// Delta subscribers start from the whole book, the others from the top
+	depth := orderbook.UpdateDepth
+	if t.channel == ChannelDeltas {
+		depth = 0
+	}
+
+	// The client joins the topic while the book is held, so every update it
+	// is sent afterwards is newer than the book it starts from
+	g.books.ObserveOrderBook(t.tokenID, depth, func(book *models.OrderBook) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if !c.topics[t] {
+			if c.subscriptions() >= g.cfg.WebSocket.MaxSubscriptions {
+				err = errTooManySubscriptions
+				return
+			}
+			if g.topics[t] == nil {
+				g.topics[t] = make(map[*client]struct{})
+			}
+			g.topics[t][c] = struct{}{}
+			c.topics[t] = true
+		}
+
+		c.sendMessage(&ackMessage{Type: "subscribed", Channel: t.channel, TokenID: t.tokenID})
+		switch {
+		case t.channel == ChannelOrderBook:
+			c.sendMessage(&orderBookMessage{Type: "orderbook_update", OrderBook: book})
+		case t.channel == ChannelDeltas:
+			c.sendMessage(&orderBookSnapshotMessage{Type: "orderbook_snapshot", OrderBook: book})
+		case t.channel == ChannelPrice && !book.LastPrice.IsZero():
+			c.sendMessage(&priceMessage{Type: "price_update", TokenID: t.tokenID, Price: book.LastPrice, Timestamp: book.UpdatedAt})
+		}
+	})
+	return err
+}
+
+// unsubscribe removes a client from a channel and acknowledges it
+func (g *Gateway) unsubscribe(c *client, req *request) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if req.Channel == ChannelUserOrders {
+		g.unsubscribeUser(c)
+		c.sendMessage(&ackMessage{Type: "unsubscribed", Channel: req.Channel})
+		return nil
+	}
+
+	t, err := toTopic(req)
+	if err != nil {
+		return err
+	}
+	g.unsubscribeTopic(c, t)
+	c.sendMessage(&ackMessage{Type: "unsubscribed", Channel: t.channel, TokenID: t.tokenID})
+	return nil
+}
+
+// authenticate makes a client act for the user of an access token. A client
+// that switches users stops receiving the previous user's orders.
+func (g *Gateway) authenticate(c *client, claims *middleware.Claims) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if claims.UserID != c.userID {
+		g.unsubscribeUser(c)
+	}
+	c.userID = claims.UserID
+	c.expiresAt = time.Time{}
+	if claims.ExpiresAt != nil {
+		c.expiresAt = claims.ExpiresAt.Time
+	}
+}
+
+// unregister removes a client that has disconnected. Callers must not hold
+// g.mu.
+func (g *Gateway) unregister(c *client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for t := range c.topics {
+		g.unsubscribeTopic(c, t)
+	}
+	g.unsubscribeUser(c)
+	delete(g.clients, c)
+}
+
+// unsubscribeTopic removes a client from a topic. Callers must hold g.mu.
+func (g *Gateway) unsubscribeTopic(c *client, t topic) {
+	delete(c.topics, t)
+	delete(g.topics[t], c)
+	if len(g.topics[t]) == 0 {
+		delete(g.topics, t)
+	}
+}
+
+// unsubscribeUser removes a client from its user's orders. Callers must hold
+// g.mu.
+func (g *Gateway) unsubscribeUser(c *client) {
+	if !c.userOrders {
+		return
+	}
+	c.userOrders = false
+	delete(g.users[c.userID], c)
+	if len(g.users[c.userID]) == 0 {
+		delete(g.users, c.userID)
+	}
+}
+
+// toTopic validates a request for a public channel
+func toTopic(req *request) (topic, error) {
+	switch req.Channel {
+	case ChannelOrderBook, ChannelDeltas, ChannelTrades, ChannelPrice:
+	default:
+		return topic{}, errInvalidChannel
+	}
+	if _, err := uuid.Parse(req.TokenID); err != nil {
+		return topic{}, errInvalidTokenID
+	}
+	return topic{channel: req.Channel, tokenID: req.TokenID}, nil
+}
+
+// encode marshals a message, logging rather than returning a failure
+func encode(v interface{}) ([]byte, bool) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode WebSocket message: %v", err)
+		return nil, false
+	}
+	return message, true
+}
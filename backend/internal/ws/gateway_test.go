@@ -0,0 +1,365 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/peoplecoin/backend/internal/config"
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/middleware"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/orderbook"
+	"github.com/peoplecoin/backend/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	tokenID = "660e8400-e29b-41d4-a716-446655440001"
+	userID  = "550e8400-e29b-41d4-a716-446655440000"
+	otherID = "550e8400-e29b-41d4-a716-446655440002"
+)
+
+// stubBooks serves the same book for every token
+type stubBooks struct {
+	book *models.OrderBook
+}
+
+func (b *stubBooks) ObserveOrderBook(tokenID string, depth int, fn func(book *models.OrderBook)) {
+	fn(b.book)
+}
+
+func testBook() *models.OrderBook {
+	return &models.OrderBook{
+		TokenID:   tokenID,
+		Bids:      []models.OrderBookLevel{{Price: decimal.MustParse("2.40"), Quantity: 100, Orders: 1}},
+		Asks:      []models.OrderBookLevel{{Price: decimal.MustParse("2.46"), Quantity: 50, Orders: 1}},
+		LastPrice: decimal.MustParse("2.45"),
+		Phase:     orderbook.PhaseContinuous,
+		Sequence:  7,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// startGateway serves a gateway over a test server and returns its
+// WebSocket URL
+func startGateway(t *testing.T, cfg *config.Config) (*Gateway, string) {
+	gateway := NewGateway(cfg, &stubBooks{book: testBook()})
+	server := httptest.NewServer(gateway)
+	t.Cleanup(func() {
+		gateway.Shutdown(context.Background())
+		server.Close()
+	})
+	return gateway, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url string, header http.Header) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	testutil.AssertNoError(t, err, "Failed to connect")
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, req request) {
+	testutil.AssertNoError(t, conn.WriteJSON(req), "Failed to send request")
+}
+
+func receive(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message map[string]interface{}
+	testutil.AssertNoError(t, conn.ReadJSON(&message), "Failed to receive message")
+	return message
+}
+
+// expectType reads the next message and checks its type
+func expectType(t *testing.T, conn *websocket.Conn, messageType string) map[string]interface{} {
+	message := receive(t, conn)
+	assert.Equal(t, messageType, message["type"], "message: %v", message)
+	return message
+}
+
+func createToken(t *testing.T, secret, userID string, expiration time.Duration) string {
+	claims := &middleware.Claims{
+		UserID: userID,
+		Role:   "user",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	testutil.AssertNoError(t, err, "Failed to create test token")
+	return token
+}
+
+func tradeUpdate() *orderbook.BookUpdate {
+	book := testBook()
+	book.Bids[0].Quantity = 40
+	return &orderbook.BookUpdate{
+		TokenID: tokenID,
+		Trades: []*models.Trade{{
+			ID:         "990e8400-e29b-41d4-a716-446655440004",
+			TokenID:    tokenID,
+			Price:      decimal.MustParse("2.40"),
+			Quantity:   60,
+			ExecutedAt: time.Now(),
+		}},
+		Orders: []orderbook.OrderChange{
+			{OrderID: "880e8400-e29b-41d4-a716-446655440003", UserID: userID, Type: orderbook.OrderEventPartiallyFilled, FilledQuantity: 60, RemainingQuantity: 40},
+			{OrderID: "880e8400-e29b-41d4-a716-446655440005", UserID: otherID, Type: orderbook.OrderEventFilled, FilledQuantity: 60, RemainingQuantity: 0},
+		},
+		Book: book,
+		Delta: &models.OrderBookDelta{
+			TokenID:   tokenID,
+			Sequence:  8,
+			Bids:      book.Bids,
+			Asks:      []models.OrderBookLevel{},
+			LastPrice: decimal.MustParse("2.40"),
+			Checksum:  orderbook.Checksum(book.Bids, book.Asks),
+			UpdatedAt: book.UpdatedAt,
+		},
+	}
+}
+
+func TestGateway(t *testing.T) {
+	t.Run("Subscribers start from the live book and receive its changes", func(t *testing.T) {
+		gateway, url := startGateway(t, testutil.NewTestConfig())
+		conn := dial(t, url, nil)
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelOrderBook, TokenID: tokenID})
+		ack := expectType(t, conn, "subscribed")
+		assert.Equal(t, ChannelOrderBook, ack["channel"])
+		assert.Equal(t, tokenID, ack["tokenId"])
+		snapshot := expectType(t, conn, "orderbook_update")
+		assert.Equal(t, float64(100), snapshot["bids"].([]interface{})[0].(map[string]interface{})["quantity"])
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelTrades, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		send(t, conn, request{Type: "subscribe", Channel: ChannelPrice, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		assert.Equal(t, 2.45, expectType(t, conn, "price_update")["price"])
+
+		gateway.BookChanged(tradeUpdate())
+		update := expectType(t, conn, "orderbook_update")
+		assert.Equal(t, float64(40), update["bids"].([]interface{})[0].(map[string]interface{})["quantity"])
+		trade := expectType(t, conn, "trade")
+		assert.Equal(t, float64(60), trade["quantity"])
+		assert.Equal(t, 2.4, trade["price"])
+		assert.Equal(t, 2.4, expectType(t, conn, "price_update")["price"])
+
+		// Changes to other tokens are not sent
+		other := tradeUpdate()
+		other.TokenID = "660e8400-e29b-41d4-a716-446655440009"
+		gateway.BookChanged(other)
+		send(t, conn, request{Type: "ping"})
+		expectType(t, conn, "pong")
+	})
+
+	t.Run("Delta subscribers start from a sequenced snapshot", func(t *testing.T) {
+		gateway, url := startGateway(t, testutil.NewTestConfig())
+		conn := dial(t, url, nil)
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelDeltas, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		snapshot := expectType(t, conn, "orderbook_snapshot")
+		assert.Equal(t, float64(7), snapshot["sequence"])
+
+		update := tradeUpdate()
+		gateway.BookChanged(update)
+		delta := expectType(t, conn, "orderbook_delta")
+		assert.Equal(t, float64(8), delta["sequence"])
+		assert.Equal(t, float64(update.Delta.Checksum), delta["checksum"])
+		assert.Equal(t, float64(40), delta["bids"].([]interface{})[0].(map[string]interface{})["quantity"])
+
+		// Changes that leave the levels alone send no delta
+		update = tradeUpdate()
+		update.Delta = nil
+		gateway.BookChanged(update)
+		send(t, conn, request{Type: "ping"})
+		expectType(t, conn, "pong")
+	})
+
+	t.Run("Unsubscribed clients stop receiving changes", func(t *testing.T) {
+		gateway, url := startGateway(t, testutil.NewTestConfig())
+		conn := dial(t, url, nil)
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelTrades, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		send(t, conn, request{Type: "unsubscribe", Channel: ChannelTrades, TokenID: tokenID})
+		expectType(t, conn, "unsubscribed")
+
+		gateway.BookChanged(tradeUpdate())
+		send(t, conn, request{Type: "ping"})
+		expectType(t, conn, "pong")
+	})
+
+	t.Run("Private channels require authentication", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		gateway, url := startGateway(t, cfg)
+		conn := dial(t, url, nil)
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelUserOrders})
+		assert.Equal(t, CodeUnauthorized, expectType(t, conn, "error")["code"])
+
+		send(t, conn, request{Type: "auth", Token: createToken(t, "wrong-secret", userID, time.Hour)})
+		assert.Equal(t, CodeUnauthorized, expectType(t, conn, "error")["code"])
+		send(t, conn, request{Type: "auth", Token: createToken(t, cfg.JWT.Secret, userID, -time.Hour)})
+		assert.Equal(t, CodeUnauthorized, expectType(t, conn, "error")["code"])
+
+		send(t, conn, request{Type: "auth", Token: createToken(t, cfg.JWT.Secret, userID, time.Hour)})
+		assert.Equal(t, userID, expectType(t, conn, "authenticated")["userId"])
+		send(t, conn, request{Type: "subscribe", Channel: ChannelUserOrders})
+		expectType(t, conn, "subscribed")
+
+		// Only the user's own order is sent
+		gateway.BookChanged(tradeUpdate())
+		update := expectType(t, conn, "order_update")
+		assert.Equal(t, "880e8400-e29b-41d4-a716-446655440003", update["orderId"])
+		assert.Equal(t, orderbook.OrderEventPartiallyFilled, update["status"])
+		assert.Equal(t, float64(40), update["remainingQuantity"])
+		send(t, conn, request{Type: "ping"})
+		expectType(t, conn, "pong")
+	})
+
+	t.Run("Connections can authenticate with a bearer token", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		gateway, url := startGateway(t, cfg)
+
+		header := http.Header{"Authorization": {"Bearer " + createToken(t, cfg.JWT.Secret, otherID, time.Hour)}}
+		conn := dial(t, url, header)
+		send(t, conn, request{Type: "subscribe", Channel: ChannelUserOrders})
+		expectType(t, conn, "subscribed")
+
+		gateway.BookChanged(tradeUpdate())
+		update := expectType(t, conn, "order_update")
+		assert.Equal(t, "880e8400-e29b-41d4-a716-446655440005", update["orderId"])
+		assert.Equal(t, orderbook.OrderEventFilled, update["status"])
+
+		header = http.Header{"Authorization": {"Bearer " + createToken(t, "wrong-secret", otherID, time.Hour)}}
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Invalid requests are refused", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		cfg.WebSocket.MaxSubscriptions = 1
+		_, url := startGateway(t, cfg)
+		conn := dial(t, url, nil)
+
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("subscribe")))
+		assert.Equal(t, CodeInvalidMessage, expectType(t, conn, "error")["code"])
+		send(t, conn, request{Type: "listen"})
+		assert.Equal(t, CodeInvalidMessage, expectType(t, conn, "error")["code"])
+		send(t, conn, request{Type: "subscribe", Channel: "candles", TokenID: tokenID})
+		assert.Equal(t, CodeInvalidChannel, expectType(t, conn, "error")["code"])
+		send(t, conn, request{Type: "subscribe", Channel: ChannelTrades, TokenID: "PEOPLE"})
+		assert.Equal(t, CodeInvalidChannel, expectType(t, conn, "error")["code"])
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelTrades, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		send(t, conn, request{Type: "subscribe", Channel: ChannelPrice, TokenID: tokenID})
+		assert.Equal(t, CodeTooManySubscriptions, expectType(t, conn, "error")["code"])
+	})
+
+	t.Run("Origins not allowed by CORS are refused", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		cfg.CORS.AllowedOrigins = []string{"https://peoplecoin.app"}
+		_, url := startGateway(t, cfg)
+
+		dial(t, url, http.Header{"Origin": {"https://peoplecoin.app"}})
+		_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Slow consumers are disconnected", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		cfg.WebSocket.SendBuffer = 1
+		gateway, url := startGateway(t, cfg)
+		conn := dial(t, url, nil)
+
+		send(t, conn, request{Type: "subscribe", Channel: ChannelOrderBook, TokenID: tokenID})
+		expectType(t, conn, "subscribed")
+		expectType(t, conn, "orderbook_update")
+
+		gateway.mu.Lock()
+		var slow *client
+		for c := range gateway.clients {
+			slow = c
+		}
+		gateway.mu.Unlock()
+
+		// The client reads nothing while the book keeps changing
+		for dropped := false; !dropped; {
+			gateway.BookChanged(tradeUpdate())
+			select {
+			case <-slow.done:
+				dropped = true
+			default:
+			}
+		}
+
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "error: %v", err)
+				break
+			}
+		}
+	})
+
+	t.Run("Clients are pinged", func(t *testing.T) {
+		cfg := testutil.NewTestConfig()
+		cfg.WebSocket.PingInterval = 1
+		_, url := startGateway(t, cfg)
+		conn := dial(t, url, nil)
+
+		pinged := make(chan struct{}, 1)
+		conn.SetPingHandler(func(string) error {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		go conn.ReadMessage()
+
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ping received")
+		}
+	})
+
+	t.Run("Shutdown closes every connection", func(t *testing.T) {
+		gateway, url := startGateway(t, testutil.NewTestConfig())
+		conns := []*websocket.Conn{dial(t, url, nil), dial(t, url, nil)}
+		for _, conn := range conns {
+			send(t, conn, request{Type: "ping"})
+			expectType(t, conn, "pong")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, gateway.Shutdown(ctx))
+
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, _, err := conn.ReadMessage()
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "error: %v", err)
+		}
+		assert.Empty(t, gateway.clients)
+
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+}
@@ -0,0 +1,144 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/peoplecoin/backend/internal/decimal"
+	"github.com/peoplecoin/backend/internal/models"
+	"github.com/peoplecoin/backend/internal/services/orderbook"
+)
+
+// Channels clients can subscribe to
+const (
+	ChannelOrderBook  = "orderbook"        // a token's book after every change
+	ChannelDeltas     = "orderbook_deltas" // a token's whole book, then each change to its levels
+	ChannelTrades     = "trades"           // a token's trades
+	ChannelPrice      = "price"            // a token's last trade price
+	ChannelUserOrders = "user_orders"      // changes to the authenticated user's orders
+)
+
+// Error codes sent in error messages
+const (
+	CodeInvalidMessage       = "INVALID_MESSAGE"
+	CodeInvalidChannel       = "INVALID_CHANNEL"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeTooManySubscriptions = "TOO_MANY_SUBSCRIPTIONS"
+)
+
+// request is a message from a client
+type request struct {
+	Type    string `json:"type"` // auth, subscribe, unsubscribe or ping
+	Channel string `json:"channel,omitempty"`
+	TokenID string `json:"tokenId,omitempty"`
+	Token   string `json:"token,omitempty"` // auth: the access token
+}
+
+// ackMessage confirms an auth, subscribe or unsubscribe request, or answers
+// a ping
+type ackMessage struct {
+	Type    string `json:"type"` // authenticated, subscribed, unsubscribed or pong
+	Channel string `json:"channel,omitempty"`
+	TokenID string `json:"tokenId,omitempty"`
+	UserID  string `json:"userId,omitempty"`
+}
+
+// errorMessage reports a request the gateway refused
+type errorMessage struct {
+	Type    string `json:"type"` // always error
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// orderBookMessage carries a token's book on the orderbook channel
+type orderBookMessage struct {
+	Type string `json:"type"` // always orderbook_update
+	*models.OrderBook
+}
+
+// orderBookSnapshotMessage carries a token's whole book on the
+// orderbook_deltas channel, for the client to apply the deltas that follow to
+type orderBookSnapshotMessage struct {
+	Type string `json:"type"` // always orderbook_snapshot
+	*models.OrderBook
+}
+
+// orderBookDeltaMessage carries a change to a token's levels on the
+// orderbook_deltas channel
+type orderBookDeltaMessage struct {
+	Type string `json:"type"` // always orderbook_delta
+	*models.OrderBookDelta
+}
+
+// tradeMessage carries a trade on the trades channel
+type tradeMessage struct {
+	Type      string          `json:"type"` // always trade
+	TokenID   string          `json:"tokenId"`
+	TradeID   string          `json:"tradeId"`
+	Price     decimal.Decimal `json:"price"`
+	Quantity  int64           `json:"quantity"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// priceMessage carries a token's last trade price on the price channel
+type priceMessage struct {
+	Type      string          `json:"type"` // always price_update
+	TokenID   string          `json:"tokenId"`
+	Price     decimal.Decimal `json:"price"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// orderMessage carries a change to one of the user's orders on the
+// user_orders channel. Quantities are sent with the events that set them.
+type orderMessage struct {
+	Type              string    `json:"type"` // always order_update
+	Event             string    `json:"event"`
+	OrderID           string    `json:"orderId"`
+	TokenID           string    `json:"tokenId"`
+	Status            string    `json:"status,omitempty"`
+	FilledQuantity    *int64    `json:"filledQuantity,omitempty"`
+	RemainingQuantity *int64    `json:"remainingQuantity,omitempty"`
+	ReducedBy         int64     `json:"reducedBy,omitempty"`
+	Reason            string    `json:"reason,omitempty"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+func newTradeMessage(trade *models.Trade) *tradeMessage {
+	return &tradeMessage{
+		Type:      "trade",
+		TokenID:   trade.TokenID,
+		TradeID:   trade.ID,
+		Price:     trade.Price,
+		Quantity:  trade.Quantity,
+		Timestamp: trade.ExecutedAt,
+	}
+}
+
+// newOrderMessage describes an order event to the order's owner. Reduced
+// orders keep their status, so none is sent for them.
+func newOrderMessage(tokenID string, change orderbook.OrderChange, at time.Time) *orderMessage {
+	message := &orderMessage{
+		Type:      "order_update",
+		Event:     change.Type,
+		OrderID:   change.OrderID,
+		TokenID:   tokenID,
+		UpdatedAt: at,
+	}
+
+	switch change.Type {
+	case orderbook.OrderEventAccepted, orderbook.OrderEventAmended, orderbook.OrderEventTriggered:
+		message.Status = change.Order.Status
+		message.FilledQuantity = &change.Order.FilledQuantity
+		message.RemainingQuantity = &change.Order.RemainingQuantity
+	case orderbook.OrderEventPartiallyFilled, orderbook.OrderEventFilled:
+		message.Status = change.Type
+		message.FilledQuantity = &change.FilledQuantity
+		message.RemainingQuantity = &change.RemainingQuantity
+	case orderbook.OrderEventReduced:
+		message.ReducedBy = change.Quantity
+	case orderbook.OrderEventCancelled, orderbook.OrderEventExpired:
+		message.Status = "cancelled"
+		message.Reason = change.Reason
+	}
+
+	return message
+}
@@ -0,0 +1,2 @@
+-- Record why an order was cancelled (user request, IOC remainder, FOK kill)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancel_reason VARCHAR(50);
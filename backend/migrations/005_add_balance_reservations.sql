@@ -0,0 +1,53 @@
+-- Funds reserved by an order for its unfilled remainder: quote currency for
+-- bids (including the worst-case fee), token units for asks
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_amount DECIMAL(20, 8) NOT NULL DEFAULT 0;
+
+-- Token inventory is held in user_balances keyed by token ID
+ALTER TABLE user_balances ALTER COLUMN currency TYPE VARCHAR(66);
+
+-- Orders resting from before reservations existed reserve their remainder
+-- now, the same way new orders do: limit price plus the fee at the order's
+-- rate (rounded up per unit) for bids, the tokens themselves for asks. Only
+-- what a user's free balance already covers is locked, oldest order first;
+-- the orders it cannot back are cancelled as insufficient_funds, as they
+-- would have been rejected on placement. Only orders with nothing locked yet
+-- are considered, so running this again changes nothing.
+WITH required AS (
+  SELECT id, user_id, created_at,
+    CASE WHEN side = 'bid' THEN 'USD' ELSE token_id::text END AS currency,
+    CASE
+      WHEN side = 'bid' THEN (price + CEIL(price * fee_rate * 100000000) / 100000000) * remaining_quantity
+      ELSE remaining_quantity
+    END AS amount
+  FROM orders
+  WHERE status IN ('open', 'partially_filled') AND locked_amount = 0 AND remaining_quantity > 0
+),
+covered AS (
+  SELECT r.id, r.user_id, r.currency, r.amount,
+    SUM(r.amount) OVER (PARTITION BY r.user_id, r.currency ORDER BY r.created_at, r.id) AS running,
+    COALESCE(b.balance, 0) - COALESCE(b.locked, 0) AS available
+  FROM required r
+  LEFT JOIN user_balances b ON b.user_id = r.user_id AND b.currency = r.currency
+),
+cancelled AS (
+  UPDATE orders o
+  SET status = 'cancelled', cancel_reason = 'insufficient_funds', locked_amount = 0, updated_at = NOW()
+  FROM covered c
+  WHERE o.id = c.id AND c.running > c.available
+  RETURNING o.id
+),
+reserved AS (
+  UPDATE orders o
+  SET locked_amount = c.amount
+  FROM covered c
+  WHERE o.id = c.id AND c.running <= c.available
+  RETURNING c.user_id, c.currency, c.amount
+)
+UPDATE user_balances b
+SET locked = COALESCE(b.locked, 0) + r.total, updated_at = NOW()
+FROM (SELECT user_id, currency, SUM(amount) AS total FROM reserved GROUP BY user_id, currency) r
+WHERE b.user_id = r.user_id AND b.currency = r.currency;
+
+ALTER TABLE user_balances DROP CONSTRAINT IF EXISTS user_balances_locked_check;
+ALTER TABLE user_balances ADD CONSTRAINT user_balances_locked_check
+  CHECK (locked >= 0 AND locked <= balance);
@@ -0,0 +1,2 @@
+-- Self-trade prevention mode the order was placed with
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stp_mode VARCHAR(30) NOT NULL DEFAULT 'cancel_newest';
@@ -0,0 +1,14 @@
+-- Stop orders rest dormant until the last trade price reaches stop_price
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stop_price DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS triggered_at TIMESTAMP;
+
+ALTER TABLE orders ALTER COLUMN execution_type TYPE VARCHAR(20);
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_execution_type_check;
+ALTER TABLE orders ADD CONSTRAINT orders_execution_type_check
+  CHECK (execution_type IN ('market', 'limit', 'stop_market', 'stop_limit'));
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+  CHECK (status IN ('pending_trigger', 'triggered', 'open', 'partially_filled', 'filled', 'cancelled', 'rejected'));
+
+CREATE INDEX IF NOT EXISTS idx_orders_pending_stops ON orders(token_id, stop_price) WHERE status = 'pending_trigger';
@@ -0,0 +1,10 @@
+-- Trailing stops trail their mark (the best last trade price seen since they
+-- were placed) by a fixed amount or a percentage. The mark is persisted so
+-- stop_price survives restarts.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS trail_amount DECIMAL(20, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS trail_percent DECIMAL(10, 6);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS trail_mark DECIMAL(20, 8);
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_execution_type_check;
+ALTER TABLE orders ADD CONSTRAINT orders_execution_type_check
+  CHECK (execution_type IN ('market', 'limit', 'stop_market', 'stop_limit', 'trailing_stop'));
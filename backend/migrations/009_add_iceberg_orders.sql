@@ -0,0 +1,3 @@
+-- Iceberg orders show only display_quantity in the order book at a time and
+-- replenish from the hidden remainder
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS display_quantity BIGINT CHECK (display_quantity > 0);
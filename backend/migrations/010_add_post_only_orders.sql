@@ -0,0 +1,2 @@
+-- Post-only orders only ever rest on the book and pay the maker rate
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS post_only BOOLEAN NOT NULL DEFAULT FALSE;
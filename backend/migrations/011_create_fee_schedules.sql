@@ -0,0 +1,49 @@
+-- Versioned fee schedules. A schedule with neither user_id nor token_id is
+-- the default; user and token overrides take precedence, most specific
+-- first. Within a scope the latest version already in effect applies.
+CREATE TABLE IF NOT EXISTS fee_schedules (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  name VARCHAR(100) NOT NULL,
+  version INT NOT NULL,
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  token_id UUID REFERENCES tokens(id) ON DELETE CASCADE,
+  effective_from TIMESTAMP NOT NULL,
+  created_by UUID REFERENCES users(id),
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_fee_schedules_scope_version
+  ON fee_schedules(COALESCE(user_id, '00000000-0000-0000-0000-000000000000'), COALESCE(token_id, '00000000-0000-0000-0000-000000000000'), version);
+CREATE INDEX IF NOT EXISTS idx_fee_schedules_effective ON fee_schedules(effective_from);
+
+-- Volume tiers: the highest min_volume not above a user's trailing 30-day
+-- quote volume applies
+CREATE TABLE IF NOT EXISTS fee_schedule_tiers (
+  schedule_id UUID NOT NULL REFERENCES fee_schedules(id) ON DELETE CASCADE,
+  min_volume DECIMAL(20, 8) NOT NULL CHECK (min_volume >= 0),
+  maker_rate DECIMAL(10, 8) NOT NULL CHECK (maker_rate >= 0),
+  taker_rate DECIMAL(10, 8) NOT NULL CHECK (taker_rate >= maker_rate),
+  PRIMARY KEY (schedule_id, min_volume)
+);
+
+-- Orders keep the rates and schedule resolved when they were placed
+ALTER TABLE orders ALTER COLUMN fee_rate TYPE DECIMAL(10, 8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS maker_fee_rate DECIMAL(10, 8) NOT NULL DEFAULT 0.003;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fee_schedule_id UUID REFERENCES fee_schedules(id);
+
+-- Each fill records the schedule that priced each side
+ALTER TABLE trades ADD COLUMN IF NOT EXISTS buyer_fee_schedule_id UUID REFERENCES fee_schedules(id);
+ALTER TABLE trades ADD COLUMN IF NOT EXISTS seller_fee_schedule_id UUID REFERENCES fee_schedules(id);
+
+CREATE INDEX IF NOT EXISTS idx_trades_buyer_executed ON trades(buyer_id, executed_at);
+CREATE INDEX IF NOT EXISTS idx_trades_seller_executed ON trades(seller_id, executed_at);
+
+-- The built-in rates as the initial default schedule
+INSERT INTO fee_schedules (name, version, effective_from)
+SELECT 'Standard', 1, '1970-01-01'
+WHERE NOT EXISTS (SELECT 1 FROM fee_schedules WHERE user_id IS NULL AND token_id IS NULL);
+
+INSERT INTO fee_schedule_tiers (schedule_id, min_volume, maker_rate, taker_rate)
+SELECT id, 0, 0.003, 0.005 FROM fee_schedules
+WHERE user_id IS NULL AND token_id IS NULL AND version = 1
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,13 @@
+-- Good-till-date orders are cancelled once expires_at passes
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_time_in_force_check;
+ALTER TABLE orders ADD CONSTRAINT orders_time_in_force_check
+  CHECK (time_in_force IN ('GTC', 'IOC', 'FOK', 'GTD'));
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_expires_at_check;
+ALTER TABLE orders ADD CONSTRAINT orders_expires_at_check
+  CHECK ((time_in_force = 'GTD') = (expires_at IS NOT NULL));
+
+CREATE INDEX IF NOT EXISTS idx_orders_expiry ON orders(expires_at)
+  WHERE expires_at IS NOT NULL AND status IN ('pending_trigger', 'triggered', 'open', 'partially_filled');
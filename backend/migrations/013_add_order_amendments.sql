@@ -0,0 +1,3 @@
+-- Amendments that cost an order its queue position (a price change or a
+-- quantity increase) send it to the back of its price level
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS requeued_at TIMESTAMP;
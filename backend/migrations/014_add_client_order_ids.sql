@@ -0,0 +1,6 @@
+-- Optional client-assigned order IDs, unique per user, so clients can refer
+-- to orders before they know the server's ID
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS client_order_id VARCHAR(64);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_user_client_order_id ON orders(user_id, client_order_id)
+  WHERE client_order_id IS NOT NULL;
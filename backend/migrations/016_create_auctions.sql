@@ -0,0 +1,24 @@
+-- Call auctions: a token in auction accumulates orders without matching and
+-- clears them at a single uncross price when the auction ends. New tokens
+-- open with one; halted tokens resume with one.
+CREATE TABLE IF NOT EXISTS auctions (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  token_id UUID NOT NULL REFERENCES tokens(id) ON DELETE CASCADE,
+  reason VARCHAR(20) NOT NULL CHECK (reason IN ('opening', 'reopening')),
+  status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'completed')),
+  started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ends_at TIMESTAMP NOT NULL,
+  uncross_price DECIMAL(20, 8),
+  uncross_volume BIGINT,
+  completed_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auctions_running ON auctions(token_id) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS idx_auctions_token_reason ON auctions(token_id, reason);
+
+-- Tokens already trading have had their opening
+INSERT INTO auctions (token_id, reason, status, ends_at, completed_at)
+SELECT id, 'opening', 'completed', NOW(), NOW()
+FROM tokens t
+WHERE status = 'active'
+  AND NOT EXISTS (SELECT 1 FROM auctions a WHERE a.token_id = t.id AND a.reason = 'opening');
@@ -0,0 +1,15 @@
+-- Trading halts: a halted token accepts no new orders until it resumes,
+-- which re-opens it with a call auction. Circuit breaker halts resume on
+-- their own at resumes_at.
+CREATE TABLE IF NOT EXISTS trading_halts (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  token_id UUID NOT NULL REFERENCES tokens(id) ON DELETE CASCADE,
+  reason VARCHAR(30) NOT NULL, -- circuit_breaker
+  message TEXT,
+  halted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  resumes_at TIMESTAMP,
+  resumed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_trading_halts_token ON trading_halts(token_id, halted_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_trading_halts_active ON trading_halts(token_id) WHERE resumed_at IS NULL;
@@ -0,0 +1,5 @@
+-- Market rules: prices must be a multiple of the tick size and quantities a
+-- multiple of the lot size. Tokens without a tick size use the default tiers,
+-- which grow coarser as the price rises.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS tick_size DECIMAL(20, 8) CHECK (tick_size > 0);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS lot_size BIGINT NOT NULL DEFAULT 1 CHECK (lot_size > 0);
@@ -0,0 +1,3 @@
+-- Administrators can halt a token (reason 'admin') until they resume it by
+-- hand, and record why they resumed it
+ALTER TABLE trading_halts ADD COLUMN IF NOT EXISTS resume_message TEXT;
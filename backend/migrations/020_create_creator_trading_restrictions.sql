@@ -0,0 +1,14 @@
+-- Each token's TokenRegistry object on chain, which holds its creator's
+-- trading restrictions
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS registry_address VARCHAR(66);
+
+-- Creator trading restrictions mirrored from each token's TokenRegistry
+-- (creator_token::get_trading_restrictions) and refreshed periodically. As
+-- on chain, the creator cannot trade the token before trading_block_end_date.
+CREATE TABLE IF NOT EXISTS creator_trading_restrictions (
+  token_id UUID PRIMARY KEY REFERENCES tokens(id) ON DELETE CASCADE,
+  creator_address VARCHAR(66) NOT NULL,
+  trading_block_end_date TIMESTAMP NOT NULL,
+  trading_block_duration_days SMALLINT NOT NULL,
+  synced_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
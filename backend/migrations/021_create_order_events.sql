@@ -0,0 +1,64 @@
+-- Order event journal: every change to an order, appended in sequence per
+-- token in the same transaction as the change. It is the audit trail of the
+-- order book and can be replayed to rebuild it (cmd/replay). Events are never
+-- updated or deleted.
+CREATE TABLE IF NOT EXISTS order_events (
+  id BIGSERIAL PRIMARY KEY,
+  token_id UUID NOT NULL REFERENCES tokens(id) ON DELETE RESTRICT,
+  sequence BIGINT NOT NULL,
+  order_id UUID NOT NULL, -- rejected orders are never stored in orders
+  event_type VARCHAR(20) NOT NULL CHECK (event_type IN (
+    'snapshot', 'accepted', 'amended', 'triggered', 'matched', 'partially_filled',
+    'filled', 'reduced', 'requeued', 'trailed', 'cancelled', 'expired', 'rejected'
+  )),
+  data JSONB NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (token_id, sequence)
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_events_order ON order_events(order_id, sequence);
+
+CREATE OR REPLACE FUNCTION reject_order_event_changes() RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'order_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS order_events_append_only ON order_events;
+CREATE TRIGGER order_events_append_only
+  BEFORE UPDATE OR DELETE ON order_events
+  FOR EACH ROW EXECUTE FUNCTION reject_order_event_changes();
+
+-- Orders placed before the journal existed start it with a snapshot of their
+-- current state, which replay takes as their starting point
+INSERT INTO order_events (token_id, sequence, order_id, event_type, data)
+SELECT token_id,
+       ROW_NUMBER() OVER (PARTITION BY token_id ORDER BY created_at, id),
+       id,
+       'snapshot',
+       jsonb_strip_nulls(jsonb_build_object(
+         'id', id,
+         'userId', user_id,
+         'tokenId', token_id,
+         'orderType', order_type,
+         'side', side,
+         'price', price,
+         'quantity', quantity,
+         'displayQuantity', display_quantity,
+         'filledQuantity', filled_quantity,
+         'remainingQuantity', remaining_quantity,
+         'executionType', execution_type,
+         'timeInForce', time_in_force,
+         'status', status,
+         'cancelReason', cancel_reason,
+         'stopPrice', stop_price,
+         'trailAmount', trail_amount,
+         'trailPercent', trail_percent,
+         'trailMark', trail_mark,
+         'feePaid', fee_paid,
+         'createdAt', to_char(created_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+         'requeuedAt', to_char(requeued_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+         'triggeredAt', to_char(triggered_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+       ))
+FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_events e WHERE e.token_id = o.token_id);
@@ -171,6 +171,29 @@ INSERT INTO orders (id, user_id, token_id, order_type, side, price, quantity, fi
 ('750e8400-e29b-41d4-a716-446655440008', '550e8400-e29b-41d4-a716-446655440003', '650e8400-e29b-41d4-a716-446655440002', 'sell', 'ask', 2.51, 1600, 0, 1600, 'limit', 'GTC', 'open', 0.003, NOW() - INTERVAL '4 hours'),
 ('750e8400-e29b-41d4-a716-446655440009', '550e8400-e29b-41d4-a716-446655440002', '650e8400-e29b-41d4-a716-446655440002', 'sell', 'ask', 2.52, 1400, 0, 1400, 'limit', 'GTC', 'open', 0.003, NOW() - INTERVAL '5 hours');
 
+-- Reserve funds for the open orders: limit price plus the 0.5% worst-case
+-- fee (rounded up per unit) for bids, the tokens themselves for asks
+UPDATE orders
+SET locked_amount = CASE
+  WHEN side = 'bid' THEN (price + CEIL(price * 0.005 * 100000000) / 100000000) * remaining_quantity
+  ELSE remaining_quantity
+END
+WHERE status IN ('open', 'partially_filled');
+
+-- Every user gets 100,000 USD of buying power on top of their reservations
+INSERT INTO user_balances (user_id, currency, balance, locked)
+SELECT u.id, 'USD', 100000 + COALESCE(SUM(o.locked_amount), 0), COALESCE(SUM(o.locked_amount), 0)
+FROM users u
+LEFT JOIN orders o ON o.user_id = u.id AND o.side = 'bid' AND o.status IN ('open', 'partially_filled')
+GROUP BY u.id;
+
+-- Sellers hold the tokens they are offering plus 10,000 spare
+INSERT INTO user_balances (user_id, currency, balance, locked)
+SELECT user_id, token_id::text, 10000 + SUM(locked_amount), SUM(locked_amount)
+FROM orders
+WHERE side = 'ask' AND status IN ('open', 'partially_filled')
+GROUP BY user_id, token_id;
+
 -- ==========================================
 -- 4. Create Test Trades
 -- ==========================================
@@ -343,6 +366,7 @@ INSERT INTO trending_topics (id, title, description, url, image_url, category, s
 -- - 5 test users (Alice, Bob, Charlie, Diana, Eve)
 -- - 6 tokens (SUI, USDC, PEOPLE, MOON, DOGE, PEPE)
 -- - 10 open orders (5 bids, 5 asks for PEOPLE token)
+-- - USD and token balances backing the open orders
 -- - 5 completed trades
 -- - 5 user follows
 -- - 6 token follows